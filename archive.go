@@ -0,0 +1,277 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewZipServer returns a ReadHandler serving the files in the zip archive
+// at path.
+//
+// The archive's directory is indexed when it is opened. Requested names
+// are cleaned as by NewStoreHandler and matched with the paths of files
+// in the archive, the uncompressed size in the file header is sent as the
+// transfer size (tsize). Files are decompressed as they are sent.
+func NewZipServer(path string, opts ...ArchiveServerOpt) (ReadHandler, error) {
+	return newArchiveServer(path, openZipArchive, opts)
+}
+
+// NewTarServer returns a ReadHandler serving the files in the tar archive
+// at path, which may be gzip compressed.
+//
+// Tar archives can't be read in random order, the regular files in the
+// archive are loaded into memory when it is opened. Requested names are
+// cleaned as by NewStoreHandler and matched with the paths of files in
+// the archive.
+func NewTarServer(path string, opts ...ArchiveServerOpt) (ReadHandler, error) {
+	return newArchiveServer(path, loadTarArchive, opts)
+}
+
+func newArchiveServer(path string, open func(string) (archive, error), opts []ArchiveServerOpt) (ReadHandler, error) {
+	s := &archiveStore{path: path, open: open, log: newLogger("archiveserver")}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	a, err := open(path)
+	if err != nil {
+		return nil, wrapError(err, "opening archive")
+	}
+	s.archive, s.modTime, s.checked = a, fi.ModTime(), time.Now()
+
+	return NewStoreHandler(s), nil
+}
+
+// ArchiveServerOpt is a function that configures a handler created by
+// NewZipServer or NewTarServer.
+type ArchiveServerOpt func(*archiveStore) error
+
+// ArchiveServerReload configures the handler to check the modification
+// time of the archive when a file is requested, at most once per interval,
+// and reopen it if it has changed. Transfers in progress continue with
+// the archive they started with, provided it is replaced by renaming a
+// new file over it rather than rewritten in place. If the new archive
+// can't be opened, the old one continues to be used.
+//
+// Default: 0 (disabled).
+func ArchiveServerReload(interval time.Duration) ArchiveServerOpt {
+	return func(s *archiveStore) error {
+		if interval < 0 {
+			return ErrInvalidReloadInterval
+		}
+		s.reload = interval
+		return nil
+	}
+}
+
+// archive is an opened archive.
+type archive interface {
+	// open returns the named file and its size. The archive is not
+	// closed until the file is.
+	open(name string) (io.ReadCloser, int64, error)
+
+	// close closes the archive once its open files are closed.
+	close()
+}
+
+// archiveStore is a read-only BlobStore for the files in an archive.
+type archiveStore struct {
+	path   string
+	open   func(string) (archive, error)
+	reload time.Duration // Interval between checks for changes, 0 to disable
+	log    *logger
+
+	mu      sync.Mutex
+	archive archive
+	modTime time.Time // Modification time of the archive when it was opened
+	checked time.Time // Last check for changes
+}
+
+func (s *archiveStore) Open(name string) (io.ReadCloser, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reload > 0 && time.Since(s.checked) >= s.reload {
+		s.checked = time.Now()
+		s.reopen()
+	}
+	// Opened with the lock held, so that the archive isn't closed first
+	return s.archive.open(name)
+}
+
+func (s *archiveStore) Create(name string) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrPermission}
+}
+
+// reopen opens the archive again if it has been modified.
+//
+// s.mu must be held.
+func (s *archiveStore) reopen() {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		s.log.debug("checking archive %q: %v", s.path, err)
+		return
+	}
+	if fi.ModTime().Equal(s.modTime) {
+		return
+	}
+
+	a, err := s.open(s.path)
+	if err != nil {
+		s.log.err("reopening archive %q: %v", s.path, err)
+		return
+	}
+	s.log.debug("reopened archive %q", s.path)
+	s.archive.close()
+	s.archive, s.modTime = a, fi.ModTime()
+}
+
+// zipArchive is an opened zip archive.
+type zipArchive struct {
+	rc    *zip.ReadCloser
+	files map[string]*zip.File // Regular files, by cleaned name
+
+	mu     sync.Mutex
+	refs   int  // Open files
+	closed bool // Close once refs reaches zero
+}
+
+func openZipArchive(path string) (archive, error) {
+	rc, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &zipArchive{rc: rc, files: make(map[string]*zip.File, len(rc.File))}
+	for _, f := range rc.File {
+		if f.Mode().IsRegular() {
+			a.files[storeName(f.Name)] = f
+		}
+	}
+	return a, nil
+}
+
+func (a *zipArchive) open(name string) (io.ReadCloser, int64, error) {
+	f, ok := a.files[name]
+	if !ok {
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	a.mu.Lock()
+	a.refs++
+	a.mu.Unlock()
+
+	r, err := f.Open()
+	if err != nil {
+		a.release()
+		return nil, 0, err
+	}
+	return &zipFile{ReadCloser: r, a: a}, int64(f.UncompressedSize64), nil
+}
+
+func (a *zipArchive) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	a.closeIfUnused()
+}
+
+// release records that a file has been closed.
+func (a *zipArchive) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.refs--
+	a.closeIfUnused()
+}
+
+// closeIfUnused closes the archive if it has been closed and has no open
+// files.
+//
+// a.mu must be held.
+func (a *zipArchive) closeIfUnused() {
+	if a.closed && a.refs == 0 {
+		a.rc.Close()
+	}
+}
+
+// zipFile releases its archive when closed.
+type zipFile struct {
+	io.ReadCloser
+	a    *zipArchive
+	once sync.Once
+}
+
+func (f *zipFile) Close() error {
+	err := f.ReadCloser.Close()
+	f.once.Do(f.a.release)
+	return err
+}
+
+// tarArchive is a tar archive loaded into memory.
+type tarArchive map[string][]byte // Regular files, by cleaned name
+
+func loadTarArchive(path string) (archive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = bufio.NewReader(file)
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	a := make(tarArchive)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		a[storeName(hdr.Name)] = data
+	}
+}
+
+func (a tarArchive) open(name string) (io.ReadCloser, int64, error) {
+	data, ok := a[name]
+	if !ok {
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (a tarArchive) close() {}
@@ -0,0 +1,249 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testArchiveFiles are the files in test archives, at the boundaries of
+// the default block size.
+var testArchiveFiles = []struct {
+	name   string
+	size   int
+	method uint16 // zip compression
+}{
+	{name: "empty", size: 0, method: zip.Store},
+	{name: "511", size: 511, method: zip.Deflate},
+	{name: "512", size: 512, method: zip.Store},
+	{name: "1024", size: 1024, method: zip.Deflate},
+	{name: "1025", size: 1025, method: zip.Store},
+	{name: "boot/pxelinux.0", size: 1025, method: zip.Deflate},
+}
+
+func testArchiveData(name string, size int) []byte {
+	return bytes.Repeat([]byte(name), size/len(name)+1)[:size]
+}
+
+func writeTestZip(t *testing.T, path, prefix string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.Create("boot/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range testArchiveFiles {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(testArchiveData(prefix+f.name, f.size))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTar(t *testing.T, path string, compress bool) {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	zw := gzip.NewWriter(&buf)
+	if compress {
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Name: "boot/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, f := range testArchiveFiles {
+		tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(f.size)})
+		tw.Write(testArchiveData(f.name, f.size))
+	}
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "512"})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if compress {
+		zw.Close()
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveServers(t *testing.T) {
+	dir := t.TempDir()
+	writeTestZip(t, filepath.Join(dir, "test.zip"), "")
+	writeTestTar(t, filepath.Join(dir, "test.tar"), false)
+	writeTestTar(t, filepath.Join(dir, "test.tar.gz"), true)
+
+	servers := []struct {
+		name string
+		new  func(string, ...ArchiveServerOpt) (ReadHandler, error)
+		path string
+	}{
+		{name: "zip", new: NewZipServer, path: "test.zip"},
+		{name: "tar", new: NewTarServer, path: "test.tar"},
+		{name: "tar.gz", new: NewTarServer, path: "test.tar.gz"},
+	}
+
+	type archiveCase struct {
+		name    string
+		reqName string
+
+		expectedData      []byte
+		expectedSize      *int64
+		expectedErrorCode ErrorCode
+	}
+	var cases []archiveCase
+	for _, f := range testArchiveFiles {
+		data := testArchiveData(f.name, f.size)
+		cases = append(cases, archiveCase{
+			name:         f.name,
+			reqName:      f.name,
+			expectedData: data,
+			expectedSize: ptrInt64(int64(len(data))),
+		})
+	}
+	cases = append(cases,
+		archiveCase{
+			name:         "leading slash",
+			reqName:      "/boot/pxelinux.0",
+			expectedData: testArchiveData("boot/pxelinux.0", 1025),
+			expectedSize: ptrInt64(1025),
+		},
+		archiveCase{
+			name:         "traversal",
+			reqName:      "../../boot/pxelinux.0",
+			expectedData: testArchiveData("boot/pxelinux.0", 1025),
+			expectedSize: ptrInt64(1025),
+		},
+		archiveCase{
+			name:              "directory",
+			reqName:           "boot",
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+		archiveCase{
+			name:              "missing",
+			reqName:           "boot/missing",
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+	)
+
+	for _, s := range servers {
+		t.Run(s.name, func(t *testing.T) {
+			h, err := s.new(filepath.Join(dir, s.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					req := readRequestMock{name: c.reqName}
+					h.ServeTFTP(&req)
+
+					if !bytes.Equal(c.expectedData, req.writer.Bytes()) {
+						t.Errorf("expected %d bytes, got %d", len(c.expectedData), req.writer.Len())
+					}
+					if !reflect.DeepEqual(c.expectedSize, req.size) {
+						t.Errorf("expected size to be %v, but it was %v", c.expectedSize, req.size)
+					}
+					if c.expectedErrorCode != req.errCode {
+						t.Errorf("expected error code %s, got %s (%q)", c.expectedErrorCode, req.errCode, req.errMsg)
+					}
+				})
+			}
+		})
+	}
+
+	t.Run("missing archive", func(t *testing.T) {
+		if _, err := NewZipServer(filepath.Join(dir, "missing.zip")); !os.IsNotExist(err) {
+			t.Errorf("expected not exist error, got %v", err)
+		}
+	})
+	t.Run("invalid archive", func(t *testing.T) {
+		if _, err := NewZipServer(filepath.Join(dir, "test.tar")); err == nil {
+			t.Error("expected an error")
+		}
+	})
+	t.Run("invalid reload", func(t *testing.T) {
+		_, err := NewZipServer(filepath.Join(dir, "test.zip"), ArchiveServerReload(-time.Second))
+		if err != ErrInvalidReloadInterval {
+			t.Errorf("expected %v, got %v", ErrInvalidReloadInterval, err)
+		}
+	})
+}
+
+func TestZipServer_reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.zip")
+	writeTestZip(t, path, "v1 ")
+
+	h, err := NewZipServer(path, ArchiveServerReload(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := h.(*storeHandler).store
+
+	// Opened before the archive is replaced
+	old, _, err := store.Open("1025")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectData := func(name string, expected []byte) {
+		t.Helper()
+		req := readRequestMock{name: name}
+		h.ServeTFTP(&req)
+		if !bytes.Equal(expected, req.writer.Bytes()) {
+			t.Errorf("expected %q, got %q (%s)", expected, req.writer.Bytes(), req.errCode)
+		}
+	}
+
+	touch := func(modTime time.Time) {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Replaced by rename
+	writeTestZip(t, path+".new", "v2 ")
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+	touch(time.Now().Add(time.Hour))
+	time.Sleep(time.Millisecond)
+	expectData("512", testArchiveData("v2 512", 512))
+
+	// The old archive is still readable by the open file
+	data, err := ioutil.ReadAll(old)
+	if err != nil {
+		t.Fatalf("reading file opened before reload: %v", err)
+	}
+	if expected := testArchiveData("v1 1025", 1025); !bytes.Equal(expected, data) {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+	old.Close()
+
+	// A corrupt archive isn't used
+	if err := ioutil.WriteFile(path+".new", []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+	touch(time.Now().Add(2 * time.Hour))
+	time.Sleep(time.Millisecond)
+	expectData("512", testArchiveData("v2 512", 512))
+}
@@ -1,7 +1,9 @@
 package trivialt
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"strconv"
 	"strings"
@@ -109,3 +111,113 @@ func BenchmarkGet_random(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkServer_listeners(b *testing.B) {
+	data := []byte("the data")
+
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("listeners: %d", n), func(b *testing.B) {
+			ip, port, closeServer := newTestServer(b, true, func(w ReadRequest) {
+				w.Write(data)
+			}, nil, ServerListeners(n))
+			defer closeServer()
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					client, err := NewClient()
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					file, err := client.Get(url)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					_, err = ioutil.ReadAll(file)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkServer_readFrom(b *testing.B) {
+	random1MB := getTestData(b, "1MB-random")
+
+	cases := []struct {
+		name string
+		dst  func(ReadRequest) io.Writer
+	}{
+		{name: "ReadFrom", dst: func(w ReadRequest) io.Writer { return w }},
+		{name: "Write", dst: func(w ReadRequest) io.Writer { return struct{ io.Writer }{w} }},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			ip, port, close := newTestServer(b, false, func(w ReadRequest) {
+				// Hide WriterTo so io.Copy uses the destination
+				io.Copy(c.dst(w), struct{ io.Reader }{bytes.NewReader(random1MB)})
+			}, nil)
+			defer close()
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+			b.SetBytes(int64(len(random1MB)))
+			for i := 0; i < b.N; i++ {
+				client, err := NewClient(ClientBlocksize(1468), ClientWindowsize(16))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				file, err := client.Get(url)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				_, err = io.Copy(ioutil.Discard, file)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServer_writeTo(b *testing.B) {
+	random1MB := getTestData(b, "1MB-random")
+
+	cases := []struct {
+		name string
+		src  func(WriteRequest) io.Reader
+	}{
+		{name: "WriteTo", src: func(w WriteRequest) io.Reader { return w }},
+		{name: "Read", src: func(w WriteRequest) io.Reader { return struct{ io.Reader }{w} }},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			ip, port, close := newTestServer(b, false, nil, func(w WriteRequest) {
+				// Hide ReaderFrom so io.Copy uses the source
+				io.Copy(struct{ io.Writer }{ioutil.Discard}, c.src(w))
+			})
+			defer close()
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+			b.SetBytes(int64(len(random1MB)))
+			for i := 0; i < b.N; i++ {
+				client, err := NewClient(ClientBlocksize(1468), ClientWindowsize(16))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				err = client.Put(url, bytes.NewReader(random1MB), int64(len(random1MB)))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BlobStore is storage for files sent and received by a handler created
+// by NewStoreHandler.
+//
+// Names are unrooted, slash-separated paths, cleaned by the handler
+// before they are passed to the store. Errors matching fs.ErrNotExist
+// are sent to clients as a File Not Found error, fs.ErrPermission as an
+// Access Violation and fs.ErrExist as a File Already Exists error.
+type BlobStore interface {
+	// Open returns a reader for the named file and its size, or -1
+	// if the size is unknown.
+	Open(name string) (io.ReadCloser, int64, error)
+
+	// Create creates or truncates the named file. The file is
+	// committed when the returned writer is closed.
+	//
+	// If the returned writer also has an Abort() error method, it is
+	// called instead of Close when a transfer fails so that the file
+	// can be discarded.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// NewStoreHandler creates a handler for sending and receiving files
+// from s.
+//
+// Requested names are cleaned and a leading slash is removed before they
+// are passed to s. The size returned by Open is sent as the transfer size
+// (tsize). Hooks can be configured with FileServerOpts.
+func NewStoreHandler(s BlobStore, opts ...FileServerOpt) ReadWriteHandler {
+	h := &storeHandler{store: s, log: newLogger("storehandler")}
+	for _, opt := range opts {
+		opt(&h.hooks)
+	}
+	return h
+}
+
+type storeHandler struct {
+	log   *logger
+	store BlobStore
+	hooks fileServerHooks
+}
+
+// ServeTFTP sends the requested file from the store.
+func (h *storeHandler) ServeTFTP(w ReadRequest) {
+	name := storeName(w.Name())
+
+	file, size, err := h.store.Open(name)
+	if err != nil {
+		h.log.debug("opening %q: %v", name, err)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			h.hooks.notFound(w.Name(), w.Addr())
+			w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+		case errors.Is(err, fs.ErrPermission):
+			h.hooks.accessDenied(w.Name(), w.Addr())
+			w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Cannot read file %q", w.Name()))
+		default:
+			w.WriteError(ErrCodeNotDefined, fmt.Sprintf("Cannot read file %q", w.Name()))
+		}
+		return
+	}
+	defer errorDefer(file.Close, h.log, "error closing file")
+
+	if size >= 0 {
+		w.WriteSize(size)
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		h.log.debug("sending %q: %v", name, err)
+		// No effect if the client ended the transfer
+		w.Abort(ErrCodeNotDefined, fmt.Sprintf("Cannot read file %q", w.Name()))
+	}
+}
+
+// ReceiveTFTP writes the received file to the store.
+func (h *storeHandler) ReceiveTFTP(w WriteRequest) {
+	name := storeName(w.Name())
+
+	file, err := h.store.Create(name)
+	if err != nil {
+		h.log.debug("creating %q: %v", name, err)
+		switch {
+		case errors.Is(err, fs.ErrExist):
+			w.WriteError(ErrCodeFileAlreadyExists, fmt.Sprintf("File %q already exists", w.Name()))
+		default:
+			h.hooks.accessDenied(w.Name(), w.Addr())
+			w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Cannot create file %q", filepath.Clean(w.Name())))
+		}
+		return
+	}
+
+	if _, err := io.Copy(file, w); err != nil {
+		h.log.debug("receiving %q: %v", name, err)
+		h.abort(file)
+		// No effect if the client ended the transfer
+		w.Abort(ErrCodeNotDefined, fmt.Sprintf("Cannot write file %q", w.Name()))
+		return
+	}
+
+	if err := file.Close(); err != nil {
+		h.log.debug("committing %q: %v", name, err)
+		w.WriteError(ErrCodeNotDefined, fmt.Sprintf("Cannot write file %q", w.Name()))
+	}
+}
+
+// abort discards file after a failed transfer. Files that can't be
+// aborted are closed.
+func (h *storeHandler) abort(file io.WriteCloser) {
+	if a, ok := file.(interface {
+		Abort() error
+	}); ok {
+		errorDefer(a.Abort, h.log, "error aborting file")
+		return
+	}
+	errorDefer(file.Close, h.log, "error closing file")
+}
+
+// storeName cleans a requested name and removes any leading slash.
+func storeName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// GzipStore returns a BlobStore that serves files stored compressed in s.
+//
+// When a file is opened and only the file with a ".gz" suffix exists in
+// s, it is decompressed as it is read. Files that exist are opened
+// unchanged, including requests for the ".gz" file itself. The size of
+// a decompressed file is unknown, and tsize is omitted, unless a ".gz.size"
+// file contains the size in decimal.
+//
+// Create is passed through to s. To serve a directory:
+//
+//	NewStoreHandler(GzipStore(OSDirStore("/srv/tftp")))
+func GzipStore(s BlobStore) BlobStore {
+	return gzipStore{s}
+}
+
+type gzipStore struct {
+	BlobStore
+}
+
+func (s gzipStore) Open(name string) (io.ReadCloser, int64, error) {
+	file, size, err := s.BlobStore.Open(name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return file, size, err
+	}
+
+	gzFile, _, gzErr := s.BlobStore.Open(name + ".gz")
+	if errors.Is(gzErr, fs.ErrNotExist) {
+		return nil, 0, err // Report the requested name
+	}
+	if gzErr != nil {
+		return nil, 0, gzErr
+	}
+	zr, err := gzip.NewReader(gzFile)
+	if err != nil {
+		gzFile.Close()
+		return nil, 0, fmt.Errorf("opening %q: %w", name+".gz", err)
+	}
+	return &gzipFile{Reader: zr, file: gzFile}, s.size(name + ".gz.size"), nil
+}
+
+// size returns the size in the sidecar file name, or -1 if it doesn't
+// exist or is invalid.
+func (s gzipStore) size(name string) int64 {
+	file, _, err := s.BlobStore.Open(name)
+	if err != nil {
+		return -1
+	}
+	defer file.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(file, 32))
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// gzipFile decompresses file.
+type gzipFile struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (f *gzipFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
+
+// OSDirStore returns a BlobStore for the files in dir.
+//
+// Files are created as by OSDirWriteFS, becoming visible once the
+// transfer completes. Directories cannot be opened.
+func OSDirStore(dir string) BlobStore {
+	return osDirStore(dir)
+}
+
+type osDirStore string
+
+func (dir osDirStore) Open(name string) (io.ReadCloser, int64, error) {
+	path, ok := osDirWriteFS(dir).path(name)
+	if !ok {
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		var perr *fs.PathError
+		if errors.As(err, &perr) {
+			perr.Path = name // Don't expose the directory
+		}
+		return nil, 0, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if fi.IsDir() {
+		file.Close()
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return file, fi.Size(), nil
+}
+
+func (dir osDirStore) Create(name string) (io.WriteCloser, error) {
+	return osDirWriteFS(dir).Create(name)
+}
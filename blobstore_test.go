@@ -0,0 +1,390 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// testStore is an in-memory BlobStore with injected failures.
+type testStore struct {
+	files     map[string][]byte
+	unsized   map[string]bool  // Files opened with unknown size
+	openErrs  map[string]error // Returned by Open
+	readErr   error            // Returned by readers after the file's data
+	createErr error            // Returned by Create
+	writeErr  error            // Returned by writers
+	closeErr  error            // Returned by writers' Close
+
+	aborted []string
+}
+
+func (s *testStore) Open(name string) (io.ReadCloser, int64, error) {
+	if err := s.openErrs[name]; err != nil {
+		return nil, 0, err
+	}
+	data, ok := s.files[name]
+	if !ok {
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if s.readErr != nil {
+		r = io.MultiReader(r, &errReader{err: s.readErr})
+	}
+	size := int64(len(data))
+	if s.unsized[name] {
+		size = -1
+	}
+	return ioutil.NopCloser(r), size, nil
+}
+
+func (s *testStore) Create(name string) (io.WriteCloser, error) {
+	if s.createErr != nil {
+		return nil, s.createErr
+	}
+	return &testStoreFile{s: s, name: name}, nil
+}
+
+type testStoreFile struct {
+	s    *testStore
+	name string
+	buf  bytes.Buffer
+}
+
+func (f *testStoreFile) Write(p []byte) (int, error) {
+	if f.s.writeErr != nil {
+		return 0, f.s.writeErr
+	}
+	return f.buf.Write(p)
+}
+
+func (f *testStoreFile) Close() error {
+	if f.s.closeErr != nil {
+		return f.s.closeErr
+	}
+	if f.s.files == nil {
+		f.s.files = make(map[string][]byte)
+	}
+	f.s.files[f.name] = f.buf.Bytes()
+	return nil
+}
+
+func (f *testStoreFile) Abort() error {
+	f.s.aborted = append(f.s.aborted, f.name)
+	return nil
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestStoreHandler_ServeTFTP(t *testing.T) {
+	data := []byte("firmware image")
+	errBackend := errors.New("backend unavailable")
+
+	cases := []struct {
+		name    string
+		reqName string
+		store   *testStore
+
+		expectedData      []byte
+		expectedSize      *int64
+		expectedErrorCode ErrorCode
+		expectedErrorMsg  string
+		expectedHook      string
+	}{
+		{
+			name:    "file exists",
+			reqName: "/firmware/../firmware/v1.img",
+			store:   &testStore{files: map[string][]byte{"firmware/v1.img": data}},
+
+			expectedData: data,
+			expectedSize: ptrInt64(int64(len(data))),
+		},
+		{
+			name:    "size unknown",
+			reqName: "v1.img",
+			store: &testStore{
+				files:   map[string][]byte{"v1.img": data},
+				unsized: map[string]bool{"v1.img": true},
+			},
+
+			expectedData: data,
+		},
+		{
+			name:    "not found",
+			reqName: "missing.img",
+			store:   &testStore{},
+
+			expectedErrorCode: ErrCodeFileNotFound,
+			expectedErrorMsg:  `File "missing.img" does not exist`,
+			expectedHook:      "not found",
+		},
+		{
+			name:    "permission denied",
+			reqName: "secret.img",
+			store:   &testStore{openErrs: map[string]error{"secret.img": fs.ErrPermission}},
+
+			expectedErrorCode: ErrCodeAccessViolation,
+			expectedErrorMsg:  `Cannot read file "secret.img"`,
+			expectedHook:      "access denied",
+		},
+		{
+			name:    "open failure",
+			reqName: "v1.img",
+			store:   &testStore{openErrs: map[string]error{"v1.img": errBackend}},
+
+			expectedErrorCode: ErrCodeNotDefined,
+			expectedErrorMsg:  `Cannot read file "v1.img"`,
+		},
+		{
+			name:    "read failure",
+			reqName: "v1.img",
+			store: &testStore{
+				files:   map[string][]byte{"v1.img": data},
+				readErr: errBackend,
+			},
+
+			expectedData:      data,
+			expectedSize:      ptrInt64(int64(len(data))),
+			expectedErrorCode: ErrCodeNotDefined,
+			expectedErrorMsg:  `Cannot read file "v1.img"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var hook string
+			h := NewStoreHandler(c.store,
+				FileServerNotFoundHook(func(string, string) { hook = "not found" }),
+				FileServerAccessDeniedHook(func(string, string) { hook = "access denied" }),
+			)
+
+			req := readRequestMock{name: c.reqName}
+			h.ServeTFTP(&req)
+
+			if !bytes.Equal(c.expectedData, req.writer.Bytes()) {
+				t.Errorf("expected data to be %q, but it was %q", c.expectedData, req.writer.Bytes())
+			}
+			if !reflect.DeepEqual(c.expectedSize, req.size) {
+				t.Errorf("expected size to be %v, but it was %v", c.expectedSize, req.size)
+			}
+			if c.expectedErrorCode != req.errCode || c.expectedErrorMsg != req.errMsg {
+				t.Errorf("expected error %s %q, got %s %q", c.expectedErrorCode, c.expectedErrorMsg, req.errCode, req.errMsg)
+			}
+			if hook != c.expectedHook {
+				t.Errorf("expected hook %q, got %q", c.expectedHook, hook)
+			}
+		})
+	}
+}
+
+func TestStoreHandler_ReceiveTFTP(t *testing.T) {
+	data := []byte("config data")
+	errBackend := errors.New("backend unavailable")
+
+	cases := []struct {
+		name  string
+		store *testStore
+
+		expectedStored    bool
+		expectedAborted   bool
+		expectedErrorCode ErrorCode
+		expectedErrorMsg  string
+	}{
+		{
+			name:           "success",
+			store:          &testStore{},
+			expectedStored: true,
+		},
+		{
+			name:              "already exists",
+			store:             &testStore{createErr: &fs.PathError{Op: "create", Path: "config", Err: fs.ErrExist}},
+			expectedErrorCode: ErrCodeFileAlreadyExists,
+			expectedErrorMsg:  `File "/config" already exists`,
+		},
+		{
+			name:              "permission denied",
+			store:             &testStore{createErr: fs.ErrPermission},
+			expectedErrorCode: ErrCodeAccessViolation,
+			expectedErrorMsg:  `Cannot create file "/config"`,
+		},
+		{
+			name:              "write failure",
+			store:             &testStore{writeErr: errBackend},
+			expectedAborted:   true,
+			expectedErrorCode: ErrCodeNotDefined,
+			expectedErrorMsg:  `Cannot write file "/config"`,
+		},
+		{
+			name:              "commit failure",
+			store:             &testStore{closeErr: errBackend},
+			expectedErrorCode: ErrCodeNotDefined,
+			expectedErrorMsg:  `Cannot write file "/config"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := NewStoreHandler(c.store)
+
+			req := writeRequestMock{name: "/config"}
+			req.reader.Write(data)
+			h.ReceiveTFTP(&req)
+
+			stored, ok := c.store.files["config"]
+			if ok != c.expectedStored || (ok && !bytes.Equal(stored, data)) {
+				t.Errorf("expected stored %t, got %t (%q)", c.expectedStored, ok, stored)
+			}
+			if aborted := len(c.store.aborted) > 0; aborted != c.expectedAborted {
+				t.Errorf("expected aborted %t, got %v", c.expectedAborted, c.store.aborted)
+			}
+			if c.expectedErrorCode != req.errCode || c.expectedErrorMsg != req.errMsg {
+				t.Errorf("expected error %s %q, got %s %q", c.expectedErrorCode, c.expectedErrorMsg, req.errCode, req.errMsg)
+			}
+		})
+	}
+}
+
+func TestOSDirStore(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store := OSDirStore(filepath.Join(dir, "sub"))
+
+	r, size, err := store.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "data" || size != 4 {
+		t.Errorf("expected 4 bytes %q, got %d %q", "data", size, data)
+	}
+
+	for _, name := range []string{"missing", ".", "../sub/file"} {
+		if _, _, err := store.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected Open(%q) to return fs.ErrNotExist, got %v", name, err)
+		}
+	}
+
+	w, err := store.Create("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new data"))
+	if _, _, err := store.Open("new"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected file to be hidden until closed, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, size, err = store.Open("new")
+	if err != nil || size != 8 {
+		t.Fatalf("expected 8 byte file, got %d (%v)", size, err)
+	}
+	r.Close()
+}
+
+func TestGzipStore(t *testing.T) {
+	plain := []byte("plain file")
+	initrd := bytes.Repeat([]byte("initrd "), 1000)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(initrd)
+	zw.Close()
+
+	store := GzipStore(&testStore{files: map[string][]byte{
+		"plain":           plain,
+		"plain.gz":        gz.Bytes(), // Not used, plain exists
+		"boot/initrd.gz":  gz.Bytes(),
+		"sized.gz":        gz.Bytes(),
+		"sized.gz.size":   []byte(strconv.Itoa(len(initrd)) + "\n"),
+		"badsize.gz":      gz.Bytes(),
+		"badsize.gz.size": []byte("unknown"),
+		"corrupt.gz":      []byte("not gzip"),
+	}})
+
+	cases := []struct {
+		name    string
+		reqName string
+
+		expectedData      []byte
+		expectedSize      *int64
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:         "plain file",
+			reqName:      "plain",
+			expectedData: plain,
+			expectedSize: ptrInt64(int64(len(plain))),
+		},
+		{
+			name:         "compressed file",
+			reqName:      "boot/initrd",
+			expectedData: initrd,
+		},
+		{
+			name:         "compressed file requested",
+			reqName:      "boot/initrd.gz",
+			expectedData: gz.Bytes(),
+			expectedSize: ptrInt64(int64(gz.Len())),
+		},
+		{
+			name:         "size sidecar",
+			reqName:      "sized",
+			expectedData: initrd,
+			expectedSize: ptrInt64(int64(len(initrd))),
+		},
+		{
+			name:         "invalid size sidecar",
+			reqName:      "badsize",
+			expectedData: initrd,
+		},
+		{
+			name:              "neither exists",
+			reqName:           "missing",
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+		{
+			name:              "corrupt",
+			reqName:           "corrupt",
+			expectedErrorCode: ErrCodeNotDefined,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := readRequestMock{name: c.reqName}
+			NewStoreHandler(store).ServeTFTP(&req)
+
+			if !bytes.Equal(c.expectedData, req.writer.Bytes()) {
+				t.Errorf("expected %d bytes, got %d", len(c.expectedData), req.writer.Len())
+			}
+			if !reflect.DeepEqual(c.expectedSize, req.size) {
+				t.Errorf("expected size to be %v, but it was %v", c.expectedSize, req.size)
+			}
+			if c.expectedErrorCode != req.errCode {
+				t.Errorf("expected error code %s, got %s (%q)", c.expectedErrorCode, req.errCode, req.errMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// Checksum extension
+//
+// A client wanting to verify a read requests the "checksum" option
+// with the name of a hash algorithm. If the server supports the
+// algorithm it is included in the OACK and the server hashes the
+// DATA payloads as they are sent.
+//
+// After the final DATA has been acknowledged the server sends a
+// trailing OACK containing the hex encoded checksum. The client
+// compares it with the hash of the DATA it received and acknowledges
+// the trailer with an ACK for the block following the final block,
+// or sends an ERROR if the checksums do not match.
+
+// checksumAlgs are the supported checksum algorithms.
+var checksumAlgs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+// sendChecksum sends the checksum trailer after the final DATA
+// has been acknowledged.
+func (c *conn) sendChecksum() stateType {
+	sum := hex.EncodeToString(c.hash.Sum(nil))
+	c.log.trace("Sending checksum %s to %s\n", sum, c.remoteAddr)
+	c.tx.writeOptionAck(options{optChecksum: sum})
+	if err := c.writeToNet(); err != nil {
+		c.err = wrapError(err, "writing checksum")
+		return nil
+	}
+
+	return c.getChecksumAck
+}
+
+// getChecksumAck waits for the receiver to acknowledge the checksum
+// trailer.
+//
+// All DATA has already been acknowledged, so a missing ACK is not
+// treated as an error. An ERROR indicates that the receiver's checksum
+// did not match.
+func (c *conn) getChecksumAck() stateType {
+	c.tries++
+	if c.tries > c.retransmit {
+		c.log.debug("No ACK received for checksum from %s", c.remoteAddr)
+		c.trailer = false
+		return nil
+	}
+
+	sAddr, err := c.readFromNet()
+	if err == ErrTransferTimeout {
+		c.trailer = false
+		return nil
+	}
+	if err != nil {
+		c.log.trace("Error waiting for checksum ACK: %v", err)
+		return c.sendChecksum
+	}
+	if c.reqChan == nil && sAddr.String() != c.remoteAddr.String() {
+		return c.getChecksumAck
+	}
+
+	if err := c.rx.validate(); err != nil {
+		c.err = wrapError(err, "checksum ACK validation failed")
+		return nil
+	}
+
+	switch c.rx.opcode() {
+	case opCodeACK:
+		if c.rx.block() != c.block+1 {
+			// Duplicate ACK for the final DATA
+			return c.getChecksumAck
+		}
+	case opCodeERROR:
+		c.err = wrapError(c.remoteError(), "error receiving checksum ACK")
+		return nil
+	default:
+		c.err = wrapError(&errUnexpectedDatagram{c.rx.String()}, "error receiving checksum ACK")
+		return nil
+	}
+
+	c.tries = 0
+	c.trailer = false
+	return nil
+}
+
+// readChecksum waits for the checksum trailer after the final DATA
+// has been acknowledged and verifies it.
+func (c *conn) readChecksum() stateType {
+	if c.tries >= c.retransmit {
+		c.log.debug("Max retries exceeded")
+		c.sendError(ErrCodeNotDefined, "max retries reached")
+		c.err = wrapError(ErrMaxRetries, "reading checksum")
+		return nil
+	}
+	c.tries++
+
+	if c.deadlineExceeded("reading checksum") {
+		return nil
+	}
+
+	// The trailer may not fit in a buffer sized for a small blksize
+	if needed := defaultBlksize + 4; len(c.rx.buf) < needed {
+		c.rx.buf = make([]byte, needed)
+	}
+
+	c.log.trace("Waiting for checksum from %s\n", c.remoteAddr)
+	_, err := c.readFromNet()
+	if err == ErrTransferTimeout {
+		c.err = wrapError(err, "reading checksum")
+		return nil
+	}
+	if err != nil {
+		c.log.debug("error receiving checksum: %v", err)
+		if err := c.sendAck(c.block); err != nil {
+			c.log.debug("resending ACK %v", err)
+		}
+		return c.readChecksum
+	}
+
+	if err := c.rx.validate(); err != nil {
+		c.err = wrapError(err, "validating checksum")
+		return nil
+	}
+
+	switch c.rx.opcode() {
+	case opCodeOACK:
+	case opCodeDATA:
+		// Sender didn't receive the final ACK
+		if err := c.sendAck(c.block); err != nil {
+			c.log.debug("resending ACK %v", err)
+		}
+		return c.readChecksum
+	case opCodeERROR:
+		c.err = wrapError(c.remoteError(), "reading checksum")
+		return nil
+	default:
+		c.err = wrapError(&errUnexpectedDatagram{dg: c.rx.String()}, "reading checksum")
+		return nil
+	}
+
+	c.tries = 0
+	c.trailer = false
+
+	if sum := hex.EncodeToString(c.hash.Sum(nil)); c.rx.options()[optChecksum] != sum {
+		c.sendError(ErrCodeNotDefined, "checksum mismatch")
+		c.err = wrapError(ErrChecksumMismatch, "verifying checksum")
+		return nil
+	}
+
+	if err := c.sendAck(c.block + 1); err != nil {
+		c.err = wrapError(err, "sending checksum ACK")
+		return nil
+	}
+
+	return c.read
+}
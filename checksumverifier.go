@@ -0,0 +1,250 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sidecarSuffix is appended to a file name to upload its checksum.
+	sidecarSuffix = ".sha256"
+	// sidecarTTL is how long a sidecar checksum waits for its file.
+	sidecarTTL = 5 * time.Minute
+)
+
+// NewChecksumVerifier returns a WriteHandler that computes the SHA-256
+// of files received by h and compares it with the expected checksum,
+// in hex, once the transfer is complete.
+//
+// The expected checksum is provided by ChecksumVerifierExpected, or
+// uploaded by the client as "<name>.sha256" before the file when
+// ChecksumVerifierSidecars is enabled. A sidecar checksum only applies
+// to uploads from the same IP address. Files without an expected
+// checksum are accepted unless ChecksumVerifierRequired is enabled.
+//
+// The final block has been acknowledged by the time the checksum is
+// compared, so the client isn't told that verification failed. Instead,
+// the hook configured with ChecksumVerifierFailureHook is called, for
+// example to delete the file, and the failure is reported in
+// TransferStats.Err. h must finish writing the file before returning.
+//
+// Verification failures are only recorded in TransferStats when the
+// verifier wraps any middleware that replaces the WriteRequest.
+func NewChecksumVerifier(h WriteHandler, opts ...ChecksumVerifierOpt) WriteHandler {
+	v := &checksumVerifier{
+		h:        h,
+		log:      newLogger("checksumverifier"),
+		sidecars: make(map[sidecarKey]sidecarChecksum),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+type checksumVerifier struct {
+	h        WriteHandler
+	log      *logger
+	expected func(filename string) (string, bool)
+	required bool
+	onFail   func(filename string, err error)
+
+	useSidecars bool
+	mu          sync.Mutex
+	sidecars    map[sidecarKey]sidecarChecksum // Uploaded checksums, by client and file name
+}
+
+// sidecarKey identifies the file a sidecar checksum was uploaded for.
+type sidecarKey struct {
+	ip   netip.Addr // Of the client, other clients can't provide the checksum
+	name string
+}
+
+// sidecarChecksum is a checksum uploaded before its file.
+type sidecarChecksum struct {
+	sum     string
+	expires time.Time
+}
+
+// failureRecorder is implemented by requests that can report a failure
+// detected after the transfer completed.
+type failureRecorder interface {
+	setFailure(error)
+}
+
+// ReceiveTFTP passes w to the wrapped handler, verifying the received
+// file once it returns.
+func (v *checksumVerifier) ReceiveTFTP(w WriteRequest) {
+	if v.useSidecars && strings.HasSuffix(w.Name(), sidecarSuffix) {
+		v.receiveSidecar(w)
+		return
+	}
+
+	cw := &checksumWriteRequest{WriteRequest: w, hash: sha256.New()}
+	v.h.ReceiveTFTP(cw)
+
+	if stats := w.Stats(); !stats.Complete || stats.Err != nil {
+		return // Not received, nothing to verify
+	}
+
+	want, ok := v.expectedSum(w)
+	if !ok {
+		if v.required {
+			v.fail(w, ErrChecksumMissing)
+		}
+		return
+	}
+	if got := hex.EncodeToString(cw.hash.Sum(nil)); !strings.EqualFold(got, want) {
+		v.fail(w, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, want, got))
+	}
+}
+
+// receiveSidecar stores the checksum uploaded in w for the file it names.
+//
+// The format written by sha256sum is accepted, only the first field is
+// used.
+func (v *checksumVerifier) receiveSidecar(w WriteRequest) {
+	b, err := ioutil.ReadAll(io.LimitReader(w, 1024))
+	if err != nil {
+		return // Transfer failed
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || !validSHA256(fields[0]) {
+		v.log.debug("invalid checksum for %q from %s", w.Name(), w.Addr())
+		// No effect if the final block has been received
+		w.Abort(ErrCodeNotDefined, "invalid checksum")
+		recordFailure(w, ErrInvalidSidecarChecksum)
+		return
+	}
+
+	key := sidecarKey{ip: w.AddrPort().Addr(), name: strings.TrimSuffix(w.Name(), sidecarSuffix)}
+	now := time.Now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for k, s := range v.sidecars {
+		if now.After(s.expires) {
+			delete(v.sidecars, k)
+		}
+	}
+	v.sidecars[key] = sidecarChecksum{sum: fields[0], expires: now.Add(sidecarTTL)}
+}
+
+// expectedSum returns the checksum the file received in w is expected
+// to have. A sidecar checksum is used once.
+func (v *checksumVerifier) expectedSum(w WriteRequest) (string, bool) {
+	if v.expected != nil {
+		if sum, ok := v.expected(w.Name()); ok {
+			return sum, true
+		}
+	}
+	if !v.useSidecars {
+		return "", false
+	}
+
+	key := sidecarKey{ip: w.AddrPort().Addr(), name: w.Name()}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.sidecars[key]
+	if !ok {
+		return "", false
+	}
+	delete(v.sidecars, key)
+	if time.Now().After(s.expires) {
+		return "", false
+	}
+	return s.sum, true
+}
+
+// fail reports that the file received in w failed verification.
+func (v *checksumVerifier) fail(w WriteRequest, err error) {
+	v.log.debug("verifying %q from %s: %v", w.Name(), w.Addr(), err)
+	if v.onFail != nil {
+		v.onFail(w.Name(), err)
+	}
+	recordFailure(w, err)
+}
+
+// recordFailure sets the error reported in the stats of req, if it
+// supports it.
+func recordFailure(req interface{}, err error) {
+	if r, ok := req.(failureRecorder); ok {
+		r.setFailure(err)
+	}
+}
+
+// validSHA256 reports whether s is a hex encoded SHA-256 checksum.
+func validSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// checksumWriteRequest hashes the data read from the request.
+type checksumWriteRequest struct {
+	WriteRequest
+	hash hash.Hash
+}
+
+func (w *checksumWriteRequest) Read(p []byte) (int, error) {
+	n, err := w.WriteRequest.Read(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// ChecksumVerifierOpt is a function that configures a handler created by
+// NewChecksumVerifier.
+type ChecksumVerifierOpt func(*checksumVerifier)
+
+// ChecksumVerifierExpected configures fn to provide the expected
+// checksum of filename, in hex. If fn returns false a sidecar checksum
+// is used, if enabled.
+func ChecksumVerifierExpected(fn func(filename string) (string, bool)) ChecksumVerifierOpt {
+	return func(v *checksumVerifier) {
+		v.expected = fn
+	}
+}
+
+// ChecksumVerifierSidecars configures the verifier to accept uploads of
+// "<name>.sha256" containing the checksum of name, which must be
+// uploaded from the same IP address within 5 minutes. Sidecar uploads
+// aren't passed to the wrapped handler.
+//
+// Default: false.
+func ChecksumVerifierSidecars(enable bool) ChecksumVerifierOpt {
+	return func(v *checksumVerifier) {
+		v.useSidecars = enable
+	}
+}
+
+// ChecksumVerifierRequired configures the verifier to treat files
+// without an expected checksum as failed, with ErrChecksumMissing.
+//
+// Default: false.
+func ChecksumVerifierRequired(required bool) ChecksumVerifierOpt {
+	return func(v *checksumVerifier) {
+		v.required = required
+	}
+}
+
+// ChecksumVerifierFailureHook configures fn to be called when a received
+// file fails verification, with ErrChecksumMissing or an error wrapping
+// ErrChecksumMismatch. It is called synchronously before the handler
+// returns.
+func ChecksumVerifierFailureHook(fn func(filename string, err error)) ChecksumVerifierOpt {
+	return func(v *checksumVerifier) {
+		v.onFail = fn
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChecksumVerifier(t *testing.T) {
+	t.Parallel()
+
+	data := getTestData(t, "1MB-random")[:3000]
+	sum := sha256.Sum256(data)
+	goodSum := hex.EncodeToString(sum[:])
+	badSum := hex.EncodeToString(make([]byte, sha256.Size))
+
+	type upload struct {
+		name string
+		data []byte
+	}
+	cases := []struct {
+		name    string
+		opts    []ChecksumVerifierOpt
+		uploads []upload
+
+		expectedErrors []error // Reported in the stats of each upload
+		expectedHook   error
+	}{
+		{
+			name: "callback match",
+			opts: []ChecksumVerifierOpt{ChecksumVerifierExpected(func(name string) (string, bool) {
+				return goodSum, name == "firmware.bin"
+			})},
+			uploads:        []upload{{"firmware.bin", data}},
+			expectedErrors: []error{nil},
+		},
+		{
+			name: "callback mismatch",
+			opts: []ChecksumVerifierOpt{ChecksumVerifierExpected(func(string) (string, bool) {
+				return badSum, true
+			})},
+			uploads:        []upload{{"firmware.bin", data}},
+			expectedErrors: []error{ErrChecksumMismatch},
+			expectedHook:   ErrChecksumMismatch,
+		},
+		{
+			name:           "missing",
+			uploads:        []upload{{"firmware.bin", data}},
+			expectedErrors: []error{nil},
+		},
+		{
+			name:           "missing, required",
+			opts:           []ChecksumVerifierOpt{ChecksumVerifierRequired(true)},
+			uploads:        []upload{{"firmware.bin", data}},
+			expectedErrors: []error{ErrChecksumMissing},
+			expectedHook:   ErrChecksumMissing,
+		},
+		{
+			name: "sidecar match",
+			opts: []ChecksumVerifierOpt{ChecksumVerifierSidecars(true), ChecksumVerifierRequired(true)},
+			uploads: []upload{
+				{"firmware.bin.sha256", []byte(goodSum + "  firmware.bin\n")},
+				{"firmware.bin", data},
+			},
+			expectedErrors: []error{nil, nil},
+		},
+		{
+			name: "sidecar mismatch",
+			opts: []ChecksumVerifierOpt{ChecksumVerifierSidecars(true)},
+			uploads: []upload{
+				{"firmware.bin.sha256", []byte(badSum)},
+				{"firmware.bin", data},
+			},
+			expectedErrors: []error{nil, ErrChecksumMismatch},
+			expectedHook:   ErrChecksumMismatch,
+		},
+		{
+			name: "sidecar used once",
+			opts: []ChecksumVerifierOpt{ChecksumVerifierSidecars(true), ChecksumVerifierRequired(true)},
+			uploads: []upload{
+				{"firmware.bin.sha256", []byte(goodSum)},
+				{"firmware.bin", data},
+				{"firmware.bin", data},
+			},
+			expectedErrors: []error{nil, nil, ErrChecksumMissing},
+			expectedHook:   ErrChecksumMissing,
+		},
+		{
+			name: "sidecar invalid",
+			opts: []ChecksumVerifierOpt{ChecksumVerifierSidecars(true)},
+			uploads: []upload{
+				{"firmware.bin.sha256", []byte("not a checksum")},
+			},
+			expectedErrors: []error{ErrInvalidSidecarChecksum},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			received := make(map[string][]byte)
+			var hookErr error
+			opts := append(c.opts, ChecksumVerifierFailureHook(func(name string, err error) {
+				if name != "firmware.bin" {
+					t.Errorf("expected hook for %q, got %q", "firmware.bin", name)
+				}
+				hookErr = err
+			}))
+			h := NewChecksumVerifier(WriteHandlerFunc(func(w WriteRequest) {
+				b, _ := ioutil.ReadAll(w)
+				received[w.Name()] = b
+			}), opts...)
+
+			stats := make(chan TransferStats, len(c.uploads))
+			ip, port, closeServer := newTestServer(t, false, nil, h.ReceiveTFTP, ServerTransferLogger(func(s TransferStats) {
+				stats <- s
+			}))
+			defer closeServer()
+
+			client, err := NewClient(ClientTransferSize(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, u := range c.uploads {
+				url := fmt.Sprintf("%s:%s/%s", ip, strconv.Itoa(port), u.name)
+				if err := client.Put(url, bytes.NewReader(u.data), int64(len(u.data))); err != nil {
+					t.Fatalf("upload %d: %v", i, err)
+				}
+
+				select {
+				case s := <-stats:
+					if !errors.Is(s.Err, c.expectedErrors[i]) || (s.Err == nil) != (c.expectedErrors[i] == nil) {
+						t.Errorf("upload %d: expected error %v, got %v", i, c.expectedErrors[i], s.Err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("upload %d: timed out waiting for stats", i)
+				}
+			}
+
+			if !errors.Is(hookErr, c.expectedHook) || (hookErr == nil) != (c.expectedHook == nil) {
+				t.Errorf("expected hook error %v, got %v", c.expectedHook, hookErr)
+			}
+			if _, ok := received["firmware.bin.sha256"]; ok {
+				t.Error("expected sidecar not to be passed to the handler")
+			}
+			if b, ok := received["firmware.bin"]; ok && !bytes.Equal(b, data) {
+				t.Errorf("expected handler to receive %d bytes, got %d", len(data), len(b))
+			}
+		})
+	}
+}
+
+func TestChecksumVerifier_sidecarClient(t *testing.T) {
+	t.Parallel()
+
+	sum := hex.EncodeToString(make([]byte, sha256.Size))
+	v := NewChecksumVerifier(WriteHandlerFunc(func(WriteRequest) {}), ChecksumVerifierSidecars(true)).(*checksumVerifier)
+
+	upload := func(ip string, port int) {
+		w := &writeRequestMock{addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: port}, name: "firmware.bin.sha256"}
+		w.reader.WriteString(sum)
+		v.receiveSidecar(w)
+	}
+	expected := func(ip string, port int) bool {
+		_, ok := v.expectedSum(&writeRequestMock{addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: port}, name: "firmware.bin"})
+		return ok
+	}
+
+	upload("192.0.2.1", 1000)
+	if expected("192.0.2.2", 1000) {
+		t.Error("expected sidecar not to apply to another client")
+	}
+	// Each transfer uses a new port
+	if !expected("192.0.2.1", 2000) {
+		t.Error("expected sidecar to apply to the same client")
+	}
+
+	// Expired sidecars are ignored, and removed by the next upload
+	upload("192.0.2.1", 1000)
+	v.mu.Lock()
+	for k, s := range v.sidecars {
+		s.expires = time.Now().Add(-time.Second)
+		v.sidecars[k] = s
+	}
+	v.mu.Unlock()
+	upload("192.0.2.3", 1000)
+	if expected("192.0.2.1", 1000) {
+		t.Error("expected expired sidecar to be ignored")
+	}
+	if n := len(v.sidecars); n != 1 {
+		t.Errorf("expected 1 sidecar stored, got %d", n)
+	}
+}
@@ -7,8 +7,10 @@ package trivialt
 import (
 	"fmt"
 	"io"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Client makes requests to a server.
@@ -18,7 +20,18 @@ type Client struct {
 	mode TransferMode      // TFTP transfer mode
 	opts map[string]string // Map of TFTP options (RFC2347)
 
-	retransmit int // Per-packet retransmission limit
+	timeout    time.Duration // Per-packet wait before retransmitting, overridden by negotiation
+	retransmit int           // Per-packet retransmission limit
+	backoff    *backoff      // Increasing per-packet wait, overrides timeout if set
+	deadline   time.Duration // Total time before a transfer is aborted, 0 for no limit
+	checksum   string        // Checksum algorithm to verify reads with, empty if disabled
+
+	readBuffer  int // Socket receive buffer size, 0 for system default
+	writeBuffer int // Socket send buffer size, 0 for system default
+	dscp        int // DiffServ code point, 0 for system default
+
+	host string       // Server host resolved to addr, set by ClientPool
+	addr *net.UDPAddr // Resolved address of host
 }
 
 // NewClient returns a configured Client.
@@ -36,6 +49,7 @@ func NewClient(opts ...ClientOpt) (*Client, error) {
 		net:        defaultUDPNet,
 		opts:       options,
 		mode:       defaultMode,
+		timeout:    defaultTimeout,
 		retransmit: defaultRetransmit,
 	}
 
@@ -59,16 +73,31 @@ func (c *Client) Get(url string) (*Response, error) {
 	}
 
 	// Create connection
-	conn, err := newConnFromHost(c.net, c.mode, u.host)
+	conn, err := c.dial(u.host)
 	if err != nil {
 		return nil, err
 	}
+	if err := setBufferSizes(conn.netConn, c.readBuffer, c.writeBuffer); err != nil {
+		errorDefer(conn.netConn.Close, c.log, "error closing network connection in Get")
+		return nil, err
+	}
+	if err := setDSCP(conn.netConn, c.dscp); err != nil {
+		errorDefer(conn.netConn.Close, c.log, "error closing network connection in Get")
+		return nil, err
+	}
 
-	// Set retransmit
+	// Set timeout and retransmit
+	conn.timeout = c.timeout
 	conn.retransmit = c.retransmit
+	conn.backoff = c.backoff
+	if c.deadline > 0 {
+		conn.deadline = time.Now().Add(c.deadline)
+	}
+	conn.checksumAlg = c.checksum
 
 	// Initiate the request
 	if err := conn.sendReadRequest(u.file, c.opts); err != nil {
+		errorDefer(conn.netConn.Close, c.log, "error closing network connection in Get")
 		return nil, err
 	}
 
@@ -85,7 +114,7 @@ func (c *Client) Put(url string, r io.Reader, size int64) (err error) {
 	}
 
 	// Create connection
-	conn, err := newConnFromHost(c.net, c.mode, u.host)
+	conn, err := c.dial(u.host)
 	if err != nil {
 		return err
 	}
@@ -95,23 +124,40 @@ func (c *Client) Put(url string, r io.Reader, size int64) (err error) {
 			err = cErr
 		}
 	}()
+	if err := setBufferSizes(conn.netConn, c.readBuffer, c.writeBuffer); err != nil {
+		return err
+	}
+	if err := setDSCP(conn.netConn, c.dscp); err != nil {
+		return err
+	}
 
-	// Set retransmit
+	// Set timeout and retransmit
+	conn.timeout = c.timeout
 	conn.retransmit = c.retransmit
+	conn.backoff = c.backoff
+	if c.deadline > 0 {
+		conn.deadline = time.Now().Add(c.deadline)
+	}
+
+	// Copy options so that tsize doesn't affect subsequent requests
+	opts := make(map[string]string, len(c.opts))
+	for k, v := range c.opts {
+		opts[k] = v
+	}
 
 	// Check if tsize is enabled
-	if _, ok := c.opts[optTransferSize]; ok {
+	if _, ok := opts[optTransferSize]; ok {
 		if size < 1 {
 			// If size is <1, remove the option
-			delete(c.opts, optTransferSize)
+			delete(opts, optTransferSize)
 		} else {
 			// Otherwise add the size as a string
-			c.opts[optTransferSize] = fmt.Sprint(size)
+			opts[optTransferSize] = fmt.Sprint(size)
 		}
 	}
 
 	// Initiate the request
-	if err := conn.sendWriteRequest(u.file, c.opts); err != nil {
+	if err := conn.sendWriteRequest(u.file, opts); err != nil {
 		return err
 	}
 
@@ -121,6 +167,15 @@ func (c *Client) Put(url string, r io.Reader, size int64) (err error) {
 	return err
 }
 
+// dial returns a new conn to host, using the pre-resolved address
+// if there is one.
+func (c *Client) dial(host string) (*conn, error) {
+	if c.addr != nil && host == c.host {
+		return newConn(c.net, c.mode, c.addr)
+	}
+	return newConnFromHost(c.net, c.mode, host)
+}
+
 // parsedURL holds the result of parseURL
 type parsedURL struct {
 	host string
@@ -140,43 +195,49 @@ func parseURL(tftpURL string) (*parsedURL, error) {
 		return nil, ErrInvalidURL
 	}
 
-	p := &parsedURL{
-		host: parts[0],
-		file: parts[1],
-	}
-
-	if p.host == "" {
+	if parts[0] == "" {
 		return nil, ErrInvalidHostIP
 	}
 
-	if p.file == "" {
+	if parts[1] == "" {
 		return nil, ErrInvalidFile
 	}
 
-	hostParts := strings.Split(p.host, ":")
+	host, err := parseHost(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsedURL{host: host, file: parts[1]}, nil
+}
+
+// parseHost validates a string with the format "[server]:[port]",
+// adding defaultPort if port is not specified.
+func parseHost(host string) (string, error) {
+	hostParts := strings.Split(host, ":")
 	if isNumeric(hostParts[0]) {
 		// Host can't be number
-		return nil, ErrInvalidHostIP
+		return "", ErrInvalidHostIP
 	}
 	switch l := len(hostParts); {
 	case l == 1:
 		// Host only add default port
-		p.host = fmt.Sprintf("%s:%d", p.host, defaultPort)
+		host = fmt.Sprintf("%s:%d", host, defaultPort)
 	case l == 2:
 		if hostParts[0] == "" {
 			// Host is blank
-			return nil, ErrInvalidHostIP
+			return "", ErrInvalidHostIP
 		}
 		if !isNumeric(hostParts[1]) {
 			// Port must be numeric
-			return nil, ErrInvalidHostIP
+			return "", ErrInvalidHostIP
 		}
 	case l > 2:
 		// Too many colons
-		return nil, ErrInvalidHostIP
+		return "", ErrInvalidHostIP
 	}
 
-	return p, nil
+	return host, nil
 }
 
 func isNumeric(s string) bool {
@@ -184,7 +245,7 @@ func isNumeric(s string) bool {
 	return err == nil
 }
 
-// Response is an io.Reader for receiving files from a TFTP server.
+// Response is an io.ReadCloser for receiving files from a TFTP server.
 type Response struct {
 	conn *conn
 }
@@ -203,9 +264,34 @@ func (r *Response) Read(p []byte) (int, error) {
 	return r.conn.Read(p)
 }
 
+// Close releases the network connection used by the transfer.
+//
+// If the transfer has not completed, an error is sent to the server
+// so that it can stop sending data.
+func (r *Response) Close() error {
+	if !r.conn.done && r.conn.err == nil {
+		r.conn.sendError(ErrCodeNotDefined, "transfer canceled")
+	}
+	return r.conn.netConn.Close()
+}
+
 // ClientOpt is a function that configures a Client.
 type ClientOpt func(*Client) error
 
+// ClientNet configures the network used to reach the server.
+// Must be one of: udp, udp4, udp6.
+//
+// Default: udp.
+func ClientNet(net string) ClientOpt {
+	return func(c *Client) error {
+		if net != "udp" && net != "udp4" && net != "udp6" {
+			return ErrInvalidNetwork
+		}
+		c.net = net
+		return nil
+	}
+}
+
 // ClientMode configures the mode.
 //
 // Valid options are ModeNetASCII and ModeOctet. Default is ModeNetASCII.
@@ -225,7 +311,7 @@ func ClientMode(mode TransferMode) ClientOpt {
 // Default: 512.
 func ClientBlocksize(size int) ClientOpt {
 	return func(c *Client) error {
-		if size < 8 || size > 65464 {
+		if size < 8 || size > maxRFCBlksize {
 			return ErrInvalidBlocksize
 		}
 		c.opts[optBlocksize] = strconv.Itoa(size)
@@ -233,16 +319,41 @@ func ClientBlocksize(size int) ClientOpt {
 	}
 }
 
-// ClientTimeout configures the number of seconds to wait before resending an unacknowledged datagram.
-// Valid range is 1 to 255.
+// ClientTimeout configures how long to wait before resending an
+// unacknowledged datagram. Sub-second values can be used to recover
+// quickly from loss on low latency networks.
 //
-// Default: 1.
-func ClientTimeout(seconds int) ClientOpt {
+// The timeout is used while waiting for the server's response to the
+// request. If it is a whole number of seconds from 1 to 255 it is also
+// requested from the server (RFC2349), other values can't be negotiated.
+//
+// Default: 1 second, not requested.
+func ClientTimeout(d time.Duration) ClientOpt {
 	return func(c *Client) error {
-		if seconds < 1 || seconds > 255 {
-			return ErrInvalidTimeout
+		if d <= 0 {
+			return ErrInvalidRetransmitTimeout
+		}
+		c.timeout = d
+		if seconds := d / time.Second; d%time.Second == 0 && seconds <= 255 {
+			c.opts[optTimeout] = strconv.Itoa(int(seconds))
+		} else {
+			delete(c.opts, optTimeout)
 		}
-		c.opts[optTimeout] = strconv.Itoa(seconds)
+		return nil
+	}
+}
+
+// ClientTransferDeadline configures the longest a transfer may take,
+// regardless of activity. Once exceeded the server is sent an ERROR and
+// ErrTransferDeadline is returned.
+//
+// Default: 0 (no limit).
+func ClientTransferDeadline(d time.Duration) ClientOpt {
+	return func(c *Client) error {
+		if d < 0 {
+			return ErrInvalidTransferDeadline
+		}
+		c.deadline = d
 		return nil
 	}
 }
@@ -274,6 +385,26 @@ func ClientTransferSize(enable bool) ClientOpt {
 	}
 }
 
+// ClientVerifyChecksum configures the client to request a checksum of
+// the file from the server and verify it against the received data. The
+// algorithm alg must be "md5" or "sha256".
+//
+// Get returns ErrChecksumNotNegotiated if the server does not agree to
+// send the checksum. If the checksums don't match, Response.Read returns
+// ErrChecksumMismatch instead of io.EOF.
+//
+// Default: disabled.
+func ClientVerifyChecksum(alg string) ClientOpt {
+	return func(c *Client) error {
+		if _, ok := checksumAlgs[alg]; !ok {
+			return ErrInvalidChecksum
+		}
+		c.opts[optChecksum] = alg
+		c.checksum = alg
+		return nil
+	}
+}
+
 // ClientRetransmit configures the per-packet retransmission limit for all requests.
 //
 // Default: 10.
@@ -286,3 +417,71 @@ func ClientRetransmit(i int) ClientOpt {
 		return nil
 	}
 }
+
+// ClientRetransmitBackoff configures the client to wait increasing amounts
+// of time before retransmitting, reducing retransmissions when the network
+// or server is congested. The first wait is initial, and each subsequent
+// wait for the same datagram is multiplied by multiplier, up to max.
+//
+// The waits replace the ClientTimeout, which is still requested from the
+// server. The ClientRetransmit limit still applies.
+//
+// Default: disabled, each wait is the ClientTimeout.
+func ClientRetransmitBackoff(initial, max time.Duration, multiplier float64) ClientOpt {
+	return func(c *Client) error {
+		if initial <= 0 || max < initial || multiplier < 1 {
+			return ErrInvalidBackoff
+		}
+		c.backoff = &backoff{initial: initial, max: max, multiplier: multiplier}
+		return nil
+	}
+}
+
+// ClientReadBufferSize configures the size of the operating system's
+// receive buffer for the client's network connections.
+//
+// Default: 0 (operating system default).
+func ClientReadBufferSize(bytes int) ClientOpt {
+	return func(c *Client) error {
+		if bytes < 0 {
+			return ErrInvalidBufferSize
+		}
+		c.readBuffer = bytes
+		return nil
+	}
+}
+
+// ClientWriteBufferSize configures the size of the operating system's
+// send buffer for the client's network connections.
+//
+// Default: 0 (operating system default).
+func ClientWriteBufferSize(bytes int) ClientOpt {
+	return func(c *Client) error {
+		if bytes < 0 {
+			return ErrInvalidBufferSize
+		}
+		c.writeBuffer = bytes
+		return nil
+	}
+}
+
+// ClientDSCP configures the DiffServ code point (RFC 2474) used to mark
+// packets sent by the client. It is applied with IP_TOS for IPv4 and
+// IPV6_TCLASS for IPv6.
+//
+// Value must be between 0 and 63. ErrDSCPUnsupported is returned on
+// platforms where the traffic class cannot be set.
+//
+// Default: 0 (operating system default).
+func ClientDSCP(value int) ClientOpt {
+	return func(c *Client) error {
+		if value < 0 || value > 63 {
+			return ErrInvalidDSCP
+		}
+		if value != 0 && !dscpSupported {
+			return ErrDSCPUnsupported
+		}
+		c.dscp = value
+		return nil
+	}
+}
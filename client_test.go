@@ -6,9 +6,11 @@ package trivialt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -18,6 +20,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -35,6 +38,8 @@ func TestNewClient(t *testing.T) {
 		opts []ClientOpt
 
 		expectedError      error
+		expectedNet        string
+		expectedTimeout    time.Duration
 		expectedOpts       map[string]string
 		expectedMode       TransferMode
 		expectedRetransmit int
@@ -45,6 +50,15 @@ func TestNewClient(t *testing.T) {
 			expectedMode:       ModeOctet,
 			expectedRetransmit: 10,
 		},
+		{
+			name: "net udp6",
+			opts: []ClientOpt{ClientNet("udp6")},
+
+			expectedNet:        "udp6",
+			expectedOpts:       defaultOpts,
+			expectedMode:       ModeOctet,
+			expectedRetransmit: 10,
+		},
 		{
 			name: "mode",
 			opts: []ClientOpt{ClientMode(ModeNetASCII)},
@@ -66,8 +80,9 @@ func TestNewClient(t *testing.T) {
 		},
 		{
 			name: "timeout",
-			opts: []ClientOpt{ClientTimeout(24)},
+			opts: []ClientOpt{ClientTimeout(24 * time.Second)},
 
+			expectedTimeout: 24 * time.Second,
 			expectedOpts: map[string]string{
 				optTransferSize: "0",
 				optTimeout:      "24",
@@ -75,6 +90,24 @@ func TestNewClient(t *testing.T) {
 			expectedMode:       ModeOctet,
 			expectedRetransmit: 10,
 		},
+		{
+			name: "timeout, sub-second",
+			opts: []ClientOpt{ClientTimeout(250 * time.Millisecond)},
+
+			expectedTimeout:    250 * time.Millisecond,
+			expectedOpts:       defaultOpts,
+			expectedMode:       ModeOctet,
+			expectedRetransmit: 10,
+		},
+		{
+			name: "timeout, too large to negotiate",
+			opts: []ClientOpt{ClientTimeout(10 * time.Minute)},
+
+			expectedTimeout:    10 * time.Minute,
+			expectedOpts:       defaultOpts,
+			expectedMode:       ModeOctet,
+			expectedRetransmit: 10,
+		},
 		{
 			name: "windowsize",
 			opts: []ClientOpt{ClientWindowsize(13)},
@@ -116,9 +149,10 @@ func TestNewClient(t *testing.T) {
 			name: "two opts",
 			opts: []ClientOpt{
 				ClientWindowsize(13),
-				ClientTimeout(24),
+				ClientTimeout(24 * time.Second),
 			},
 
+			expectedTimeout: 24 * time.Second,
 			expectedOpts: map[string]string{
 				optTransferSize: "0",
 				optWindowSize:   "13",
@@ -127,6 +161,14 @@ func TestNewClient(t *testing.T) {
 			expectedMode:       ModeOctet,
 			expectedRetransmit: 10,
 		},
+		{
+			name: "bad net",
+			opts: []ClientOpt{
+				ClientNet("tcp"),
+			},
+
+			expectedError: ErrInvalidNetwork,
+		},
 		{
 			name: "bad mode",
 			opts: []ClientOpt{
@@ -152,20 +194,20 @@ func TestNewClient(t *testing.T) {
 			expectedError: ErrInvalidBlocksize,
 		},
 		{
-			name: "timeout too small",
+			name: "timeout zero",
 			opts: []ClientOpt{
 				ClientTimeout(0),
 			},
 
-			expectedError: ErrInvalidTimeout,
+			expectedError: ErrInvalidRetransmitTimeout,
 		},
 		{
-			name: "timeout too large",
+			name: "timeout negative",
 			opts: []ClientOpt{
-				ClientTimeout(256),
+				ClientTimeout(-time.Second),
 			},
 
-			expectedError: ErrInvalidTimeout,
+			expectedError: ErrInvalidRetransmitTimeout,
 		},
 		{
 			name: "windowsize too small",
@@ -191,6 +233,81 @@ func TestNewClient(t *testing.T) {
 
 			expectedError: ErrInvalidRetransmit,
 		},
+		{
+			name: "backoff zero initial",
+			opts: []ClientOpt{
+				ClientRetransmitBackoff(0, time.Second, 2),
+			},
+
+			expectedError: ErrInvalidBackoff,
+		},
+		{
+			name: "backoff max less than initial",
+			opts: []ClientOpt{
+				ClientRetransmitBackoff(time.Second, time.Millisecond, 2),
+			},
+
+			expectedError: ErrInvalidBackoff,
+		},
+		{
+			name: "backoff multiplier less than 1",
+			opts: []ClientOpt{
+				ClientRetransmitBackoff(time.Millisecond, time.Second, 0.5),
+			},
+
+			expectedError: ErrInvalidBackoff,
+		},
+		{
+			name: "transfer deadline negative",
+			opts: []ClientOpt{
+				ClientTransferDeadline(-1),
+			},
+
+			expectedError: ErrInvalidTransferDeadline,
+		},
+		{
+			name: "verify checksum",
+			opts: []ClientOpt{ClientVerifyChecksum("sha256")},
+
+			expectedOpts: map[string]string{
+				optTransferSize: "0",
+				optChecksum:     "sha256",
+			},
+			expectedMode:       ModeOctet,
+			expectedRetransmit: 10,
+		},
+		{
+			name: "verify checksum, invalid",
+			opts: []ClientOpt{
+				ClientVerifyChecksum("crc32"),
+			},
+
+			expectedError: ErrInvalidChecksum,
+		},
+		{
+			name: "read buffer negative",
+			opts: []ClientOpt{
+				ClientReadBufferSize(-1),
+			},
+
+			expectedError: ErrInvalidBufferSize,
+		},
+		{
+			name: "write buffer negative",
+			opts: []ClientOpt{
+				ClientWriteBufferSize(-1),
+			},
+
+			expectedError: ErrInvalidBufferSize,
+		},
+		{
+			name: "dscp too large",
+			opts: []ClientOpt{
+				ClientDSCP(64),
+			},
+
+			expectedError: ErrInvalidDSCP,
+		},
 	}
 
 	for _, c := range cases {
@@ -206,6 +323,24 @@ func TestNewClient(t *testing.T) {
 				return // Skip remaining test if error, avoid nil dereference
 			}
 
+			// Net
+			expectedNet := c.expectedNet
+			if expectedNet == "" {
+				expectedNet = "udp"
+			}
+			if client.net != expectedNet {
+				t.Errorf("expected net to be %q, but it was %q", expectedNet, client.net)
+			}
+
+			// Timeout
+			expectedTimeout := c.expectedTimeout
+			if expectedTimeout == 0 {
+				expectedTimeout = time.Second
+			}
+			if client.timeout != expectedTimeout {
+				t.Errorf("expected timeout to be %s, but it was %s", expectedTimeout, client.timeout)
+			}
+
 			// Options
 			if !reflect.DeepEqual(client.opts, c.expectedOpts) {
 				t.Errorf("expected opts to be %#v, but they were %#v", c.expectedOpts, client.opts)
@@ -237,6 +372,7 @@ func TestClient_Get(t *testing.T) {
 		url             string
 		response        []byte
 		opts            []ClientOpt
+		serverOpts      []ServerOpt
 		omitSize        bool
 		sendServerError bool
 		windowsOnly     bool
@@ -346,6 +482,29 @@ func TestClient_Get(t *testing.T) {
 			expectedResponse: random1MB,
 			expectedSize:     1048576,
 		},
+		{
+			name:       "1MB-blksize9000, server max 1024",
+			url:        "tftp://#host#:#port#/file",
+			response:   random1MB,
+			opts:       []ClientOpt{ClientBlocksize(9000)},
+			serverOpts: []ServerOpt{ServerBlocksize(1024)},
+
+			expectedResponse: random1MB,
+			expectedSize:     1048576,
+		},
+		{
+			name:     "1MB-buffer sizes",
+			url:      "tftp://#host#:#port#/file",
+			response: random1MB,
+			opts:     []ClientOpt{ClientReadBufferSize(1 << 20), ClientWriteBufferSize(1 << 20)},
+			serverOpts: []ServerOpt{
+				ServerReadBufferSize(1 << 20),
+				ServerWriteBufferSize(1 << 20),
+			},
+
+			expectedResponse: random1MB,
+			expectedSize:     1048576,
+		},
 		{
 			name:     "1MB-window5",
 			url:      "tftp://#host#:#port#/file",
@@ -359,7 +518,7 @@ func TestClient_Get(t *testing.T) {
 			name:     "1MB-timeout5",
 			url:      "tftp://#host#:#port#/file",
 			response: random1MB,
-			opts:     []ClientOpt{ClientTimeout(5)},
+			opts:     []ClientOpt{ClientTimeout(5 * time.Second)},
 
 			expectedResponse: random1MB,
 			expectedSize:     1048576,
@@ -403,7 +562,7 @@ func TestClient_Get(t *testing.T) {
 			name:     "under-1MB-timeout5",
 			url:      "tftp://#host#:#port#/file",
 			response: randomUnder1MB,
-			opts:     []ClientOpt{ClientTimeout(5)},
+			opts:     []ClientOpt{ClientTimeout(5 * time.Second)},
 
 			expectedResponse: randomUnder1MB,
 			expectedSize:     1048573,
@@ -461,7 +620,7 @@ func TestClient_Get(t *testing.T) {
 						w.WriteSize(int64(len(c.response)))
 					}
 					w.Write([]byte(c.response))
-				}, nil)
+				}, nil, c.serverOpts...)
 				defer close()
 
 				client, err := NewClient(c.opts...)
@@ -482,6 +641,8 @@ func TestClient_Get(t *testing.T) {
 					return
 				}
 
+				defer file.Close()
+
 				response, err := ioutil.ReadAll(file)
 				mu.Lock()
 				mu.Unlock()
@@ -642,7 +803,7 @@ func TestClient_Put(t *testing.T) {
 			name: "1MB-timeout5",
 			url:  "tftp://#host#:#port#/file",
 			send: random1MB,
-			opts: []ClientOpt{ClientTimeout(5)},
+			opts: []ClientOpt{ClientTimeout(5 * time.Second)},
 
 			expectedData: random1MB,
 			expectedSize: 1048576,
@@ -695,7 +856,7 @@ func TestClient_Put(t *testing.T) {
 			name: "under-1MB-timeout5",
 			url:  "tftp://#host#:#port#/file",
 			send: randomUnder1MB,
-			opts: []ClientOpt{ClientTimeout(5)},
+			opts: []ClientOpt{ClientTimeout(5 * time.Second)},
 
 			expectedData: randomUnder1MB,
 			expectedSize: 1048573,
@@ -910,8 +1071,210 @@ func TestClient_parseURL(t *testing.T) {
 	}
 }
 
-func newTestServer(t tester, singlePort bool, rh ReadHandlerFunc, wh WriteHandlerFunc) (string, int, func()) {
-	s, err := NewServer("127.0.0.1:0", ServerSinglePort(singlePort))
+func newTestServer(t tester, singlePort bool, rh ReadHandlerFunc, wh WriteHandlerFunc, opts ...ServerOpt) (string, int, func()) {
+	_, ip, port, closer := startTestServer(t, singlePort, rh, wh, opts...)
+	return ip, port, closer
+}
+
+func TestClient_transferDeadline(t *testing.T) {
+	const deadline = 300 * time.Millisecond
+
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		// Send slowly
+		for i := 0; i < 10; i++ {
+			time.Sleep(deadline / 4)
+			if _, err := w.Write(make([]byte, 512)); err != nil {
+				return
+			}
+		}
+	}, nil)
+	defer closeServer()
+
+	client, err := NewClient(ClientTransferDeadline(deadline))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp)
+	}
+	if ErrorCause(err) != ErrTransferDeadline {
+		t.Errorf("expected error %v, got %v", ErrTransferDeadline, err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*deadline {
+		t.Errorf("expected transfer to be aborted after about %s, took %s", deadline, elapsed)
+	}
+}
+
+// startTestServer is newTestServer, additionally returning the Server.
+func TestClient_verifyChecksum(t *testing.T) {
+	random1MB := getTestData(t, "1MB-random")
+
+	cases := []struct {
+		name       string
+		response   []byte
+		opts       []ClientOpt
+		serverOpts []ServerOpt
+
+		expectedError error
+	}{
+		{
+			name:       "sha256",
+			response:   random1MB,
+			opts:       []ClientOpt{ClientVerifyChecksum("sha256")},
+			serverOpts: []ServerOpt{ServerChecksumVerify("sha256")},
+		},
+		{
+			name:       "md5, windowsize 4",
+			response:   random1MB,
+			opts:       []ClientOpt{ClientVerifyChecksum("md5"), ClientWindowsize(4)},
+			serverOpts: []ServerOpt{ServerChecksumVerify("md5")},
+		},
+		{
+			name:       "small blocksize",
+			response:   []byte("the data"),
+			opts:       []ClientOpt{ClientVerifyChecksum("sha256"), ClientBlocksize(8)},
+			serverOpts: []ServerOpt{ServerChecksumVerify("sha256")},
+		},
+		{
+			name:       "empty",
+			response:   []byte{},
+			opts:       []ClientOpt{ClientVerifyChecksum("sha256")},
+			serverOpts: []ServerOpt{ServerChecksumVerify("sha256")},
+		},
+		{
+			name:       "netascii",
+			response:   []byte("line1\nline2\n"),
+			opts:       []ClientOpt{ClientVerifyChecksum("sha256"), ClientMode(ModeNetASCII)},
+			serverOpts: []ServerOpt{ServerChecksumVerify("sha256")},
+		},
+		{
+			name:     "server disabled",
+			response: random1MB,
+			opts:     []ClientOpt{ClientVerifyChecksum("sha256")},
+
+			expectedError: ErrChecksumNotNegotiated,
+		},
+		{
+			name:       "algorithm mismatch",
+			response:   random1MB,
+			opts:       []ClientOpt{ClientVerifyChecksum("sha256")},
+			serverOpts: []ServerOpt{ServerChecksumVerify("md5")},
+
+			expectedError: ErrChecksumNotNegotiated,
+		},
+		{
+			name:       "strict server",
+			response:   random1MB,
+			opts:       []ClientOpt{ClientVerifyChecksum("sha256")},
+			serverOpts: []ServerOpt{ServerChecksumVerify("sha256"), ServerStrictRFC1350(true)},
+
+			expectedError: ErrChecksumNotNegotiated,
+		},
+		{
+			name:       "client disabled",
+			response:   random1MB,
+			serverOpts: []ServerOpt{ServerChecksumVerify("sha256")},
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, single port mode: %t", c.name, singlePort), func(t *testing.T) {
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					w.Write(c.response)
+				}, nil, c.serverOpts...)
+				defer closeServer()
+
+				client, err := NewClient(c.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				resp, err := client.Get(fmt.Sprintf("%s:%d/file", ip, port))
+				if err == nil {
+					var data []byte
+					data, err = ioutil.ReadAll(resp)
+					resp.Close()
+					if err == nil && !bytes.Equal(data, c.response) {
+						t.Errorf("response didn't match (%d bytes, expected %d)", len(data), len(c.response))
+					}
+				}
+				if ErrorCause(err) != c.expectedError {
+					t.Errorf("expected error %v, got %v", c.expectedError, err)
+				}
+			})
+		}
+	}
+}
+
+func TestClient_verifyChecksumMismatch(t *testing.T) {
+	// Fake server sending a bad checksum
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	serverErr := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		read := func() (datagram, net.Addr) {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return datagram{}, nil
+			}
+			return datagram{buf: buf, offset: n}, addr
+		}
+
+		var tx datagram
+		_, addr := read() // RRQ
+		if addr == nil {
+			serverErr <- "no request"
+			return
+		}
+		tx.writeOptionAck(options{optChecksum: "sha256"})
+		conn.WriteTo(tx.bytes(), addr)
+		read() // ACK 0
+		tx.writeData(1, []byte("the data"))
+		conn.WriteTo(tx.bytes(), addr)
+		read() // ACK 1
+		tx.writeOptionAck(options{optChecksum: "0123"})
+		conn.WriteTo(tx.bytes(), addr)
+
+		dg, _ := read()
+		if dg.opcode() != opCodeERROR {
+			serverErr <- fmt.Sprintf("expected ERROR, got %s", dg)
+			return
+		}
+		serverErr <- ""
+	}()
+
+	client, err := NewClient(ClientVerifyChecksum("sha256"), ClientTransferSize(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(conn.LocalAddr().String() + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+
+	_, err = ioutil.ReadAll(resp)
+	if ErrorCause(err) != ErrChecksumMismatch {
+		t.Errorf("expected error %v, got %v", ErrChecksumMismatch, err)
+	}
+	if msg := <-serverErr; msg != "" {
+		t.Error(msg)
+	}
+}
+
+func startTestServer(t tester, singlePort bool, rh ReadHandlerFunc, wh WriteHandlerFunc, opts ...ServerOpt) (*Server, string, int, func()) {
+	s, err := NewServer("127.0.0.1:0", append(opts, ServerSinglePort(singlePort))...)
 
 	if err != nil {
 		t.Fatalf("newTestServer: %v\n", err)
@@ -937,7 +1300,7 @@ func newTestServer(t tester, singlePort bool, rh ReadHandlerFunc, wh WriteHandle
 		ip = fmt.Sprintf("[%s]", addr.IP)
 	}
 
-	return ip, addr.Port, closer
+	return s, ip, addr.Port, closer
 }
 
 type tester interface {
@@ -954,3 +1317,187 @@ func getTestData(t tester, name string) []byte {
 
 	return data
 }
+
+func TestClient_remoteError(t *testing.T) {
+	ip, port, closeServer := newTestServer(t, false, func(r ReadRequest) {
+		r.WriteError(ErrCodeFileNotFound, "no such file")
+	}, func(w WriteRequest) {
+		w.WriteError(ErrCodeAccessViolation, "read only")
+	})
+	defer closeServer()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("%s:%d/file", ip, port)
+
+	cases := []struct {
+		name string
+		do   func() error
+
+		expected Error
+	}{
+		{
+			name: "get",
+			do: func() error {
+				_, err := client.Get(url)
+				return err
+			},
+			expected: Error{Code: ErrCodeFileNotFound, Message: "no such file"},
+		},
+		{
+			name: "put",
+			do: func() error {
+				return client.Put(url, strings.NewReader("data"), 4)
+			},
+			expected: Error{Code: ErrCodeAccessViolation, Message: "read only"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.do()
+
+			var tftpErr *Error
+			if !errors.As(err, &tftpErr) {
+				t.Fatalf("expected *Error, got %v", err)
+			}
+			if *tftpErr != c.expected {
+				t.Errorf("expected %#v, got %#v", c.expected, *tftpErr)
+			}
+			if !errors.Is(err, c.expected.Code) {
+				t.Errorf("expected errors.Is %s to be true", c.expected.Code)
+			}
+		})
+	}
+}
+
+func TestBackoff_wait(t *testing.T) {
+	b := &backoff{initial: 100 * time.Millisecond, max: time.Second, multiplier: 2}
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, e := range expected {
+		if got := b.wait(i + 1); got != e {
+			t.Errorf("try %d: expected wait %s, got %s", i+1, e, got)
+		}
+	}
+}
+
+func TestClientRetransmitBackoff(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("x"), 512*2+1)
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		w.Write(data)
+	}, nil)
+	defer closeServer()
+	server := &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+
+	// Simulate congestion by delaying datagrams from the server longer
+	// than the client's initial wait. The client retransmits its ACK
+	// each time the wait expires.
+	const delay = 300 * time.Millisecond
+	sent := func(opts ...ClientOpt) int {
+		proxy, fromClient, closeProxy := startDelayProxy(t, server, delay)
+		defer closeProxy()
+
+		client, err := NewClient(append(opts, ClientRetransmit(20))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get("tftp://" + proxy.String() + "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("expected %d bytes, got %d", len(data), len(got))
+		}
+		return fromClient()
+	}
+
+	fixed := sent(ClientRetransmitBackoff(40*time.Millisecond, 40*time.Millisecond, 1))
+	backoff := sent(ClientRetransmitBackoff(40*time.Millisecond, time.Second, 2))
+
+	t.Logf("datagrams sent with fixed wait: %d, with backoff: %d", fixed, backoff)
+	if backoff >= fixed {
+		t.Errorf("expected backoff to send fewer datagrams than fixed wait (%d), got %d", fixed, backoff)
+	}
+}
+
+// startDelayProxy relays datagrams between a client and server, delaying
+// those from the server by delay. It returns the address for the client
+// to use and a function returning the number of datagrams received from
+// the client.
+func startDelayProxy(t *testing.T, server *net.UDPAddr, delay time.Duration) (*net.UDPAddr, func() int, func()) {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: server.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: server.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		client   net.Addr
+		upstream = server // Request port until the server responds from a transfer port
+		count    int
+	)
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := front.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			client = addr
+			count++
+			to := upstream
+			mu.Unlock()
+			back.WriteTo(buf[:n], to)
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := back.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			upstream = addr
+			to := client
+			mu.Unlock()
+			dg := append([]byte(nil), buf[:n]...)
+			time.AfterFunc(delay, func() {
+				front.WriteTo(dg, to)
+			})
+		}
+	}()
+
+	counter := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	}
+	closer := func() {
+		front.Close()
+		back.Close()
+	}
+	return front.LocalAddr().(*net.UDPAddr), counter, closer
+}
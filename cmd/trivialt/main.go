@@ -11,6 +11,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/cheggaaa/pb.v1"
 
@@ -178,6 +179,7 @@ func cmdGet(c *cli.Context) {
 	if err != nil {
 		log.Fatalln("\n", trivialt.ErrorCause(err))
 	}
+	defer resp.Close()
 
 	var out io.Writer
 	if output := c.String("output"); output == "-" {
@@ -264,7 +266,7 @@ func newClient(c *cli.Context) *trivialt.Client {
 		trivialt.ClientBlocksize(c.Int("blksize")),
 		trivialt.ClientTransferSize(c.Bool("tsize")),
 		trivialt.ClientWindowsize(c.Int("windowsize")),
-		trivialt.ClientTimeout(c.Int("timeout")),
+		trivialt.ClientTimeout(time.Duration(c.Int("timeout")) * time.Second),
 		trivialt.ClientRetransmit(c.Int("retransmit")),
 		trivialt.ClientMode(mode),
 	}
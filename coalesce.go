@@ -0,0 +1,339 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// defaultCoalesceBufferSize is the amount of data buffered for a shared
+// read before the handler waits for the slowest transfer.
+const defaultCoalesceBufferSize = 1 << 20
+
+// readCoalescer shares a single run of the read handler between
+// concurrent requests for the same file.
+type readCoalescer struct {
+	s       *Server
+	bufSize int // Bytes buffered before the handler's Write blocks
+
+	mu    sync.Mutex
+	reads map[string]*readBroadcaster // In progress reads by file name
+}
+
+// serve sends the file requested by w, joining a read of the same file
+// that is already in progress or starting a new one.
+func (rc *readCoalescer) serve(w *readRequest) {
+	b := rc.subscribe(w)
+	defer rc.unsubscribe(b, w)
+	b.sendTo(w)
+}
+
+// subscribe returns the broadcaster for w's file, starting the read
+// handler if there isn't one that w can join.
+func (rc *readCoalescer) subscribe(w *readRequest) *readBroadcaster {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if b, ok := rc.reads[w.name]; ok && b.join(w) {
+		b.subscribers++
+		return b
+	}
+
+	ctx, cancel := context.WithCancel(rc.s.ctx)
+	b := &readBroadcaster{
+		ctx:         ctx,
+		cancel:      cancel,
+		addr:        w.Addr(),
+		local:       w.LocalAddr(),
+		id:          w.ID(),
+		name:        w.name,
+		mode:        w.TransferMode(),
+		opts:        w.opts,
+		blksize:     w.BlockSize(),
+		windowsize:  w.WindowSize(),
+		bufSize:     rc.bufSize,
+		subscribers: 1,
+		offsets:     map[*readRequest]int{w: 0},
+	}
+	b.cond = sync.NewCond(&b.mu)
+	context.AfterFunc(ctx, b.broadcast) // Unblock Write once canceled
+	rc.reads[w.name] = b
+
+	go rc.run(b)
+	return b
+}
+
+// unsubscribe releases w's subscription from subscribe. The broadcaster
+// is removed, and the handler canceled if still running, once it has no
+// subscribers.
+func (rc *readCoalescer) unsubscribe(b *readBroadcaster, w *readRequest) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	b.leave(w)
+	if b.subscribers--; b.subscribers > 0 {
+		return
+	}
+	b.cancel()
+	if rc.reads[b.name] == b {
+		delete(rc.reads, b.name)
+	}
+}
+
+// run runs the read handler for b, recovering any panic.
+func (rc *readCoalescer) run(b *readBroadcaster) {
+	defer b.finish()
+	defer func() {
+		if p := recover(); p != nil {
+			b.WriteError(ErrCodeNotDefined, "internal server error")
+			rc.s.reportPanic(p, RequestInfo{Op: "read", Addr: b.addr, Name: b.name})
+		}
+	}()
+	rc.s.rh.ServeTFTP(b)
+}
+
+// readBroadcaster implements ReadRequest, buffering the data written by
+// the handler so that each subscribed transfer can send it at its own pace.
+//
+// Data is kept until it has been sent to every subscriber. Once bufSize
+// bytes are buffered, data sent to every subscriber is discarded, and
+// the handler's Write blocks until the slowest subscriber catches up.
+// Requests can only join before any data is discarded.
+//
+// The handler is called with the address, mode, options, and negotiated
+// block and window size of the first request.
+type readBroadcaster struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	addr   *net.UDPAddr
+	local  *net.UDPAddr // LocalAddr of the first request
+	id     uint64       // ID of the first request
+	name   string
+	mode   TransferMode
+	opts   options
+
+	blksize    int
+	windowsize int
+	bufSize    int
+
+	subscribers int // Protected by readCoalescer.mu
+
+	mu      sync.Mutex
+	cond    *sync.Cond // Signaled when any of the following change
+	size    *int64
+	data    []byte               // Written by the handler, not yet sent to every subscriber
+	base    int                  // Offset in the file of data[0]
+	offsets map[*readRequest]int // Offset in the file sent to each subscriber
+	err     *Error
+	aborted bool // err was set by Abort
+	started bool // WriteSize, Write, or WriteError has been called
+	done    bool // Handler has returned
+}
+
+// join subscribes w from the start of the file, returning false if the
+// handler has returned or data has been discarded.
+func (b *readBroadcaster) join(w *readRequest) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done || b.base > 0 {
+		return false
+	}
+	b.offsets[w] = 0
+	return true
+}
+
+// leave unsubscribes w, allowing the data it hadn't been sent to be
+// discarded.
+func (b *readBroadcaster) leave(w *readRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.offsets, w)
+	b.trim()
+	b.cond.Broadcast()
+}
+
+// trim discards data that has been sent to every subscriber, once
+// bufSize bytes are buffered.
+//
+// b.mu must be held.
+func (b *readBroadcaster) trim() {
+	if len(b.data) < b.bufSize {
+		return
+	}
+	slowest := b.base + len(b.data)
+	for _, off := range b.offsets {
+		if off < slowest {
+			slowest = off
+		}
+	}
+	// Resliced rather than copied, chunks being sent by subscribers
+	// are left intact
+	b.data = b.data[slowest-b.base:]
+	b.base = slowest
+}
+
+// broadcast wakes goroutines waiting on b.cond.
+func (b *readBroadcaster) broadcast() {
+	b.mu.Lock()
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// sendTo writes the data written by the handler to w as it
+// becomes available.
+func (b *readBroadcaster) sendTo(w *readRequest) {
+	b.mu.Lock()
+	for !b.started && !b.done {
+		b.cond.Wait()
+	}
+	size := b.size
+	b.mu.Unlock()
+
+	if size != nil {
+		w.WriteSize(*size)
+	}
+
+	for {
+		b.mu.Lock()
+		off := b.offsets[w]
+		for off == b.base+len(b.data) && !b.done {
+			b.cond.Wait()
+		}
+		chunk, done, err := b.data[off-b.base:], b.done, b.err
+		b.mu.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.offsets[w] += len(chunk)
+			b.trim()
+			b.mu.Unlock()
+			b.cond.Broadcast()
+			continue
+		}
+		if done {
+			if err != nil {
+				w.WriteError(err.Code, err.Message)
+			}
+			return
+		}
+	}
+}
+
+// finish marks the handler as returned.
+func (b *readBroadcaster) finish() {
+	b.mu.Lock()
+	b.done = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *readBroadcaster) Addr() *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(b.AddrPort())
+}
+
+func (b *readBroadcaster) AddrPort() netip.AddrPort {
+	return addrKey(b.addr)
+}
+
+func (b *readBroadcaster) LocalAddr() *net.UDPAddr {
+	return b.local
+}
+
+func (b *readBroadcaster) ID() uint64 {
+	return b.id
+}
+
+// Stats reports the data written by the handler, the transfers to each
+// client are counted separately.
+func (b *readBroadcaster) Stats() TransferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return TransferStats{ID: b.id, Op: "read", Addr: b.addr, Name: b.name, Bytes: int64(b.base + len(b.data)), BlockSize: b.blksize, WindowSize: b.windowsize}
+}
+
+func (b *readBroadcaster) Name() string {
+	return b.name
+}
+
+func (b *readBroadcaster) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.aborted {
+		return 0, ErrTransferAborted
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	for len(b.data) >= b.bufSize && b.ctx.Err() == nil {
+		b.cond.Wait() // For the slowest subscriber
+		b.trim()
+	}
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	b.data = append(b.data, p...)
+	b.started = true
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+func (b *readBroadcaster) WriteError(c ErrorCode, s string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = &Error{Code: c, Message: s}
+	}
+	b.started = true
+	b.cond.Broadcast()
+}
+
+func (b *readBroadcaster) Abort(c ErrorCode, s string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = &Error{Code: c, Message: s}
+		b.aborted = true
+	}
+	b.started = true
+	b.cond.Broadcast()
+}
+
+func (b *readBroadcaster) WriteSize(i int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size = &i
+	b.started = true
+	b.cond.Broadcast()
+}
+
+func (b *readBroadcaster) TransferMode() TransferMode {
+	return b.mode
+}
+
+func (b *readBroadcaster) Options() map[string]string {
+	opts := make(map[string]string, len(b.opts))
+	for k, v := range b.opts {
+		opts[k] = v
+	}
+	return opts
+}
+
+func (b *readBroadcaster) BlockSize() int {
+	return b.blksize
+}
+
+func (b *readBroadcaster) WindowSize() int {
+	return b.windowsize
+}
+
+func (b *readBroadcaster) Context() context.Context {
+	return b.ctx
+}
@@ -0,0 +1,279 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerCoalesceReads(t *testing.T) {
+	t.Parallel()
+
+	random := getTestData(t, "1MB-random")
+	half := len(random) / 2
+
+	for _, singlePort := range []bool{false, true} {
+		singlePort := singlePort
+		t.Run(fmt.Sprintf("single port %t", singlePort), func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			release := make(chan struct{})
+			s, ip, port, closeServer := startTestServer(t, singlePort, func(w ReadRequest) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteSize(int64(len(random)))
+				w.Write(random[:half])
+				<-release
+				w.Write(random[half:])
+			}, nil, ServerCoalesceReads(true))
+			defer closeServer()
+
+			const clients = 3
+			var wg sync.WaitGroup
+			errs := make(chan error, clients)
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					client, err := NewClient(ClientBlocksize(1468))
+					if err != nil {
+						errs <- err
+						return
+					}
+					resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/kernel")
+					if err != nil {
+						errs <- err
+						return
+					}
+					if size, err := resp.Size(); err != nil || size != int64(len(random)) {
+						errs <- fmt.Errorf("expected size %d, got %d (%v)", len(random), size, err)
+						return
+					}
+					data, err := ioutil.ReadAll(resp)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if !bytes.Equal(data, random) {
+						errs <- fmt.Errorf("expected %d bytes of data, got %d", len(random), len(data))
+					}
+				}()
+			}
+
+			// Hold the handler until every client has subscribed
+			deadline := time.Now().Add(5 * time.Second)
+			for subscribers(s, "kernel") < clients {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected %d subscribers, got %d", clients, subscribers(s, "kernel"))
+				}
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("expected handler to be called once, got %d", n)
+			}
+
+			// Transfers unsubscribe once they're closed
+			for subscribers(s, "kernel") > 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("expected read to be removed")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			// Subsequent requests call the handler again
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/kernel")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp)
+			if n := atomic.LoadInt32(&calls); n != 2 {
+				t.Errorf("expected handler to be called twice, got %d", n)
+			}
+		})
+	}
+}
+
+func TestServerCoalesceReads_error(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+		<-release
+		w.WriteError(ErrCodeFileNotFound, "no such file")
+	}, nil, ServerCoalesceReads(true))
+	defer closeServer()
+
+	const clients = 2
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			client, err := NewClient()
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/missing")
+			errs <- err
+		}()
+	}
+
+	for subscribers(s, "missing") < clients {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	for i := 0; i < clients; i++ {
+		err := <-errs
+		if !errors.Is(err, ErrCodeFileNotFound) {
+			t.Errorf("expected FILE_NOT_FOUND error, got %v", err)
+		}
+	}
+}
+
+func TestServerCoalesceReads_bufferLimit(t *testing.T) {
+	t.Parallel()
+
+	const bufSize = 16 * 1024
+	random := getTestData(t, "1MB-random")
+
+	var calls int32
+	maxBuffered := make(chan int, 1)
+	s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+		atomic.AddInt32(&calls, 1)
+		b := w.(*readBroadcaster)
+		var max int
+		for i := 0; i < len(random); i += 512 {
+			if _, err := w.Write(random[i : i+512]); err != nil {
+				t.Errorf("write: %v", err)
+				break
+			}
+			b.mu.Lock()
+			if len(b.data) > max {
+				max = len(b.data)
+			}
+			b.mu.Unlock()
+		}
+		maxBuffered <- max
+	}, nil, ServerCoalesceReads(true))
+	defer closeServer()
+	s.coalesce.mu.Lock()
+	s.coalesce.bufSize = bufSize
+	s.coalesce.mu.Unlock()
+
+	const clients = 2
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			client, err := NewClient(ClientWindowsize(4))
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/kernel")
+			if err != nil {
+				errs <- err
+				return
+			}
+			data, err := ioutil.ReadAll(resp)
+			if err == nil && !bytes.Equal(data, random) {
+				err = fmt.Errorf("expected %d bytes of data, got %d", len(random), len(data))
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if max := <-maxBuffered; max > bufSize+512 {
+		t.Errorf("expected at most %d bytes buffered, got %d", bufSize+512, max)
+	}
+	if n := atomic.LoadInt32(&calls); n > clients {
+		t.Errorf("expected handler to be called at most %d times, got %d", clients, n)
+	}
+}
+
+func TestServerCoalesceReads_afterEOF(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+		n := atomic.AddInt32(&calls, 1)
+		// More than a block, the first transfer waits for an ACK
+		w.Write([]byte("version " + strconv.Itoa(int(n)) + strings.Repeat(".", 1024)))
+	}, nil, ServerCoalesceReads(true))
+	defer closeServer()
+
+	// Request without acknowledging, the transfer stays subscribed
+	conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "config", nil)
+	defer conn.Close()
+	handlerReturned := func() bool {
+		s.coalesce.mu.Lock()
+		defer s.coalesce.mu.Unlock()
+		b, ok := s.coalesce.reads["config"]
+		if !ok {
+			return false
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.done
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !handlerReturned() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected handler to return")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The handler has returned, a new request doesn't join the read
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("version 2")) {
+		t.Errorf("expected %q, got %q", "version 2", data)
+	}
+}
+
+// subscribers returns the number of transfers sharing the read of name.
+func subscribers(s *Server, name string) int {
+	s.coalesce.mu.Lock()
+	defer s.coalesce.mu.Unlock()
+	if b, ok := s.coalesce.reads[name]; ok {
+		return b.subscribers
+	}
+	return 0
+}
@@ -6,10 +6,15 @@ package trivialt
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vcabbage/trivialt/netascii"
@@ -21,8 +26,12 @@ const (
 	defaultUDPNet     = "udp"
 	defaultTimeout    = time.Second
 	defaultBlksize    = 512
+	maxRFCBlksize     = 65464 // RFC2348
 	defaultWindowsize = 1
 	defaultRetransmit = 10
+	defaultQueueDepth = 64
+
+	defaultIdleTimeout = 5 * time.Minute
 )
 
 // All connections will use these options unless overridden.
@@ -35,8 +44,18 @@ var defaultOptions = map[string]string{
 // udpNet is one of "udp", "udp4", or "udp6"
 // addr is the address of the target client or server
 func newConn(udpNet string, mode TransferMode, addr *net.UDPAddr) (*conn, error) {
-	// Start listening, an empty UDPAddr will cause the system to assign a port
-	netConn, err := net.ListenUDP(udpNet, &net.UDPAddr{})
+	return newBoundConn(udpNet, mode, nil, addr)
+}
+
+// newBoundConn is newConn listening on the local address laddr, with
+// a system assigned port. If laddr is nil all local addresses are used.
+func newBoundConn(udpNet string, mode TransferMode, laddr, addr *net.UDPAddr) (*conn, error) {
+	if laddr == nil {
+		laddr = &net.UDPAddr{}
+	}
+
+	// Start listening, a zero port will cause the system to assign a port
+	netConn, err := net.ListenUDP(udpNet, laddr)
 	if err != nil {
 		return nil, wrapError(err, "network listen failed")
 	}
@@ -56,7 +75,7 @@ func newConn(udpNet string, mode TransferMode, addr *net.UDPAddr) (*conn, error)
 	return c, nil
 }
 
-func newSinglePortConn(addr *net.UDPAddr, mode TransferMode, netConn *net.UDPConn, reqChan chan []byte) *conn {
+func newSinglePortConn(addr *net.UDPAddr, mode TransferMode, netConn net.PacketConn, reqChan chan []byte) *conn {
 	return &conn{
 		log:        newLogger(addr.String()),
 		remoteAddr: addr,
@@ -84,16 +103,53 @@ func newConnFromHost(udpNet string, mode TransferMode, host string) (*conn, erro
 	return newConn(udpNet, mode, addr)
 }
 
+// setBufferSizes sets the operating system's receive and send buffer sizes
+// on conn. Sizes of zero are left at the system default, as are
+// connections other than *net.UDPConn.
+func setBufferSizes(pc net.PacketConn, read, write int) error {
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	if read > 0 {
+		if err := conn.SetReadBuffer(read); err != nil {
+			return wrapError(err, "setting read buffer size")
+		}
+	}
+	if write > 0 {
+		if err := conn.SetWriteBuffer(write); err != nil {
+			return wrapError(err, "setting write buffer size")
+		}
+	}
+	return nil
+}
+
+// setDSCP marks packets sent on conn with the DiffServ code point dscp.
+// A value of 0 leaves the operating system default in place, as do
+// connections other than *net.UDPConn.
+func setDSCP(pc net.PacketConn, dscp int) error {
+	conn, ok := pc.(*net.UDPConn)
+	if !ok || dscp == 0 {
+		return nil
+	}
+	return wrapError(setTOS(conn, dscp<<2), "setting DSCP")
+}
+
 // conn handles TFTP read and write requests
 type conn struct {
 	log        *logger
-	netConn    *net.UDPConn // Underlying network connection
-	remoteAddr net.Addr     // Address of the remote server or client
+	netConn    net.PacketConn // Underlying network connection
+	remoteAddr net.Addr       // Address of the remote server or client
+	id         uint64         // Transfer ID assigned by the server, zero for clients
 
 	// Single Port Mode
 	reqChan chan []byte
 	timer   *time.Timer
 
+	// Server requests only, canceled when the transfer ends
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	// Transfer type
 	isClient bool // Whether or not we're the client, gets set by sendRequest
 	isSender bool // Whether we're sending or receiving, gets set by writeSetup
@@ -106,19 +162,56 @@ type conn struct {
 	tsize      *int64        // Size of the file being sent/received
 
 	// Other, non-negotiable options
-	retransmit int // Number of times an individual datagram will be retransmitted on error
+	retransmit  int           // Number of times an individual datagram will be retransmitted on error
+	retransmits int           // Number of DATA blocks resent and ACKs repeated
+	backoff     *backoff      // Increasing per-packet wait, overrides timeout if set
+	maxBlksize  uint16        // Largest blksize that will be accepted, 0 for no limit
+	maxTimeout  time.Duration // Longest timeout that will be accepted, 0 for no limit
+	maxWindow   uint16        // Largest windowsize that will be accepted, 0 for no limit
+
+	ignoreOptions bool    // Don't negotiate options (RFC1350 only)
+	reqOpts       options // Options to negotiate instead of those in the request, if not nil
+
+	// Checksum extension
+	checksumAlg string    // Algorithm requested by the client or supported by the server
+	hash        hash.Hash // Hash of DATA payloads, nil if not enabled
+	trailer     bool      // Whether a checksum trailer will be sent/received
+
+	// Idle timeout, started when first waiting for the client and reset
+	// whenever DATA or ACK is received
+	transferTimeout time.Duration // 0 for no limit
+	idleDeadline    time.Time     // When the transfer will be aborted, zero until started
+
+	deadline time.Time // When the transfer will be aborted regardless of activity, zero for none
+
+	limiters []*tokenBucket // Pace DATA packets, see NewRateLimitedReader and ServerRateLimit
 
 	// Track state of transfer
 	optionsParsed bool   // Whether TFTP options have been parsed yet
 	window        uint16 // Packets sent since last ACK
 	block         uint16 // Current block #
+	lastAck       uint16 // Last block acknowledged by the receiver, when sending
 	catchup       bool   // Ignore incoming blocks from a window we reset
 	p             []byte // bytes to be read/written (depending on send/receive)
 	n             int    // byte count read/written
 	tries         int    // retry counter
 	err           error  // error has occurreds
 	closing       bool   // connection is closing
+	hijacked      bool   // netConn is owned by the handler, see Hijacker
 	done          bool   // the transfer is complete
+	total         int64  // total bytes read/written
+	sentErr       error  // ERROR sent to the remote, if any
+	acked         bool   // The final block has been acknowledged, when sending
+	duplicates    int    // DATA blocks or ACKs received again and discarded
+
+	// Server requests only
+	stats    *serverStats   // Counters to update
+	info     RequestInfo    // Describes the request
+	start    time.Time      // When the request was received
+	upstream string         // Upstream server relaying the transfer, see Proxy
+	failure  error          // Detected by the handler after completion, see NewChecksumVerifier
+	statsMu  sync.Mutex     // Protects final
+	final    *TransferStats // Recorded when the transfer finishes
 
 	// Buffers
 	buf   []byte       // incoming data from, sized to blksize + headers
@@ -132,6 +225,9 @@ type conn struct {
 	// reader/writer are rxBuf/txBuf, possibly wrapped by netascii reader/writer
 	reader io.Reader
 	writer io.Writer
+
+	dst     io.Writer // receives DATA directly during WriteTo, bypassing rxBuf
+	discard bool      // final DATA is answered with an ERROR rather than an ACK, see WriteRequest.Discard
 }
 
 // sendWriteRequest sends WRQ to server and negotiates transfer options
@@ -182,12 +278,17 @@ func (c *conn) receiveResponse() stateType {
 	}
 	c.tries++
 
+	if c.deadlineExceeded("receiving request response") {
+		return nil
+	}
+
 	addr, err := c.readFromNet()
 	if err != nil {
 		c.log.debug("error getting %s response from %v", c.tx.opcode(), c.remoteAddr)
 		c.err = err
 		return c.receiveResponse
 	}
+	c.err = nil // Clear timeouts from previous tries
 
 	if err := c.rx.validate(); err != nil {
 		c.log.debug("error validating response from %v: %v", c.remoteAddr, err)
@@ -268,10 +369,130 @@ func (c *conn) Write(p []byte) (int, error) {
 	for state := c.startWrite; state != nil; {
 		state = state()
 	}
+	c.total += int64(c.n)
 
 	return c.n, wrapError(c.err, "writing")
 }
 
+// ReadFrom implements io.ReaderFrom, sending the data read from r.
+//
+// In octet mode without checksums, full blocks are read from r directly
+// into txBuf rather than through an intermediate buffer. Data less than
+// a full block remaining when r returns io.EOF is buffered, to be sent
+// by a subsequent Write or Close.
+func (c *conn) ReadFrom(r io.Reader) (int64, error) {
+	// Setup and negotiate options before the first block
+	if _, err := c.Write(nil); err != nil {
+		return 0, err
+	}
+	if c.mode != ModeOctet || c.hash != nil || c.txBuf.Buffer.Len() > 0 {
+		// Hide ReadFrom from io.Copy
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+
+	var total int64
+	for {
+		slot := c.txBuf.nextSlot()
+		n, err := readBlock(r, slot)
+		total += int64(n)
+		c.total += int64(n)
+
+		if n < len(slot) {
+			// Partial block, buffer for the next Write or Close
+			c.txBuf.Buffer.Write(slot[:n])
+			if err == io.EOF {
+				err = nil
+			}
+			return total, err
+		}
+
+		c.txBuf.commitSlot()
+		c.p = nil
+		for state := c.writeData; state != nil; {
+			state = state()
+		}
+		if c.err != nil {
+			return total, wrapError(c.err, "writing")
+		}
+	}
+}
+
+// hijack passes ownership of netConn to the caller, see Hijacker.
+func (c *conn) hijack() (net.PacketConn, *net.UDPAddr, error) {
+	if c.reqChan != nil {
+		return nil, nil, ErrHijackNotSupported
+	}
+	if c.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, nil, wrapError(c.err, "checking conn err before Hijack")
+	}
+
+	c.log.debug("Connection to %s hijacked", c.remoteAddr)
+	c.hijacked = true
+	c.err = ErrHijacked
+	if err := c.netConn.SetDeadline(time.Time{}); err != nil {
+		c.log.debug("clearing deadline on hijacked connection: %v", err)
+	}
+	return c.netConn, c.remoteAddr.(*net.UDPAddr), nil
+}
+
+// readBlock reads from r until p is full or r returns an error.
+//
+// Unlike io.ReadFull, errors from r are returned unchanged, an
+// io.ErrUnexpectedEOF from r isn't mistaken for a short final block.
+func readBlock(r io.Reader, p []byte) (n int, err error) {
+	for n < len(p) && err == nil {
+		var nn int
+		nn, err = r.Read(p[n:])
+		n += nn
+	}
+	return n, err
+}
+
+// WriteTo writes received data to w until the transfer is complete.
+//
+// In octet mode each block is written to w as it's received, without
+// being buffered. The block is ACKed once it has been written. Otherwise
+// data is decoded and copied as with Read.
+func (c *conn) WriteTo(w io.Writer) (int64, error) {
+	// Setup and ACK the request before the first block
+	if _, err := c.Read(nil); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if c.reader != &c.rxBuf {
+		// Hide WriteTo from io.Copy
+		return io.Copy(w, struct{ io.Reader }{c})
+	}
+
+	// Data may be buffered by an earlier Read
+	total, err := c.rxBuf.WriteTo(w)
+	c.total += total
+	if err != nil {
+		return total, err
+	}
+
+	start := c.total
+	c.dst = w
+	c.p = nil
+	for c.err == nil {
+		for state := c.readData; state != nil; {
+			state = state()
+		}
+	}
+	c.dst = nil
+	total += c.total - start
+
+	if c.err == io.EOF {
+		return total, nil
+	}
+	return total, wrapError(c.err, "reading")
+}
+
 type stateType func() stateType
 
 func (c *conn) startWrite() stateType {
@@ -298,11 +519,19 @@ func (c *conn) writeSetup() stateType {
 	if len(c.buf) != int(c.blksize) {
 		c.buf = make([]byte, c.blksize)
 	}
+	// rx may still be the request datagram, make sure it
+	// can hold an ERROR from the receiver
+	if needed := int(c.blksize + 4); len(c.rx.buf) < needed {
+		c.rx.buf = make([]byte, needed)
+	}
 
 	// Init ringBuffer
 	c.txBuf = newRingBuffer(int(c.windowsize), int(c.blksize))
 
 	c.writer = c.txBuf
+	if c.hash != nil {
+		c.writer = io.MultiWriter(c.txBuf, c.hash)
+	}
 	if c.mode == ModeNetASCII {
 		c.writer = netascii.NewWriter(c.writer)
 	}
@@ -357,6 +586,10 @@ func (c *conn) write() stateType {
 // writeData writes a single DATA datagram
 func (c *conn) writeData() stateType {
 	if c.closing && c.done {
+		c.acked = true
+		if c.trailer {
+			return c.sendChecksum
+		}
 		return nil
 	}
 	if c.txBuf.Len() < int(c.blksize) && !c.closing {
@@ -406,6 +639,9 @@ func (c *conn) writeData() stateType {
 // If mode is ModeNetASCII, read() is wrapped with netascii.ReadDecoder
 func (c *conn) Read(p []byte) (int, error) {
 	c.n = 0
+	if c.err == io.EOF {
+		return 0, io.EOF
+	}
 	if c.err != nil {
 		// Can't read if an error has been sent/received
 		return 0, wrapError(c.err, "checking conn error before Read")
@@ -415,6 +651,12 @@ func (c *conn) Read(p []byte) (int, error) {
 	for state := c.startRead; state != nil; {
 		state = state()
 	}
+	if c.err != nil && c.n == 0 && c.rxBuf.Len() > 0 {
+		// Return data received before the error with it, it can't
+		// be read after.
+		c.n, _ = c.reader.Read(p)
+	}
+	c.total += int64(c.n)
 	return c.n, c.err
 }
 
@@ -430,7 +672,7 @@ func (c *conn) startRead() stateType {
 func (c *conn) readSetup() stateType {
 	c.reader = &c.rxBuf
 	if c.mode == ModeNetASCII {
-		c.reader = netascii.NewReader(c.reader)
+		c.reader = netascii.NewReader(rxReader{c})
 	}
 
 	ackOpts, err := c.parseOptions()
@@ -439,6 +681,12 @@ func (c *conn) readSetup() stateType {
 		return nil
 	}
 
+	if c.isClient && c.checksumAlg != "" && !c.trailer {
+		c.sendError(ErrCodeNotDefined, "checksum required")
+		c.err = wrapError(ErrChecksumNotNegotiated, "read setup")
+		return nil
+	}
+
 	// Set buf size
 	if needed := int(c.blksize + 4); len(c.rx.buf) != needed {
 		c.rx.buf = make([]byte, needed)
@@ -475,7 +723,7 @@ func (c *conn) read() stateType {
 		// Read buffered data into p
 		n, err := c.reader.Read(c.p)
 		c.n = n
-		if err != nil && err != io.EOF { // Ignore EOF from bytes.Buffer
+		if err != nil && err != io.EOF && err != errRxBufEmpty { // Ignore EOF from bytes.Buffer
 			c.err = wrapError(err, "reading from rxBuf after read")
 		}
 		// If done, signal that there's nothing more to read by io.EOF
@@ -489,6 +737,35 @@ func (c *conn) read() stateType {
 	return c.readData
 }
 
+// rxReader reads rxBuf for the netascii decoder. Until the final DATA
+// has been received an empty rxBuf isn't the end of the data, so that
+// a CR at the end of a block is decoded with the start of the next.
+type rxReader struct {
+	c *conn
+}
+
+func (r rxReader) Read(p []byte) (int, error) {
+	n, err := r.c.rxBuf.Read(p)
+	return n, r.eof(err)
+}
+
+func (r rxReader) ReadByte() (byte, error) {
+	b, err := r.c.rxBuf.ReadByte()
+	return b, r.eof(err)
+}
+
+func (r rxReader) UnreadByte() error {
+	return r.c.rxBuf.UnreadByte()
+}
+
+// eof replaces io.EOF with errRxBufEmpty if more data is expected.
+func (r rxReader) eof(err error) error {
+	if err == io.EOF && !r.c.done {
+		return errRxBufEmpty
+	}
+	return err
+}
+
 // readDatagram reads a single datagram into rx
 func (c *conn) readData() stateType {
 	if c.tries >= c.retransmit {
@@ -499,14 +776,23 @@ func (c *conn) readData() stateType {
 	}
 	c.tries++
 
+	if c.deadlineExceeded("reading data") {
+		return nil
+	}
+
 	c.log.trace("Waiting for DATA from %s\n", c.remoteAddr)
 	_, err := c.readFromNet()
+	if err == ErrTransferTimeout {
+		c.err = wrapError(err, "reading data")
+		return nil
+	}
 	if err != nil {
 		c.log.debug("error receiving block %d: %v", c.block+1, err)
 		c.log.trace("Resending ACK for %d\n", c.block)
 		if err := c.sendAck(c.block); err != nil {
 			c.log.debug("resending ACK %v", err)
 		}
+		c.retransmits++
 		c.window = 0
 		return c.readData
 	}
@@ -531,6 +817,7 @@ func (c *conn) readData() stateType {
 
 	c.log.trace("Received block %d\n", c.rx.block())
 	c.tries = 0
+	c.resetIdleDeadline()
 
 	return c.ackData
 }
@@ -547,6 +834,7 @@ func (c *conn) ackData() stateType {
 	case diff == 0:
 		// Same block again, ignore
 		c.log.trace("ackData diff: %d, current block: %d, rx block %d", diff, c.block, c.rx.block())
+		c.duplicates++
 		return c.read
 	case diff > c.windowsize:
 		c.log.trace("ackData diff: %d, current block: %d, rx block %d", diff, c.block, c.rx.block())
@@ -565,17 +853,31 @@ func (c *conn) ackData() stateType {
 			c.err = wrapError(err, "sending missed block(s) ACK")
 			return nil
 		}
+		c.retransmits++
 		c.window = 0
 		c.catchup = true
 		return c.read
 	}
 
-	// Add data to buffer
-	n, err := c.rxBuf.Write(c.rx.data())
-	if err != nil {
+	// Add data to buffer, or pass it to WriteTo's destination
+	if c.dst != nil {
+		n, err := c.dst.Write(c.rx.data())
+		c.total += int64(n)
+		if err == nil && n < len(c.rx.data()) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			c.err = wrapError(err, "writing data to destination")
+			return nil
+		}
+	} else if _, err := c.rxBuf.Write(c.rx.data()); err != nil {
 		c.err = wrapError(err, "writing to rxBuf after read")
 		return nil
 	}
+	n := len(c.rx.data())
+	if c.hash != nil {
+		c.hash.Write(c.rx.data())
+	}
 
 	if n < int(c.blksize) {
 		// Reveived last DATA, we're done
@@ -587,6 +889,14 @@ func (c *conn) ackData() stateType {
 		return c.read
 	}
 
+	if c.done && c.discard {
+		// Reject in place of the final ACK, the client would consider
+		// the transfer successful once it's ACKed
+		c.sendError(ErrCodeAccessViolation, "transfer rejected")
+		c.err = ErrTransferRejected
+		return nil
+	}
+
 	// Reached the windowsize or final data, send ACK and reset window
 	c.log.trace("window %d, windowsize: %d, offset: %d, blksize: %d", c.window, c.windowsize, c.rx.offset, c.blksize)
 	c.window = 0
@@ -596,11 +906,21 @@ func (c *conn) ackData() stateType {
 		return nil
 	}
 
+	if c.done && c.trailer {
+		return c.readChecksum
+	}
+
 	return c.read
 }
 
 // Close flushes any remaining data to be transferred and closes netConn
 func (c *conn) Close() error {
+	if c.hijacked {
+		// netConn belongs to the handler
+		c.cancelContext()
+		return nil
+	}
+
 	c.log.debug("Closing connection to %s\n", c.remoteAddr)
 
 	if c.reqChan == nil {
@@ -608,7 +928,7 @@ func (c *conn) Close() error {
 			// Close network even if another error occurs
 			err := c.netConn.Close()
 			if err != nil {
-				c.log.debug("error closing network connection:", err)
+				c.log.debug("error closing network connection: %v", err)
 			}
 			if c.err == nil {
 				c.err = err
@@ -618,6 +938,7 @@ func (c *conn) Close() error {
 
 	// Can't write if an error has been sent/received
 	if c.err != nil && c.err != io.EOF {
+		c.cancelContext()
 		return wrapError(c.err, "checking conn err before Close")
 	}
 
@@ -636,6 +957,7 @@ func (c *conn) Close() error {
 		c.closing = true
 		c.Write([]byte{})
 	}
+	c.cancelContext()
 
 	if c.err == io.EOF {
 		return nil
@@ -649,23 +971,38 @@ func (c *conn) Close() error {
 func (c *conn) parseOptions() (options, error) {
 	ackOpts := make(map[string]string)
 
+	if c.ignoreOptions {
+		c.optionsParsed = true
+		return ackOpts, nil
+	}
+
 	// parse and set options
-	for opt, val := range c.rx.options() {
+	for opt, val := range c.requestedOptions() {
 		switch opt {
 		case optBlocksize:
-			size, err := strconv.ParseUint(val, 10, 16)
+			size, err := c.negotiateBlocksize(val)
 			if err != nil {
-				return nil, &errParsingOption{option: opt, value: val}
+				return nil, err
 			}
-			c.blksize = uint16(size)
-			ackOpts[opt] = val
+			c.blksize = size
+			ackOpts[opt] = strconv.FormatUint(uint64(size), 10)
 		case optTimeout:
-			seconds, err := strconv.ParseUint(val, 10, 8)
+			seconds, err := strconv.ParseUint(val, 10, 64)
 			if err != nil {
 				return nil, &errParsingOption{option: opt, value: val}
 			}
+			// RFC2349: valid values range between 1 and 255 seconds
+			switch {
+			case seconds < 1:
+				seconds = 1
+			case seconds > 255:
+				seconds = 255
+			}
+			if max := uint64(c.maxTimeout / time.Second); max > 0 && seconds > max {
+				seconds = max
+			}
 			c.timeout = time.Second * time.Duration(seconds)
-			ackOpts[opt] = val
+			ackOpts[opt] = strconv.FormatUint(seconds, 10)
 		case optTransferSize:
 			tsize, err := strconv.ParseInt(val, 10, 64)
 			if err != nil {
@@ -678,11 +1015,23 @@ func (c *conn) parseOptions() (options, error) {
 			}
 			c.tsize = &tsize
 		case optWindowSize:
-			size, err := strconv.ParseUint(val, 10, 16)
+			size, ok, err := c.negotiateWindowsize(val)
 			if err != nil {
-				return nil, &errParsingOption{option: opt, value: val}
+				return nil, err
 			}
-			c.windowsize = uint16(size)
+			if !ok {
+				// Omitting windowsize from the OACK declines it
+				continue
+			}
+			c.windowsize = size
+			ackOpts[opt] = strconv.FormatUint(uint64(size), 10)
+		case optChecksum:
+			// Checksums are only sent from server to client
+			if c.isClient == c.isSender || c.checksumAlg == "" || val != c.checksumAlg {
+				continue
+			}
+			c.hash = checksumAlgs[val]()
+			c.trailer = true
 			ackOpts[opt] = val
 		}
 	}
@@ -692,8 +1041,88 @@ func (c *conn) parseOptions() (options, error) {
 	return ackOpts, nil
 }
 
+// transferSize returns the tsize sent by the client, or nil if it was
+// not sent. Before options are parsed it is read from the request.
+func (c *conn) transferSize() *int64 {
+	if c.optionsParsed || c.ignoreOptions {
+		return c.tsize
+	}
+	val, ok := c.requestedOptions()[optTransferSize]
+	if !ok {
+		return nil
+	}
+	tsize, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &tsize
+}
+
+// requestedOptions returns the options to negotiate, reqOpts if set or
+// the options in the request.
+func (c *conn) requestedOptions() options {
+	if c.reqOpts != nil {
+		return c.reqOpts
+	}
+	return c.rx.options()
+}
+
+// negotiateBlocksize returns the blksize to use when val is requested.
+func (c *conn) negotiateBlocksize(val string) (uint16, error) {
+	size, err := strconv.ParseUint(val, 10, 16)
+	if err != nil {
+		return 0, &errParsingOption{option: optBlocksize, value: val}
+	}
+	if c.maxBlksize != 0 && uint16(size) > c.maxBlksize {
+		// RFC2348: the server may reply with a smaller blocksize
+		size = uint64(c.maxBlksize)
+	}
+	return uint16(size), nil
+}
+
+// negotiateWindowsize returns the windowsize to use when val is requested,
+// or false if the option is declined.
+func (c *conn) negotiateWindowsize(val string) (uint16, bool, error) {
+	size, err := strconv.ParseUint(val, 10, 16)
+	if err != nil {
+		return 0, false, &errParsingOption{option: optWindowSize, value: val}
+	}
+	if c.maxWindow == 1 {
+		return 0, false, nil
+	}
+	if c.maxWindow != 0 && uint16(size) > c.maxWindow {
+		size = uint64(c.maxWindow)
+	}
+	return uint16(size), true, nil
+}
+
+// negotiated returns the blksize and windowsize that are, or will be
+// once options are parsed, used for the transfer.
+func (c *conn) negotiated() (blksize, windowsize uint16) {
+	if c.optionsParsed || c.ignoreOptions {
+		return c.blksize, c.windowsize
+	}
+
+	blksize, windowsize = c.blksize, c.windowsize
+	opts := c.requestedOptions()
+	if val, ok := opts[optBlocksize]; ok {
+		if size, err := c.negotiateBlocksize(val); err == nil {
+			blksize = size
+		}
+	}
+	if val, ok := opts[optWindowSize]; ok {
+		if size, ok, err := c.negotiateWindowsize(val); err == nil && ok {
+			windowsize = size
+		}
+	}
+	return blksize, windowsize
+}
+
 // sendError sends ERROR datagram to remote host
 func (c *conn) sendError(code ErrorCode, msg string) {
+	if c.hijacked {
+		return
+	}
 	c.log.debug("Sending error code %s to %s: %s\n", code, c.remoteAddr, msg)
 
 	// Check error message length
@@ -702,11 +1131,20 @@ func (c *conn) sendError(code ErrorCode, msg string) {
 		msg = msg[:c.blksize-1]
 	}
 
+	if c.sentErr == nil {
+		c.sentErr = fmt.Errorf("sent error %s: %s", code, msg)
+	}
+
+	if c.stats != nil {
+		atomic.AddUint64(&c.stats.errorsSent, 1)
+	}
+
 	// Send error
 	c.tx.writeError(code, msg)
 	if err := c.writeToNet(); err != nil {
 		c.log.debug("sending ERROR: %v", err)
 	}
+	c.cancelContext()
 }
 
 // sendAck sends ACK
@@ -719,8 +1157,11 @@ func (c *conn) sendAck(block uint16) error {
 
 // getAck reads ACK, validates structure and checks for ERROR
 //
-// If the received ACK is for a previous block, indicating the receiver missed data,
-// it will rollback the transfer to the ACK'd block and reset the window.
+// If the received ACK is for a previous block in the window, indicating the
+// receiver missed data, it will rollback the transfer to the ACK'd block and
+// reset the window. Duplicate ACKs for blocks already acknowledged are
+// discarded, data is only resent when no ACK is received before the timeout
+// (RFC1123 4.2.3.1), avoiding the Sorcerer's Apprentice Syndrome.
 func (c *conn) getAck() stateType {
 	c.tries++
 	if c.tries > c.retransmit {
@@ -730,11 +1171,23 @@ func (c *conn) getAck() stateType {
 		return nil
 	}
 
+	if c.deadlineExceeded("reading ack") {
+		return nil
+	}
+
 	c.log.trace("Waiting for ACK from %s\n", c.remoteAddr)
 	sAddr, err := c.readFromNet()
+	if err == ErrTransferTimeout {
+		c.err = wrapError(err, "waiting for ACK")
+		return nil
+	}
 	if err != nil {
 		c.log.trace("Error waiting for ACK: %v", err)
-		c.err = wrapError(err, "waiting for ACK")
+		if c.tx.opcode() == opCodeDATA && c.block != c.lastAck {
+			c.log.debug("Timeout waiting for ACK for block %d, resending from block %d.", c.block, c.lastAck+1)
+			c.rollback(c.lastAck)
+			return c.writeData
+		}
 		return c.getAck
 	}
 
@@ -753,6 +1206,9 @@ func (c *conn) getAck() stateType {
 			// Don't care about an error here, just a courtesy
 			_, _ = c.netConn.WriteTo(err.bytes(), sAddr)
 		}()
+		if c.stats != nil {
+			atomic.AddUint64(&c.stats.errorsSent, 1)
+		}
 
 		return c.getAck // Read another datagram
 	}
@@ -767,6 +1223,7 @@ func (c *conn) getAck() stateType {
 	switch op := c.rx.opcode(); op {
 	case opCodeACK:
 		c.log.trace("Got ACK for block %d\n", c.rx.block())
+		c.resetIdleDeadline()
 		// continue on
 	case opCodeERROR:
 		c.err = wrapError(c.remoteError(), "error receiving ACK")
@@ -776,21 +1233,27 @@ func (c *conn) getAck() stateType {
 		return nil
 	}
 
-	// Check block #
-	if rxBlock := c.rx.block(); rxBlock != c.block {
-		if rxBlock > c.block {
-			// Out of order ACKs can cause this scenario, ignore the ACK
-			c.log.debug("Received ACK > current block, ignoring.")
-			return c.getAck
-		}
+	// Check block #, distances are modulo 2^16 to handle block rollover
+	rxBlock := c.rx.block()
+	outstanding := c.block - c.lastAck // Blocks sent but not acknowledged
+	switch behind := c.block - rxBlock; {
+	case behind == 0:
+		// Everything sent has been acknowledged
+	case behind < outstanding:
 		c.log.debug("Expected ACK for block %d, got %d. Resetting to block %d.", c.block, rxBlock, rxBlock)
-		c.txBuf.UnreadSlots(int(c.block - rxBlock))
-		c.block = rxBlock
-		c.window = 0
-
-		// Reset done in case error on final send
-		c.done = false
+		c.rollback(rxBlock)
+	case behind == outstanding:
+		// Already acknowledged, resending would duplicate the data
+		// already in flight
+		c.log.debug("Received duplicate ACK for block %d, ignoring.", rxBlock)
+		c.duplicates++
+		return c.getAck
+	default:
+		// Out of order ACKs can cause this scenario, ignore the ACK
+		c.log.debug("Received ACK for block %d outside window, ignoring.", rxBlock)
+		return c.getAck
 	}
+	c.lastAck = rxBlock
 
 	c.tries = 0
 
@@ -800,25 +1263,122 @@ func (c *conn) getAck() stateType {
 	return c.writeData
 }
 
+// rollback resets the transfer to resend the blocks following block.
+func (c *conn) rollback(block uint16) {
+	n := int(c.block - block)
+	c.txBuf.UnreadSlots(n)
+	c.retransmits += n
+	c.block = block
+	c.window = 0
+
+	// Reset done in case error on final send
+	c.done = false
+}
+
 // remoteError formats the error in rx, sets err and returns the error.
 func (c *conn) remoteError() error {
-	c.err = &errRemoteError{dg: c.rx.String()}
+	c.err = &errRemoteError{
+		dg:  c.rx.String(),
+		err: &Error{Code: c.rx.errorCode(), Message: c.rx.errMsg()},
+	}
+	c.cancelContext()
 	return c.err
 }
 
+// cancelContext cancels the transfer's context, if it has one.
+func (c *conn) cancelContext() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// resetIdleDeadline extends the idle deadline by transferTimeout, if set.
+func (c *conn) resetIdleDeadline() {
+	if c.transferTimeout > 0 {
+		c.idleDeadline = time.Now().Add(c.transferTimeout)
+	}
+}
+
+// deadlineExceeded checks the idle and overall transfer deadlines. If
+// either has passed, an ERROR is sent, err is set, and true is returned.
+func (c *conn) deadlineExceeded(desc string) bool {
+	now := time.Now()
+	switch {
+	case c.transferTimeout > 0 && !c.idleDeadline.IsZero() && !now.Before(c.idleDeadline):
+		c.sendError(ErrCodeNotDefined, "transfer timeout")
+		c.err = wrapError(ErrTransferTimeout, desc)
+	case !c.deadline.IsZero() && !now.Before(c.deadline):
+		c.sendError(ErrCodeNotDefined, "transfer timed out")
+		c.err = wrapError(ErrTransferDeadline, desc)
+	default:
+		return false
+	}
+	return true
+}
+
+// readTimeout returns how long to wait for the next datagram, limited
+// by the idle and overall transfer deadlines.
+func (c *conn) readTimeout() time.Duration {
+	timeout := c.timeout
+	if c.backoff != nil {
+		timeout = c.backoff.wait(c.tries)
+	}
+	if c.transferTimeout > 0 {
+		if remaining := time.Until(c.idleDeadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if !c.deadline.IsZero() {
+		if remaining := time.Until(c.deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout
+}
+
+// backoff configures exponentially increasing waits between retransmits.
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+}
+
+// wait returns how long to wait on the given try, starting at 1.
+func (b *backoff) wait(try int) time.Duration {
+	wait := float64(b.initial)
+	for i := 1; i < try && wait < float64(b.max); i++ {
+		wait *= b.multiplier
+	}
+	if wait > float64(b.max) {
+		return b.max
+	}
+	return time.Duration(wait)
+}
+
 // readFromNet reads from netConn into b.
 func (c *conn) readFromNet() (net.Addr, error) {
+	if c.idleDeadline.IsZero() {
+		// Time spent by the handler before the transfer starts
+		// isn't idle
+		c.resetIdleDeadline()
+	}
+	timeout := c.readTimeout()
 	if c.reqChan != nil {
 		// Setup timer
 		if c.timer == nil {
-			c.timer = time.NewTimer(c.timeout)
+			c.timer = time.NewTimer(timeout)
 		} else {
-			c.timer.Reset(c.timeout)
+			c.timer.Reset(timeout)
 		}
 
 		// Single port mode
 		select {
-		case c.rx.buf = <-c.reqChan:
+		case buf, ok := <-c.reqChan:
+			if !ok {
+				// Closed by the server after being idle
+				return nil, ErrTransferTimeout
+			}
+			c.rx.buf = buf
 			c.rx.offset = len(c.rx.buf)
 			return nil, nil
 		case <-c.timer.C:
@@ -826,7 +1386,7 @@ func (c *conn) readFromNet() (net.Addr, error) {
 		}
 	}
 
-	if err := c.netConn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+	if err := c.netConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, wrapError(err, "setting network read deadline")
 	}
 	n, addr, err := c.netConn.ReadFrom(c.rx.buf)
@@ -836,6 +1396,11 @@ func (c *conn) readFromNet() (net.Addr, error) {
 
 // writeToNet writes tx to netConn.
 func (c *conn) writeToNet() error {
+	if c.tx.opcode() == opCodeDATA {
+		if err := c.pace(len(c.tx.bytes())); err != nil {
+			return err
+		}
+	}
 	if err := c.netConn.SetWriteDeadline(time.Now().Add(c.timeout * time.Duration(c.retransmit))); err != nil {
 		return wrapError(err, "setting network write deadline")
 	}
@@ -843,6 +1408,33 @@ func (c *conn) writeToNet() error {
 	return err
 }
 
+// pace waits until n bytes can be sent within the rate limits.
+func (c *conn) pace(n int) error {
+	var wait time.Duration
+	now := time.Now()
+	for _, l := range c.limiters {
+		if d := l.reserve(now, n); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	var done <-chan struct{}
+	if c.ctx != nil {
+		done = c.ctx.Done()
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-done:
+		return wrapError(c.ctx.Err(), "waiting for rate limit")
+	}
+}
+
 // ringBuffer wraps a bytes.Buffer, adding the ability to unread data
 // up to the number of slots.
 type ringBuffer struct {
@@ -897,6 +1489,19 @@ func (r *ringBuffer) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// nextSlot returns the slot at head, for a block to be written directly.
+// It must only be used when Buffer is empty and all slots have been read.
+func (r *ringBuffer) nextSlot() []byte {
+	offset := (r.head % r.slots) * r.size
+	return r.buf[offset : offset+r.size]
+}
+
+// commitSlot adds the full slot returned by nextSlot as an unread block.
+func (r *ringBuffer) commitSlot() {
+	r.slotsLen[r.head%r.slots] = r.size
+	r.head++
+}
+
 // UnreadSlots decrements the current slot, resulting in the
 // new reads going to the ringBuffer until current catches up to head
 func (r *ringBuffer) UnreadSlots(n int) {
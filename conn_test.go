@@ -122,10 +122,13 @@ func TestConn_getAck(t *testing.T) {
 		timeout  time.Duration
 		block    uint16
 		window   uint16
+		lastAck  uint16
+		sentData bool // DATA sent rather than ACK
 		connFunc func(*net.UDPConn, *net.UDPAddr) error
 
 		expectedBlock   uint16
 		expectedWindow  uint16
+		expectedLastAck uint16
 		expectedRingBuf int
 		expectedError   string
 	}{
@@ -139,9 +142,10 @@ func TestConn_getAck(t *testing.T) {
 				return testWriteConn(t, conn, sAddr, tDG)
 			},
 
-			expectedBlock:  14,
-			expectedWindow: 5,
-			expectedError:  "^$",
+			expectedBlock:   14,
+			expectedWindow:  5,
+			expectedLastAck: 14,
+			expectedError:   "^$",
 		},
 		{
 			name:    "timeout",
@@ -253,6 +257,7 @@ func TestConn_getAck(t *testing.T) {
 
 			expectedBlock:   14,
 			expectedWindow:  0,
+			expectedLastAck: 14,
 			expectedRingBuf: -4,
 			expectedError:   "^$",
 		},
@@ -270,6 +275,101 @@ func TestConn_getAck(t *testing.T) {
 			expectedWindow: 5,
 			expectedError:  "^$",
 		},
+		{
+			name:    "duplicate ACK",
+			timeout: time.Second * 1,
+			block:   18,
+			window:  4,
+			lastAck: 14,
+			connFunc: func(conn *net.UDPConn, sAddr *net.UDPAddr) error {
+				tDG.writeAck(14)
+				return testWriteConn(t, conn, sAddr, tDG)
+			},
+
+			expectedBlock:   18,
+			expectedWindow:  4,
+			expectedLastAck: 14,
+			expectedError:   "^$",
+		},
+		{
+			name:    "duplicate ACK, rollover",
+			timeout: time.Second * 1,
+			block:   1,
+			window:  2,
+			lastAck: 65535,
+			connFunc: func(conn *net.UDPConn, sAddr *net.UDPAddr) error {
+				tDG.writeAck(65535)
+				return testWriteConn(t, conn, sAddr, tDG)
+			},
+
+			expectedBlock:   1,
+			expectedWindow:  2,
+			expectedLastAck: 65535,
+			expectedError:   "^$",
+		},
+		{
+			name:    "incorrect block, rollover",
+			timeout: time.Second * 1,
+			block:   2,
+			window:  4,
+			lastAck: 65534,
+			connFunc: func(conn *net.UDPConn, sAddr *net.UDPAddr) error {
+				tDG.writeAck(0)
+				return testWriteConn(t, conn, sAddr, tDG)
+			},
+
+			expectedBlock:   0,
+			expectedWindow:  0,
+			expectedLastAck: 0,
+			expectedRingBuf: -2,
+			expectedError:   "^$",
+		},
+		{
+			name:    "success, rollover",
+			timeout: time.Second * 1,
+			block:   0,
+			window:  3,
+			lastAck: 65533,
+			connFunc: func(conn *net.UDPConn, sAddr *net.UDPAddr) error {
+				tDG.writeAck(0)
+				return testWriteConn(t, conn, sAddr, tDG)
+			},
+
+			expectedBlock:   0,
+			expectedWindow:  3,
+			expectedLastAck: 0,
+			expectedError:   "^$",
+		},
+		{
+			name:    "success, 65535 to 0",
+			timeout: time.Second * 1,
+			block:   0,
+			window:  1,
+			lastAck: 65535,
+			connFunc: func(conn *net.UDPConn, sAddr *net.UDPAddr) error {
+				tDG.writeAck(0)
+				return testWriteConn(t, conn, sAddr, tDG)
+			},
+
+			expectedBlock:   0,
+			expectedWindow:  1,
+			expectedLastAck: 0,
+			expectedError:   "^$",
+		},
+		{
+			name:     "timeout, resend",
+			timeout:  time.Millisecond,
+			block:    18,
+			window:   2,
+			lastAck:  16,
+			sentData: true,
+
+			expectedBlock:   16,
+			expectedWindow:  0,
+			expectedLastAck: 16,
+			expectedRingBuf: -2,
+			expectedError:   "^$",
+		},
 	}
 
 	for _, c := range cases {
@@ -279,9 +379,13 @@ func TestConn_getAck(t *testing.T) {
 			tConn.timeout = c.timeout
 			tConn.block = c.block
 			tConn.window = c.window
+			tConn.lastAck = c.lastAck
 			tConn.rx.buf = make([]byte, 516)
 			tConn.txBuf = newRingBuffer(100, 100)
 			tConn.tx.writeAck(1) // TODO: set prev opcode in test, needs to be done when checking for OACK
+			if c.sentData {
+				tConn.tx.writeData(c.block, nil)
+			}
 
 			errChan := testConnFunc(cNetConn, sAddr, c.connFunc)
 			_ = tConn.getAck() // TODO: check return func
@@ -309,6 +413,11 @@ func TestConn_getAck(t *testing.T) {
 				t.Errorf("expected window %d, got %d", c.expectedWindow, tConn.window)
 			}
 
+			// Last ACK
+			if tConn.lastAck != c.expectedLastAck {
+				t.Errorf("expected last ACK %d, got %d", c.expectedLastAck, tConn.lastAck)
+			}
+
 			// ringBuf
 			if tConn.txBuf.current != c.expectedRingBuf {
 				t.Errorf("expected ringBuf current %d, got %d", c.expectedRingBuf, tConn.txBuf.current)
@@ -1099,10 +1208,12 @@ func TestConn_parseOptions(t *testing.T) {
 	dg := datagram{}
 
 	cases := []struct {
-		name     string
-		rx       func() datagram
-		tsize    *int64
-		isSender bool
+		name       string
+		rx         func() datagram
+		tsize      *int64
+		isSender   bool
+		maxBlksize uint16
+		maxTimeout time.Duration
 
 		expectOptionsParsed bool
 		expectedOptions     options
@@ -1124,6 +1235,32 @@ func TestConn_parseOptions(t *testing.T) {
 			expectedBlksize:     234,
 			expectedError:       "^$",
 		},
+		{
+			name: "blocksize, larger than max",
+			rx: func() datagram {
+				dg.writeOptionAck(options{optBlocksize: "9000"})
+				return dg
+			},
+			maxBlksize: 1468,
+
+			expectOptionsParsed: true,
+			expectedOptions:     options{optBlocksize: "1468"},
+			expectedBlksize:     1468,
+			expectedError:       "^$",
+		},
+		{
+			name: "blocksize, smaller than max",
+			rx: func() datagram {
+				dg.writeOptionAck(options{optBlocksize: "1024"})
+				return dg
+			},
+			maxBlksize: 1468,
+
+			expectOptionsParsed: true,
+			expectedOptions:     options{optBlocksize: "1024"},
+			expectedBlksize:     1024,
+			expectedError:       "^$",
+		},
 		{
 			name: "blocksize, invalid",
 			rx: func() datagram {
@@ -1147,6 +1284,43 @@ func TestConn_parseOptions(t *testing.T) {
 			expectedTimeout:     3 * time.Second,
 			expectedError:       `^$`,
 		},
+		{
+			name: "timeout, too small",
+			rx: func() datagram {
+				dg.writeOptionAck(options{optTimeout: "0"})
+				return dg
+			},
+
+			expectedOptions:     options{optTimeout: "1"},
+			expectOptionsParsed: true,
+			expectedTimeout:     1 * time.Second,
+			expectedError:       `^$`,
+		},
+		{
+			name: "timeout, too large",
+			rx: func() datagram {
+				dg.writeOptionAck(options{optTimeout: "300"})
+				return dg
+			},
+
+			expectedOptions:     options{optTimeout: "255"},
+			expectOptionsParsed: true,
+			expectedTimeout:     255 * time.Second,
+			expectedError:       `^$`,
+		},
+		{
+			name: "timeout, larger than max",
+			rx: func() datagram {
+				dg.writeOptionAck(options{optTimeout: "30"})
+				return dg
+			},
+			maxTimeout: 5 * time.Second,
+
+			expectedOptions:     options{optTimeout: "5"},
+			expectOptionsParsed: true,
+			expectedTimeout:     5 * time.Second,
+			expectedError:       `^$`,
+		},
 		{
 			name: "timeout, invalid",
 			rx: func() datagram {
@@ -1270,6 +1444,8 @@ func TestConn_parseOptions(t *testing.T) {
 			tConn := conn{rx: c.rx()}
 			tConn.tsize = c.tsize
 			tConn.isSender = c.isSender
+			tConn.maxBlksize = c.maxBlksize
+			tConn.maxTimeout = c.maxTimeout
 
 			opts, err := tConn.parseOptions()
 
@@ -0,0 +1,120 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnManager tracks transfers in single port mode, where datagrams for
+// all transfers are received on the server's socket and passed to the
+// transfer by client address.
+//
+// The addresses passed by the server are TransferAddrs, identifying
+// transfers by client address and direction; implementations can key
+// transfers by the address's String. Methods are called from the
+// server's receive loop and must not block. The server closes the channel
+// of a transfer that it removes for being idle.
+type ConnManager interface {
+	// GetOrNew returns the channel of the transfer from addr and
+	// true if there is one. Otherwise it registers a transfer from
+	// addr and returns the new channel the transfer's datagrams are
+	// sent on, and false. The check and registration must be atomic.
+	//
+	// Requests from an address with a transfer, usually retransmitted
+	// by the client, are dropped. The server doesn't block sending to
+	// the channel, datagrams are dropped if it's full.
+	GetOrNew(addr net.Addr) (chan []byte, bool)
+
+	// Get returns the channel of the transfer from addr, if any.
+	Get(addr net.Addr) (chan []byte, bool)
+
+	// Remove unregisters the transfer from addr.
+	Remove(addr net.Addr)
+}
+
+// TransferAddr identifies a transfer in single port mode. A client may
+// read and write from the same address, so transfers are identified by
+// the client's address and direction.
+type TransferAddr struct {
+	*net.UDPAddr      // Client address
+	Write        bool // Whether the client is writing (WRQ)
+}
+
+// String returns the client address followed by "/read" or "/write".
+// IPv4-mapped IPv6 addresses are formatted as IPv4.
+func (a TransferAddr) String() string {
+	dir := "/read"
+	if a.Write {
+		dir = "/write"
+	}
+	return addrKey(a.UDPAddr).String() + dir
+}
+
+// DefaultConnManager is the ConnManager used by the server unless
+// ServerConnManager is configured, backed by a map. It may be embedded
+// to add behavior, such as logging, to a custom ConnManager.
+//
+// DefaultConnManager is safe for concurrent use.
+type DefaultConnManager struct {
+	queueDepth int
+
+	mu    sync.Mutex
+	conns map[string]chan []byte
+}
+
+// NewDefaultConnManager returns a DefaultConnManager buffering up to
+// queueDepth datagrams per transfer. If queueDepth is less than one,
+// the ServerSinglePortQueueDepth default is used.
+func NewDefaultConnManager(queueDepth int) *DefaultConnManager {
+	if queueDepth < 1 {
+		queueDepth = defaultQueueDepth
+	}
+	return &DefaultConnManager{
+		queueDepth: queueDepth,
+		conns:      make(map[string]chan []byte),
+	}
+}
+
+// GetOrNew implements ConnManager.
+func (m *DefaultConnManager) GetOrNew(addr net.Addr) (chan []byte, bool) {
+	key := connKey(addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ch, ok := m.conns[key]; ok {
+		return ch, true
+	}
+	ch := make(chan []byte, m.queueDepth)
+	m.conns[key] = ch
+	return ch, false
+}
+
+// Get implements ConnManager.
+func (m *DefaultConnManager) Get(addr net.Addr) (chan []byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, ok := m.conns[connKey(addr)]
+	return ch, ok
+}
+
+// Remove implements ConnManager.
+func (m *DefaultConnManager) Remove(addr net.Addr) {
+	m.mu.Lock()
+	delete(m.conns, connKey(addr))
+	m.mu.Unlock()
+}
+
+// connKey returns a map key for addr. UDP addresses are normalized
+// with addrKey, so that IPv4-mapped addresses equal their IPv4 form.
+func connKey(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case TransferAddr:
+		return addr.String()
+	case *net.UDPAddr:
+		return addrKey(addr).String()
+	}
+	return addr.Network() + ":" + addr.String()
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ ConnManager = &DefaultConnManager{}
+
+func TestDefaultConnManager(t *testing.T) {
+	m := NewDefaultConnManager(0)
+
+	v4 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1234}
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1235}
+
+	ch, ok := m.GetOrNew(v4)
+	if ok {
+		t.Error("expected new transfer")
+	}
+	if cap(ch) != defaultQueueDepth {
+		t.Errorf("expected queue depth %d, got %d", defaultQueueDepth, cap(ch))
+	}
+	if got, ok := m.GetOrNew(mapped); !ok || got != ch {
+		t.Error("expected GetOrNew to return the existing transfer")
+	}
+	if got, ok := m.Get(mapped); !ok || got != ch {
+		t.Error("expected IPv4-mapped address to match IPv4 transfer")
+	}
+	if _, ok := m.Get(other); ok {
+		t.Error("expected no transfer for other port")
+	}
+
+	m.Remove(mapped)
+	if _, ok := m.Get(v4); ok {
+		t.Error("expected transfer to be removed")
+	}
+
+	if ch, _ := NewDefaultConnManager(3).GetOrNew(v4); cap(ch) != 3 {
+		t.Errorf("expected queue depth 3, got %d", cap(ch))
+	}
+
+	// Transfers in each direction are distinct
+	read, _ := m.GetOrNew(TransferAddr{UDPAddr: v4})
+	write, ok := m.GetOrNew(TransferAddr{UDPAddr: mapped, Write: true})
+	if ok || write == read {
+		t.Error("expected new transfer for write from the same address")
+	}
+	if got, ok := m.Get(TransferAddr{UDPAddr: mapped}); !ok || got != read {
+		t.Error("expected IPv4-mapped address to match IPv4 read transfer")
+	}
+}
+
+func TestTransferAddr_String(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1234}
+	if got := (TransferAddr{UDPAddr: addr}).String(); got != "192.0.2.1:1234/read" {
+		t.Errorf("expected %q, got %q", "192.0.2.1:1234/read", got)
+	}
+	if got := (TransferAddr{UDPAddr: addr, Write: true}).String(); got != "192.0.2.1:1234/write" {
+		t.Errorf("expected %q, got %q", "192.0.2.1:1234/write", got)
+	}
+}
+
+// countingConnManager counts calls to an embedded DefaultConnManager.
+type countingConnManager struct {
+	*DefaultConnManager
+
+	mu      sync.Mutex
+	news    int
+	removes int
+}
+
+func (m *countingConnManager) GetOrNew(addr net.Addr) (chan []byte, bool) {
+	ch, ok := m.DefaultConnManager.GetOrNew(addr)
+	if !ok {
+		m.mu.Lock()
+		m.news++
+		m.mu.Unlock()
+	}
+	return ch, ok
+}
+
+func (m *countingConnManager) Remove(addr net.Addr) {
+	m.mu.Lock()
+	m.removes++
+	m.mu.Unlock()
+	m.DefaultConnManager.Remove(addr)
+}
+
+func TestServerConnManager(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewServer(":0", ServerConnManager(nil)); err != ErrNilConnManager {
+		t.Errorf("expected %v, got %v", ErrNilConnManager, err)
+	}
+
+	data := getTestData(t, "1MB-random")[:100000]
+	cm := &countingConnManager{DefaultConnManager: NewDefaultConnManager(0)}
+	ip, port, closeServer := newTestServer(t, true, func(w ReadRequest) {
+		w.Write(data)
+	}, func(w WriteRequest) {
+		ioutil.ReadAll(w)
+	}, ServerConnManager(cm))
+	defer closeServer()
+
+	url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+	const transfers = 3
+	for i := 0; i < transfers; i++ {
+		client, err := NewClient(ClientWindowsize(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("expected %d bytes, got %d", len(data), len(got))
+		}
+		if err := client.Put(url, bytes.NewReader(data), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Transfers are removed once the handler returns
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cm.mu.Lock()
+		news, removes := cm.news, cm.removes
+		cm.mu.Unlock()
+		if removes == 2*transfers {
+			if news != 2*transfers {
+				t.Errorf("expected %d transfers, got %d", 2*transfers, news)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d transfers removed, got %d", 2*transfers, removes)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cm.DefaultConnManager.mu.Lock()
+	defer cm.DefaultConnManager.mu.Unlock()
+	if len(cm.conns) != 0 {
+		t.Errorf("expected no tracked transfers, got %d", len(cm.conns))
+	}
+}
+
+func TestServerConnManager_duplicateRequest(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	cm := &countingConnManager{DefaultConnManager: NewDefaultConnManager(0)}
+	ip, port, closeServer := newTestServer(t, true, func(w ReadRequest) {
+		started <- struct{}{}
+		<-release
+	}, nil, ServerConnManager(cm))
+	defer closeServer()
+	defer close(release)
+
+	conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", nil)
+	defer conn.Close()
+	<-started
+
+	// Retransmit the request from the same address
+	var dg datagram
+	dg.writeReq(opCodeRRQ, "file", ModeOctet, nil)
+	if _, err := conn.WriteTo(dg.bytes(), &net.UDPAddr{IP: net.ParseIP(ip), Port: port}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+		t.Error("expected duplicate request to be dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.news != 1 {
+		t.Errorf("expected 1 transfer, got %d", cm.news)
+	}
+}
+
+func TestServerConnManager_idleTimeout(t *testing.T) {
+	t.Parallel()
+
+	errChan := make(chan error, 1)
+	cm := &countingConnManager{DefaultConnManager: NewDefaultConnManager(0)}
+	s, ip, port, closeServer := startTestServer(t, true, func(w ReadRequest) {
+		_, err := w.Write(make([]byte, 1024))
+		errChan <- err
+	}, nil, ServerConnManager(cm), ServerSinglePortIdleTimeout(200*time.Millisecond), ServerRetransmit(100))
+	defer closeServer()
+
+	// Send a request and disappear
+	conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", nil)
+	conn.Close()
+
+	select {
+	case err := <-errChan:
+		if ErrorCause(err) != ErrTransferTimeout {
+			t.Errorf("expected handler error %v, got %v", ErrTransferTimeout, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return")
+	}
+
+	if expired := s.Stats().Expired; expired != 1 {
+		t.Errorf("expected 1 expired transfer, got %d", expired)
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.removes != 1 {
+		t.Errorf("expected expired transfer to be removed, got %d removes", cm.removes)
+	}
+}
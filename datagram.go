@@ -33,6 +33,22 @@ func (e ErrorCode) String() string {
 	return fmt.Sprintf("UNKNOWN_ERROR_%v", uint16(e))
 }
 
+// Description returns the description of e from RFC 1350, for
+// example "Disk full or allocation exceeded.".
+func (e ErrorCode) Description() string {
+	desc, ok := errorDescriptions[e]
+	if ok {
+		return desc
+	}
+	return fmt.Sprintf("Unknown error %v.", uint16(e))
+}
+
+// Error implements error so that an ErrorCode can be the target
+// of errors.Is, see Error.
+func (e ErrorCode) Error() string {
+	return e.String()
+}
+
 const (
 	opCodeRRQ   opcode = 0x1 // Read Request
 	opCodeWRQ   opcode = 0x2 // Write Request
@@ -68,6 +84,8 @@ const (
 	optTimeout      = "timeout"
 	optTransferSize = "tsize"
 	optWindowSize   = "windowsize"
+	optChecksum     = "checksum"
+	optMulticast    = "multicast"
 )
 
 // TransferMode is a TFTP transer mode
@@ -84,6 +102,16 @@ var (
 		ErrCodeFileAlreadyExists: "FILE_ALREADY_EXISTS",
 		ErrCodeNoSuchUser:        "NO_SUCH_USER",
 	}
+	errorDescriptions = map[ErrorCode]string{
+		ErrCodeNotDefined:        "Not defined, see error message (if any).",
+		ErrCodeFileNotFound:      "File not found.",
+		ErrCodeAccessViolation:   "Access violation.",
+		ErrCodeDiskFull:          "Disk full or allocation exceeded.",
+		ErrCodeIllegalOperation:  "Illegal TFTP operation.",
+		ErrCodeUnknownTransferID: "Unknown transfer ID.",
+		ErrCodeFileAlreadyExists: "File already exists.",
+		ErrCodeNoSuchUser:        "No such user.",
+	}
 	opcodeStrings = map[opcode]string{
 		opCodeRRQ:   "READ_REQUEST",
 		opCodeWRQ:   "WRITE_REQUEST",
@@ -235,14 +263,32 @@ func (d *datagram) errMsg() string {
 
 // Filename from RRQ and WRQ datagrams
 func (d *datagram) filename() string {
-	offset := bytes.IndexByte(d.buf[2:], 0x0) + 2
-	return string(d.buf[2:offset])
+	return d.field(0)
 }
 
 // Mode from RRQ and WRQ datagrams
 func (d *datagram) mode() TransferMode {
-	fields := bytes.Split(d.buf[2:], []byte{0x0})
-	return TransferMode(fields[1])
+	return TransferMode(d.field(1))
+}
+
+// field returns the i'th NULL terminated string following the opcode.
+// A truncated final string is returned as is, missing strings are "".
+func (d *datagram) field(i int) string {
+	if d.offset < 2 {
+		return ""
+	}
+	b := d.buf[2:d.offset]
+	for ; i > 0; i-- {
+		n := bytes.IndexByte(b, 0x0)
+		if n < 0 {
+			return ""
+		}
+		b = b[n+1:]
+	}
+	if n := bytes.IndexByte(b, 0x0); n >= 0 {
+		b = b[:n]
+	}
+	return string(b)
 }
 
 // Opcode from all datagrams
@@ -264,12 +310,18 @@ func (o options) String() string {
 func (d *datagram) options() options {
 	options := make(options)
 
+	// Only requests and OACKs contain options
+	op := d.opcode()
+	if op != opCodeRRQ && op != opCodeWRQ && op != opCodeOACK {
+		return options
+	}
+
 	optSlice := bytes.Split(d.buf[2:d.offset-1], []byte{0x0}) // d.buf[2:d.offset-1] = file -> just before final NULL
-	if op := d.opcode(); op == opCodeRRQ || op == opCodeWRQ {
+	if op == opCodeRRQ || op == opCodeWRQ {
 		optSlice = optSlice[2:] // Remove filename, mode
 	}
 
-	for i := 0; i < len(optSlice); i += 2 {
+	for i := 0; i+1 < len(optSlice); i += 2 {
 		options[string(optSlice[i])] = string(optSlice[i+1])
 	}
 	return options
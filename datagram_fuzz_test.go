@@ -0,0 +1,70 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import "testing"
+
+func FuzzDatagram(f *testing.F) {
+	var dg datagram
+	seed := func() { f.Add(append([]byte(nil), dg.bytes()...)) }
+
+	dg.writeReadReq("file", ModeOctet, nil)
+	seed()
+	dg.writeReadReq("dir/file", ModeNetASCII, map[string]string{optBlocksize: "1468", optTransferSize: "0"})
+	seed()
+	dg.writeWriteReq("file", ModeOctet, map[string]string{optWindowSize: "16"})
+	seed()
+	dg.writeData(1, []byte("data"))
+	seed()
+	dg.writeData(65535, nil)
+	seed()
+	dg.writeAck(0)
+	seed()
+	dg.writeError(ErrCodeFileNotFound, "File not found")
+	seed()
+	dg.writeOptionAck(map[string]string{optBlocksize: "512"})
+	seed()
+
+	// Truncated and malformed
+	f.Add([]byte{})
+	f.Add([]byte{0x0})
+	f.Add([]byte{0x0, 0x1})
+	f.Add([]byte{0x0, 0x1, 'f'})
+	f.Add([]byte{0x0, 0x2, 'f', 0x0})
+	f.Add([]byte{0x0, 0x5, 0x0})
+	f.Add([]byte{0x0, 0x6})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var dg datagram
+		dg.setBytes(b)
+
+		// Accessors used before validation must tolerate any input
+		name := dg.filename()
+		mode := dg.mode()
+
+		if err := dg.validate(); err != nil {
+			return
+		}
+
+		_ = dg.String()
+		_ = dg.options()
+
+		switch dg.opcode() {
+		case opCodeRRQ, opCodeWRQ:
+			if name == "" {
+				t.Errorf("validated %s with empty filename", dg.opcode())
+			}
+			if mode != ModeOctet && mode != ModeNetASCII {
+				t.Errorf("validated %s with mode %q", dg.opcode(), mode)
+			}
+		case opCodeDATA:
+			_, _ = dg.block(), dg.data()
+		case opCodeACK:
+			_ = dg.block()
+		case opCodeERROR:
+			_, _ = dg.errorCode(), dg.errMsg()
+		}
+	})
+}
@@ -108,6 +108,46 @@ func TestErrorCode_String(t *testing.T) {
 	}
 }
 
+func TestErrorCode_Description(t *testing.T) {
+	cases := []struct {
+		code ErrorCode
+
+		expected string
+	}{
+		{
+			code:     ErrCodeNotDefined,
+			expected: "Not defined, see error message (if any).",
+		},
+		{
+			code:     ErrCodeDiskFull,
+			expected: "Disk full or allocation exceeded.",
+		},
+		{
+			code:     ErrCodeNoSuchUser,
+			expected: "No such user.",
+		},
+		{
+			code:     13,
+			expected: "Unknown error 13.",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.expected, func(t *testing.T) {
+			if got := c.code.Description(); got != c.expected {
+				t.Errorf("Expected errCode(%d).Description() to be %q, but it was %q", c.code, c.expected, got)
+			}
+		})
+	}
+
+	// Every code has a description
+	for code := range errorStrings {
+		if _, ok := errorDescriptions[code]; !ok {
+			t.Errorf("missing description for %s", code)
+		}
+	}
+}
+
 func TestDatagram_String(t *testing.T) {
 	cases := []struct {
 		name string
@@ -229,6 +269,21 @@ func TestDatagram(t *testing.T) {
 			len:    20,
 			offset: 20,
 			code:   opCodeDATA,
+			opts:   options{},
+		},
+		{
+			name: "data, null bytes",
+			dg: func() datagram {
+				dg := datagram{}
+				dg.writeData(1, make([]byte, 512))
+				return dg
+			}(),
+
+			valid:  true,
+			len:    516,
+			offset: 516,
+			code:   opCodeDATA,
+			opts:   options{},
 		},
 		{
 			name: "RRQ",
@@ -0,0 +1,44 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package trivialt
+
+import (
+	"net"
+	"syscall"
+)
+
+const dscpSupported = true
+
+// setTOS sets the traffic class octet on conn. IPv4 sockets use IP_TOS,
+// IPv6 sockets use IPV6_TCLASS and, since they may carry IPv4-mapped
+// traffic, IP_TOS on a best effort basis.
+func setTOS(conn *net.UDPConn, tos int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ipv4 := false
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		ipv4 = true
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos) // Dual-stack sockets only
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -12,7 +12,11 @@ import (
 var (
 	// errBlockSequnce is a sentinel error used internally, never returned to API clients.
 	errBlockSequence = errors.New("block sequence error")
-	// ErrInvalidURL indicates that the URL passed to Get or Put is invalid.
+	// errStoreFull is a sentinel error used internally by MemoryStore, never returned to API clients.
+	errStoreFull = errors.New("memory store full")
+	// errRxBufEmpty is a sentinel error used internally by conn's netascii decoder, never returned to API clients.
+	errRxBufEmpty = errors.New("receive buffer empty")
+	// ErrInvalidURL indicates that the URL passed to Get, Put or NewHTTPOrigin is invalid.
 	ErrInvalidURL = errors.New("invalid URL")
 	// ErrInvalidHostIP indicates an empty or invalid host.
 	ErrInvalidHostIP = errors.New("invalid host/IP")
@@ -31,12 +35,121 @@ var (
 	ErrInvalidBlocksize = errors.New("invalid blocksize: must be between 8 and 65464")
 	// ErrInvalidTimeout indicates that a timeout outside the range 1 to 255 was configured.
 	ErrInvalidTimeout = errors.New("invalid timeout: must be between 1 and 255")
+	// ErrInvalidRetransmitTimeout indicates that a retransmission timeout of zero or less was configured.
+	ErrInvalidRetransmitTimeout = errors.New("invalid timeout: must be greater than 0")
 	// ErrInvalidWindowsize indicates that a windowsize outside the range 1 to 65535 was configured.
 	ErrInvalidWindowsize = errors.New("invalid windowsize: must be between 1 and 65535")
 	// ErrInvalidMode indicates that a mode other than ModeNetASCII or ModeOctet was configured.
 	ErrInvalidMode = errors.New("invalid transfer mode: must be ModeNetASCII or ModeOctet")
 	// ErrInvalidRetransmit indicates that the retransmit limit was configured with a negative value.
 	ErrInvalidRetransmit = errors.New("invalid retransmit: cannot be negative")
+	// ErrInvalidBackoff indicates that a retransmit backoff was configured with a
+	// non-positive initial wait, a max less than initial, or a multiplier less than 1.
+	ErrInvalidBackoff = errors.New("invalid backoff: initial must be positive, max at least initial, and multiplier at least 1")
+	// ErrInvalidMaxConcurrent indicates that the concurrent transfer limit was configured with a negative value.
+	ErrInvalidMaxConcurrent = errors.New("invalid max concurrent: cannot be negative")
+	// ErrInvalidRateLimit indicates that a rate limit was configured with a negative rate or burst.
+	ErrInvalidRateLimit = errors.New("invalid rate limit: cannot be negative")
+	// ErrInvalidQueueTimeout indicates that the queue timeout was configured with a negative value.
+	ErrInvalidQueueTimeout = errors.New("invalid queue timeout: cannot be negative")
+	// ErrInvalidTransferTimeout indicates that the transfer timeout was configured with a negative value.
+	ErrInvalidTransferTimeout = errors.New("invalid transfer timeout: cannot be negative")
+	// ErrInvalidTransferDeadline indicates that the transfer deadline was configured with a negative value.
+	ErrInvalidTransferDeadline = errors.New("invalid transfer deadline: cannot be negative")
+	// ErrInvalidReloadInterval indicates that an archive reload interval was configured with a negative value.
+	ErrInvalidReloadInterval = errors.New("invalid reload interval: cannot be negative")
+	// ErrInvalidCommitDelay indicates that the write commit delay was configured with a negative value.
+	ErrInvalidCommitDelay = errors.New("invalid commit delay: cannot be negative")
+	// ErrInvalidIdleTimeout indicates that a single port or client pool idle timeout was configured with a negative value.
+	ErrInvalidIdleTimeout = errors.New("invalid idle timeout: cannot be negative")
+	// ErrInvalidQueueDepth indicates that a single port queue depth less than 1 was configured.
+	ErrInvalidQueueDepth = errors.New("invalid queue depth: must be at least 1")
+	// ErrInvalidBufferSize indicates that a socket buffer size was configured with a negative value.
+	ErrInvalidBufferSize = errors.New("invalid buffer size: cannot be negative")
+	// ErrInvalidAddress indicates that the address passed to NewServer is missing
+	// its port or the port is not a number between 0 and 65535 or a service name.
+	ErrInvalidAddress = errors.New("invalid address: must be host:port with a port between 0 and 65535")
+	// ErrInvalidInterface indicates that a configured network interface does not exist
+	// or has no address usable with the configured network.
+	ErrInvalidInterface = errors.New("invalid interface: not found or no usable address")
+	// ErrServerNotStarted indicates the server has not started serving.
+	ErrServerNotStarted = errors.New("server not started")
+	// ErrServerClosed indicates the server has been closed.
+	ErrServerClosed = errors.New("server closed")
+	// ErrServerDraining indicates the server is draining and refusing new requests.
+	ErrServerDraining = errors.New("server draining")
+	// ErrInvalidIPNet indicates that a nil network was passed to ServerAllowedNets or ServerDeniedNets.
+	ErrInvalidIPNet = errors.New("invalid network: cannot be nil")
+	// ErrInvalidListeners indicates that fewer than one listener was configured.
+	ErrInvalidListeners = errors.New("invalid listeners: must be at least 1")
+	// ErrReusePortUnsupported indicates that SO_REUSEPORT is not supported on the platform.
+	ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+	// ErrReusePortSinglePort indicates that SO_REUSEPORT was configured with single port mode.
+	ErrReusePortSinglePort = errors.New("SO_REUSEPORT cannot be used in single port mode")
+	// ErrInvalidDSCP indicates that a DSCP value outside of 0-63 was provided.
+	ErrInvalidDSCP = errors.New("DSCP must be between 0 and 63")
+	// ErrDSCPUnsupported indicates that DSCP marking is not supported on the platform.
+	ErrDSCPUnsupported = errors.New("DSCP marking is not supported on this platform")
+	// ErrJoinGroupUnsupported indicates that joining multicast groups with
+	// ServerJoinMulticastGroup is not supported on the current platform.
+	ErrJoinGroupUnsupported = errors.New("joining multicast groups is not supported on this platform")
+	// ErrInvalidGroupAddress indicates that a multicast group to join was not a multicast IP address.
+	ErrInvalidGroupAddress = errors.New("invalid multicast group: must be a multicast IP address")
+	// ErrInvalidMulticastGroup indicates that a multicast group address was not a multicast IP and port.
+	ErrInvalidMulticastGroup = errors.New("invalid multicast group: must be a multicast IP address and port")
+	// ErrNilContext indicates that a nil context was configured.
+	ErrNilContext = errors.New("invalid context: cannot be nil")
+	// ErrInvalidMaxIdle indicates that a negative ClientPoolMaxIdle was configured.
+	ErrInvalidMaxIdle = errors.New("invalid max idle: cannot be negative")
+	// ErrPoolClosed is returned by ClientPool.Get after the pool has been closed.
+	ErrPoolClosed = errors.New("client pool closed")
+	// ErrTransferTimeout indicates that a transfer was idle longer than the configured transfer
+	// or single port idle timeout.
+	ErrTransferTimeout = errors.New("transfer timeout")
+	// ErrTransferDeadline indicates that a transfer took longer than the configured transfer deadline.
+	ErrTransferDeadline = errors.New("transfer deadline exceeded")
+	// ErrInvalidChecksum indicates that an unsupported checksum algorithm was configured.
+	ErrInvalidChecksum = errors.New("invalid checksum algorithm: must be md5 or sha256")
+	// ErrChecksumNotNegotiated indicates that the server did not agree to send a checksum.
+	ErrChecksumNotNegotiated = errors.New("checksum not negotiated")
+	// ErrChecksumMismatch indicates that the checksum of the received data did not
+	// match the checksum sent by the server, or the expected checksum of a file
+	// received by a handler created by NewChecksumVerifier.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrChecksumMissing indicates that no checksum was provided for a file received
+	// by a handler requiring verification, see NewChecksumVerifier.
+	ErrChecksumMissing = errors.New("checksum missing")
+	// ErrInvalidSidecarChecksum indicates that an uploaded "<name>.sha256" file did
+	// not contain a hex encoded SHA-256 checksum.
+	ErrInvalidSidecarChecksum = errors.New("invalid sidecar checksum")
+	// ErrChecksumNotEnabled indicates that checksums were not enabled on the server.
+	ErrChecksumNotEnabled = errors.New("checksum not enabled")
+	// ErrTransferRejected is returned by ReadRequest.Write and WriteRequest.Read
+	// after the handler has rejected the transfer with WriteError or Discard.
+	ErrTransferRejected = errors.New("transfer rejected")
+	// ErrTransferComplete indicates that a transfer could not be rejected because
+	// all of the data has been received and acknowledged.
+	ErrTransferComplete = errors.New("transfer already complete")
+	// ErrTransferAborted is returned by ReadRequest.Write and WriteRequest.Read
+	// after the handler has aborted the transfer with Abort.
+	ErrTransferAborted = errors.New("transfer aborted")
+	// ErrHijacked is returned by ReadRequest.Write, WriteRequest.Read and
+	// Hijack after the handler has hijacked the transfer.
+	ErrHijacked = errors.New("transfer hijacked")
+	// ErrHijackNotSupported indicates that a transfer cannot be hijacked because
+	// it shares the server's connection in single port mode, or the request
+	// wrapped by middleware doesn't implement Hijacker.
+	ErrHijackNotSupported = errors.New("hijack not supported")
+	// ErrNilLogger indicates that a nil logger was configured.
+	ErrNilLogger = errors.New("invalid logger: cannot be nil")
+	// ErrNilConnManager indicates that a nil ConnManager was configured.
+	ErrNilConnManager = errors.New("invalid conn manager: cannot be nil")
+	// ErrInvalidMaxBytes indicates that a negative size limit was configured.
+	ErrInvalidMaxBytes = errors.New("invalid max bytes: cannot be negative")
+	// ErrNoUpstreams indicates that a Proxy was created without upstream servers.
+	ErrNoUpstreams = errors.New("no upstream servers")
+	// ErrInvalidCooldown indicates that a negative proxy upstream cooldown was configured.
+	ErrInvalidCooldown = errors.New("invalid cooldown: cannot be negative")
 	// ErrMaxRetries indicates that the maximum number of retries has been reached.
 	ErrMaxRetries = errors.New("max retries reached")
 )
@@ -58,13 +171,22 @@ func IsUnexpectedDatagram(err error) bool {
 }
 
 type errRemoteError struct {
-	dg string
+	dg  string
+	err *Error // Code and message from the ERROR datagram
 }
 
 func (e *errRemoteError) Error() string {
 	return "remote error: " + e.dg
 }
 
+// Unwrap returns the *Error sent by the remote client/server.
+func (e *errRemoteError) Unwrap() error {
+	if e.err == nil {
+		return nil
+	}
+	return e.err
+}
+
 // IsRemoteError allows a consumer to check if an error
 // was an error by the remote client/server.
 func IsRemoteError(err error) bool {
@@ -90,6 +212,33 @@ func IsOptionParsingError(err error) bool {
 	return ok
 }
 
+// Error is a TFTP ERROR, consisting of an ErrorCode and message.
+//
+// When the remote client/server sends an ERROR, the returned error wraps
+// an *Error which can be retrieved with errors.As. errors.Is reports
+// whether the code matches an ErrorCode:
+//
+//	if errors.Is(err, trivialt.ErrCodeFileNotFound) {
+//		...
+//	}
+//
+// An *Error can also be returned from a ServerRequestFilter function to
+// control the ERROR sent when a request is refused.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is an ErrorCode equal to e.Code.
+func (e *Error) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && code == e.Code
+}
+
 // tftpError wraps an error with a context message and is itself and error.
 type tftpError struct {
 	orig error
@@ -100,6 +249,11 @@ func (e *tftpError) Error() string {
 	return e.msg + ": " + e.orig.Error()
 }
 
+// Unwrap returns the wrapped error.
+func (e *tftpError) Unwrap() error {
+	return e.orig
+}
+
 // wrapError wraps an error with a contextual message.
 //
 // This is a simplistic version of github.com/pkg/errors
@@ -4,7 +4,10 @@
 
 package trivialt
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestIsUnexpectedDatagram(t *testing.T) {
 	cases := []struct {
@@ -74,6 +77,69 @@ func TestIsRemoteError(t *testing.T) {
 	}
 }
 
+func TestError(t *testing.T) {
+	remote := &errRemoteError{
+		dg:  "ERROR",
+		err: &Error{Code: ErrCodeFileNotFound, Message: "no such file"},
+	}
+
+	cases := []struct {
+		name string
+		err  error
+
+		expected *Error
+	}{
+		{
+			name:     "error",
+			err:      &Error{Code: ErrCodeFileNotFound, Message: "no such file"},
+			expected: &Error{Code: ErrCodeFileNotFound, Message: "no such file"},
+		},
+		{
+			name:     "remote error",
+			err:      remote,
+			expected: remote.err,
+		},
+		{
+			name:     "remote error, wrapped",
+			err:      wrapError(wrapError(remote, "reading data"), "reading"),
+			expected: remote.err,
+		},
+		{
+			name: "remote error, without code",
+			err:  wrapError(&errRemoteError{}, "testing"),
+		},
+		{
+			name: "other error",
+			err:  wrapError(errBlockSequence, "testing"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var tftpErr *Error
+			if ok := errors.As(c.err, &tftpErr); ok != (c.expected != nil) {
+				t.Fatalf("expected errors.As to be %t, got %t", c.expected != nil, ok)
+			}
+			if c.expected == nil {
+				if errors.Is(c.err, ErrCodeFileNotFound) {
+					t.Errorf("expected errors.Is %s to be false", ErrCodeFileNotFound)
+				}
+				return
+			}
+
+			if *tftpErr != *c.expected {
+				t.Errorf("expected %#v, got %#v", c.expected, tftpErr)
+			}
+			if !errors.Is(c.err, ErrCodeFileNotFound) {
+				t.Errorf("expected errors.Is %s to be true", ErrCodeFileNotFound)
+			}
+			if errors.Is(c.err, ErrCodeAccessViolation) {
+				t.Errorf("expected errors.Is %s to be false", ErrCodeAccessViolation)
+			}
+		})
+	}
+}
+
 func TestIsOptionParsingError(t *testing.T) {
 	cases := []struct {
 		name string
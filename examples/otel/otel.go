@@ -0,0 +1,127 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+// +build ignore
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/vcabbage/trivialt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func main() {
+	// Create a new server listening on port 6900, all interfaces, tracing
+	// transfers with the global TracerProvider. Configure an exporter
+	// (Jaeger, Zipkin, OTLP) with the OpenTelemetry SDK to collect them.
+	server, err := trivialt.NewServer(":6900", ServerWithTracer(otel.GetTracerProvider()))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Serve files from the current directory
+	fs := trivialt.FileServer(".")
+	server.ReadHandler(fs)
+	server.WriteHandler(fs)
+
+	// Start the server, if it fails error will be printed by log.Fatal
+	log.Fatal(server.ListenAndServe())
+}
+
+// ServerWithTracer wraps the server's handlers so that each transfer is
+// recorded as a span named "tftp.read" or "tftp.write". The span ends when
+// the handler returns and the span's context is available from the
+// request's Context method.
+func ServerWithTracer(tp trace.TracerProvider) trivialt.ServerOpt {
+	tracer := tp.Tracer("github.com/vcabbage/trivialt")
+
+	readMW := func(h trivialt.ReadHandler) trivialt.ReadHandler {
+		return trivialt.ReadHandlerFunc(func(w trivialt.ReadRequest) {
+			ctx, span := startSpan(tracer, w.Context(), "tftp.read", w.Addr().IP.String(), w.Name(), w.TransferMode())
+			defer span.End()
+
+			h.ServeTFTP(&tracedReadRequest{ReadRequest: w, ctx: ctx, span: span})
+		})
+	}
+	writeMW := func(h trivialt.WriteHandler) trivialt.WriteHandler {
+		return trivialt.WriteHandlerFunc(func(w trivialt.WriteRequest) {
+			ctx, span := startSpan(tracer, w.Context(), "tftp.write", w.Addr().IP.String(), w.Name(), w.TransferMode())
+			defer span.End()
+			if size, err := w.Size(); err == nil {
+				span.SetAttributes(attribute.Int64("tftp.tsize", size))
+			}
+
+			h.ReceiveTFTP(&tracedWriteRequest{WriteRequest: w, ctx: ctx, span: span})
+		})
+	}
+
+	return func(s *trivialt.Server) error {
+		if err := trivialt.ServerReadMiddleware(readMW)(s); err != nil {
+			return err
+		}
+		return trivialt.ServerWriteMiddleware(writeMW)(s)
+	}
+}
+
+func startSpan(tracer trace.Tracer, ctx context.Context, name, client, filename string, mode trivialt.TransferMode) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("net.peer.ip", client),
+			attribute.String("tftp.filename", filename),
+			attribute.String("tftp.mode", string(mode)),
+		),
+	)
+}
+
+// tracedReadRequest records errors on the span.
+type tracedReadRequest struct {
+	trivialt.ReadRequest
+	ctx  context.Context
+	span trace.Span
+}
+
+func (r *tracedReadRequest) Context() context.Context { return r.ctx }
+
+func (r *tracedReadRequest) Write(p []byte) (int, error) {
+	n, err := r.ReadRequest.Write(p)
+	if err != nil {
+		r.span.SetStatus(codes.Error, err.Error())
+	}
+	return n, err
+}
+
+func (r *tracedReadRequest) WriteError(code trivialt.ErrorCode, msg string) {
+	r.span.SetStatus(codes.Error, msg)
+	r.ReadRequest.WriteError(code, msg)
+}
+
+// tracedWriteRequest records errors on the span.
+type tracedWriteRequest struct {
+	trivialt.WriteRequest
+	ctx  context.Context
+	span trace.Span
+}
+
+func (r *tracedWriteRequest) Context() context.Context { return r.ctx }
+
+func (r *tracedWriteRequest) Read(p []byte) (int, error) {
+	n, err := r.WriteRequest.Read(p)
+	if err != nil && err != io.EOF {
+		r.span.SetStatus(codes.Error, err.Error())
+	}
+	return n, err
+}
+
+func (r *tracedWriteRequest) WriteError(code trivialt.ErrorCode, msg string) {
+	r.span.SetStatus(codes.Error, msg)
+	r.WriteRequest.WriteError(code, msg)
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+// +build ignore
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vcabbage/trivialt"
+)
+
+func main() {
+	// Create a new server listening on port 6900, all interfaces,
+	// recording metrics in the default registry.
+	server, err := trivialt.NewServer(":6900", ServerWithPrometheus(prometheus.DefaultRegisterer))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Serve files from the current directory
+	fs := trivialt.FileServer(".")
+	server.ReadHandler(fs)
+	server.WriteHandler(fs)
+
+	// Expose metrics for scraping on port 9100
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Fatal(http.ListenAndServe(":9100", nil))
+	}()
+
+	// Start the server, if it fails error will be printed by log.Fatal
+	log.Fatal(server.ListenAndServe())
+}
+
+// ServerWithPrometheus registers TFTP metrics with reg and
+// configures the server to record them.
+func ServerWithPrometheus(reg prometheus.Registerer) trivialt.ServerOpt {
+	m := &promMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tftp_requests_total",
+			Help: "Total TFTP requests by operation and status.",
+		}, []string{"op", "status"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tftp_bytes_transferred_total",
+			Help: "Total bytes transferred by operation.",
+		}, []string{"op"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tftp_transfer_duration_seconds",
+			Help:    "Duration of TFTP transfers by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tftp_active_transfers",
+			Help: "Number of transfers in progress.",
+		}),
+	}
+	reg.MustRegister(m.requests, m.bytes, m.duration, m.active)
+
+	return trivialt.ServerMetrics(m)
+}
+
+// promMetrics implements trivialt.Metrics.
+type promMetrics struct {
+	requests *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	active   prometheus.Gauge
+}
+
+func (m *promMetrics) TransferStarted(op string) {
+	m.active.Inc()
+}
+
+func (m *promMetrics) TransferFinished(op string, bytes int64, duration time.Duration, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	m.active.Dec()
+	m.requests.WithLabelValues(op, status).Inc()
+	m.bytes.WithLabelValues(op).Add(float64(bytes))
+	m.duration.WithLabelValues(op).Observe(duration.Seconds())
+}
@@ -5,12 +5,18 @@
 package trivialt
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"io/ioutil"
 	"net"
-	"os"
-	"path/filepath"
+	"net/netip"
+	"path"
+	"strings"
 )
 
 // ReadHandler responds to a TFTP read request.
@@ -31,37 +37,164 @@ type ReadWriteHandler interface {
 
 // WriteRequest is provided to a WriteHandler's ReceiveTFTP method.
 type WriteRequest interface {
-	// Addr is the network address of the client.
+	// Addr is the network address of the client. It is derived from
+	// AddrPort and kept for compatibility.
 	Addr() *net.UDPAddr
 
+	// AddrPort is the network address of the client. IPv4 addresses
+	// are never returned in IPv4-mapped IPv6 form.
+	AddrPort() netip.AddrPort
+
+	// LocalAddr is the local network address used for the transfer,
+	// its TID. In single port mode it is the server's listening address.
+	LocalAddr() *net.UDPAddr
+
+	// ID is a unique identifier for the transfer, assigned by the
+	// server when the request is dispatched. It is included in the
+	// server's log messages for the transfer.
+	ID() uint64
+
+	// Stats returns the transfer's counters so far. Once the handler
+	// has returned the transfer has finished and Stats reports its
+	// final state, including whether the last block was received. Before
+	// then, Stats must only be called from the handler's goroutine.
+	//
+	// Bytes is the number of bytes read so far, and Rate the average
+	// rate they have been received at.
+	Stats() TransferStats
+
 	// Name is the file name provided by the client.
 	Name() string
 
 	// Read reads the request data from the client.
+	//
+	// If the client aborts the transfer with an ERROR, the error
+	// returned is an *Error with the client's code and message. Data
+	// received before the ERROR is returned with it.
 	Read([]byte) (int, error)
 
+	// Peek returns the next n bytes of the request data without
+	// consuming them, subsequent reads return them first. If fewer than
+	// n bytes are returned, the error explains why, io.EOF if the file
+	// is shorter than n. Like Read, Peek accepts the transfer.
+	Peek(n int) ([]byte, error)
+
 	// Size returns the transfer size (tsize) as provided by the client.
 	// If the tsize option was not negotiated, an error will be returned.
+	// A zero size with a nil error is an empty upload.
 	Size() (int64, error)
 
+	// SizeKnown reports whether the client provided the transfer size,
+	// in which case Size returns it without error.
+	SizeKnown() bool
+
 	// WriteError sends an error to the client and terminates the
-	// connection. WriteError can only be called once. Read cannot
-	// be called after an error has been written.
+	// connection. WriteError can only be called once. Subsequent
+	// calls to Read return ErrTransferRejected.
+	//
+	// The ACK or OACK accepting the request is sent on the first call
+	// to Read. If WriteError is called before Read, the client receives
+	// only the ERROR, even if it requested options. A handler can accept
+	// the request before reading any data by calling Read with an empty
+	// buffer.
 	WriteError(ErrorCode, string)
 
+	// Abort sends an ERROR with code and msg to the client, ending the
+	// transfer immediately. Subsequent calls to Read return
+	// ErrTransferAborted. Abort has no effect once the transfer is
+	// complete or has failed.
+	Abort(code ErrorCode, msg string)
+
+	// Discard rejects the transfer, sending an access violation error
+	// to the client. It allows a handler to refuse a file after
+	// inspecting the start of it.
+	//
+	// The remaining data is received and discarded, the error is sent in
+	// place of the final ACK so that the client doesn't time out. Before
+	// the request has been accepted by Read, the error is sent
+	// immediately. If the final block has already been received,
+	// ErrTransferComplete is returned.
+	Discard() error
+
 	// TransferMode returns the TFTP transfer mode requested by the client.
 	TransferMode() TransferMode
+
+	// Options returns the options (RFC2347) sent by the client in the
+	// request, keyed by option name. The values are as requested, the
+	// server may have negotiated different values.
+	Options() map[string]string
+
+	// BlockSize returns the block size (RFC2348) negotiated with the
+	// client, or 512 if blksize was not negotiated.
+	BlockSize() int
+
+	// WindowSize returns the window size (RFC7440) negotiated with the
+	// client, or 1 if windowsize was not negotiated.
+	WindowSize() int
+
+	// Context returns the request's context. It is canceled when the
+	// transfer ends, including when the client sends an error, stops
+	// responding, or the server is closed.
+	Context() context.Context
+
+	// Checksum returns the checksum of the data received, using the
+	// algorithm configured with ServerChecksumVerify. It is complete
+	// once Read has returned io.EOF.
+	//
+	// If ServerChecksumVerify was not configured, ErrChecksumNotEnabled
+	// is returned.
+	Checksum() ([]byte, error)
 }
 
 // writeRequest implements WriteRequest.
 type writeRequest struct {
 	conn *conn
 
-	name string
+	name   string
+	opts   options       // Options from the request datagram
+	peeked *bufio.Reader // Buffers data returned by Peek, nil until Peek is called
 }
 
 func (w *writeRequest) Addr() *net.UDPAddr {
-	return w.conn.remoteAddr.(*net.UDPAddr)
+	return net.UDPAddrFromAddrPort(w.AddrPort())
+}
+
+func (w *writeRequest) AddrPort() netip.AddrPort {
+	return addrKey(w.conn.remoteAddr.(*net.UDPAddr))
+}
+
+func (w *writeRequest) LocalAddr() *net.UDPAddr {
+	return localUDPAddr(w.conn.netConn)
+}
+
+func (w *writeRequest) ID() uint64 {
+	return w.conn.id
+}
+
+func (w *writeRequest) Stats() TransferStats {
+	return w.conn.currentStats()
+}
+
+func (w *writeRequest) Hijack() (net.PacketConn, *net.UDPAddr, error) {
+	return w.conn.hijack()
+}
+
+func (w *writeRequest) setUpstream(host string) {
+	w.conn.upstream = host
+}
+
+func (w *writeRequest) setFailure(err error) {
+	w.conn.failure = err
+}
+
+func (w *writeRequest) BlockSize() int {
+	blksize, _ := w.conn.negotiated()
+	return int(blksize)
+}
+
+func (w *writeRequest) WindowSize() int {
+	_, windowsize := w.conn.negotiated()
+	return int(windowsize)
 }
 
 func (w *writeRequest) Name() string {
@@ -69,46 +202,232 @@ func (w *writeRequest) Name() string {
 }
 
 func (w *writeRequest) Read(p []byte) (int, error) {
+	if w.peeked != nil && w.peeked.Buffered() > 0 {
+		return w.peeked.Read(p)
+	}
 	return w.conn.Read(p)
 }
 
+func (w *writeRequest) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+	if w.peeked == nil || w.peeked.Size() < n {
+		// Hide WriteTo from bufio
+		var r io.Reader = struct{ io.Reader }{w.conn}
+		if w.peeked != nil && w.peeked.Buffered() > 0 {
+			// Carry over previously peeked data
+			buffered, _ := w.peeked.Peek(w.peeked.Buffered())
+			r = io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), r)
+		}
+		w.peeked = bufio.NewReaderSize(r, n)
+	}
+	return w.peeked.Peek(n)
+}
+
+// WriteTo implements io.WriterTo, writing the data received from the
+// client to dst until the transfer is complete.
+//
+// In octet mode blocks are written to dst as they're received and
+// ACKed once written. If a write to dst fails the block isn't ACKed,
+// WriteError can still be used to notify the client.
+func (w *writeRequest) WriteTo(dst io.Writer) (int64, error) {
+	var peeked int64
+	if w.peeked != nil && w.peeked.Buffered() > 0 {
+		// Only write the buffered data, the remainder is
+		// written directly from the conn
+		buffered, _ := w.peeked.Peek(w.peeked.Buffered())
+		n, err := dst.Write(buffered)
+		w.peeked.Discard(n)
+		if err != nil {
+			return int64(n), err
+		}
+		peeked = int64(n)
+	}
+	n, err := w.conn.WriteTo(dst)
+	return peeked + n, err
+}
+
 func (w *writeRequest) Size() (int64, error) {
-	if w.conn.tsize == nil {
+	tsize := w.conn.transferSize()
+	if tsize == nil {
 		return 0, ErrSizeNotReceived
 	}
-	return *w.conn.tsize, nil
+	return *tsize, nil
+}
+
+func (w *writeRequest) SizeKnown() bool {
+	return w.conn.transferSize() != nil
 }
 
 func (w *writeRequest) WriteError(c ErrorCode, s string) {
+	w.reject(c, s)
+}
+
+// reject sends an error to the client and fails subsequent reads.
+func (w *writeRequest) reject(c ErrorCode, s string) {
 	w.conn.sendError(c, s)
+	if w.conn.err == nil {
+		w.conn.err = ErrTransferRejected
+	}
+}
+
+func (w *writeRequest) Abort(c ErrorCode, s string) {
+	if w.conn.done || w.conn.err != nil {
+		return
+	}
+	w.conn.sendError(c, s)
+	w.conn.err = ErrTransferAborted
+}
+
+func (w *writeRequest) Discard() error {
+	if w.conn.done {
+		return ErrTransferComplete
+	}
+	if !w.conn.optionsParsed {
+		// Not accepted yet, there's nothing to drain
+		w.reject(ErrCodeAccessViolation, "transfer rejected")
+		return nil
+	}
+	w.conn.discard = true
+	_, err := w.WriteTo(ioutil.Discard)
+	if err == nil {
+		return ErrTransferComplete
+	}
+	if ErrorCause(err) != ErrTransferRejected {
+		return err
+	}
+	return nil
 }
 
 func (w *writeRequest) TransferMode() TransferMode {
 	return w.conn.mode
 }
 
+func (w *writeRequest) Options() map[string]string {
+	opts := make(map[string]string, len(w.opts))
+	for k, v := range w.opts {
+		opts[k] = v
+	}
+	return opts
+}
+
+func (w *writeRequest) Context() context.Context {
+	return w.conn.ctx
+}
+
+func (w *writeRequest) Checksum() ([]byte, error) {
+	if w.conn.hash == nil {
+		return nil, ErrChecksumNotEnabled
+	}
+	return w.conn.hash.Sum(nil), nil
+}
+
+// Hijacker is implemented by the ReadRequest and WriteRequest provided
+// to handlers, allowing a handler to take over a transfer to implement
+// protocol extensions. Transfers in single port mode cannot be hijacked.
+type Hijacker interface {
+	// Hijack passes ownership of the transfer's connection to the
+	// caller, returning the connection and the client's address. The
+	// server will not read from, write to or close the connection, and
+	// subsequent calls to Read and Write return ErrHijacked. The caller
+	// is responsible for sending any remaining datagrams, including the
+	// final ACK or an ERROR, and closing the connection.
+	//
+	// The request is acknowledged on the first Read or Write, if Hijack
+	// is called before then nothing has been sent to the client. Data
+	// buffered by earlier calls to Read or Write is discarded. Deadlines
+	// on the connection are cleared.
+	//
+	// The transfer is counted as completed once the handler returns.
+	Hijack() (net.PacketConn, *net.UDPAddr, error)
+}
+
 // ReadRequest is provided to a ReadHandler's ServeTFTP method.
 type ReadRequest interface {
-	// Addr is the network address of the client.
+	// Addr is the network address of the client. It is derived from
+	// AddrPort and kept for compatibility.
 	Addr() *net.UDPAddr
 
+	// AddrPort is the network address of the client. IPv4 addresses
+	// are never returned in IPv4-mapped IPv6 form.
+	AddrPort() netip.AddrPort
+
+	// LocalAddr is the local network address used for the transfer,
+	// its TID. In single port mode it is the server's listening address.
+	LocalAddr() *net.UDPAddr
+
+	// ID is a unique identifier for the transfer, assigned by the
+	// server when the request is dispatched. It is included in the
+	// server's log messages for the transfer.
+	ID() uint64
+
+	// Stats returns the transfer's counters so far. Once the handler
+	// has returned the transfer has finished and Stats reports its
+	// final state, including whether the last block was acknowledged. Before
+	// then, Stats must only be called from the handler's goroutine.
+	//
+	// Bytes is the number of bytes written so far, and Rate the
+	// average rate they have been sent at.
+	Stats() TransferStats
+
 	// Name is the file name requested by the client.
 	Name() string
 
 	// Write write's data to the client.
+	//
+	// If the client aborts the transfer with an ERROR, the error
+	// returned is an *Error with the client's code and message.
 	Write([]byte) (int, error)
 
 	// WriteError sends an error to the client and terminates the
-	// connection. WriteError can only be called once. Write cannot
-	// be called after an error has been written.
+	// connection. WriteError can only be called once. Subsequent
+	// calls to Write return ErrTransferRejected and no further data
+	// is sent, allowing a handler to reject the request after it has
+	// started, such as when authentication fails.
 	WriteError(ErrorCode, string)
 
+	// Abort sends an ERROR with code and msg to the client, ending the
+	// transfer immediately. Subsequent calls to Write return
+	// ErrTransferAborted. Abort has no effect if the transfer has
+	// already failed.
+	//
+	// If the handler returns after writing less than the size set with
+	// WriteSize, the transfer is aborted with ErrCodeNotDefined rather
+	// than completed with a truncated file.
+	Abort(code ErrorCode, msg string)
+
 	// WriteSize sets the transfer size (tsize) value to be sent to
 	// the client. It must be called before any calls to Write.
+	//
+	// If the client requested tsize, the value will be included in
+	// the OACK. If WriteSize is not called, tsize is omitted from the OACK.
+	//
+	// Handlers that send a file or io.Seeker with io.Copy don't need to
+	// call WriteSize, the server's ReadRequest implements io.ReaderFrom
+	// and determines the size from the source.
 	WriteSize(int64)
 
 	// TransferMode returns the TFTP transfer mode requested by the client.
 	TransferMode() TransferMode
+
+	// Options returns the options (RFC2347) sent by the client in the
+	// request, keyed by option name. The values are as requested, the
+	// server may have negotiated different values.
+	Options() map[string]string
+
+	// BlockSize returns the block size (RFC2348) negotiated with the
+	// client, or 512 if blksize was not negotiated.
+	BlockSize() int
+
+	// WindowSize returns the window size (RFC7440) negotiated with the
+	// client, or 1 if windowsize was not negotiated.
+	WindowSize() int
+
+	// Context returns the request's context. It is canceled when the
+	// transfer ends, including when the client sends an error, stops
+	// responding, or the server is closed.
+	Context() context.Context
 }
 
 // readRequest implements ReadRequest.
@@ -116,10 +435,49 @@ type readRequest struct {
 	conn *conn
 
 	name string
+	opts options // Options from the request datagram
 }
 
 func (w *readRequest) Addr() *net.UDPAddr {
-	return w.conn.remoteAddr.(*net.UDPAddr)
+	return net.UDPAddrFromAddrPort(w.AddrPort())
+}
+
+func (w *readRequest) AddrPort() netip.AddrPort {
+	return addrKey(w.conn.remoteAddr.(*net.UDPAddr))
+}
+
+func (w *readRequest) LocalAddr() *net.UDPAddr {
+	return localUDPAddr(w.conn.netConn)
+}
+
+func (w *readRequest) ID() uint64 {
+	return w.conn.id
+}
+
+func (w *readRequest) Stats() TransferStats {
+	return w.conn.currentStats()
+}
+
+func (w *readRequest) Hijack() (net.PacketConn, *net.UDPAddr, error) {
+	return w.conn.hijack()
+}
+
+func (w *readRequest) setUpstream(host string) {
+	w.conn.upstream = host
+}
+
+func (w *readRequest) addRateLimit(b *tokenBucket) {
+	w.conn.limiters = append(w.conn.limiters, b)
+}
+
+func (w *readRequest) BlockSize() int {
+	blksize, _ := w.conn.negotiated()
+	return int(blksize)
+}
+
+func (w *readRequest) WindowSize() int {
+	_, windowsize := w.conn.negotiated()
+	return int(windowsize)
 }
 
 func (w *readRequest) Name() string {
@@ -132,64 +490,254 @@ func (w *readRequest) Write(p []byte) (int, error) {
 
 func (w *readRequest) WriteError(c ErrorCode, s string) {
 	w.conn.sendError(c, s)
+	if w.conn.err == nil {
+		w.conn.err = ErrTransferRejected
+	}
+}
+
+func (w *readRequest) Abort(c ErrorCode, s string) {
+	if w.conn.err != nil {
+		return
+	}
+	w.conn.sendError(c, s)
+	w.conn.err = ErrTransferAborted
+}
+
+// finish aborts the transfer if the handler has returned after writing
+// less than the size set with WriteSize.
+func (w *readRequest) finish() {
+	c := w.conn
+	if c.err == nil && c.sentErr == nil && c.tsize != nil && c.total < *c.tsize {
+		c.log.debug("Handler wrote %d of %d bytes, aborting transfer", c.total, *c.tsize)
+		w.Abort(ErrCodeNotDefined, "transfer incomplete")
+	}
 }
 
 func (w *readRequest) WriteSize(i int64) {
 	w.conn.tsize = &i
 }
 
+// ReadFrom implements io.ReaderFrom, sending the contents of r to the client.
+//
+// If the client requested tsize, WriteSize has not been called, and
+// nothing has been written, tsize is set to the remaining size of r
+// when r has a Stat method reporting a regular file or implements
+// io.Seeker. Otherwise tsize is omitted.
+func (w *readRequest) ReadFrom(r io.Reader) (int64, error) {
+	if _, ok := w.opts[optTransferSize]; ok && w.conn.tsize == nil && !w.conn.optionsParsed {
+		if size, ok := readerSize(r); ok {
+			w.WriteSize(size)
+		}
+	}
+	return w.conn.ReadFrom(r)
+}
+
+// readerSize returns the number of bytes remaining in r, if it
+// can be determined without reading.
+func readerSize(r io.Reader) (int64, bool) {
+	if s, ok := r.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if fi, err := s.Stat(); err == nil && fi.Mode().IsRegular() {
+			if sk, ok := r.(io.Seeker); ok {
+				// Account for data that has already been read
+				if off, err := sk.Seek(0, io.SeekCurrent); err == nil && off <= fi.Size() {
+					return fi.Size() - off, true
+				}
+			}
+			return fi.Size(), true
+		}
+	}
+	sk, ok := r.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	off, err := sk.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	end, err := sk.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := sk.Seek(off, io.SeekStart); err != nil {
+		return 0, false
+	}
+	if end < off {
+		return 0, true
+	}
+	return end - off, true
+}
+
 func (w *readRequest) TransferMode() TransferMode {
 	return w.conn.mode
 }
 
-// FileServer creates a handler for sending and reciving files on the filesystem.
-func FileServer(dir string) ReadWriteHandler {
-	return &fileServer{path: dir, log: newLogger("fileserver")}
+func (w *readRequest) Options() map[string]string {
+	opts := make(map[string]string, len(w.opts))
+	for k, v := range w.opts {
+		opts[k] = v
+	}
+	return opts
 }
 
-type fileServer struct {
-	log  *logger
-	path string
+func (w *readRequest) Context() context.Context {
+	return w.conn.ctx
 }
 
-// ServeTFTP serves files rooted at the configured directory.
-//
-// If the file does not exist or otherwise cannot be opened, a File Not Found
-// error will be sent.
-func (f *fileServer) ServeTFTP(w ReadRequest) {
-	path := filepath.Join(f.path, filepath.Clean(w.Name()))
+// FileServer creates a handler for sending and receiving files in the
+// directory dir. It is shorthand for NewStoreHandler(OSDirStore(dir), opts...).
+func FileServer(dir string, opts ...FileServerOpt) ReadWriteHandler {
+	return NewStoreHandler(OSDirStore(dir), opts...)
+}
 
-	file, err := os.Open(path)
-	if err != nil {
-		log.Println(err)
-		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
-		return
+// FileServerOpt is a function that configures a handler created by
+// FileServer, FileServerRead or NewStoreHandler.
+type FileServerOpt func(*fileServerHooks)
+
+// fileServerHooks are called by file server handlers before an error
+// is sent to the client.
+type fileServerHooks struct {
+	onNotFound     func(filename, clientAddr string)
+	onAccessDenied func(filename, clientAddr string)
+}
+
+// FileServerNotFoundHook configures fn to be called when a requested file
+// does not exist. It is called synchronously before the File Not Found
+// error is sent.
+func FileServerNotFoundHook(fn func(filename, clientAddr string)) FileServerOpt {
+	return func(h *fileServerHooks) {
+		h.onNotFound = fn
 	}
-	defer errorDefer(file.Close, f.log, "error closing file")
+}
 
-	finfo, _ := file.Stat()
-	w.WriteSize(finfo.Size())
-	if _, err = io.Copy(w, file); err != nil {
-		log.Println(err)
+// FileServerAccessDeniedHook configures fn to be called when a file cannot
+// be accessed due to permissions. It is called synchronously before the
+// Access Violation error is sent.
+func FileServerAccessDeniedHook(fn func(filename, clientAddr string)) FileServerOpt {
+	return func(h *fileServerHooks) {
+		h.onAccessDenied = fn
+	}
+}
+
+// notFound calls the not found hook, if configured.
+func (h *fileServerHooks) notFound(name string, addr *net.UDPAddr) {
+	if h.onNotFound != nil {
+		h.onNotFound(name, addr.String())
+	}
+}
+
+// accessDenied calls the access denied hook, if configured.
+func (h *fileServerHooks) accessDenied(name string, addr *net.UDPAddr) {
+	if h.onAccessDenied != nil {
+		h.onAccessDenied(name, addr.String())
 	}
 }
 
-// ReceiveTFTP writes received files to the configured directory.
+// FileServerRead creates a handler for sending files from fsys, such as
+// an embed.FS or os.DirFS.
 //
-// If the file cannot be created an Access Violation error will be sent.
-func (f *fileServer) ReceiveTFTP(r WriteRequest) {
-	path := filepath.Join(f.path, filepath.Clean(r.Name()))
+// Requested names are cleaned and a leading slash is removed before
+// opening. If the file does not exist a File Not Found error is sent,
+// if it cannot be opened due to permissions an Access Violation error
+// is sent. Hooks can be configured with FileServerOpts.
+func FileServerRead(fsys fs.FS, opts ...FileServerOpt) ReadHandler {
+	f := &fsServer{fsys: fsys, log: newLogger("fileserver")}
+	for _, opt := range opts {
+		opt(&f.hooks)
+	}
+	return f
+}
+
+type fsServer struct {
+	log    *logger
+	fsys   fs.FS
+	hooks  fileServerHooks
+	strict bool // Refuse invalid names rather than cleaning them
+}
+
+// NewFileServerFS creates a handler for sending files from fsys, such as
+// an embed.FS.
+//
+// Unlike FileServerRead, requested names are not cleaned. Names that are
+// not valid fs.FS paths, including those containing "..", a leading
+// slash, or a backslash, are refused with an Access Violation error.
+//
+// Write requests are refused with an Illegal Operation error unless fsys
+// also implements WritableFS, in which case files are received as by
+// DirWriteServer.
+func NewFileServerFS(fsys fs.FS, opts ...FileServerOpt) ReadWriteHandler {
+	f := &fsFileServer{fsServer: fsServer{fsys: fsys, strict: true, log: newLogger("fileserver")}}
+	for _, opt := range opts {
+		opt(&f.hooks)
+	}
+	if wfs, ok := fsys.(WritableFS); ok {
+		f.wh = DirWriteServer(wfs)
+	}
+	return f
+}
 
-	file, err := os.Create(path)
+// fsFileServer is an fsServer that also handles write requests.
+type fsFileServer struct {
+	fsServer
+	wh WriteHandler // nil if fsys isn't writable
+}
+
+// ReceiveTFTP receives files into the configured fs.FS, if it is writable.
+func (f *fsFileServer) ReceiveTFTP(w WriteRequest) {
+	if f.wh == nil {
+		w.WriteError(ErrCodeIllegalOperation, "Server does not support write requests.")
+		return
+	}
+	if !validFSName(w.Name()) {
+		f.hooks.accessDenied(w.Name(), w.Addr())
+		w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Invalid file name %q", w.Name()))
+		return
+	}
+	f.wh.ReceiveTFTP(w)
+}
+
+// validFSName reports whether name can be opened from an fs.FS without
+// modification. Backslashes are refused as some clients use them as
+// path separators.
+func validFSName(name string) bool {
+	return fs.ValidPath(name) && !strings.Contains(name, `\`)
+}
+
+// ServeTFTP serves files from the configured fs.FS.
+func (f *fsServer) ServeTFTP(w ReadRequest) {
+	name := strings.TrimPrefix(path.Clean("/"+w.Name()), "/")
+	if f.strict {
+		if name = w.Name(); !validFSName(name) {
+			f.hooks.accessDenied(name, w.Addr())
+			w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Invalid file name %q", name))
+			return
+		}
+	}
+
+	file, err := f.fsys.Open(name)
 	if err != nil {
-		log.Println(err)
-		r.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Cannot create file %q", filepath.Clean(r.Name())))
+		f.log.debug("opening %q: %v", name, err)
+		switch {
+		case errors.Is(err, fs.ErrPermission):
+			f.hooks.accessDenied(w.Name(), w.Addr())
+			w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Cannot read file %q", w.Name()))
+		default:
+			f.hooks.notFound(w.Name(), w.Addr())
+			w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+		}
+		return
 	}
 	defer errorDefer(file.Close, f.log, "error closing file")
 
-	_, err = io.Copy(file, r)
-	if err != nil {
-		log.Println(err)
+	finfo, err := file.Stat()
+	if err != nil || finfo.IsDir() {
+		f.hooks.notFound(w.Name(), w.Addr())
+		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+		return
+	}
+
+	w.WriteSize(finfo.Size())
+	if _, err = io.Copy(w, file); err != nil {
+		f.log.debug("sending %q: %v", name, err)
 	}
 }
 
@@ -6,11 +6,16 @@ package trivialt
 
 import (
 	"bytes"
+	"context"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"net"
+	"net/netip"
 	"path/filepath"
 	"reflect"
 	"testing"
+	"testing/fstest"
 )
 
 type readRequestMock struct {
@@ -24,6 +29,10 @@ type readRequestMock struct {
 }
 
 func (r *readRequestMock) Addr() *net.UDPAddr          { return r.addr }
+func (r *readRequestMock) AddrPort() netip.AddrPort    { return addrKey(r.addr) }
+func (r *readRequestMock) LocalAddr() *net.UDPAddr     { return nil }
+func (r *readRequestMock) Stats() TransferStats        { return TransferStats{} }
+func (r *readRequestMock) ID() uint64                  { return 0 }
 func (r *readRequestMock) Name() string                { return r.name }
 func (r *readRequestMock) Write(p []byte) (int, error) { return r.writer.Write(p) }
 func (r *readRequestMock) WriteSize(i int64)           { r.size = &i }
@@ -31,7 +40,12 @@ func (r *readRequestMock) WriteError(c ErrorCode, m string) {
 	r.errCode = c
 	r.errMsg = m
 }
-func (r *readRequestMock) TransferMode() TransferMode { return r.tmode }
+func (r *readRequestMock) Abort(c ErrorCode, m string) { r.WriteError(c, m) }
+func (r *readRequestMock) TransferMode() TransferMode  { return r.tmode }
+func (r *readRequestMock) Options() map[string]string  { return nil }
+func (r *readRequestMock) BlockSize() int              { return 512 }
+func (r *readRequestMock) WindowSize() int             { return 1 }
+func (r *readRequestMock) Context() context.Context    { return context.Background() }
 
 func TestFileServer_ServeTFTP(t *testing.T) {
 	text := getTestData(t, "text")
@@ -96,6 +110,273 @@ func TestFileServer_ServeTFTP(t *testing.T) {
 	}
 }
 
+func TestFileServerRead(t *testing.T) {
+	data := []byte("firmware image")
+	fsys := permissionFS{
+		MapFS: fstest.MapFS{
+			"firmware/v1.img": &fstest.MapFile{Data: data},
+		},
+		denied: "firmware/secret.img",
+	}
+
+	cases := []struct {
+		name    string
+		reqName string
+
+		expectedData      []byte
+		expectedSize      *int64
+		expectedErrorCode ErrorCode
+		expectedHook      string
+	}{
+		{
+			name:    "file exists",
+			reqName: "firmware/v1.img",
+
+			expectedData: data,
+			expectedSize: ptrInt64(int64(len(data))),
+		},
+		{
+			name:    "leading slash",
+			reqName: "/firmware/v1.img",
+
+			expectedData: data,
+			expectedSize: ptrInt64(int64(len(data))),
+		},
+		{
+			name:    "does not exist",
+			reqName: "firmware/v2.img",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+			expectedHook:      "not found",
+		},
+		{
+			name:    "directory",
+			reqName: "firmware",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+			expectedHook:      "not found",
+		},
+		{
+			name:    "outside root",
+			reqName: "../firmware/v1.img",
+
+			expectedData: data,
+			expectedSize: ptrInt64(int64(len(data))),
+		},
+		{
+			name:    "permission denied",
+			reqName: "firmware/secret.img",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+			expectedHook:      "access denied",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := readRequestMock{name: c.reqName, addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2000}}
+
+			var hook string
+			record := func(name string) func(string, string) {
+				return func(filename, clientAddr string) {
+					if filename != c.reqName || clientAddr != "192.0.2.1:2000" {
+						t.Errorf("unexpected hook arguments %q, %q", filename, clientAddr)
+					}
+					if req.errCode != 0 {
+						t.Error("expected hook to be called before the error was sent")
+					}
+					hook = name
+				}
+			}
+
+			FileServerRead(fsys,
+				FileServerNotFoundHook(record("not found")),
+				FileServerAccessDeniedHook(record("access denied")),
+			).ServeTFTP(&req)
+
+			if !reflect.DeepEqual(c.expectedData, req.writer.Bytes()) {
+				t.Errorf("expected data to be %q, but it was %q", c.expectedData, req.writer.Bytes())
+			}
+			if !reflect.DeepEqual(c.expectedSize, req.size) {
+				t.Errorf("expected size to be %v, but it was %v", c.expectedSize, req.size)
+			}
+			if c.expectedErrorCode != req.errCode {
+				t.Errorf("expected error code to be %s, but it was %s", c.expectedErrorCode, req.errCode)
+			}
+			if c.expectedHook != hook {
+				t.Errorf("expected hook %q to be called, got %q", c.expectedHook, hook)
+			}
+		})
+	}
+}
+
+func TestNewFileServerFS(t *testing.T) {
+	data := []byte("kernel image")
+	fsys := fstest.MapFS{
+		"boot/vmlinuz": &fstest.MapFile{Data: data},
+		"boot/empty":   &fstest.MapFile{},
+	}
+
+	cases := []struct {
+		name    string
+		reqName string
+
+		expectedData      []byte
+		expectedSize      *int64
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:    "file exists",
+			reqName: "boot/vmlinuz",
+
+			expectedData: data,
+			expectedSize: ptrInt64(int64(len(data))),
+		},
+		{
+			name:    "empty file",
+			reqName: "boot/empty",
+
+			expectedSize: ptrInt64(0),
+		},
+		{
+			name:    "does not exist",
+			reqName: "boot/initrd",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+		{
+			name:    "directory",
+			reqName: "boot",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+		{
+			name:    "parent directory",
+			reqName: "../boot/vmlinuz",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+		{
+			name:    "parent directory, inner",
+			reqName: "boot/../boot/vmlinuz",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+		{
+			name:    "absolute",
+			reqName: "/boot/vmlinuz",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+		{
+			name:    "backslash",
+			reqName: `boot\vmlinuz`,
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+		{
+			name:    "backslash traversal",
+			reqName: `..\boot\vmlinuz`,
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := readRequestMock{name: c.reqName}
+
+			NewFileServerFS(fsys).ServeTFTP(&req)
+
+			if !bytes.Equal(c.expectedData, req.writer.Bytes()) {
+				t.Errorf("expected data to be %q, but it was %q", c.expectedData, req.writer.Bytes())
+			}
+			if !reflect.DeepEqual(c.expectedSize, req.size) {
+				t.Errorf("expected size to be %v, but it was %v", c.expectedSize, req.size)
+			}
+			if c.expectedErrorCode != req.errCode {
+				t.Errorf("expected error code to be %s, but it was %s", c.expectedErrorCode, req.errCode)
+			}
+		})
+	}
+}
+
+func TestNewFileServerFS_write(t *testing.T) {
+	data := []byte("uploaded")
+
+	cases := []struct {
+		name    string
+		fsys    fs.FS
+		reqName string
+
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:    "read only",
+			fsys:    fstest.MapFS{},
+			reqName: "upload",
+
+			expectedErrorCode: ErrCodeIllegalOperation,
+		},
+		{
+			name:    "writable",
+			reqName: "logs/upload",
+		},
+		{
+			name:    "writable, traversal",
+			reqName: "../upload",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wfs := &memWriteFS{files: make(map[string]*bytes.Buffer), committed: make(map[string]bool)}
+			fsys := c.fsys
+			if fsys == nil {
+				fsys = writableMapFS{MapFS: fstest.MapFS{}, memWriteFS: wfs}
+			}
+			req := writeRequestMock{name: c.reqName}
+			req.reader.Write(data)
+
+			NewFileServerFS(fsys).ReceiveTFTP(&req)
+
+			if c.expectedErrorCode != req.errCode {
+				t.Errorf("expected error code to be %s, but it was %s", c.expectedErrorCode, req.errCode)
+			}
+			if c.expectedErrorCode != 0 {
+				if len(wfs.files) != 0 {
+					t.Errorf("expected no files to be created, got %d", len(wfs.files))
+				}
+				return
+			}
+			if got := wfs.files[c.reqName]; got == nil || !bytes.Equal(got.Bytes(), data) || !wfs.committed[c.reqName] {
+				t.Errorf("expected %q to be committed with %q", c.reqName, data)
+			}
+		})
+	}
+}
+
+// writableMapFS is an fs.FS that is also a WritableFS.
+type writableMapFS struct {
+	fstest.MapFS
+	*memWriteFS
+}
+
+// permissionFS returns a permission error when opening denied.
+type permissionFS struct {
+	fstest.MapFS
+	denied string
+}
+
+func (p permissionFS) Open(name string) (fs.File, error) {
+	if name == p.denied {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return p.MapFS.Open(name)
+}
+
 type writeRequestMock struct {
 	addr    *net.UDPAddr
 	name    string
@@ -107,8 +388,19 @@ type writeRequestMock struct {
 }
 
 func (r *writeRequestMock) Addr() *net.UDPAddr         { return r.addr }
+func (r *writeRequestMock) AddrPort() netip.AddrPort   { return addrKey(r.addr) }
+func (r *writeRequestMock) LocalAddr() *net.UDPAddr    { return nil }
+func (r *writeRequestMock) Stats() TransferStats       { return TransferStats{} }
+func (r *writeRequestMock) ID() uint64                 { return 0 }
 func (r *writeRequestMock) Name() string               { return r.name }
 func (r *writeRequestMock) Read(p []byte) (int, error) { return r.reader.Read(p) }
+func (r *writeRequestMock) SizeKnown() bool            { return r.size != nil }
+func (r *writeRequestMock) Peek(n int) ([]byte, error) {
+	if b := r.reader.Bytes(); len(b) < n {
+		return b, io.EOF
+	}
+	return r.reader.Bytes()[:n], nil
+}
 func (r *writeRequestMock) Size() (int64, error) {
 	if r.size != nil {
 		return *r.size, nil
@@ -119,7 +411,17 @@ func (r *writeRequestMock) WriteError(c ErrorCode, m string) {
 	r.errCode = c
 	r.errMsg = m
 }
-func (r *writeRequestMock) TransferMode() TransferMode { return r.tmode }
+func (r *writeRequestMock) Abort(c ErrorCode, m string) { r.WriteError(c, m) }
+func (r *writeRequestMock) TransferMode() TransferMode  { return r.tmode }
+func (r *writeRequestMock) Options() map[string]string  { return nil }
+func (r *writeRequestMock) BlockSize() int              { return 512 }
+func (r *writeRequestMock) WindowSize() int             { return 1 }
+func (r *writeRequestMock) Context() context.Context    { return context.Background() }
+func (r *writeRequestMock) Checksum() ([]byte, error)   { return nil, ErrChecksumNotEnabled }
+func (r *writeRequestMock) Discard() error {
+	r.WriteError(ErrCodeAccessViolation, "transfer rejected")
+	return nil
+}
 
 func TestFileServer_ReceiveTFTP(t *testing.T) {
 	text := getTestData(t, "text")
@@ -182,3 +484,20 @@ func TestFileServer_ReceiveTFTP(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerFuncs(t *testing.T) {
+	var gotRead, gotWrite string
+
+	var rh ReadHandler = ReadHandlerFunc(func(r ReadRequest) { gotRead = r.Name() })
+	var wh WriteHandler = WriteHandlerFunc(func(w WriteRequest) { gotWrite = w.Name() })
+
+	rh.ServeTFTP(&readRequestMock{name: "read"})
+	wh.ReceiveTFTP(&writeRequestMock{name: "write"})
+
+	if gotRead != "read" {
+		t.Errorf("expected ReadHandlerFunc to be called with %q, got %q", "read", gotRead)
+	}
+	if gotWrite != "write" {
+		t.Errorf("expected WriteHandlerFunc to be called with %q, got %q", "write", gotWrite)
+	}
+}
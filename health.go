@@ -0,0 +1,82 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// healthStatus is the JSON body written by HealthHandler.
+type healthStatus struct {
+	Status          string `json:"status"`
+	Addr            string `json:"addr,omitempty"`
+	ActiveTransfers int64  `json:"active_transfers"`
+	Error           string `json:"error,omitempty"`
+}
+
+// HealthHandler returns an http.Handler reporting the health of the
+// server, for use as a health check endpoint such as /healthz.
+//
+// The handler responds 200 OK if the server is serving. It responds
+// 503 Service Unavailable if the server hasn't started, is draining,
+// has been closed, or stopped receiving requests due to an error.
+// The body is a JSON object with the status, the server's address,
+// the number of active transfers, and the error, if any.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := healthStatus{
+			Status:          "ok",
+			ActiveTransfers: s.Stats().ActiveTransfers,
+		}
+		if addr, err := s.Addr(); err == nil {
+			status.Addr = addr.String()
+		}
+		if err := s.healthErr(); err != nil {
+			status.Status = "unavailable"
+			status.Error = err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if status.Error != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+// healthErr returns the reason the server is unhealthy, or nil.
+func (s *Server) healthErr() error {
+	select {
+	case <-s.close:
+		return ErrServerClosed
+	default:
+	}
+
+	s.connMu.RLock()
+	connected := s.conn != nil
+	s.connMu.RUnlock()
+	if !connected {
+		return ErrServerNotStarted
+	}
+
+	s.errMu.Lock()
+	err := s.err
+	s.errMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.drainMu.Lock()
+	draining := s.draining
+	s.drainMu.Unlock()
+	if draining {
+		return ErrServerDraining
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func checkHealth(t *testing.T, s *Server, expectedCode int, expected healthStatus) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rec.Code != expectedCode {
+		t.Errorf("expected status code %d, got %d", expectedCode, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+	var got healthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != expected {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestServer_HealthHandler(t *testing.T) {
+	t.Run("not started", func(t *testing.T) {
+		s, err := NewServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkHealth(t, s, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Error: ErrServerNotStarted.Error()})
+	})
+
+	t.Run("serving", func(t *testing.T) {
+		s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {}, nil)
+		defer closeServer()
+
+		checkHealth(t, s, http.StatusOK, healthStatus{Status: "ok", Addr: ip + ":" + strconv.Itoa(port)})
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {}, nil)
+		closeServer()
+
+		checkHealth(t, s, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Addr: ip + ":" + strconv.Itoa(port), Error: ErrServerClosed.Error()})
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {}, nil)
+		defer closeServer()
+
+		// Draining with a transfer in progress keeps the server open
+		s.startTransfer()
+		defer s.transfers.Done()
+		go s.Drain(s.ctx)
+		for {
+			s.drainMu.Lock()
+			draining := s.draining
+			s.drainMu.Unlock()
+			if draining {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		checkHealth(t, s, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Addr: ip + ":" + strconv.Itoa(port), Error: ErrServerDraining.Error()})
+	})
+
+	t.Run("receive failed", func(t *testing.T) {
+		s, err := NewServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {}))
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Closing the conn without closing the server stops it with an error
+		conn.Close()
+		if err := s.Serve(conn); err == nil {
+			t.Fatal("expected Serve to fail")
+		}
+
+		rec := httptest.NewRecorder()
+		s.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+}
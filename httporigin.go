@@ -0,0 +1,115 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// HTTPOriginOpt is a function that configures a handler created by NewHTTPOrigin.
+type HTTPOriginOpt func(*httpOrigin)
+
+// HTTPOriginMaxSize configures the largest file that will be sent.
+// Requests for files with a larger Content-Length are refused and
+// transfers are aborted once they exceed size.
+//
+// Default: 0 (no limit).
+func HTTPOriginMaxSize(size int64) HTTPOriginOpt {
+	return func(h *httpOrigin) {
+		h.maxSize = size
+	}
+}
+
+// NewHTTPOrigin creates a handler for sending files from an HTTP server.
+//
+// Requested names are cleaned, a leading slash is removed and the result
+// is appended to the path of baseURL. The file is fetched with a GET
+// using client, or http.DefaultClient if client is nil, and streamed to
+// the TFTP client as it is received. The Content-Length of the response,
+// if any, is sent as the transfer size (tsize).
+//
+// Responses with status 404 are sent as a File Not Found error, 403 as an
+// Access Violation, and other unsuccessful responses as Not Defined with
+// the HTTP status.
+func NewHTTPOrigin(baseURL string, client *http.Client, opts ...HTTPOriginOpt) (ReadHandler, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, ErrInvalidURL
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	h := &httpOrigin{base: base, client: client, log: newLogger("httporigin")}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h, nil
+}
+
+type httpOrigin struct {
+	log     *logger
+	base    *url.URL
+	client  *http.Client
+	maxSize int64
+}
+
+// ServeTFTP sends the requested file from the HTTP server.
+func (h *httpOrigin) ServeTFTP(w ReadRequest) {
+	u := *h.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + path.Clean("/"+w.Name())
+	u.RawPath = ""
+
+	resp, err := h.client.Get(u.String())
+	if err != nil {
+		h.log.debug("requesting %q: %v", u.String(), err)
+		w.WriteError(ErrCodeNotDefined, "origin request failed")
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+		return
+	case http.StatusForbidden:
+		w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Access to %q denied", w.Name()))
+		return
+	default:
+		w.WriteError(ErrCodeNotDefined, resp.Status)
+		return
+	}
+
+	if resp.ContentLength >= 0 {
+		if h.maxSize > 0 && resp.ContentLength > h.maxSize {
+			w.WriteError(ErrCodeNotDefined, fmt.Sprintf("File size %d exceeds maximum %d", resp.ContentLength, h.maxSize))
+			return
+		}
+		w.WriteSize(resp.ContentLength)
+	}
+
+	var r io.Reader = resp.Body
+	if h.maxSize > 0 {
+		r = io.LimitReader(resp.Body, h.maxSize)
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		h.log.debug("sending %q: %v", u.String(), err)
+		w.Abort(ErrCodeNotDefined, "origin transfer failed")
+		return
+	}
+	// Check for data past the limit before the final block is sent
+	if h.maxSize > 0 && n == h.maxSize {
+		if m, _ := io.ReadFull(resp.Body, make([]byte, 1)); m > 0 {
+			w.Abort(ErrCodeNotDefined, fmt.Sprintf("File exceeds maximum size %d", h.maxSize))
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestNewHTTPOrigin(t *testing.T) {
+	cases := []struct {
+		name string
+		url  string
+
+		expectedErr error
+	}{
+		{name: "http", url: "http://localhost/images"},
+		{name: "https", url: "https://localhost/"},
+		{name: "no scheme", url: "localhost/images", expectedErr: ErrInvalidURL},
+		{name: "unsupported scheme", url: "ftp://localhost/images", expectedErr: ErrInvalidURL},
+		{name: "no host", url: "http:///images", expectedErr: ErrInvalidURL},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewHTTPOrigin(c.url, nil)
+			if err != c.expectedErr {
+				t.Errorf("expected error %v, got %v", c.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestHTTPOrigin(t *testing.T) {
+	t.Parallel()
+
+	data := getTestData(t, "1MB-random")[:100000]
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images/boot.img", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	})
+	mux.HandleFunc("/images/chunked.img", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before the handler returns omits Content-Length
+		w.Write(data[:1000])
+		w.(http.Flusher).Flush()
+		w.Write(data[1000:])
+	})
+	mux.HandleFunc("/images/truncated.img", func(w http.ResponseWriter, r *http.Request) {
+		// The connection is closed after writing less than Content-Length
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:len(data)/2])
+	})
+	mux.HandleFunc("/images/secret.img", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	mux.HandleFunc("/images/broken.img", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	})
+	origin := httptest.NewServer(mux)
+	defer origin.Close()
+
+	cases := []struct {
+		name    string
+		file    string
+		maxSize int64
+
+		expectedData []byte
+		expectedSize int64 // -1 if tsize is not expected
+		expectedCode ErrorCode
+		expectedMsg  string
+	}{
+		{
+			name:         "success",
+			file:         "boot.img",
+			expectedData: data,
+			expectedSize: int64(len(data)),
+		},
+		{
+			name:         "cleaned name",
+			file:         "/../boot.img",
+			expectedData: data,
+			expectedSize: int64(len(data)),
+		},
+		{
+			name:         "no content length",
+			file:         "chunked.img",
+			expectedData: data,
+			expectedSize: -1,
+		},
+		{
+			name:         "at max size",
+			file:         "chunked.img",
+			maxSize:      int64(len(data)),
+			expectedData: data,
+			expectedSize: -1,
+		},
+		{
+			name:         "not found",
+			file:         "missing.img",
+			expectedCode: ErrCodeFileNotFound,
+			expectedMsg:  `File "missing.img" does not exist`,
+		},
+		{
+			name:         "forbidden",
+			file:         "secret.img",
+			expectedCode: ErrCodeAccessViolation,
+			expectedMsg:  `Access to "secret.img" denied`,
+		},
+		{
+			name:         "server error",
+			file:         "broken.img",
+			expectedCode: ErrCodeNotDefined,
+			expectedMsg:  "500 Internal Server Error",
+		},
+		{
+			name:         "truncated body",
+			file:         "truncated.img",
+			expectedSize: int64(len(data)),
+			expectedCode: ErrCodeNotDefined,
+			expectedMsg:  "origin transfer failed",
+		},
+		{
+			name:         "content length exceeds max size",
+			file:         "boot.img",
+			maxSize:      1000,
+			expectedCode: ErrCodeNotDefined,
+			expectedMsg:  "File size 100000 exceeds maximum 1000",
+		},
+		{
+			name:         "body exceeds max size",
+			file:         "chunked.img",
+			maxSize:      int64(len(data) - 1),
+			expectedSize: -1,
+			expectedCode: ErrCodeNotDefined,
+			expectedMsg:  "File exceeds maximum size 99999",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h, err := NewHTTPOrigin(origin.URL+"/images/", origin.Client(), HTTPOriginMaxSize(c.maxSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ip, port, closeServer := newTestServer(t, false, h.ServeTFTP, nil)
+			defer closeServer()
+
+			client, err := NewClient(ClientTransferSize(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []byte
+			resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/" + c.file)
+			if err == nil {
+				size, sizeErr := resp.Size()
+				if c.expectedSize < 0 && sizeErr == nil {
+					t.Errorf("expected no size, got %d", size)
+				} else if c.expectedSize >= 0 && size != c.expectedSize {
+					t.Errorf("expected size %d, got %d (%v)", c.expectedSize, size, sizeErr)
+				}
+				got, err = ioutil.ReadAll(resp)
+			}
+
+			if c.expectedMsg != "" {
+				var tftpErr *Error
+				if !errors.As(err, &tftpErr) {
+					t.Fatalf("expected *Error, got %v", err)
+				}
+				if tftpErr.Code != c.expectedCode || tftpErr.Message != c.expectedMsg {
+					t.Errorf("expected ERROR %s %q, got %s %q", c.expectedCode, c.expectedMsg, tftpErr.Code, tftpErr.Message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, c.expectedData) {
+				t.Errorf("expected %d bytes, got %d", len(c.expectedData), len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package trivialt
+
+import "net"
+
+const joinGroupSupported = false
+
+// joinGroup is not supported on this platform.
+func joinGroup(conn *net.UDPConn, g groupMembership) error {
+	return ErrJoinGroupUnsupported
+}
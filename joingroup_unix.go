@@ -0,0 +1,45 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package trivialt
+
+import (
+	"net"
+	"syscall"
+)
+
+const joinGroupSupported = true
+
+// joinGroup adds conn to the multicast group g. IPv4 groups use
+// IP_ADD_MEMBERSHIP, which dual-stack IPv6 sockets also accept, and
+// IPv6 groups use IPV6_JOIN_GROUP.
+func joinGroup(conn *net.UDPConn, g groupMembership) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ip4 := g.group.To4(); ip4 != nil {
+			mreq := &syscall.IPMreq{}
+			copy(mreq.Multiaddr[:], ip4)
+			if g.ifaceIP != nil {
+				copy(mreq.Interface[:], g.ifaceIP.To4())
+			}
+			sockErr = syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+			return
+		}
+		mreq := &syscall.IPv6Mreq{Interface: uint32(g.ifaceIndex)}
+		copy(mreq.Multiaddr[:], g.group.To16())
+		sockErr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -5,8 +5,12 @@
 package trivialt
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
 )
 
 var (
@@ -28,6 +32,34 @@ type logger struct {
 	log *log.Logger
 	d   bool
 	t   bool
+
+	slog *slog.Logger // If set, used instead of log
+}
+
+// levelTrace is the slog level used for trace messages.
+const levelTrace = slog.LevelDebug - 4
+
+func newSlogger(l *slog.Logger) *logger {
+	return &logger{slog: l}
+}
+
+// with returns a logger that includes attrs, as slog key-value pairs,
+// with each message. Attrs are ignored if the logger isn't backed by slog.
+func (l *logger) with(attrs ...interface{}) *logger {
+	if l.slog == nil {
+		return l
+	}
+	return &logger{slog: l.slog.With(attrs...)}
+}
+
+// withID returns a logger that includes the transfer id with each
+// message, as a slog attr or in the log prefix.
+func (l *logger) withID(id uint64) *logger {
+	if l.slog != nil {
+		return l.with("transfer_id", id)
+	}
+	prefix := l.log.Prefix() + strconv.FormatUint(id, 10) + "|"
+	return &logger{log: log.New(l.log.Writer(), prefix, l.log.Flags()), d: l.d, t: l.t}
 }
 
 func newLogger(name string) *logger {
@@ -39,17 +71,31 @@ func newLogger(name string) *logger {
 }
 
 func (l *logger) debug(f string, args ...interface{}) {
+	if l.slog != nil {
+		l.slog.Debug(fmt.Sprintf(f, args...))
+		return
+	}
 	if l.d {
 		l.log.Printf("[DEBUG] "+f, args...)
 	}
 }
 
 func (l *logger) trace(f string, args ...interface{}) {
+	if l.slog != nil {
+		if l.slog.Enabled(context.Background(), levelTrace) {
+			l.slog.Log(context.Background(), levelTrace, fmt.Sprintf(f, args...))
+		}
+		return
+	}
 	if l.t {
 		l.log.Printf("[TRACE] "+f, args...)
 	}
 }
 
 func (l *logger) err(f string, args ...interface{}) {
+	if l.slog != nil {
+		l.slog.Error(fmt.Sprintf(f, args...))
+		return
+	}
 	l.log.Printf("[ERROR] "+f, args...)
 }
@@ -0,0 +1,277 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryReadHandler creates a handler for sending files from memory.
+//
+// Keys of files are file names, which are matched against the cleaned
+// requested name with any leading slash removed. A copy of files is
+// made, changes after MemoryReadHandler returns are not served.
+//
+// If the file does not exist a File Not Found error is sent.
+func MemoryReadHandler(files map[string][]byte) ReadHandler {
+	h := &memoryReadHandler{files: make(map[string][]byte, len(files))}
+	for name, data := range files {
+		h.files[name] = data
+	}
+	return h
+}
+
+type memoryReadHandler struct {
+	files map[string][]byte // Read only after creation
+}
+
+// ServeTFTP sends the requested file from memory.
+func (h *memoryReadHandler) ServeTFTP(w ReadRequest) {
+	name := memoryName(w.Name())
+
+	data, ok := h.files[name]
+	if !ok {
+		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+		return
+	}
+
+	w.WriteSize(int64(len(data)))
+	w.Write(data)
+}
+
+// MemoryWriteHandler is a WriteHandler that stores received files in
+// memory. It is safe for concurrent use.
+//
+// The zero value is ready to use.
+type MemoryWriteHandler struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// ReceiveTFTP stores the received file, replacing any previously received
+// file with the same name. Names are cleaned and a leading slash is
+// removed.
+//
+// The file is only stored if the transfer completes successfully.
+func (h *MemoryWriteHandler) ReceiveTFTP(w WriteRequest) {
+	name := memoryName(w.Name())
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(w); err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.files == nil {
+		h.files = make(map[string][]byte)
+	}
+	h.files[name] = buf.Bytes()
+}
+
+// Files returns a copy of the received files, keyed by name.
+func (h *MemoryWriteHandler) Files() map[string][]byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	files := make(map[string][]byte, len(h.files))
+	for name, data := range h.files {
+		files[name] = append([]byte(nil), data...)
+	}
+	return files
+}
+
+// memoryName cleans name and removes any leading slash.
+func memoryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// MemoryStore is a ReadHandler and WriteHandler serving files from
+// memory. Files can also be managed with Put, Get, Delete, and List.
+// It is safe for concurrent use.
+//
+// Names are cleaned and a leading slash is removed.
+//
+// The zero value is ready to use, without a size limit.
+type MemoryStore struct {
+	maxBytes int64 // Limit of total bytes stored, 0 for no limit
+
+	mu       sync.RWMutex
+	files    map[string][]byte // Never modified after being stored
+	size     int64             // Total bytes stored
+	reserved int64             // Bytes received by uploads in progress
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+//
+// Any number of MemoryStoreOpts can be provided to modify the default
+// behavior.
+func NewMemoryStore(opts ...MemoryStoreOpt) (*MemoryStore, error) {
+	s := &MemoryStore{}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// MemoryStoreOpt is a function that configures a MemoryStore.
+type MemoryStoreOpt func(*MemoryStore) error
+
+// MemoryStoreMaxBytes configures the total size of files the store will
+// accept from uploads. Uploads that would exceed it are refused with a
+// Disk Full error, before the transfer if the client sent tsize.
+//
+// Files added with Put are not limited, but count towards the total.
+//
+// Default: 0 (no limit).
+func MemoryStoreMaxBytes(n int64) MemoryStoreOpt {
+	return func(s *MemoryStore) error {
+		if n < 0 {
+			return ErrInvalidMaxBytes
+		}
+		s.maxBytes = n
+		return nil
+	}
+}
+
+// Put stores a copy of data as name, replacing any existing file.
+func (s *MemoryStore) Put(name string, data []byte) {
+	s.store(memoryName(name), append([]byte(nil), data...), 0)
+}
+
+// Get returns a copy of the file name and whether it exists.
+func (s *MemoryStore) Get(name string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.files[memoryName(name)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), data...), true
+}
+
+// Delete removes the file name, if it exists.
+func (s *MemoryStore) Delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = memoryName(name)
+	s.size -= int64(len(s.files[name]))
+	delete(s.files, name)
+}
+
+// List returns the names of the stored files in sorted order.
+func (s *MemoryStore) List() []string {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// ServeTFTP sends the requested file, with tsize set to its length.
+// If the file does not exist a File Not Found error is sent.
+func (s *MemoryStore) ServeTFTP(w ReadRequest) {
+	s.mu.RLock()
+	data, ok := s.files[memoryName(w.Name())]
+	s.mu.RUnlock()
+	if !ok {
+		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+		return
+	}
+
+	w.WriteSize(int64(len(data)))
+	w.Write(data)
+}
+
+// ReceiveTFTP stores the received file, replacing any existing file
+// with the same name. The file is only stored if the transfer completes
+// successfully.
+func (s *MemoryStore) ReceiveTFTP(w WriteRequest) {
+	if size, err := w.Size(); err == nil && !s.fits(size) {
+		w.WriteError(ErrCodeDiskFull, "Disk full")
+		return
+	}
+
+	// The upload is written block by block, each block is
+	// reserved before it's acknowledged.
+	u := &memoryUpload{s: s}
+	_, err := io.Copy(u, w)
+	if u.full {
+		s.release(int64(u.buf.Len()))
+		w.WriteError(ErrCodeDiskFull, "Disk full")
+		return
+	}
+	if err != nil {
+		s.release(int64(u.buf.Len()))
+		return
+	}
+	s.store(memoryName(w.Name()), u.buf.Bytes(), int64(u.buf.Len()))
+}
+
+// fits reports whether the store has space for n more bytes.
+func (s *MemoryStore) fits(n int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxBytes == 0 || s.size+s.reserved+n <= s.maxBytes
+}
+
+// reserve reserves n bytes for an upload, returning false if
+// the store doesn't have space.
+func (s *MemoryStore) reserve(n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && s.size+s.reserved+n > s.maxBytes {
+		return false
+	}
+	s.reserved += n
+	return true
+}
+
+// release releases n reserved bytes.
+func (s *MemoryStore) release(n int64) {
+	s.mu.Lock()
+	s.reserved -= n
+	s.mu.Unlock()
+}
+
+// store stores data as name, releasing reserved bytes.
+func (s *MemoryStore) store(name string, data []byte, reserved int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[string][]byte)
+	}
+	s.reserved -= reserved
+	s.size += int64(len(data)) - int64(len(s.files[name]))
+	s.files[name] = data
+}
+
+// memoryUpload buffers an upload, reserving space in the store
+// before accepting each write.
+type memoryUpload struct {
+	s    *MemoryStore
+	buf  bytes.Buffer
+	full bool
+}
+
+func (u *memoryUpload) Write(p []byte) (int, error) {
+	if !u.s.reserve(int64(len(p))) {
+		u.full = true
+		return 0, errStoreFull
+	}
+	return u.buf.Write(p)
+}
@@ -0,0 +1,374 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryReadHandler(t *testing.T) {
+	data := []byte("firmware image")
+	files := map[string][]byte{
+		"firmware/v1.img": data,
+		"empty":           {},
+	}
+
+	cases := []struct {
+		name    string
+		reqName string
+
+		expectedData      []byte
+		expectedSize      *int64
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:    "file exists",
+			reqName: "firmware/v1.img",
+
+			expectedData: data,
+			expectedSize: ptrInt64(int64(len(data))),
+		},
+		{
+			name:    "leading slash",
+			reqName: "/firmware/v1.img",
+
+			expectedData: data,
+			expectedSize: ptrInt64(int64(len(data))),
+		},
+		{
+			name:    "empty file",
+			reqName: "empty",
+
+			expectedSize: ptrInt64(0),
+		},
+		{
+			name:    "does not exist",
+			reqName: "firmware/v2.img",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+		{
+			name:    "added after creation",
+			reqName: "added",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+	}
+
+	handler := MemoryReadHandler(files)
+	files["added"] = data
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := readRequestMock{name: c.reqName}
+
+			handler.ServeTFTP(&req)
+
+			if !bytes.Equal(c.expectedData, req.writer.Bytes()) {
+				t.Errorf("expected data to be %q, but it was %q", c.expectedData, req.writer.Bytes())
+			}
+			if !reflect.DeepEqual(c.expectedSize, req.size) {
+				t.Errorf("expected size to be %v, but it was %v", c.expectedSize, req.size)
+			}
+			if c.expectedErrorCode != req.errCode {
+				t.Errorf("expected error code to be %s, but it was %s", c.expectedErrorCode, req.errCode)
+			}
+		})
+	}
+}
+
+func TestMemoryWriteHandler(t *testing.T) {
+	var handler MemoryWriteHandler
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := writeRequestMock{name: fmt.Sprintf("/file%d", i)}
+			req.reader.WriteString(fmt.Sprintf("data %d", i))
+			handler.ReceiveTFTP(&req)
+		}(i)
+	}
+	wg.Wait()
+
+	files := handler.Files()
+	if len(files) != 10 {
+		t.Fatalf("expected 10 files, got %d", len(files))
+	}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if expected := fmt.Sprintf("data %d", i); string(files[name]) != expected {
+			t.Errorf("expected %s to be %q, got %q", name, expected, files[name])
+		}
+	}
+
+	// Files returns a copy
+	files["file0"][0] = 'X'
+	if data := handler.Files()["file0"]; string(data) != "data 0" {
+		t.Errorf("expected stored file to be unchanged, got %q", data)
+	}
+}
+
+func TestMemoryHandlers_server(t *testing.T) {
+	var wh MemoryWriteHandler
+	ip, port, closeServer := newTestServer(t, false, MemoryReadHandler(map[string][]byte{
+		"file": []byte("the data"),
+	}).ServeTFTP, wh.ReceiveTFTP)
+	defer closeServer()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("%s:%d/", ip, port)
+
+	resp, err := client.Get(url + "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "the data" {
+		t.Errorf("expected %q, got %q", "the data", data)
+	}
+
+	if err := client.Put(url+"uploaded", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler stores the file after the final ACK is sent
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		uploaded, ok := wh.Files()["uploaded"]
+		if ok {
+			if string(uploaded) != "the data" {
+				t.Errorf("expected uploaded file to be %q, got %q", "the data", uploaded)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("uploaded file not stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	if _, err := NewMemoryStore(MemoryStoreMaxBytes(-1)); err != ErrInvalidMaxBytes {
+		t.Errorf("expected %v, got %v", ErrInvalidMaxBytes, err)
+	}
+
+	s, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("config")
+	s.Put("/pxelinux.cfg/default", data)
+	s.Put("b", []byte("b"))
+	s.Put("a", []byte("a"))
+	data[0] = 'X' // Put stores a copy
+
+	got, ok := s.Get("pxelinux.cfg/../pxelinux.cfg/default")
+	if !ok || string(got) != "config" {
+		t.Errorf("expected %q, got %q (%t)", "config", got, ok)
+	}
+	got[0] = 'X' // Get returns a copy
+	if got, _ := s.Get("pxelinux.cfg/default"); string(got) != "config" {
+		t.Errorf("expected stored file to be unchanged, got %q", got)
+	}
+
+	expected := []string{"a", "b", "pxelinux.cfg/default"}
+	if names := s.List(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	s.Delete("/a")
+	s.Delete("missing")
+	if _, ok := s.Get("a"); ok {
+		t.Error("expected deleted file to be missing")
+	}
+	if s.size != int64(len("config")+len("b")) {
+		t.Errorf("expected size %d, got %d", len("config")+len("b"), s.size)
+	}
+
+	// The zero value is usable
+	var zero MemoryStore
+	if _, ok := zero.Get("a"); ok {
+		t.Error("expected empty store")
+	}
+	zero.Put("a", []byte("a"))
+	if got, _ := zero.Get("a"); string(got) != "a" {
+		t.Errorf("expected %q, got %q", "a", got)
+	}
+}
+
+func TestMemoryStore_server(t *testing.T) {
+	t.Parallel()
+
+	random := getTestData(t, "1MB-random")
+
+	for _, singlePort := range []bool{false, true} {
+		singlePort := singlePort
+		t.Run(fmt.Sprintf("single port %t", singlePort), func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewMemoryStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			const files = 4
+			for i := 0; i < files; i++ {
+				s.Put(fmt.Sprintf("read-%d", i), random[i*10000:(i+1)*10000+i])
+			}
+			ip, port, closeServer := newTestServer(t, singlePort, s.ServeTFTP, s.ReceiveTFTP)
+			defer closeServer()
+			url := fmt.Sprintf("tftp://%s:%d/", ip, port)
+
+			var wg sync.WaitGroup
+			for i := 0; i < files; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					client, err := NewClient(ClientTransferSize(true))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					expected := random[i*10000 : (i+1)*10000+i]
+					for j := 0; j < 5; j++ {
+						resp, err := client.Get(fmt.Sprintf("%sread-%d", url, i))
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if size, err := resp.Size(); err != nil || size != int64(len(expected)) {
+							t.Errorf("expected tsize %d, got %d (%v)", len(expected), size, err)
+						}
+						got, err := ioutil.ReadAll(resp)
+						if err != nil {
+							t.Error(err)
+						} else if !bytes.Equal(got, expected) {
+							t.Errorf("expected %d bytes, got %d", len(expected), len(got))
+						}
+					}
+				}(i)
+				go func(i int) {
+					defer wg.Done()
+					client, err := NewClient()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					for j := 0; j < 5; j++ {
+						data := random[j*1000 : j*1000+i*600]
+						if err := client.Put(fmt.Sprintf("%swrite-%d", url, i), bytes.NewReader(data), 0); err != nil {
+							t.Error(err)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Get(url + "missing"); !errors.Is(err, ErrCodeFileNotFound) {
+				t.Errorf("expected %s, got %v", ErrCodeFileNotFound, err)
+			}
+
+			// The handler stores the file after the final ACK is sent
+			deadline := time.Now().Add(2 * time.Second)
+			for i := 0; i < files; i++ {
+				expected := random[4000 : 4000+i*600]
+				for {
+					got, _ := s.Get(fmt.Sprintf("write-%d", i))
+					if bytes.Equal(got, expected) {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("write-%d: expected %d bytes, got %d", i, len(expected), len(got))
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStore_maxBytes(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewMemoryStore(MemoryStoreMaxBytes(2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, port, closeServer := newTestServer(t, false, s.ServeTFTP, s.ReceiveTFTP)
+	defer closeServer()
+	url := fmt.Sprintf("tftp://%s:%d/", ip, port)
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		size     int
+		sendSize bool
+
+		expectFull bool
+	}{
+		{name: "fits", size: 1000, sendSize: true},
+		{name: "too large, tsize", size: 1100, sendSize: true, expectFull: true},
+		// The first block fits, the final block is refused before it's ACKed
+		{name: "too large, final block", size: 1020, expectFull: true},
+		{name: "fills", size: 1000},
+	}
+	for _, c := range cases {
+		var size int64
+		if c.sendSize {
+			size = int64(c.size)
+		}
+		err := client.Put(url+c.name, bytes.NewReader(make([]byte, c.size)), size)
+		if c.expectFull != errors.Is(err, ErrCodeDiskFull) {
+			t.Errorf("%s: expected disk full %t, got %v", c.name, c.expectFull, err)
+		}
+		if !c.expectFull && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+
+		// Wait for the handler to finish
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			s.mu.RLock()
+			reserved := s.reserved
+			_, stored := s.files[c.name]
+			s.mu.RUnlock()
+			if reserved == 0 && stored != c.expectFull {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected stored %t, reserved 0, got %t, %d", c.name, !c.expectFull, stored, reserved)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if s.size != 2000 {
+		t.Errorf("expected 2000 bytes stored, got %d", s.size)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import "time"
+
+// Metrics receives instrumentation events from a Server. It allows
+// integrating metrics libraries, such as Prometheus, without adding
+// dependencies to this package. See examples/prometheus for an
+// implementation.
+//
+// Op is "read" or "write". Methods are called concurrently from
+// each transfer's goroutine.
+type Metrics interface {
+	// TransferStarted is called when a request is accepted, before
+	// the handler is called.
+	TransferStarted(op string)
+
+	// TransferFinished is called once the transfer has ended. Bytes
+	// is the number of bytes written or read by the handler. Err is
+	// non-nil if the transfer failed, including when an ERROR was sent
+	// to the client.
+	TransferFinished(op string, bytes int64, duration time.Duration, err error)
+}
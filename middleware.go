@@ -0,0 +1,305 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadMiddleware wraps a ReadHandler to add behavior such as logging,
+// access control, or metrics.
+type ReadMiddleware func(ReadHandler) ReadHandler
+
+// WriteMiddleware wraps a WriteHandler to add behavior such as logging,
+// access control, or metrics.
+type WriteMiddleware func(WriteHandler) WriteHandler
+
+// ChainRead wraps h with mw. Middleware is applied left-to-right; the
+// first middleware is the outermost and sees each request first.
+func ChainRead(h ReadHandler, mw ...ReadMiddleware) ReadHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// ChainWrite wraps h with mw. Middleware is applied left-to-right; the
+// first middleware is the outermost and sees each request first.
+func ChainWrite(h WriteHandler, mw ...WriteMiddleware) WriteHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// ReadRequestLogger returns middleware that logs each read request to l
+// once the handler returns, with the op, filename, client, bytes, and
+// duration_ms attributes. If l is nil, slog.Default is used.
+//
+// Requests are logged at Info level, or at Error level with an error
+// attribute if a write failed, the handler sent an ERROR, or the
+// transfer failed or was aborted.
+//
+// The ReadRequest passed to the handler implements Hijacker if the
+// wrapped request does.
+func ReadRequestLogger(l *slog.Logger) ReadMiddleware {
+	return func(h ReadHandler) ReadHandler {
+		return ReadHandlerFunc(func(w ReadRequest) {
+			start := time.Now()
+			lw := &loggedReadRequest{ReadRequest: w}
+			h.ServeTFTP(lw)
+			logRequest(l, "read", w.Name(), w.AddrPort().String(), lw.n, transferErr(lw.err, w.Stats), start)
+		})
+	}
+}
+
+// WriteRequestLogger returns middleware that logs each write request to l
+// once the handler returns, with the op, filename, client, bytes, and
+// duration_ms attributes. If l is nil, slog.Default is used.
+//
+// Requests are logged at Info level, or at Error level with an error
+// attribute if a read failed, the handler rejected the request, or the
+// transfer failed or was aborted.
+//
+// The WriteRequest passed to the handler implements Hijacker if the
+// wrapped request does.
+func WriteRequestLogger(l *slog.Logger) WriteMiddleware {
+	return func(h WriteHandler) WriteHandler {
+		return WriteHandlerFunc(func(w WriteRequest) {
+			start := time.Now()
+			lw := &loggedWriteRequest{WriteRequest: w}
+			h.ReceiveTFTP(lw)
+			logRequest(l, "write", w.Name(), w.AddrPort().String(), lw.n, transferErr(lw.err, w.Stats), start)
+		})
+	}
+}
+
+// TransferLogFormat is the header of the log written by
+// ReadTransferLogWriter and WriteTransferLogWriter, naming the
+// tab-separated columns of each line.
+//
+// The timestamp is when the request was received, in RFC 3339 format.
+// The status is "ok", or the error that ended the transfer. Tabs,
+// newlines and backslashes in the filename and status are escaped with
+// a backslash.
+const TransferLogFormat = "timestamp\tclient\top\tfilename\tbytes\tduration_ms\tstatus"
+
+// ReadTransferLogWriter returns middleware that writes a line to w for
+// each read request once the handler returns, in the format described
+// by TransferLogFormat. The header isn't written.
+//
+// Lines are written with a single call to w.Write, which is serialized
+// with other transfer log middleware.
+func ReadTransferLogWriter(w io.Writer) ReadMiddleware {
+	return func(h ReadHandler) ReadHandler {
+		return ReadHandlerFunc(func(r ReadRequest) {
+			start := time.Now()
+			lr := &loggedReadRequest{ReadRequest: r}
+			h.ServeTFTP(lr)
+			writeTransferLog(w, start, r.AddrPort().Addr().String(), "read", r.Name(), lr.n, transferErr(lr.err, r.Stats))
+		})
+	}
+}
+
+// WriteTransferLogWriter returns middleware that writes a line to w for
+// each write request once the handler returns, in the format described
+// by TransferLogFormat. The header isn't written.
+//
+// Lines are written with a single call to w.Write, which is serialized
+// with other transfer log middleware.
+func WriteTransferLogWriter(w io.Writer) WriteMiddleware {
+	return func(h WriteHandler) WriteHandler {
+		return WriteHandlerFunc(func(r WriteRequest) {
+			start := time.Now()
+			lr := &loggedWriteRequest{WriteRequest: r}
+			h.ReceiveTFTP(lr)
+			writeTransferLog(w, start, r.AddrPort().Addr().String(), "write", r.Name(), lr.n, transferErr(lr.err, r.Stats))
+		})
+	}
+}
+
+// transferLogMu serializes writes by all transfer log middleware, which
+// may share a writer.
+var transferLogMu sync.Mutex
+
+// transferLogEscaper escapes the separators of the transfer log.
+var transferLogEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func writeTransferLog(w io.Writer, start time.Time, client, op, name string, n int64, err error) {
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	line := fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+		start.Format(time.RFC3339), client, op, transferLogEscaper.Replace(name),
+		n, time.Since(start).Milliseconds(), transferLogEscaper.Replace(status))
+
+	transferLogMu.Lock()
+	defer transferLogMu.Unlock()
+	w.Write([]byte(line))
+}
+
+// transferErr returns err, or the error in the request's stats, which
+// includes transfers aborted by the handler or client.
+func transferErr(err error, stats func() TransferStats) error {
+	if err != nil {
+		return err
+	}
+	return stats().Err
+}
+
+func logRequest(l *slog.Logger, op, name, client string, n int64, err error, start time.Time) {
+	if l == nil {
+		l = slog.Default()
+	}
+	attrs := []slog.Attr{
+		slog.String("op", op),
+		slog.String("filename", name),
+		slog.String("client", client),
+		slog.Int64("bytes", n),
+		slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+	}
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	l.LogAttrs(context.Background(), level, "tftp request", attrs...)
+}
+
+// loggedReadRequest counts the bytes written to a ReadRequest and
+// records the first error.
+type loggedReadRequest struct {
+	ReadRequest
+	n   int64
+	err error
+}
+
+func (w *loggedReadRequest) Write(p []byte) (int, error) {
+	n, err := w.ReadRequest.Write(p)
+	w.n += int64(n)
+	w.setErr(err)
+	return n, err
+}
+
+// ReadFrom preserves the wrapped request's io.ReaderFrom.
+func (w *loggedReadRequest) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := w.ReadRequest.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{w.ReadRequest}, r)
+	}
+	w.n += n
+	w.setErr(err)
+	return n, err
+}
+
+func (w *loggedReadRequest) WriteError(code ErrorCode, msg string) {
+	w.ReadRequest.WriteError(code, msg)
+	w.setErr(&Error{Code: code, Message: msg})
+}
+
+func (w *loggedReadRequest) setErr(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Hijack preserves the wrapped request's Hijacker.
+func (w *loggedReadRequest) Hijack() (net.PacketConn, *net.UDPAddr, error) {
+	return hijack(w.ReadRequest)
+}
+
+func (w *loggedReadRequest) addRateLimit(b *tokenBucket) {
+	if l, ok := w.ReadRequest.(rateLimiter); ok {
+		l.addRateLimit(b)
+	}
+}
+
+func (w *loggedReadRequest) setUpstream(host string) {
+	recordUpstream(w.ReadRequest, host)
+}
+
+// loggedWriteRequest counts the bytes read from a WriteRequest and
+// records the first error.
+type loggedWriteRequest struct {
+	WriteRequest
+	n   int64
+	err error
+}
+
+func (w *loggedWriteRequest) Read(p []byte) (int, error) {
+	n, err := w.WriteRequest.Read(p)
+	w.n += int64(n)
+	if err != io.EOF {
+		w.setErr(err)
+	}
+	return n, err
+}
+
+// WriteTo preserves the wrapped request's io.WriterTo.
+func (w *loggedWriteRequest) WriteTo(dst io.Writer) (int64, error) {
+	var n int64
+	var err error
+	if wt, ok := w.WriteRequest.(io.WriterTo); ok {
+		n, err = wt.WriteTo(dst)
+	} else {
+		n, err = io.Copy(dst, struct{ io.Reader }{w.WriteRequest})
+	}
+	w.n += n
+	w.setErr(err)
+	return n, err
+}
+
+func (w *loggedWriteRequest) WriteError(code ErrorCode, msg string) {
+	w.WriteRequest.WriteError(code, msg)
+	w.setErr(&Error{Code: code, Message: msg})
+}
+
+func (w *loggedWriteRequest) Discard() error {
+	err := w.WriteRequest.Discard()
+	if err == nil {
+		err = ErrTransferRejected
+	}
+	w.setErr(err)
+	return err
+}
+
+func (w *loggedWriteRequest) setErr(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Hijack preserves the wrapped request's Hijacker.
+func (w *loggedWriteRequest) Hijack() (net.PacketConn, *net.UDPAddr, error) {
+	return hijack(w.WriteRequest)
+}
+
+func (w *loggedWriteRequest) setUpstream(host string) {
+	recordUpstream(w.WriteRequest, host)
+}
+
+func (w *loggedWriteRequest) setFailure(err error) {
+	recordFailure(w.WriteRequest, err)
+}
+
+// hijack hijacks req, if it supports it.
+func hijack(req interface{}) (net.PacketConn, *net.UDPAddr, error) {
+	h, ok := req.(Hijacker)
+	if !ok {
+		return nil, nil, ErrHijackNotSupported
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,398 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	_ ReadHandler  = ReadHandlerFunc(nil)
+	_ WriteHandler = WriteHandlerFunc(nil)
+
+	// Optional interfaces are preserved by the logging middleware
+	_ Hijacker         = (*loggedReadRequest)(nil)
+	_ rateLimiter      = (*loggedReadRequest)(nil)
+	_ upstreamRecorder = (*loggedReadRequest)(nil)
+	_ Hijacker         = (*loggedWriteRequest)(nil)
+	_ upstreamRecorder = (*loggedWriteRequest)(nil)
+	_ failureRecorder  = (*loggedWriteRequest)(nil)
+)
+
+func TestChainRead(t *testing.T) {
+	var calls []string
+	mw := func(name string) ReadMiddleware {
+		return func(h ReadHandler) ReadHandler {
+			return ReadHandlerFunc(func(w ReadRequest) {
+				calls = append(calls, name)
+				h.ServeTFTP(w)
+			})
+		}
+	}
+	deny := func(h ReadHandler) ReadHandler {
+		return ReadHandlerFunc(func(w ReadRequest) {
+			if w.Name() == "secret" {
+				w.WriteError(ErrCodeAccessViolation, "denied")
+				return
+			}
+			h.ServeTFTP(w)
+		})
+	}
+	handler := ReadHandlerFunc(func(w ReadRequest) {
+		calls = append(calls, "handler")
+	})
+
+	cases := []struct {
+		name    string
+		reqName string
+		mw      []ReadMiddleware
+
+		expectedCalls     []string
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:    "no middleware",
+			reqName: "file",
+
+			expectedCalls: []string{"handler"},
+		},
+		{
+			name:    "left-to-right",
+			reqName: "file",
+			mw:      []ReadMiddleware{mw("first"), mw("second"), deny},
+
+			expectedCalls: []string{"first", "second", "handler"},
+		},
+		{
+			name:    "short circuit",
+			reqName: "secret",
+			mw:      []ReadMiddleware{mw("first"), deny, mw("second")},
+
+			expectedCalls:     []string{"first"},
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			calls = nil
+			req := readRequestMock{name: c.reqName}
+
+			ChainRead(handler, c.mw...).ServeTFTP(&req)
+
+			if !reflect.DeepEqual(calls, c.expectedCalls) {
+				t.Errorf("expected calls %v, got %v", c.expectedCalls, calls)
+			}
+			if req.errCode != c.expectedErrorCode {
+				t.Errorf("expected error code %s, got %s", c.expectedErrorCode, req.errCode)
+			}
+		})
+	}
+}
+
+func TestChainWrite(t *testing.T) {
+	var calls []string
+	mw := func(name string) WriteMiddleware {
+		return func(h WriteHandler) WriteHandler {
+			return WriteHandlerFunc(func(w WriteRequest) {
+				calls = append(calls, name)
+				h.ReceiveTFTP(w)
+			})
+		}
+	}
+	handler := WriteHandlerFunc(func(w WriteRequest) {
+		calls = append(calls, "handler")
+	})
+
+	ChainWrite(handler, mw("first"), mw("second")).ReceiveTFTP(&writeRequestMock{})
+
+	expected := []string{"first", "second", "handler"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, nil))
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	rh := ChainRead(ReadHandlerFunc(func(w ReadRequest) {
+		if w.Name() == "missing" {
+			w.WriteError(ErrCodeFileNotFound, "not found")
+			return
+		}
+		w.Write([]byte("data"))
+		io.Copy(w, strings.NewReader("more"))
+	}), ReadRequestLogger(l))
+	wh := ChainWrite(WriteHandlerFunc(func(w WriteRequest) {
+		if w.Name() == "denied" {
+			w.Discard()
+			return
+		}
+		ioutil.ReadAll(w)
+	}), WriteRequestLogger(l))
+
+	rh.ServeTFTP(&readRequestMock{addr: addr, name: "kernel"})
+	rh.ServeTFTP(&readRequestMock{addr: addr, name: "missing"})
+	wr := &writeRequestMock{addr: addr, name: "config"}
+	wr.reader.WriteString("config data")
+	wh.ReceiveTFTP(wr)
+	wh.ReceiveTFTP(&writeRequestMock{addr: addr, name: "denied"})
+
+	dec := json.NewDecoder(&buf)
+	for _, expected := range []struct {
+		op, filename, level, err string
+		bytes                    float64
+	}{
+		{op: "read", filename: "kernel", level: "INFO", bytes: 8},
+		{op: "read", filename: "missing", level: "ERROR", err: "FILE_NOT_FOUND: not found"},
+		{op: "write", filename: "config", level: "INFO", bytes: 11},
+		{op: "write", filename: "denied", level: "ERROR", err: ErrTransferRejected.Error()},
+	} {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["level"] != expected.level || entry["op"] != expected.op || entry["filename"] != expected.filename || entry["client"] != "192.0.2.1:1234" {
+			t.Errorf("unexpected log entry %v", entry)
+		}
+		if entry["bytes"] != expected.bytes {
+			t.Errorf("expected %v bytes in log entry %v", expected.bytes, entry)
+		}
+		if _, ok := entry["duration_ms"]; !ok {
+			t.Errorf("expected duration_ms in log entry %v", entry)
+		}
+		if expected.err == "" {
+			if _, ok := entry["error"]; ok {
+				t.Errorf("unexpected error in log entry %v", entry)
+			}
+		} else if entry["error"] != expected.err {
+			t.Errorf("expected error %q in log entry %v", expected.err, entry)
+		}
+	}
+}
+
+func TestTransferLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	rh := ChainRead(ReadHandlerFunc(func(w ReadRequest) {
+		if w.Name() == "missing" {
+			w.WriteError(ErrCodeFileNotFound, "not found")
+			return
+		}
+		w.Write([]byte("data"))
+	}), ReadTransferLogWriter(&buf))
+	wh := ChainWrite(WriteHandlerFunc(func(w WriteRequest) {
+		if w.Name() == "denied" {
+			w.Discard()
+			return
+		}
+		ioutil.ReadAll(w)
+	}), WriteTransferLogWriter(&buf))
+
+	start := time.Now().Truncate(time.Second)
+	rh.ServeTFTP(&readRequestMock{addr: addr, name: "kernel"})
+	rh.ServeTFTP(&readRequestMock{addr: addr, name: "missing"})
+	rh.ServeTFTP(&readRequestMock{addr: addr, name: "tab\tname"})
+	wr := &writeRequestMock{addr: addr, name: "config"}
+	wr.reader.WriteString("config data")
+	wh.ReceiveTFTP(wr)
+	wh.ReceiveTFTP(&writeRequestMock{addr: addr, name: "denied"})
+
+	columns := strings.Split(TransferLogFormat, "\t")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	expected := [][]string{
+		{"192.0.2.1", "read", "kernel", "4", "ok"},
+		{"192.0.2.1", "read", "missing", "0", "FILE_NOT_FOUND: not found"},
+		{"192.0.2.1", "read", `tab\tname`, "4", "ok"},
+		{"192.0.2.1", "write", "config", "11", "ok"},
+		{"192.0.2.1", "write", "denied", "0", ErrTransferRejected.Error()},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d: %q", len(expected), len(lines), buf.String())
+	}
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != len(columns) {
+			t.Errorf("expected %d columns, got %q", len(columns), line)
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil || ts.Before(start) {
+			t.Errorf("expected timestamp after %s, got %q (%v)", start, fields[0], err)
+		}
+		if _, err := strconv.Atoi(fields[5]); err != nil {
+			t.Errorf("expected duration in ms, got %q", fields[5])
+		}
+		got := []string{fields[1], fields[2], fields[3], fields[4], fields[6]}
+		if !reflect.DeepEqual(got, expected[i]) {
+			t.Errorf("expected line %d to be %q, got %q", i, expected[i], got)
+		}
+	}
+}
+
+func TestRequestLogger_server(t *testing.T) {
+	t.Parallel()
+
+	random := getTestData(t, "1MB-random")[:5000]
+
+	for _, singlePort := range []bool{false, true} {
+		singlePort := singlePort
+		t.Run(fmt.Sprintf("single port %t", singlePort), func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mu  sync.Mutex
+				buf bytes.Buffer
+			)
+			l := slog.New(slog.NewJSONHandler(writerFunc(func(p []byte) (int, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return buf.Write(p)
+			}), nil))
+			done := make(chan struct{}, 2)
+			ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+				io.Copy(w, bytes.NewReader(random))
+			}, func(w WriteRequest) {
+				ioutil.ReadAll(w)
+			}, ServerReadMiddleware(func(h ReadHandler) ReadHandler {
+				return ReadHandlerFunc(func(w ReadRequest) { h.ServeTFTP(w); done <- struct{}{} })
+			}, ReadRequestLogger(l)), ServerWriteMiddleware(func(h WriteHandler) WriteHandler {
+				return WriteHandlerFunc(func(w WriteRequest) { h.ReceiveTFTP(w); done <- struct{}{} })
+			}, WriteRequestLogger(l)))
+			defer closeServer()
+
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(resp); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Put(url, bytes.NewReader(random[:1000]), 0); err != nil {
+				t.Fatal(err)
+			}
+			// Requests are logged before the outer middleware is done
+			<-done
+			<-done
+			mu.Lock()
+			defer mu.Unlock()
+			dec := json.NewDecoder(&buf)
+			for _, expected := range []struct {
+				op    string
+				bytes float64
+			}{{"read", 5000}, {"write", 1000}} {
+				var entry map[string]interface{}
+				if err := dec.Decode(&entry); err != nil {
+					t.Fatal(err)
+				}
+				if entry["op"] != expected.op || entry["bytes"] != expected.bytes || entry["level"] != "INFO" {
+					t.Errorf("unexpected log entry %v", entry)
+				}
+			}
+		})
+	}
+}
+
+// hijackableReadRequest is a readRequestMock implementing Hijacker.
+type hijackableReadRequest struct {
+	readRequestMock
+	hijacked bool
+}
+
+func (r *hijackableReadRequest) Hijack() (net.PacketConn, *net.UDPAddr, error) {
+	r.hijacked = true
+	return nil, r.addr, nil
+}
+
+func TestRequestLogger_hijack(t *testing.T) {
+	l := slog.New(slog.NewJSONHandler(ioutil.Discard, nil))
+	var hijackErr error
+	h := ChainRead(ReadHandlerFunc(func(w ReadRequest) {
+		_, _, hijackErr = w.(Hijacker).Hijack()
+	}), ReadRequestLogger(l))
+
+	req := &hijackableReadRequest{readRequestMock: readRequestMock{name: "file"}}
+	h.ServeTFTP(req)
+	if hijackErr != nil || !req.hijacked {
+		t.Errorf("expected wrapped request to be hijacked, got %v", hijackErr)
+	}
+
+	h.ServeTFTP(&readRequestMock{name: "file"})
+	if hijackErr != ErrHijackNotSupported {
+		t.Errorf("expected %v, got %v", ErrHijackNotSupported, hijackErr)
+	}
+}
+
+func TestRequestLogger_abort(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu  sync.Mutex
+		buf bytes.Buffer
+	)
+	l := slog.New(slog.NewJSONHandler(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	}), nil))
+	done := make(chan struct{}, 2)
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		w.Write(make([]byte, 600))
+		w.Abort(ErrCodeNotDefined, "source failed")
+	}, func(w WriteRequest) {
+		w.Read(make([]byte, 10))
+		w.Abort(ErrCodeDiskFull, "disk full")
+	}, ServerReadMiddleware(func(h ReadHandler) ReadHandler {
+		return ReadHandlerFunc(func(w ReadRequest) { h.ServeTFTP(w); done <- struct{}{} })
+	}, ReadRequestLogger(l)), ServerWriteMiddleware(func(h WriteHandler) WriteHandler {
+		return WriteHandlerFunc(func(w WriteRequest) { h.ReceiveTFTP(w); done <- struct{}{} })
+	}, WriteRequestLogger(l)))
+	defer closeServer()
+
+	url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get(url); err == nil {
+		ioutil.ReadAll(resp)
+	}
+	<-done
+	client.Put(url, bytes.NewReader(make([]byte, 2000)), 0)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	dec := json.NewDecoder(&buf)
+	for _, op := range []string{"read", "write"} {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["op"] != op || entry["level"] != "ERROR" || entry["error"] == nil {
+			t.Errorf("expected aborted %s to be logged as an error, got %v", op, entry)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// multicastManager coordinates multicast read transfers (RFC 2090).
+//
+// Only one file is sent to the group at a time. Requests for the same
+// file join the transfer in progress, requests for other files are
+// served individually.
+type multicastManager struct {
+	s     *Server
+	group *net.UDPAddr
+
+	mu      sync.Mutex
+	session *multicastSession // Transfer in progress, nil if none
+}
+
+// multicastSession is a file being sent to the multicast group.
+type multicastSession struct {
+	name    string
+	blksize int
+	conn    *net.UDPConn // Transfer ID for all clients
+
+	ready chan struct{} // Closed when data is available or the handler failed
+	data  []byte
+	err   error
+
+	// Clients which haven't received the complete file, in order of
+	// arrival. The first is the master client, which ACKs DATA.
+	clients []*multicastClient
+	done    bool // No longer accepting clients
+}
+
+// multicastClient is a client participating in a multicastSession.
+type multicastClient struct {
+	addr    *net.UDPAddr
+	blksize bool // Whether blksize was requested
+	tsize   bool // Whether tsize was requested
+}
+
+// join adds the client that sent dg to the multicast session for the
+// requested file, starting one if necessary.
+//
+// It returns false if the request should be served as a normal transfer,
+// because multicast wasn't requested or a different file is already being
+// sent to the group.
+func (m *multicastManager) join(req *request, dg datagram) bool {
+	opts := dg.options()
+	if _, ok := opts[optMulticast]; !ok || dg.mode() != ModeOctet {
+		return false
+	}
+
+	blksize := defaultBlksize
+	_, reqBlksize := opts[optBlocksize]
+	if reqBlksize {
+		size, err := strconv.ParseUint(opts[optBlocksize], 10, 16)
+		if err != nil {
+			return false
+		}
+		if m.s.maxBlksize != 0 && uint16(size) > m.s.maxBlksize {
+			size = uint64(m.s.maxBlksize)
+		}
+		blksize = int(size)
+	}
+	_, reqTsize := opts[optTransferSize]
+
+	addr := *req.addr
+	client := &multicastClient{addr: &addr, blksize: reqBlksize, tsize: reqTsize}
+
+	m.mu.Lock()
+	ses := m.session
+	if ses == nil {
+		ses = &multicastSession{
+			name:    dg.filename(),
+			blksize: blksize,
+			ready:   make(chan struct{}),
+			clients: []*multicastClient{client},
+		}
+		m.session = ses
+		m.mu.Unlock()
+		return m.start(ses, req, dg)
+	}
+	m.mu.Unlock()
+
+	if ses.name != dg.filename() || ses.blksize != blksize {
+		return false
+	}
+
+	<-ses.ready
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ses.done {
+		return false
+	}
+
+	for i, c := range ses.clients {
+		if addrKey(c.addr) == addrKey(client.addr) {
+			// Retransmitted request, the OACK may have been lost
+			m.sendOACK(ses, c, i == 0)
+			return true
+		}
+	}
+	ses.clients = append(ses.clients, client)
+	m.sendOACK(ses, client, false)
+	return true
+}
+
+// start runs the read handler for a new session and begins sending
+// the file to the group.
+func (m *multicastManager) start(ses *multicastSession, req *request, dg datagram) bool {
+	fail := func(err error) {
+		m.mu.Lock()
+		ses.err = err
+		ses.done = true
+		m.session = nil
+		m.mu.Unlock()
+		close(ses.ready)
+	}
+
+	conn, err := net.ListenUDP(m.s.net, &net.UDPAddr{})
+	if err != nil {
+		m.s.log.err("Received error opening multicast connection: %v", err)
+		fail(err)
+		return false
+	}
+	if err := setBufferSizes(conn, m.s.readBuffer, m.s.writeBuffer); err == nil {
+		err = setDSCP(conn, m.s.dscp)
+	}
+	if err != nil {
+		m.s.log.err("Received error configuring multicast connection: %v", err)
+		errorDefer(conn.Close, m.s.log, "error closing multicast connection")
+		fail(err)
+		return false
+	}
+	ses.conn = conn
+
+	r := &multicastRequest{
+		ctx:     m.s.ctx,
+		addr:    ses.clients[0].addr,
+		local:   conn.LocalAddr().(*net.UDPAddr),
+		id:      atomic.AddUint64(&m.s.stats.transfers, 1),
+		name:    dg.filename(),
+		opts:    dg.options(),
+		blksize: ses.blksize,
+	}
+	m.serve(r)
+
+	if r.err != nil {
+		var out datagram
+		out.writeError(r.err.Code, r.err.Message)
+		_, _ = conn.WriteTo(out.bytes(), req.addr) // Ignore error
+		atomic.AddUint64(&m.s.stats.errorsSent, 1)
+		atomic.AddUint64(&m.s.stats.failed, 1)
+		errorDefer(conn.Close, m.s.log, "error closing multicast connection")
+		fail(r.err)
+		return true
+	}
+	if r.buf.Len()/ses.blksize >= 65535 {
+		// Block numbers would wrap, send individually
+		errorDefer(conn.Close, m.s.log, "error closing multicast connection")
+		fail(nil)
+		return false
+	}
+
+	ses.data = r.buf.Bytes()
+	close(ses.ready)
+
+	m.s.log.debug("Starting multicast transfer of %q to %v", ses.name, m.group)
+	m.s.transfers.Add(1)
+	atomic.AddInt64(&m.s.stats.active, 1)
+	go func() {
+		defer m.s.transfers.Done()
+		defer atomic.AddInt64(&m.s.stats.active, -1)
+		m.run(ses)
+	}()
+	return true
+}
+
+// serve runs the read handler, recovering any panic.
+func (m *multicastManager) serve(r *multicastRequest) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		r.WriteError(ErrCodeNotDefined, "internal server error")
+		m.s.reportPanic(p, RequestInfo{Op: "read", Addr: r.addr, Name: r.name})
+	}()
+	m.s.rh.ServeTFTP(r)
+}
+
+// run sends ses to the group, driven by ACKs from the master client,
+// until every client has received the file.
+//
+// The session is counted as a single transfer in Stats, and each DATA
+// sent to the group is included in BytesSent.
+func (m *multicastManager) run(ses *multicastSession) {
+	defer errorDefer(ses.conn.Close, m.s.log, "error closing multicast connection")
+
+	blocks := len(ses.data)/ses.blksize + 1
+	buf := make([]byte, 65536)
+
+	var rx, tx datagram
+	var dst *net.UDPAddr // Destination of tx, retransmitted on timeout
+
+	m.mu.Lock()
+	master := ses.clients[0]
+	tx, dst = m.sendOACK(ses, master, true), master.addr
+	m.mu.Unlock()
+
+	retries := 0
+	for {
+		select {
+		case <-m.s.close:
+			m.finish(ses)
+			return
+		default:
+		}
+
+		ses.conn.SetReadDeadline(time.Now().Add(m.s.timeout))
+		n, addr, err := ses.conn.ReadFromUDP(buf)
+		if err != nil {
+			if err, ok := err.(*net.OpError); !ok || !err.Timeout() {
+				m.s.log.err("Multicast transfer of %q stopped: %v", ses.name, err)
+				m.finish(ses)
+				return
+			}
+
+			if retries++; retries <= m.s.retransmit {
+				_, _ = ses.conn.WriteTo(tx.bytes(), dst) // Retransmit
+				continue
+			}
+
+			// The master client stopped responding, move on to the next
+			m.s.log.debug("Multicast client %v stopped responding", master.addr)
+			if master = m.nextMaster(ses, master); master == nil {
+				return
+			}
+			tx, dst, retries = m.sendOACK(ses, master, true), master.addr, 0
+			continue
+		}
+		if n < 4 {
+			continue
+		}
+		rx.setBytes(buf[:n])
+
+		switch rx.opcode() {
+		case opCodeACK:
+			if addrKey(addr) != addrKey(master.addr) {
+				continue // Only the master client ACKs
+			}
+			retries = 0
+
+			block := int(rx.block())
+			if block < blocks {
+				start := block * ses.blksize
+				end := start + ses.blksize
+				if end > len(ses.data) {
+					end = len(ses.data)
+				}
+				tx.writeData(uint16(block+1), ses.data[start:end])
+				dst = m.group
+				_, _ = ses.conn.WriteTo(tx.bytes(), dst)
+				atomic.AddUint64(&m.s.stats.bytesSent, uint64(end-start))
+				continue
+			}
+
+			// Master client has the complete file
+			if master = m.nextMaster(ses, master); master == nil {
+				return
+			}
+			tx, dst = m.sendOACK(ses, master, true), master.addr
+		case opCodeERROR:
+			m.s.log.debug("Multicast client %v sent error: %s", addr, rx)
+			if addrKey(addr) != addrKey(master.addr) {
+				m.removeClient(ses, addr)
+				continue
+			}
+			if master = m.nextMaster(ses, master); master == nil {
+				return
+			}
+			tx, dst, retries = m.sendOACK(ses, master, true), master.addr, 0
+		}
+	}
+}
+
+// nextMaster removes the current master client from ses and sends an
+// OACK to the next client, making it the master.
+//
+// If there are no more clients the session is finished and nil is returned.
+func (m *multicastManager) nextMaster(ses *multicastSession, master *multicastClient) *multicastClient {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(ses.clients) > 0 && ses.clients[0] == master {
+		ses.clients = ses.clients[1:]
+	}
+	if len(ses.clients) == 0 {
+		ses.done = true
+		m.session = nil
+		atomic.AddUint64(&m.s.stats.completed, 1)
+		m.s.log.debug("Finished multicast transfer of %q", ses.name)
+		return nil
+	}
+	return ses.clients[0]
+}
+
+// removeClient removes the client with addr from ses.
+func (m *multicastManager) removeClient(ses *multicastSession, addr *net.UDPAddr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, c := range ses.clients {
+		if addrKey(c.addr) == addrKey(addr) {
+			ses.clients = append(ses.clients[:i], ses.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// finish ends ses, remaining clients are sent an ERROR.
+func (m *multicastManager) finish(ses *multicastSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var dg datagram
+	dg.writeError(ErrCodeNotDefined, "Server closed")
+	for _, c := range ses.clients {
+		_, _ = ses.conn.WriteTo(dg.bytes(), c.addr) // Ignore error
+	}
+	ses.clients = nil
+	ses.done = true
+	m.session = nil
+	atomic.AddUint64(&m.s.stats.failed, 1)
+}
+
+// sendOACK sends an OACK to client from the session's connection, returning
+// the sent datagram. If master is true the client is asked to send ACKs.
+//
+// m.mu must be held.
+func (m *multicastManager) sendOACK(ses *multicastSession, client *multicastClient, master bool) datagram {
+	mc := 0
+	if master {
+		mc = 1
+	}
+	opts := map[string]string{
+		optMulticast: fmt.Sprintf("%s,%d,%d", m.group.IP, m.group.Port, mc),
+	}
+	if client.blksize {
+		opts[optBlocksize] = strconv.Itoa(ses.blksize)
+	}
+	if client.tsize {
+		opts[optTransferSize] = strconv.Itoa(len(ses.data))
+	}
+
+	var dg datagram
+	dg.writeOptionAck(opts)
+	_, _ = ses.conn.WriteTo(dg.bytes(), client.addr) // Retransmitted if lost
+	return dg
+}
+
+// multicastRequest implements ReadRequest, buffering the data written
+// by the handler so that it can be sent to the multicast group.
+type multicastRequest struct {
+	ctx     context.Context
+	addr    *net.UDPAddr
+	local   *net.UDPAddr // Address the group is sent from
+	id      uint64
+	name    string
+	opts    options
+	blksize int
+
+	buf     bytes.Buffer
+	err     *Error // Set by WriteError or Abort
+	aborted bool
+}
+
+func (r *multicastRequest) Addr() *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(r.AddrPort())
+}
+
+func (r *multicastRequest) AddrPort() netip.AddrPort {
+	return addrKey(r.addr)
+}
+
+func (r *multicastRequest) LocalAddr() *net.UDPAddr {
+	return r.local
+}
+
+func (r *multicastRequest) ID() uint64 {
+	return r.id
+}
+
+// Stats reports the data written by the handler, which is sent to the
+// group once the handler returns.
+func (r *multicastRequest) Stats() TransferStats {
+	return TransferStats{ID: r.id, Op: "read", Addr: r.addr, Name: r.name, Bytes: int64(r.buf.Len()), BlockSize: r.blksize, WindowSize: 1}
+}
+
+func (r *multicastRequest) Name() string {
+	return r.name
+}
+
+func (r *multicastRequest) Write(p []byte) (int, error) {
+	if r.aborted {
+		return 0, ErrTransferAborted
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.buf.Write(p)
+}
+
+func (r *multicastRequest) WriteError(c ErrorCode, s string) {
+	if r.err == nil {
+		r.err = &Error{Code: c, Message: s}
+	}
+}
+
+func (r *multicastRequest) Abort(c ErrorCode, s string) {
+	if r.err == nil {
+		r.err = &Error{Code: c, Message: s}
+		r.aborted = true
+	}
+}
+
+// WriteSize is ignored, tsize is the length of the data written.
+func (r *multicastRequest) WriteSize(int64) {}
+
+func (r *multicastRequest) TransferMode() TransferMode {
+	return ModeOctet
+}
+
+func (r *multicastRequest) Options() map[string]string {
+	opts := make(map[string]string, len(r.opts))
+	for k, v := range r.opts {
+		opts[k] = v
+	}
+	return opts
+}
+
+func (r *multicastRequest) BlockSize() int {
+	return r.blksize
+}
+
+// WindowSize is always 1, multicast transfers are acknowledged per block.
+func (r *multicastRequest) WindowSize() int {
+	return 1
+}
+
+func (r *multicastRequest) Context() context.Context {
+	return r.ctx
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerMulticast(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("0123456789"), 120) // 3 blocks
+
+	// Stand in for the multicast group with a unicast socket so that the
+	// test doesn't depend on the host's multicast routing.
+	group, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+	testGroup := func(s *Server) error {
+		s.multicast.group = group.LocalAddr().(*net.UDPAddr)
+		return nil
+	}
+
+	var calls int32
+	s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+		atomic.AddInt32(&calls, 1)
+		w.Write(data)
+	}, nil, ServerMulticast("239.255.0.1:1758"), testGroup)
+	defer closeServer()
+	addr := ip + ":" + strconv.Itoa(port)
+
+	mcOpts := map[string]string{optMulticast: "", optTransferSize: "0"}
+
+	// First client becomes the master
+	a := sendTestRequest(t, addr, opCodeRRQ, "file", mcOpts)
+	defer a.Close()
+	oack, tid := readTestDatagramFrom(t, a)
+	expectOACK(t, oack, s.multicast.group, 1)
+	if tsize := oack.options()[optTransferSize]; tsize != strconv.Itoa(len(data)) {
+		t.Errorf("expected tsize %d, got %q", len(data), tsize)
+	}
+
+	ackBlock(t, a, tid, 0)
+	expectGroupData(t, group, 1, data[:512])
+	ackBlock(t, a, tid, 1)
+	expectGroupData(t, group, 2, data[512:1024])
+
+	// Second client joins the transfer in progress
+	b := sendTestRequest(t, addr, opCodeRRQ, "file", mcOpts)
+	defer b.Close()
+	oack, bTID := readTestDatagramFrom(t, b)
+	expectOACK(t, oack, s.multicast.group, 0)
+	if bTID.String() != tid.String() {
+		t.Errorf("expected OACK from %v, got %v", tid, bTID)
+	}
+
+	// A different file is served individually
+	c := sendTestRequest(t, addr, opCodeRRQ, "other", map[string]string{optMulticast: ""})
+	defer c.Close()
+	if dg := readTestDatagram(t, c); dg.opcode() != opCodeDATA || dg.block() != 1 {
+		t.Errorf("expected DATA block 1 for individual transfer, got %s", dg)
+	}
+
+	ackBlock(t, a, tid, 2)
+	expectGroupData(t, group, 3, data[1024:])
+	ackBlock(t, a, tid, 3)
+
+	// First client is finished, second becomes master and requests the
+	// blocks it missed
+	oack, _ = readTestDatagramFrom(t, b)
+	expectOACK(t, oack, s.multicast.group, 1)
+	ackBlock(t, b, tid, 0)
+	expectGroupData(t, group, 1, data[:512])
+	ackBlock(t, b, tid, 1)
+	expectGroupData(t, group, 2, data[512:1024])
+	ackBlock(t, b, tid, 3)
+
+	// The transfer ends once all clients have the file
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.multicast.mu.Lock()
+		ses := s.multicast.session
+		s.multicast.mu.Unlock()
+		if ses == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("multicast session did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := s.Stats(); got.Completed < 1 || got.BytesSent < uint64(len(data)+1024) {
+		t.Errorf("expected multicast transfer to be recorded in stats, got %+v", got)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected handler to be called twice (multicast and individual), got %d", n)
+	}
+}
+
+func TestServerMulticast_handlerError(t *testing.T) {
+	t.Parallel()
+
+	_, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+		w.WriteError(ErrCodeFileNotFound, "no such file")
+	}, nil, ServerMulticast("239.255.0.1:1758"))
+	defer closeServer()
+
+	conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", map[string]string{optMulticast: ""})
+	defer conn.Close()
+	dg := readTestDatagram(t, conn)
+	if dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeFileNotFound {
+		t.Errorf("expected FILE_NOT_FOUND error, got %s", dg)
+	}
+}
+
+// readTestDatagramFrom reads a single datagram from conn, returning
+// it and the sender's address.
+func readTestDatagramFrom(t *testing.T, conn *net.UDPConn) (datagram, *net.UDPAddr) {
+	dg := datagram{buf: make([]byte, 65536)}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := conn.ReadFromUDP(dg.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dg.offset = n
+	return dg, addr
+}
+
+func expectOACK(t *testing.T, dg datagram, group *net.UDPAddr, mc int) {
+	t.Helper()
+	if dg.opcode() != opCodeOACK {
+		t.Fatalf("expected OACK, got %s", dg)
+	}
+	expected := fmt.Sprintf("%s,%d,%d", group.IP, group.Port, mc)
+	if got := dg.options()[optMulticast]; got != expected {
+		t.Errorf("expected multicast option %q, got %q", expected, got)
+	}
+}
+
+func ackBlock(t *testing.T, conn *net.UDPConn, tid *net.UDPAddr, block uint16) {
+	t.Helper()
+	var dg datagram
+	dg.writeAck(block)
+	if _, err := conn.WriteTo(dg.bytes(), tid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectGroupData(t *testing.T, group *net.UDPConn, block uint16, data []byte) {
+	t.Helper()
+	dg := readTestDatagram(t, group)
+	if dg.opcode() != opCodeDATA || dg.block() != block {
+		t.Fatalf("expected DATA block %d, got %s", block, dg)
+	}
+	if !bytes.Equal(dg.data(), data) {
+		t.Errorf("block %d: expected %d bytes of data, got %d", block, len(data), len(dg.data()))
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ServeMux routes requests to handlers based on the requested file name.
+//
+// Patterns take one of the following forms:
+//
+//	"/config/boot.cfg" matches the name exactly
+//	"/firmware/"       a trailing slash matches names with the prefix
+//	"*.bin"            a leading "*" matches names with the suffix
+//	"/img/*/kernel"    any other pattern is matched with path.Match
+//
+// An exact match is always preferred, otherwise the longest matching
+// pattern wins. Names are matched as sent by the client, many clients
+// omit the leading slash (e.g. "pxelinux.cfg/default") and patterns
+// should be written to match.
+//
+// ServeMux is safe for concurrent use.
+type ServeMux struct {
+	// NotFound handles requests that do not match any pattern. If nil,
+	// a File Not Found error is sent to the client.
+	NotFound ReadWriteHandler
+
+	mu    sync.RWMutex
+	read  []muxEntry
+	write []muxEntry
+}
+
+type muxEntry struct {
+	pattern string
+	rh      ReadHandler
+	wh      WriteHandler
+}
+
+// NewServeMux returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// HandleRead registers h for read requests matching pattern.
+//
+// HandleRead panics if pattern is invalid or already registered.
+func (m *ServeMux) HandleRead(pattern string, h ReadHandler) {
+	if h == nil {
+		panic("trivialt: nil read handler")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.read = addMuxEntry(m.read, muxEntry{pattern: pattern, rh: h})
+}
+
+// HandleWrite registers h for write requests matching pattern.
+//
+// HandleWrite panics if pattern is invalid or already registered.
+func (m *ServeMux) HandleWrite(pattern string, h WriteHandler) {
+	if h == nil {
+		panic("trivialt: nil write handler")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.write = addMuxEntry(m.write, muxEntry{pattern: pattern, wh: h})
+}
+
+// ServeTFTP dispatches the request to the read handler whose pattern
+// best matches the requested name.
+func (m *ServeMux) ServeTFTP(w ReadRequest) {
+	m.mu.RLock()
+	e, ok := matchMuxEntry(m.read, w.Name())
+	m.mu.RUnlock()
+
+	switch {
+	case ok:
+		e.rh.ServeTFTP(w)
+	case m.NotFound != nil:
+		m.NotFound.ServeTFTP(w)
+	default:
+		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+	}
+}
+
+// ReceiveTFTP dispatches the request to the write handler whose pattern
+// best matches the requested name.
+func (m *ServeMux) ReceiveTFTP(w WriteRequest) {
+	m.mu.RLock()
+	e, ok := matchMuxEntry(m.write, w.Name())
+	m.mu.RUnlock()
+
+	switch {
+	case ok:
+		e.wh.ReceiveTFTP(w)
+	case m.NotFound != nil:
+		m.NotFound.ReceiveTFTP(w)
+	default:
+		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+	}
+}
+
+// addMuxEntry validates e's pattern and appends it to entries.
+func addMuxEntry(entries []muxEntry, e muxEntry) []muxEntry {
+	if e.pattern == "" {
+		panic("trivialt: empty pattern")
+	}
+	if _, err := path.Match(e.pattern, ""); err != nil {
+		panic(fmt.Sprintf("trivialt: invalid pattern %q: %v", e.pattern, err))
+	}
+	for _, existing := range entries {
+		if existing.pattern == e.pattern {
+			panic(fmt.Sprintf("trivialt: multiple registrations for %q", e.pattern))
+		}
+	}
+	return append(entries, e)
+}
+
+// matchMuxEntry returns the entry that best matches name.
+func matchMuxEntry(entries []muxEntry, name string) (muxEntry, bool) {
+	var best muxEntry
+	found := false
+	for _, e := range entries {
+		if e.pattern == name {
+			return e, true
+		}
+		if patternMatches(e.pattern, name) && (!found || len(e.pattern) > len(best.pattern)) {
+			best = e
+			found = true
+		}
+	}
+	return best, found
+}
+
+// patternMatches reports whether name matches pattern.
+func patternMatches(pattern, name string) bool {
+	switch {
+	case strings.HasSuffix(pattern, "/") && !hasMeta(pattern):
+		return strings.HasPrefix(name, pattern)
+	case strings.HasPrefix(pattern, "*") && !hasMeta(pattern[1:]):
+		return strings.HasSuffix(name, pattern[1:])
+	case hasMeta(pattern):
+		ok, _ := path.Match(pattern, name) // Pattern validated on registration
+		return ok
+	}
+	return false // Exact match checked by caller
+}
+
+// hasMeta reports whether s contains path.Match special characters.
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
@@ -0,0 +1,189 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"testing"
+)
+
+func TestServeMux_ServeTFTP(t *testing.T) {
+	var called string
+	mux := NewServeMux()
+	for _, pattern := range []string{
+		"/firmware/",
+		"/firmware/beta/",
+		"/config/boot.cfg",
+		"*.bin",
+		"/img/*/kernel",
+		"pxelinux.cfg/",
+	} {
+		pattern := pattern
+		mux.HandleRead(pattern, ReadHandlerFunc(func(ReadRequest) { called = pattern }))
+	}
+
+	cases := []struct {
+		name    string
+		reqName string
+
+		expectedHandler   string
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:    "exact",
+			reqName: "/config/boot.cfg",
+
+			expectedHandler: "/config/boot.cfg",
+		},
+		{
+			name:    "exact, no partial",
+			reqName: "/config/boot.cfg.old",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+		{
+			name:    "prefix",
+			reqName: "/firmware/v1.img",
+
+			expectedHandler: "/firmware/",
+		},
+		{
+			name:    "longest prefix",
+			reqName: "/firmware/beta/v2.img",
+
+			expectedHandler: "/firmware/beta/",
+		},
+		{
+			name:    "longest pattern over suffix",
+			reqName: "/firmware/beta/v2.bin",
+
+			expectedHandler: "/firmware/beta/",
+		},
+		{
+			name:    "suffix",
+			reqName: "/other/v2.bin",
+
+			expectedHandler: "*.bin",
+		},
+		{
+			name:    "glob",
+			reqName: "/img/arm64/kernel",
+
+			expectedHandler: "/img/*/kernel",
+		},
+		{
+			name:    "relative prefix",
+			reqName: "pxelinux.cfg/01-52-54-00-12-34-56",
+
+			expectedHandler: "pxelinux.cfg/",
+		},
+		{
+			name:    "relative, no match",
+			reqName: "pxelinux.0",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+		{
+			name:    "no match",
+			reqName: "/etc/passwd",
+
+			expectedErrorCode: ErrCodeFileNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			called = ""
+			req := readRequestMock{name: c.reqName}
+
+			mux.ServeTFTP(&req)
+
+			if called != c.expectedHandler {
+				t.Errorf("expected handler %q to be called, got %q", c.expectedHandler, called)
+			}
+			if req.errCode != c.expectedErrorCode {
+				t.Errorf("expected error code %s, got %s", c.expectedErrorCode, req.errCode)
+			}
+		})
+	}
+}
+
+func TestServeMux_ReceiveTFTP(t *testing.T) {
+	var called string
+	mux := NewServeMux()
+	mux.HandleRead("/config/", ReadHandlerFunc(func(ReadRequest) { called = "read" }))
+	mux.HandleWrite("/config/", WriteHandlerFunc(func(WriteRequest) { called = "write" }))
+
+	req := writeRequestMock{name: "/config/boot.cfg"}
+	mux.ReceiveTFTP(&req)
+	if called != "write" {
+		t.Errorf("expected write handler to be called, got %q", called)
+	}
+
+	called = ""
+	req = writeRequestMock{name: "/firmware/v1.img"}
+	mux.ReceiveTFTP(&req)
+	if called != "" {
+		t.Errorf("expected no handler to be called, got %q", called)
+	}
+	if req.errCode != ErrCodeFileNotFound {
+		t.Errorf("expected error code %s, got %s", ErrCodeFileNotFound, req.errCode)
+	}
+}
+
+func TestServeMux_NotFound(t *testing.T) {
+	mux := NewServeMux()
+	mux.NotFound = notFoundHandler{}
+
+	rreq := readRequestMock{name: "file"}
+	mux.ServeTFTP(&rreq)
+	if rreq.errCode != ErrCodeAccessViolation {
+		t.Errorf("expected read error code %s, got %s", ErrCodeAccessViolation, rreq.errCode)
+	}
+
+	wreq := writeRequestMock{name: "file"}
+	mux.ReceiveTFTP(&wreq)
+	if wreq.errCode != ErrCodeAccessViolation {
+		t.Errorf("expected write error code %s, got %s", ErrCodeAccessViolation, wreq.errCode)
+	}
+}
+
+type notFoundHandler struct{}
+
+func (notFoundHandler) ServeTFTP(w ReadRequest) {
+	w.WriteError(ErrCodeAccessViolation, "denied")
+}
+
+func (notFoundHandler) ReceiveTFTP(w WriteRequest) {
+	w.WriteError(ErrCodeAccessViolation, "denied")
+}
+
+func TestServeMux_HandleRead_panics(t *testing.T) {
+	h := ReadHandlerFunc(func(ReadRequest) {})
+
+	cases := []struct {
+		name    string
+		pattern string
+		handler ReadHandler
+	}{
+		{name: "empty pattern", pattern: "", handler: h},
+		{name: "bad pattern", pattern: "/[", handler: h},
+		{name: "duplicate", pattern: "/dup/", handler: h},
+		{name: "nil handler", pattern: "/file", handler: nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mux := NewServeMux()
+			mux.HandleRead("/dup/", h)
+
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected HandleRead(%q) to panic", c.pattern)
+				}
+			}()
+			mux.HandleRead(c.pattern, c.handler)
+		})
+	}
+}
@@ -24,13 +24,23 @@ const (
 
 // Reader is an io.Reader used to retrieve data in the
 // local system's format from a netascii encoded source.
+//
+// If the source returns an error other than io.EOF directly after a CR,
+// the CR is kept until the next Read. A CRLF split between reads of a
+// source that doesn't have the rest of the data yet is decoded as LF.
 type Reader struct {
-	r *bufio.Reader
+	r  io.ByteScanner
+	cr bool // CR read before an error from r, decoded with the next byte
 }
 
-// NewReader returns a Reader wrapping r.
+// NewReader returns a Reader wrapping r. If r implements io.ByteScanner
+// it is read directly, otherwise it is buffered.
 func NewReader(reader io.Reader) *Reader {
-	return &Reader{r: bufio.NewReader(reader)}
+	r, ok := reader.(io.ByteScanner)
+	if !ok {
+		r = bufio.NewReader(reader)
+	}
+	return &Reader{r: r}
 }
 
 // Read reads and decodes netascii from r.
@@ -40,14 +50,28 @@ func (d *Reader) Read(p []byte) (int, error) {
 	written := 0
 
 	for written < bufLen {
-		current, err := d.r.ReadByte()
-		if err != nil {
-			return written, err
+		current := byte(cr)
+		if d.cr {
+			d.cr = false
+		} else {
+			var err error
+			current, err = d.r.ReadByte()
+			if err != nil {
+				return written, err
+			}
 		}
 
 		if current == cr {
 			b, err := d.r.ReadByte()
+			if err == io.EOF {
+				// Bare CR at the end of the data is passed through,
+				// the next call returns EOF
+				p[written] = current
+				return written + 1, nil
+			}
 			if err != nil {
+				// Decoded once the next byte is available
+				d.cr = true
 				return written, err
 			}
 			if runtime.GOOS != "windows" && b == lf {
@@ -120,6 +144,15 @@ func (e *Writer) Write(p []byte) (int, error) {
 }
 
 // Flush flushes any pending data to w.
+//
+// If the last byte written was CR it is terminated with NUL, as CR
+// must always be followed by LF or NUL in netascii.
 func (e *Writer) Flush() error {
+	if e.last == cr {
+		if err := e.w.WriteByte(nul); err != nil {
+			return err
+		}
+		e.last = nul
+	}
 	return e.w.Flush()
 }
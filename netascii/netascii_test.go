@@ -6,6 +6,7 @@ package netascii
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"runtime"
@@ -33,6 +34,10 @@ func TestReader(t *testing.T) {
 			input:    "A string with incorrect \r encoding",
 			expected: "A string with incorrect \r encoding",
 		},
+		{
+			input:    "A string ending with bare \r",
+			expected: "A string ending with bare \r",
+		},
 	}
 
 	for _, c := range cases {
@@ -85,6 +90,81 @@ func TestReader_windows(t *testing.T) {
 	}
 }
 
+// errMore is returned by chunkReader until the final chunk is added.
+var errMore = errors.New("more data expected")
+
+// chunkReader is a source whose data arrives in chunks, like the DATA
+// blocks of a transfer.
+type chunkReader struct {
+	bytes.Buffer
+	final bool
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n, err := r.Buffer.Read(p)
+	if err == io.EOF && !r.final {
+		err = errMore
+	}
+	return n, err
+}
+
+func (r *chunkReader) ReadByte() (byte, error) {
+	b, err := r.Buffer.ReadByte()
+	if err == io.EOF && !r.final {
+		err = errMore
+	}
+	return b, err
+}
+
+func TestReader_split(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping non-windows tests")
+	}
+	cases := []struct {
+		chunks   []string
+		expected string
+	}{
+		{chunks: []string{"aaa\r", "\nbbb"}, expected: "aaa\nbbb"},
+		{chunks: []string{"aaa\r", "\x00bbb"}, expected: "aaa\rbbb"},
+		{chunks: []string{"aaa\r", "bbb"}, expected: "aaa\rbbb"},
+		{chunks: []string{"aaa\r", ""}, expected: "aaa\r"},
+	}
+
+	for _, c := range cases {
+		for _, buffered := range []bool{false, true} {
+			src := &chunkReader{}
+			var reader *Reader
+			if buffered {
+				// Hide io.ByteScanner
+				reader = NewReader(struct{ io.Reader }{src})
+			} else {
+				reader = NewReader(src)
+			}
+
+			var result []byte
+			for i, chunk := range c.chunks {
+				src.WriteString(chunk)
+				src.final = i == len(c.chunks)-1
+				for {
+					p := make([]byte, 512)
+					n, err := reader.Read(p)
+					result = append(result, p[:n]...)
+					if err == errMore || err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			if string(result) != c.expected {
+				t.Errorf("Expected %q to be %q, but it was %q (buffered %t)", c.chunks, c.expected, result, buffered)
+			}
+		}
+	}
+}
+
 func TestWriter(t *testing.T) {
 	cases := []struct {
 		input    string
@@ -102,6 +182,10 @@ func TestWriter(t *testing.T) {
 			input:    "A string \r\x00 with existing \r\n encoding",
 			expected: "A string \r\x00 with existing \r\n encoding",
 		},
+		{
+			input:    "A string ending with \r",
+			expected: "A string ending with \r\x00",
+		},
 	}
 
 	for _, c := range cases {
@@ -0,0 +1,64 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// pktInfoLen is the size of the control message buffer needed to
+// receive packet info.
+var pktInfoLen = syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// enablePktInfo requests that the destination address of datagrams
+// received on conn be reported, returning false if it isn't supported.
+//
+// IP_PKTINFO is also enabled on IPv6 sockets to cover IPv4 datagrams
+// received on dual-stack sockets.
+func enablePktInfo(conn *net.UDPConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var err4, err6 error
+	err = raw.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	})
+	return err == nil && (err4 == nil || err6 == nil)
+}
+
+// parsePktInfo returns the local address a datagram was received on from
+// its control messages, or nil if it isn't present.
+func parsePktInfo(oob []byte) *net.UDPAddr {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			// struct in_pktinfo { int ipi_ifindex; struct in_addr ipi_spec_dst; struct in_addr ipi_addr; }
+			// ipi_spec_dst is the local address of the receiving interface,
+			// ipi_addr may be a broadcast address.
+			return &net.UDPAddr{IP: net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7])}
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO && len(m.Data) >= syscall.SizeofInet6Pktinfo:
+			// struct in6_pktinfo { struct in6_addr ipi6_addr; unsigned int ipi6_ifindex; }
+			addr := &net.UDPAddr{IP: make(net.IP, net.IPv6len)}
+			copy(addr.IP, m.Data[:net.IPv6len])
+			if addr.IP.IsLinkLocalUnicast() {
+				ifindex := binary.NativeEndian.Uint32(m.Data[net.IPv6len:])
+				if ifi, err := net.InterfaceByIndex(int(ifindex)); err == nil {
+					addr.Zone = ifi.Name
+				}
+			}
+			return addr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build !linux
+// +build !linux
+
+package trivialt
+
+import "net"
+
+const pktInfoLen = 0
+
+// enablePktInfo is not supported on this platform.
+func enablePktInfo(conn *net.UDPConn) bool {
+	return false
+}
+
+// parsePktInfo is not supported on this platform.
+func parsePktInfo(oob []byte) *net.UDPAddr {
+	return nil
+}
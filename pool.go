@@ -0,0 +1,195 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultMaxIdle = 2
+
+// ClientPool is a pool of Clients making requests to a single server.
+//
+// Clients returned by the pool have the server's address pre-resolved,
+// avoiding a lookup for each transfer to the server. Each transfer still
+// uses a new socket, as RFC1350 requires a new transfer ID per transfer.
+//
+// A Client is not safe for concurrent use, a ClientPool allows many
+// goroutines to make requests by giving each exclusive use of a Client
+// between Get and Put. ClientPool is safe for concurrent use.
+type ClientPool struct {
+	host        string      // Normalized server host and port
+	clientOpts  []ClientOpt // Options applied to each new Client
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []idleClient // Most recently returned last
+	closed bool
+}
+
+type idleClient struct {
+	c     *Client
+	since time.Time
+}
+
+// NewClientPool returns a ClientPool for the server at host, in the
+// format [server]:[port]. If port is not specified, 69 is used.
+//
+// Any number of ClientPoolOpts can be provided to modify the default
+// pool behavior.
+func NewClientPool(host string, opts ...ClientPoolOpt) (*ClientPool, error) {
+	if host == "" {
+		return nil, ErrInvalidHostIP
+	}
+	host, err := parseHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ClientPool{
+		host:    host,
+		maxIdle: defaultMaxIdle,
+	}
+
+	// Apply option functions to pool
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+
+	// Validate client options
+	if _, err := NewClient(p.clientOpts...); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Get returns an idle Client from the pool, or a new Client if there are
+// none. The Client should be returned with Put once the caller is done
+// with it.
+//
+// Requests made by the Client to hosts other than the pool's are
+// resolved as usual.
+func (p *ClientPool) Get() (*Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	p.evictExpired(time.Now())
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1].c
+		p.idle[n-1] = idleClient{}
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	c, err := NewClient(p.clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c.addr, err = net.ResolveUDPAddr(c.net, p.host)
+	if err != nil {
+		return nil, wrapError(err, "address resolve failed")
+	}
+	c.host = p.host
+	return c, nil
+}
+
+// Put returns c to the pool. If the pool is closed or already holds
+// the maximum number of idle Clients, c is discarded.
+//
+// c must not be used after it has been returned.
+func (p *ClientPool) Put(c *Client) {
+	if c == nil || c.host != p.host {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.evictExpired(now)
+	if p.closed || len(p.idle) >= p.maxIdle {
+		return
+	}
+	p.idle = append(p.idle, idleClient{c: c, since: now})
+}
+
+// Close discards all idle Clients. Subsequent calls to Get
+// return ErrPoolClosed.
+//
+// Clients in use are unaffected, they are discarded by Put.
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.idle = nil
+	return nil
+}
+
+// evictExpired removes Clients that have been idle longer than
+// idleTimeout. p.mu must be held.
+func (p *ClientPool) evictExpired(now time.Time) {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	// idle is ordered by return time, oldest first
+	i := 0
+	for i < len(p.idle) && now.Sub(p.idle[i].since) >= p.idleTimeout {
+		p.idle[i] = idleClient{}
+		i++
+	}
+	p.idle = p.idle[i:]
+}
+
+// ClientPoolOpt is a function that configures a ClientPool.
+type ClientPoolOpt func(*ClientPool) error
+
+// ClientPoolClientOpts configures the options used to create
+// each Client in the pool.
+func ClientPoolClientOpts(opts ...ClientOpt) ClientPoolOpt {
+	return func(p *ClientPool) error {
+		p.clientOpts = append(p.clientOpts, opts...)
+		return nil
+	}
+}
+
+// ClientPoolMaxIdle configures the maximum number of idle Clients kept
+// by the pool. Clients returned while the pool is full are discarded.
+// A value of zero disables reuse.
+//
+// Default: 2.
+func ClientPoolMaxIdle(n int) ClientPoolOpt {
+	return func(p *ClientPool) error {
+		if n < 0 {
+			return ErrInvalidMaxIdle
+		}
+		p.maxIdle = n
+		return nil
+	}
+}
+
+// ClientPoolIdleTimeout configures how long a Client may remain idle in
+// the pool before it is discarded. Discarded Clients are replaced by new
+// Clients, which resolve the server's address again.
+//
+// Default: 0 (no limit).
+func ClientPoolIdleTimeout(d time.Duration) ClientPoolOpt {
+	return func(p *ClientPool) error {
+		if d < 0 {
+			return ErrInvalidIdleTimeout
+		}
+		p.idleTimeout = d
+		return nil
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewClientPool(t *testing.T) {
+	cases := []struct {
+		name string
+		host string
+		opts []ClientPoolOpt
+
+		expectedHost string
+		expectedErr  error
+	}{
+		{
+			name:         "default port",
+			host:         "localhost",
+			expectedHost: "localhost:69",
+		},
+		{
+			name:         "with port",
+			host:         "localhost:6969",
+			expectedHost: "localhost:6969",
+		},
+		{
+			name:        "empty host",
+			host:        "",
+			expectedErr: ErrInvalidHostIP,
+		},
+		{
+			name:        "invalid port",
+			host:        "localhost:tftp",
+			expectedErr: ErrInvalidHostIP,
+		},
+		{
+			name:        "negative max idle",
+			host:        "localhost",
+			opts:        []ClientPoolOpt{ClientPoolMaxIdle(-1)},
+			expectedErr: ErrInvalidMaxIdle,
+		},
+		{
+			name:        "negative idle timeout",
+			host:        "localhost",
+			opts:        []ClientPoolOpt{ClientPoolIdleTimeout(-time.Second)},
+			expectedErr: ErrInvalidIdleTimeout,
+		},
+		{
+			name:        "invalid client option",
+			host:        "localhost",
+			opts:        []ClientPoolOpt{ClientPoolClientOpts(ClientBlocksize(1))},
+			expectedErr: ErrInvalidBlocksize,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := NewClientPool(c.host, c.opts...)
+			if err != c.expectedErr {
+				t.Fatalf("expected error %v, got %v", c.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if p.host != c.expectedHost {
+				t.Errorf("expected host %q, got %q", c.expectedHost, p.host)
+			}
+		})
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	t.Parallel()
+
+	random := getTestData(t, "1MB-random")
+	var mu sync.Mutex
+	written := map[string][]byte{}
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		w.WriteSize(int64(len(random)))
+		w.Write(random)
+	}, func(w WriteRequest) {
+		data, _ := ioutil.ReadAll(w)
+		mu.Lock()
+		written[w.Name()] = data
+		mu.Unlock()
+	})
+	defer closeServer()
+
+	host := ip + ":" + strconv.Itoa(port)
+	p, err := NewClientPool(host, ClientPoolClientOpts(ClientBlocksize(1468), ClientTransferSize(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	const workers = 4
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				c, err := p.Get()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				resp, err := c.Get("tftp://" + host + "/file")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if size, err := resp.Size(); err != nil || size != int64(len(random)) {
+					t.Errorf("expected size %d, got %d (%v)", len(random), size, err)
+				}
+				data, err := ioutil.ReadAll(resp)
+				resp.Close()
+				if err != nil {
+					t.Error(err)
+				} else if !bytes.Equal(data, random) {
+					t.Errorf("expected %d bytes, got %d", len(random), len(data))
+				}
+
+				// A Put without size must not disable tsize for later requests
+				name := strconv.Itoa(i) + "-" + strconv.Itoa(j)
+				if err := c.Put("tftp://"+host+"/"+name, bytes.NewReader([]byte(name)), 0); err != nil {
+					t.Error(err)
+				}
+
+				p.Put(c)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Handlers may still be storing the final writes
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(written)
+		mu.Unlock()
+		if n == workers*3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d files written, got %d", workers*3, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for name, data := range written {
+		if string(data) != name {
+			t.Errorf("expected %q to contain its name, got %q", name, data)
+		}
+	}
+	if n := len(p.idle); n != defaultMaxIdle {
+		t.Errorf("expected %d idle clients, got %d", defaultMaxIdle, n)
+	}
+}
+
+func TestClientPool_reuse(t *testing.T) {
+	p, err := NewClientPool("127.0.0.1:6969", ClientPoolMaxIdle(1), ClientPoolIdleTimeout(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.addr == nil || a.addr.String() != "127.0.0.1:6969" {
+		t.Errorf("expected client with resolved address, got %v", a.addr)
+	}
+	b, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("expected distinct clients while both are in use")
+	}
+
+	p.Put(a)
+	p.Put(b) // Discarded, pool is full
+	if got, _ := p.Get(); got != a {
+		t.Error("expected idle client to be reused")
+	}
+	if got, _ := p.Get(); got == a || got == b {
+		t.Error("expected a new client when none are idle")
+	}
+
+	// Clients from elsewhere are not pooled
+	other, _ := NewClient()
+	p.Put(other)
+	if len(p.idle) != 0 {
+		t.Error("expected client not created by the pool to be discarded")
+	}
+
+	// Expired clients are replaced
+	p.Put(a)
+	p.idle[0].since = time.Now().Add(-2 * time.Hour)
+	if got, _ := p.Get(); got == a {
+		t.Error("expected expired client to be discarded")
+	}
+
+	p.Close()
+	if _, err := p.Get(); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed, got %v", err)
+	}
+	p.Put(a)
+	if len(p.idle) != 0 {
+		t.Error("expected client to be discarded after Close")
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultProxyCooldown = 10 * time.Second
+
+// Proxy is a ReadWriteHandler that relays requests to upstream TFTP
+// servers. It is safe for concurrent use.
+//
+// Read requests are satisfied by a Get from an upstream server, write
+// requests are forwarded with a Put, using the requested file name
+// unchanged. Data is streamed between the transfers, which negotiate
+// options independently. ERRORs from the upstream server are sent to
+// the client with the same code and message.
+//
+// Upstream servers are tried in order until one accepts the request. An
+// upstream that doesn't respond is skipped by later requests until its
+// cooldown expires, see ProxyCooldown. Once data has been exchanged with
+// the client the transfer is not retried, as blocks from another
+// upstream may not match. The upstream used is reported in
+// TransferStats.Upstream.
+type Proxy struct {
+	upstreams  []*upstream
+	clientOpts []ClientOpt
+	roundRobin bool
+	failover   map[ErrorCode]bool // ERROR codes retried with the next upstream
+	cooldown   time.Duration
+
+	next uint32 // Incremented atomically to choose the first upstream
+}
+
+// upstream is a server requests can be relayed to.
+type upstream struct {
+	pool *ClientPool
+
+	mu        sync.Mutex
+	downUntil time.Time // Skipped until, after failing to respond
+}
+
+// upstreamRecorder is implemented by requests that record the upstream
+// server relaying them.
+type upstreamRecorder interface {
+	setUpstream(host string)
+}
+
+// NewProxy returns a Proxy for the upstream servers at hosts, in the
+// format [server]:[port]. If port is not specified, 69 is used.
+//
+// Any number of ProxyOpts can be provided to modify the default
+// proxy behavior.
+func NewProxy(hosts []string, opts ...ProxyOpt) (*Proxy, error) {
+	if len(hosts) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	p := &Proxy{
+		failover: make(map[ErrorCode]bool),
+		cooldown: defaultProxyCooldown,
+	}
+
+	// Apply option functions to proxy
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+
+	// The transfer size (tsize) is requested by default, so that
+	// it can be passed on to the client
+	clientOpts := append([]ClientOpt{ClientTransferSize(true)}, p.clientOpts...)
+	for _, host := range hosts {
+		pool, err := NewClientPool(host, ClientPoolClientOpts(clientOpts...))
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, &upstream{pool: pool})
+	}
+
+	return p, nil
+}
+
+// ServeTFTP sends the requested file from an upstream server.
+func (p *Proxy) ServeTFTP(w ReadRequest) {
+	var err error
+	for _, u := range p.candidates() {
+		recordUpstream(w, u.pool.host)
+
+		var resp *Response
+		resp, err = u.get(w.Name())
+		if err != nil {
+			if p.shouldFailover(u, err) {
+				continue
+			}
+			break
+		}
+		defer resp.Close()
+
+		// Data may be sent to the client from here on, errors
+		// end the transfer.
+		if size, err := resp.Size(); err == nil {
+			w.WriteSize(size)
+		}
+		if _, err := io.Copy(w, resp); err != nil {
+			proxyError(w.Abort, err)
+		}
+		return
+	}
+	proxyError(w.Abort, err)
+}
+
+// ReceiveTFTP sends the received file to an upstream server.
+func (p *Proxy) ReceiveTFTP(w WriteRequest) {
+	r := &countingReader{r: w}
+	size, _ := w.Size() // Zero if unknown, omitting tsize
+
+	var err error
+	for _, u := range p.candidates() {
+		recordUpstream(w, u.pool.host)
+
+		err = u.put(w.Name(), r, size)
+		if err == nil {
+			return
+		}
+		// Data read from the client can't be sent again
+		if r.n > 0 || !p.shouldFailover(u, err) {
+			break
+		}
+	}
+	proxyError(w.Abort, err)
+}
+
+// candidates returns the upstreams to try, in order. Upstreams in
+// their cooldown are omitted, unless all of them are.
+func (p *Proxy) candidates() []*upstream {
+	first := 0
+	if p.roundRobin {
+		first = int((atomic.AddUint32(&p.next, 1) - 1) % uint32(len(p.upstreams)))
+	}
+
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for i := range p.upstreams {
+		u := p.upstreams[(first+i)%len(p.upstreams)]
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range p.upstreams {
+			candidates = append(candidates, p.upstreams[(first+i)%len(p.upstreams)])
+		}
+	}
+	return candidates
+}
+
+// shouldFailover reports whether a request that failed on u with err
+// should be tried with the next upstream.
+//
+// Upstreams that fail without sending an ERROR are put in cooldown.
+func (p *Proxy) shouldFailover(u *upstream, err error) bool {
+	var tftpErr *Error
+	if errors.As(err, &tftpErr) {
+		return p.failover[tftpErr.Code]
+	}
+	u.markDown(time.Now().Add(p.cooldown))
+	return true
+}
+
+func (u *upstream) get(name string) (*Response, error) {
+	c, err := u.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	// The response has its own conn, the client is free once Get returns
+	defer u.pool.Put(c)
+	return c.Get(u.url(name))
+}
+
+func (u *upstream) put(name string, r io.Reader, size int64) error {
+	c, err := u.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer u.pool.Put(c)
+	return c.Put(u.url(name), r, size)
+}
+
+func (u *upstream) url(name string) string {
+	return "tftp://" + u.pool.host + "/" + name
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+func (u *upstream) markDown(until time.Time) {
+	u.mu.Lock()
+	u.downUntil = until
+	u.mu.Unlock()
+}
+
+// recordUpstream sets the upstream reported in the stats of req,
+// if it supports it.
+func recordUpstream(req interface{}, host string) {
+	if r, ok := req.(upstreamRecorder); ok {
+		r.setUpstream(host)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// proxyError ends a proxied transfer with abort. ERRORs from the upstream
+// server are relayed with their code and message, other errors are
+// reported as ErrCodeNotDefined.
+//
+// Abort has no effect if the client ended the transfer.
+func proxyError(abort func(ErrorCode, string), err error) {
+	var tftpErr *Error
+	if errors.As(err, &tftpErr) {
+		abort(tftpErr.Code, tftpErr.Message)
+		return
+	}
+	abort(ErrCodeNotDefined, "upstream transfer failed")
+}
+
+// ProxyOpt is a function that configures a Proxy.
+type ProxyOpt func(*Proxy) error
+
+// ProxyClientOpts configures the options used by the Clients making
+// requests to upstream servers.
+func ProxyClientOpts(opts ...ClientOpt) ProxyOpt {
+	return func(p *Proxy) error {
+		if _, err := NewClient(opts...); err != nil {
+			return err
+		}
+		p.clientOpts = append(p.clientOpts, opts...)
+		return nil
+	}
+}
+
+// ProxyRoundRobin configures the proxy to start each request with the
+// upstream after the one the previous request started with, spreading
+// requests across the upstreams. Otherwise, requests start with the
+// first upstream.
+//
+// Default: false.
+func ProxyRoundRobin(enable bool) ProxyOpt {
+	return func(p *Proxy) error {
+		p.roundRobin = enable
+		return nil
+	}
+}
+
+// ProxyFailoverCodes configures ERROR codes from an upstream server that
+// cause the request to be tried with the next upstream, rather than
+// relayed to the client. The ERROR from the last upstream tried is
+// relayed to the client.
+//
+// Upstreams that don't respond are always failed over.
+//
+// Default: none.
+func ProxyFailoverCodes(codes ...ErrorCode) ProxyOpt {
+	return func(p *Proxy) error {
+		for _, code := range codes {
+			p.failover[code] = true
+		}
+		return nil
+	}
+}
+
+// ProxyCooldown configures how long an upstream server that didn't
+// respond is skipped for. Requests are only sent to upstreams in their
+// cooldown if all of them are. A value of zero disables the cooldown.
+//
+// Default: 10 seconds.
+func ProxyCooldown(d time.Duration) ProxyOpt {
+	return func(p *Proxy) error {
+		if d < 0 {
+			return ErrInvalidCooldown
+		}
+		p.cooldown = d
+		return nil
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxy(t *testing.T) {
+	t.Parallel()
+
+	data := getTestData(t, "1MB-random")[:100000]
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("file", data)
+
+	// Upstream and proxy negotiate different block and window sizes
+	// than the client, requiring the data to be re-blocked.
+	ip, port, closeOrigin := newTestServer(t, false, store.ServeTFTP, func(w WriteRequest) {
+		if w.Name() == "denied" {
+			w.WriteError(ErrCodeAccessViolation, "uploads to denied are not allowed")
+			return
+		}
+		store.ReceiveTFTP(w)
+	})
+	defer closeOrigin()
+
+	proxy, err := NewProxy([]string{ip + ":" + strconv.Itoa(port)}, ProxyClientOpts(ClientBlocksize(512), ClientWindowsize(4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, port, closeProxy := newTestServer(t, true, proxy.ServeTFTP, proxy.ReceiveTFTP)
+	defer closeProxy()
+	url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/"
+
+	client, err := NewClient(ClientBlocksize(1468), ClientTransferSize(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectError := func(t *testing.T, err error, code ErrorCode, msg string) {
+		t.Helper()
+		var tftpErr *Error
+		if !errors.As(err, &tftpErr) {
+			t.Fatalf("expected *Error, got %v", err)
+		}
+		if tftpErr.Code != code || tftpErr.Message != msg {
+			t.Errorf("expected ERROR %s %q, got %s %q", code, msg, tftpErr.Code, tftpErr.Message)
+		}
+	}
+
+	t.Run("read", func(t *testing.T) {
+		resp, err := client.Get(url + "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, err := resp.Size(); err != nil || size != int64(len(data)) {
+			t.Errorf("expected size %d, got %d (%v)", len(data), size, err)
+		}
+		got, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("expected %d bytes, got %d", len(data), len(got))
+		}
+	})
+
+	t.Run("read, not found", func(t *testing.T) {
+		_, err := client.Get(url + "missing")
+		expectError(t, err, ErrCodeFileNotFound, `File "missing" does not exist`)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		if err := client.Put(url+"upload", bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		// The client's transfer completes before the upstream transfer
+		deadline := time.Now().Add(2 * time.Second)
+		got, ok := store.Get("upload")
+		for !ok && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			got, ok = store.Get("upload")
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("expected upstream to store %d bytes, got %d", len(data), len(got))
+		}
+	})
+
+	t.Run("write, denied", func(t *testing.T) {
+		err := client.Put(url+"denied", bytes.NewReader(data), int64(len(data)))
+		expectError(t, err, ErrCodeAccessViolation, "uploads to denied are not allowed")
+	})
+}
+
+func TestProxy_failover(t *testing.T) {
+	t.Parallel()
+
+	data := getTestData(t, "1MB-random")[:10000]
+
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("file", data)
+	ip, port, closeOrigin := newTestServer(t, false, store.ServeTFTP, store.ReceiveTFTP)
+	defer closeOrigin()
+	origin := ip + ":" + strconv.Itoa(port)
+
+	// Upstream that never responds
+	down, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+	var downReceived int64
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, _, err := down.ReadFrom(buf); err != nil {
+				return
+			}
+			atomic.AddInt64(&downReceived, 1)
+		}
+	}()
+
+	// Upstream that has no files
+	ip, port, closeEmpty := newTestServer(t, false, func(w ReadRequest) {
+		w.WriteError(ErrCodeFileNotFound, "not here")
+	}, func(w WriteRequest) {
+		w.WriteError(ErrCodeAccessViolation, "read only")
+	})
+	defer closeEmpty()
+	empty := ip + ":" + strconv.Itoa(port)
+
+	client, err := NewClient(ClientTimeout(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// startProxy returns the URL of a server proxying to upstreams, and
+	// a channel receiving the upstream reported for each transfer
+	startProxy := func(t *testing.T, upstreams []string, opts ...ProxyOpt) (string, chan string) {
+		opts = append(opts, ProxyClientOpts(ClientTimeout(time.Second), ClientRetransmit(1)))
+		proxy, err := NewProxy(upstreams, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan string, 1)
+		ip, port, closeProxy := newTestServer(t, false, func(w ReadRequest) {
+			proxy.ServeTFTP(w)
+			served <- w.Stats().Upstream
+		}, func(w WriteRequest) {
+			proxy.ReceiveTFTP(w)
+			served <- w.Stats().Upstream
+		})
+		t.Cleanup(closeProxy)
+		return "tftp://" + ip + ":" + strconv.Itoa(port) + "/", served
+	}
+
+	expectUpstream := func(t *testing.T, served chan string, expected string) {
+		t.Helper()
+		select {
+		case got := <-served:
+			if got != expected {
+				t.Errorf("expected transfer served by %s, got %s", expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for proxy handler")
+		}
+	}
+
+	t.Run("first down", func(t *testing.T) {
+		url, served := startProxy(t, []string{down.LocalAddr().String(), origin})
+
+		resp, err := client.Get(url + "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("expected %d bytes, got %d", len(data), len(got))
+		}
+		expectUpstream(t, served, origin)
+		received := atomic.LoadInt64(&downReceived)
+		if received == 0 {
+			t.Fatal("expected request to be sent to the first upstream")
+		}
+
+		// The first upstream is in its cooldown, writes go straight to the second
+		if err := client.Put(url+"upload", bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		expectUpstream(t, served, origin)
+		if got, _ := store.Get("upload"); !bytes.Equal(got, data) {
+			t.Errorf("expected upstream to store %d bytes, got %d", len(data), len(got))
+		}
+		if n := atomic.LoadInt64(&downReceived); n != received {
+			t.Errorf("expected no requests to upstream in cooldown, got %d", n-received)
+		}
+	})
+
+	cases := []struct {
+		name  string
+		codes []ErrorCode
+
+		expectedUpstream string
+		expectedErr      bool
+	}{
+		{
+			name:             "FileNotFound, failover disabled",
+			codes:            []ErrorCode{ErrCodeAccessViolation},
+			expectedUpstream: empty,
+			expectedErr:      true,
+		},
+		{
+			name:             "FileNotFound, failover enabled",
+			codes:            []ErrorCode{ErrCodeFileNotFound},
+			expectedUpstream: origin,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			url, served := startProxy(t, []string{empty, origin}, ProxyFailoverCodes(c.codes...))
+
+			resp, err := client.Get(url + "file")
+			if c.expectedErr {
+				var tftpErr *Error
+				if !errors.As(err, &tftpErr) || tftpErr.Code != ErrCodeFileNotFound || tftpErr.Message != "not here" {
+					t.Errorf("expected FileNotFound from first upstream, got %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err := ioutil.ReadAll(resp); err != nil || !bytes.Equal(got, data) {
+					t.Errorf("expected %d bytes, got %d (%v)", len(data), len(got), err)
+				}
+			}
+			expectUpstream(t, served, c.expectedUpstream)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// NewPXEConfigHandler returns a ReadHandler serving PXELINUX configuration
+// files from lookup.
+//
+// PXELINUX requests the configuration files for a client in order,
+// until one is found:
+//
+//	pxelinux.cfg/<uuid>                 e.g. b8945908-d6a6-41a9-611d-74a6ab80b83d
+//	pxelinux.cfg/<type>-<mac>           e.g. 01-88-99-aa-bb-cc-dd
+//	pxelinux.cfg/<ip>                   e.g. C0A8020A, the IPv4 address in hex
+//	pxelinux.cfg/<ip prefix>            C0A8020, C0A802, ... C
+//	pxelinux.cfg/default
+//
+// Requests for the MAC form call lookup with the client's hardware address
+// and requests for the full IP form with its IP address. The other forms,
+// including shorter prefixes of the IP address which name subnets rather
+// than clients, and any other file are served by fallback.
+//
+// lookup returns the configuration file and its size, or -1 if the size
+// is unknown. If it returns an error matching fs.ErrNotExist the request
+// is served by fallback, allowing a FileServer to provide static files.
+// Other errors are sent to the client. If fallback is nil, a File Not
+// Found error is sent instead, causing the client to request the next
+// file.
+func NewPXEConfigHandler(lookup func(mac net.HardwareAddr, ip net.IP) (io.ReadCloser, int64, error), fallback ReadHandler) ReadHandler {
+	return &pxeConfigHandler{
+		lookup:   lookup,
+		fallback: fallback,
+		log:      newLogger("pxeconfig"),
+	}
+}
+
+type pxeConfigHandler struct {
+	lookup   func(mac net.HardwareAddr, ip net.IP) (io.ReadCloser, int64, error)
+	fallback ReadHandler
+	log      *logger
+}
+
+// ServeTFTP sends the configuration file for the client named by w.
+func (h *pxeConfigHandler) ServeTFTP(w ReadRequest) {
+	mac, ip := parsePXEConfigName(w.Name())
+	if mac == nil && ip == nil {
+		h.serveFallback(w)
+		return
+	}
+
+	file, size, err := h.lookup(mac, ip)
+	if errors.Is(err, fs.ErrNotExist) {
+		h.serveFallback(w)
+		return
+	}
+	if err != nil {
+		h.log.debug("looking up %q: %v", w.Name(), err)
+		w.WriteError(ErrCodeNotDefined, fmt.Sprintf("Cannot read file %q", w.Name()))
+		return
+	}
+	defer errorDefer(file.Close, h.log, "error closing file")
+
+	if size >= 0 {
+		w.WriteSize(size)
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		h.log.debug("sending %q: %v", w.Name(), err)
+		// No effect if the client ended the transfer
+		w.Abort(ErrCodeNotDefined, fmt.Sprintf("Cannot read file %q", w.Name()))
+	}
+}
+
+func (h *pxeConfigHandler) serveFallback(w ReadRequest) {
+	if h.fallback == nil {
+		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+		return
+	}
+	h.fallback.ServeTFTP(w)
+}
+
+// parsePXEConfigName returns the hardware address or IP address named by
+// a PXELINUX configuration file, or nil for both if it names neither.
+//
+// The hardware address form is the ARP hardware type followed by the
+// address, in lowercase hex separated by dashes. The IP address form is
+// the IPv4 address in uppercase hex.
+func parsePXEConfigName(name string) (net.HardwareAddr, net.IP) {
+	if path.Base(path.Dir("/"+name)) != "pxelinux.cfg" {
+		return nil, nil
+	}
+	base := path.Base(name)
+
+	// <type>-<mac>
+	if len(base) > 3 && base[2] == '-' {
+		if _, err := strconv.ParseUint(base[:2], 16, 8); err != nil {
+			return nil, nil
+		}
+		mac, err := net.ParseMAC(base[3:])
+		if err != nil || base[3:] != strings.ToLower(base[3:]) {
+			return nil, nil
+		}
+		return mac, nil
+	}
+
+	// <ip>, shorter prefixes aren't a client's address
+	if len(base) != 2*net.IPv4len || base != strings.ToUpper(base) {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(base)
+	if err != nil {
+		return nil, nil
+	}
+	return nil, net.IPv4(b[0], b[1], b[2], b[3])
+}
@@ -0,0 +1,186 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPXEConfigHandler(t *testing.T) {
+	mac, _ := net.ParseMAC("88:99:aa:bb:cc:dd")
+	ip := net.IPv4(192, 168, 2, 10)
+	hostConfig := []byte("LABEL host\n")
+	errBackend := errors.New("backend unavailable")
+
+	// lookup has a configuration for mac and ip only
+	lookup := func(m net.HardwareAddr, i net.IP) (io.ReadCloser, int64, error) {
+		switch {
+		case m != nil && i != nil:
+			t.Errorf("expected MAC or IP, got %s and %s", m, i)
+		case m.String() == "de:ad:be:ef:00:00":
+			return nil, 0, errBackend
+		case bytes.Equal(m, mac), i.Equal(ip):
+			return ioutil.NopCloser(bytes.NewReader(hostConfig)), int64(len(hostConfig)), nil
+		}
+		return nil, 0, &fs.PathError{Op: "open", Path: "config", Err: fs.ErrNotExist}
+	}
+	// fallback has static files for a subnet and the default
+	fallback := ReadHandlerFunc(func(w ReadRequest) {
+		switch w.Name() {
+		case "pxelinux.cfg/C0A802", "pxelinux.cfg/default":
+			w.Write([]byte("LABEL " + w.Name() + "\n"))
+		default:
+			w.WriteError(ErrCodeFileNotFound, "fallback: not found")
+		}
+	})
+
+	cases := []struct {
+		name       string
+		reqName    string
+		noFallback bool
+
+		expectedData      string
+		expectedSize      *int64
+		expectedErrorCode ErrorCode
+		expectedErrorMsg  string
+	}{
+		{
+			name:         "MAC",
+			reqName:      "pxelinux.cfg/01-88-99-aa-bb-cc-dd",
+			expectedData: string(hostConfig),
+			expectedSize: ptrInt64(int64(len(hostConfig))),
+		},
+		{
+			name:         "MAC, leading slash",
+			reqName:      "/boot/pxelinux.cfg/01-88-99-aa-bb-cc-dd",
+			expectedData: string(hostConfig),
+			expectedSize: ptrInt64(int64(len(hostConfig))),
+		},
+		{
+			name:              "MAC, not found",
+			reqName:           "pxelinux.cfg/01-88-99-aa-bb-cc-00",
+			expectedErrorCode: ErrCodeFileNotFound,
+			expectedErrorMsg:  "fallback: not found",
+		},
+		{
+			name:              "MAC, lookup error",
+			reqName:           "pxelinux.cfg/01-de-ad-be-ef-00-00",
+			expectedErrorCode: ErrCodeNotDefined,
+			expectedErrorMsg:  `Cannot read file "pxelinux.cfg/01-de-ad-be-ef-00-00"`,
+		},
+		{
+			name:         "IP",
+			reqName:      "pxelinux.cfg/C0A8020A",
+			expectedData: string(hostConfig),
+			expectedSize: ptrInt64(int64(len(hostConfig))),
+		},
+		{
+			name:              "IP, not found",
+			reqName:           "pxelinux.cfg/C0A8020B",
+			expectedErrorCode: ErrCodeFileNotFound,
+			expectedErrorMsg:  "fallback: not found",
+		},
+		{
+			name:         "default",
+			reqName:      "pxelinux.cfg/default",
+			expectedData: "LABEL pxelinux.cfg/default\n",
+		},
+		{
+			name:              "default, no fallback",
+			reqName:           "pxelinux.cfg/default",
+			noFallback:        true,
+			expectedErrorCode: ErrCodeFileNotFound,
+			expectedErrorMsg:  `File "pxelinux.cfg/default" does not exist`,
+		},
+		{
+			name:              "UUID",
+			reqName:           "pxelinux.cfg/b8945908-d6a6-41a9-611d-74a6ab80b83d",
+			expectedErrorCode: ErrCodeFileNotFound,
+			expectedErrorMsg:  "fallback: not found",
+		},
+	}
+
+	// Shorter IP prefixes are served by the fallback, which has C0A802
+	for n := 7; n > 0; n-- {
+		prefix := "C0A8020A"[:n]
+		c := cases[0]
+		c.name = "IP prefix " + prefix
+		c.reqName = "pxelinux.cfg/" + prefix
+		c.expectedData, c.expectedSize = "", nil
+		c.expectedErrorCode, c.expectedErrorMsg = ErrCodeFileNotFound, "fallback: not found"
+		if n == 6 {
+			c.expectedData = "LABEL pxelinux.cfg/C0A802\n"
+			c.expectedErrorCode, c.expectedErrorMsg = ErrCodeNotDefined, ""
+		}
+		cases = append(cases, c)
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var fb ReadHandler = fallback
+			if c.noFallback {
+				fb = nil
+			}
+			h := NewPXEConfigHandler(lookup, fb)
+
+			req := readRequestMock{name: c.reqName}
+			h.ServeTFTP(&req)
+
+			if got := req.writer.String(); got != c.expectedData {
+				t.Errorf("expected data %q, got %q", c.expectedData, got)
+			}
+			if !reflect.DeepEqual(c.expectedSize, req.size) {
+				t.Errorf("expected size to be %v, but it was %v", c.expectedSize, req.size)
+			}
+			if c.expectedErrorCode != req.errCode || c.expectedErrorMsg != req.errMsg {
+				t.Errorf("expected error %s %q, got %s %q", c.expectedErrorCode, c.expectedErrorMsg, req.errCode, req.errMsg)
+			}
+		})
+	}
+}
+
+func TestParsePXEConfigName(t *testing.T) {
+	cases := []struct {
+		name        string
+		expectedMAC string
+		expectedIP  string
+	}{
+		{name: "pxelinux.cfg/01-88-99-aa-bb-cc-dd", expectedMAC: "88:99:aa:bb:cc:dd"},
+		{name: "pxelinux.cfg/20-00-00-00-00-00-00-00-00", expectedMAC: "00:00:00:00:00:00:00:00"},
+		{name: "pxelinux.cfg/01-88-99-AA-BB-CC-DD"}, // PXELINUX uses lowercase
+		{name: "pxelinux.cfg/zz-88-99-aa-bb-cc-dd"},
+		{name: "pxelinux.cfg/01-88-99-aa-bb-cc"},
+		{name: "pxelinux.cfg/C0A8020A", expectedIP: "192.168.2.10"},
+		{name: "pxelinux.cfg/c0a8020a"}, // PXELINUX uses uppercase
+		{name: "pxelinux.cfg/C0A8020G"},
+		{name: "pxelinux.cfg/C0A8020"},
+		{name: "pxelinux.cfg/default"},
+		{name: "other/C0A8020A"},
+		{name: "C0A8020A"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mac, ip := parsePXEConfigName(c.name)
+			gotMAC, gotIP := "", ""
+			if mac != nil {
+				gotMAC = mac.String()
+			}
+			if ip != nil {
+				gotIP = ip.String()
+			}
+			if gotMAC != c.expectedMAC || gotIP != c.expectedIP {
+				t.Errorf("expected MAC %q IP %q, got %q %q", c.expectedMAC, c.expectedIP, gotMAC, gotIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"sync"
+	"time"
+)
+
+// NewRateLimitedReader returns a ReadHandler that limits each transfer
+// served by h to bytesPerSec, allowing bursts of up to burst bytes.
+//
+// The limit applies to the DATA packets sent to the client, including
+// their headers. Each packet is paced individually, so a window of
+// blocks isn't sent faster than the limit, and retransmitted blocks count
+// against it. If bytesPerSec is zero or negative h is returned unchanged.
+//
+// The limit is only enforced on transfers sent by the server, it must
+// wrap any middleware that replaces the ReadRequest. Reads coalesced with
+// ServerCoalesceReads are limited by the transfer reading the file. To
+// limit the total of all transfers, see ServerRateLimit.
+func NewRateLimitedReader(h ReadHandler, bytesPerSec int64, burst int64) ReadHandler {
+	if bytesPerSec <= 0 {
+		return h
+	}
+	return ReadHandlerFunc(func(w ReadRequest) {
+		if l, ok := w.(rateLimiter); ok {
+			l.addRateLimit(newTokenBucket(bytesPerSec, burst))
+		}
+		h.ServeTFTP(w)
+	})
+}
+
+// rateLimiter is implemented by requests that can pace their DATA packets.
+type rateLimiter interface {
+	addRateLimit(*tokenBucket)
+}
+
+// tokenBucket paces bytes to rate per second, allowing bursts of up
+// to burst bytes. It is safe for concurrent use.
+type tokenBucket struct {
+	rate  float64 // Bytes per second
+	burst float64 // Maximum tokens
+
+	mu     sync.Mutex
+	tokens float64   // Available bytes, negative when reserved ahead
+	last   time.Time // When tokens was last updated
+}
+
+// newTokenBucket returns a full tokenBucket. A burst less than zero is
+// treated as zero.
+func newTokenBucket(bytesPerSec, burst int64) *tokenBucket {
+	if burst < 0 {
+		burst = 0
+	}
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket at now, returning how long to
+// wait before sending them.
+func (b *tokenBucket) reserve(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
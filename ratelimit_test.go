@@ -0,0 +1,138 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_reserve(t *testing.T) {
+	b := newTokenBucket(1000, 500)
+	now := b.last
+
+	steps := []struct {
+		elapsed time.Duration
+		n       int
+		wait    time.Duration
+	}{
+		{0, 500, 0},                      // Burst is available
+		{0, 100, 100 * time.Millisecond}, // Bucket is empty
+		{0, 100, 200 * time.Millisecond}, // Reserved behind the previous packet
+		{200 * time.Millisecond, 100, 100 * time.Millisecond},
+		{time.Second, 600, 100 * time.Millisecond}, // Refills up to burst only
+	}
+	for i, s := range steps {
+		now = now.Add(s.elapsed)
+		if wait := b.reserve(now, s.n); wait != s.wait {
+			t.Errorf("step %d: expected wait %s, got %s", i, s.wait, wait)
+		}
+	}
+}
+
+// rateLimitTolerance is subtracted from the expected duration of rate
+// limited transfers to allow for timer imprecision.
+const rateLimitTolerance = 50 * time.Millisecond
+
+func TestNewRateLimitedReader(t *testing.T) {
+	t.Parallel()
+
+	const rate = 20000
+	data := getTestData(t, "1MB-random")[:10000]
+	// 20 DATA packets, 19 full blocks and the final 272 bytes
+	expected := time.Duration(len(data)+20*4) * time.Second / rate
+
+	for _, windowsize := range []int{1, 4} {
+		t.Run(fmt.Sprintf("windowsize %d", windowsize), func(t *testing.T) {
+			h := NewRateLimitedReader(ReadHandlerFunc(func(w ReadRequest) {
+				w.WriteSize(int64(len(data)))
+				w.Write(data)
+			}), rate, 0)
+			ip, port, closeServer := newTestServer(t, false, h.ServeTFTP, nil)
+			defer closeServer()
+
+			client, err := NewClient(ClientWindowsize(windowsize), ClientTransferSize(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			resp, err := client.Get(ip + ":" + strconv.Itoa(port) + "/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			received, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+
+			if !bytes.Equal(received, data) {
+				t.Fatalf("expected %d bytes, got %d", len(data), len(received))
+			}
+			if elapsed < expected-rateLimitTolerance {
+				t.Errorf("expected transfer to take at least %s, took %s", expected, elapsed)
+			}
+		})
+	}
+
+}
+
+func TestServerRateLimit(t *testing.T) {
+	t.Parallel()
+
+	const rate = 20000
+	data := getTestData(t, "1MB-random")[:5000]
+	// Two transfers of 10 DATA packets each share the limit
+	expected := time.Duration(2*(len(data)+10*4)) * time.Second / rate
+
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		w.Write(data)
+	}, nil, ServerRateLimit(rate, 0))
+	defer closeServer()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := NewClient()
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp, err := client.Get(ip + ":" + strconv.Itoa(port) + "/file")
+			if err != nil {
+				errs <- err
+				return
+			}
+			received, err := ioutil.ReadAll(resp)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(received, data) {
+				errs <- fmt.Errorf("expected %d bytes, got %d", len(data), len(received))
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if elapsed < expected-rateLimitTolerance {
+		t.Errorf("expected transfers to take at least %s, took %s", expected, elapsed)
+	}
+}
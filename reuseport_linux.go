@@ -0,0 +1,12 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build linux && (386 || amd64 || arm)
+// +build linux
+// +build 386 amd64 arm
+
+package trivialt
+
+// Package syscall does not define SO_REUSEPORT on these architectures.
+const soReusePort = 0xf
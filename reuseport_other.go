@@ -0,0 +1,17 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package trivialt
+
+import "syscall"
+
+const reusePortSupported = false
+
+// reusePortControl is not supported on this platform.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return ErrReusePortUnsupported
+}
@@ -0,0 +1,12 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !386 && !amd64 && !arm)
+// +build aix darwin dragonfly freebsd netbsd openbsd linux,!386,!amd64,!arm
+
+package trivialt
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
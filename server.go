@@ -5,8 +5,16 @@
 package trivialt
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
+	"net/netip"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,34 +24,149 @@ import (
 // of the handlers isn't registered, the server will return errors to clients
 // attempting to use them.
 type Server struct {
+	stats serverStats // First field for 64-bit alignment of atomic counters
+
 	log     *logger
 	net     string
 	addrStr string
+	iface   string // Interface to listen on, empty to use addrStr's host
 	addr    *net.UDPAddr
 	connMu  sync.RWMutex
-	conn    *net.UDPConn
+	conn    net.PacketConn
 	close   chan struct{}
+	closed  sync.Once // Guards closing close
+
+	errMu sync.Mutex
+	err   error // Error that stopped the server from receiving requests
+
+	drainMu   sync.Mutex     // Orders draining with transfers.Add
+	draining  bool           // New requests are refused, protected by drainMu
+	transfers sync.WaitGroup // Dispatched requests that haven't finished
+
+	numListeners int            // Number of sockets receiving requests
+	reusePort    bool           // Set SO_REUSEPORT, allowing other processes to bind the address
+	listeners    []*net.UDPConn // Sockets in addition to conn receiving requests
 
-	singlePort bool
+	groups []groupMembership // Multicast groups joined by the sockets receiving requests
+
+	ctx    context.Context // Parent of all request contexts
+	cancel context.CancelFunc
+
+	singlePort  bool
+	connMgr     ConnManager   // Tracks single port transfers
+	queueDepth  int           // Datagrams buffered per transfer in single port mode
+	idleTimeout time.Duration // Idle time before a single port transfer is removed
 
 	dispatchChan chan *request
-	reqDoneChan  chan string
+	reqDoneChan  chan *request
+
+	timeout    time.Duration  // Per-packet wait before retransmitting, overridden by negotiation
+	retransmit int            // Per-packet retransmission limit
+	maxBlksize uint16         // Largest blksize that will be negotiated
+	maxTimeout time.Duration  // Longest timeout that will be negotiated, 0 for no limit
+	maxWindow  uint16         // Largest windowsize that will be negotiated, 0 for no limit
+	strict     bool           // Ignore all options, RFC1350 only
+	modes      []TransferMode // Allowed transfer modes, nil for all
+	readOnly   *Error         // Sent to write requests, nil to allow them
+	writeOnly  *Error         // Sent to read requests, nil to allow them
+	noRead     Error          // Sent to read requests if there isn't a read handler
+	noWrite    Error          // Sent to write requests if there isn't a write handler
+	needTSize  bool           // Reject write requests without tsize
+	checksum   string         // Checksum algorithm, empty if disabled
+
+	// Replaces the options requested by the client, nil if disabled
+	negotiator func(addr *net.UDPAddr, filename string, requested map[string]string) map[string]string
+
+	multicast *multicastManager // RFC 2090 transfers, nil if disabled
+	coalesce  *readCoalescer    // Shares reads of the same file, nil if disabled
+
+	transferTimeout  time.Duration // Idle time before a transfer is aborted, 0 for no limit
+	transferDeadline time.Duration // Total time before a transfer is aborted, 0 for no limit
+
+	commitDelay time.Duration // Wait after write handlers return, 0 for none
+	commits     writeCommits  // Files written within commitDelay, by name
+
+	maxConcurrent int           // Limit of simultaneous transfers, 0 for no limit
+	queueTimeout  time.Duration // How long a request waits for a transfer slot
+	transferSlots chan struct{} // Semaphore enforcing maxConcurrent
+	maxReads      int           // Limit of simultaneous read transfers, 0 for no limit
+	readSlots     chan struct{} // Semaphore enforcing maxReads
+	maxWrites     int           // Limit of simultaneous write transfers, 0 for no limit
+	writeSlots    chan struct{} // Semaphore enforcing maxWrites
+
+	readBuffer  int // Socket receive buffer size, 0 for system default
+	writeBuffer int // Socket send buffer size, 0 for system default
+	dscp        int // DiffServ code point, 0 for system default
+
+	allowedNets []*net.IPNet // If set, only clients in these networks are served
+	deniedNets  []*net.IPNet // Clients in these networks are refused
+
+	filter func(RequestInfo) error // Accepts or refuses requests before dispatch
+
+	maxPerIP    int            // Limit of simultaneous transfers per client IP, 0 for no limit
+	rateLimit   *tokenBucket   // Paces DATA sent by all transfers, nil for no limit
+	ipMu        sync.Mutex     // Protects ipTransfers
+	ipTransfers map[string]int // Active transfers by client IP
 
-	retransmit int // Per-packet retransmission limit
+	metrics        Metrics
+	transferLogger func(TransferStats)
+	panicHandler   func(interface{}, RequestInfo)
+
+	readMiddleware  []ReadMiddleware  // Applied to rh on registration
+	writeMiddleware []WriteMiddleware // Applied to wh on registration
 
 	rh ReadHandler
 	wh WriteHandler
 }
 
+// RequestInfo describes a request to hooks that are called
+// outside of a handler.
+type RequestInfo struct {
+	Op   string       // "read" or "write"
+	Addr *net.UDPAddr // Network address of the client
+	Name string       // File name requested by the client
+}
+
 type request struct {
-	addr *net.UDPAddr
-	pkt  []byte
+	addr    *net.UDPAddr
+	local   *net.UDPAddr // Local address the request was received on, if known
+	pkt     []byte
+	reqChan chan []byte // Single port mode only
+}
+
+// transferKey identifies a single port mode transfer.
+type transferKey struct {
+	addr  netip.AddrPort
+	write bool // Whether the client is writing (WRQ)
+}
+
+// transferKey returns the key for the transfer started by req.
+func (r *request) transferKey() transferKey {
+	return transferKey{addr: addrKey(r.addr), write: r.pkt[1] == 2}
+}
+
+// transferAddr returns the ConnManager address of the transfer started
+// by req.
+func (r *request) transferAddr() TransferAddr {
+	return TransferAddr{UDPAddr: r.addr, Write: r.pkt[1] == 2}
+}
+
+// addrKey returns addr as a comparable netip.AddrPort.
+//
+// The zone is included so that clients using the same IPv6 link-local
+// address on different interfaces are kept distinct. IPv4-mapped IPv6
+// addresses are unmapped so that they equal the IPv4 address.
+func addrKey(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
 }
 
 // NewServer returns a configured Server.
 //
 // Addr is the network address to listen on and is in the form "host:port".
-// If a no host is given the server will listen on all interfaces.
+// If a no host is given the server will listen on all interfaces. If addr
+// is empty or the port is 0, a port is chosen by the system.
+// ErrInvalidAddress is returned if the port is missing or invalid.
 //
 // Any number of ServerOpts can be provided to configure optional values.
 func NewServer(addr string, opts ...ServerOpt) (*Server, error) {
@@ -51,10 +174,19 @@ func NewServer(addr string, opts ...ServerOpt) (*Server, error) {
 		log:          newLogger("server"),
 		net:          defaultUDPNet,
 		addrStr:      addr,
+		timeout:      defaultTimeout,
 		retransmit:   defaultRetransmit,
+		maxBlksize:   maxRFCBlksize,
+		numListeners: 1,
+		queueDepth:   defaultQueueDepth,
+		idleTimeout:  defaultIdleTimeout,
 		dispatchChan: make(chan *request, 64),
-		reqDoneChan:  make(chan string, 64),
+		reqDoneChan:  make(chan *request, 64),
 		close:        make(chan struct{}),
+		ctx:          context.Background(),
+		ipTransfers:  make(map[string]int),
+		noRead:       Error{Code: ErrCodeIllegalOperation, Message: "Server does not support read requests."},
+		noWrite:      Error{Code: ErrCodeIllegalOperation, Message: "Server does not support write requests."},
 	}
 
 	for _, opt := range opts {
@@ -63,9 +195,75 @@ func NewServer(addr string, opts ...ServerOpt) (*Server, error) {
 		}
 	}
 
+	if !validServerAddr(s.net, s.addrStr) {
+		return nil, ErrInvalidAddress
+	}
+
+	if s.reusePort && s.singlePort {
+		return nil, ErrReusePortSinglePort
+	}
+
+	if s.connMgr == nil {
+		s.connMgr = NewDefaultConnManager(s.queueDepth)
+	}
+
+	if s.iface != "" {
+		ip, err := interfaceAddr(s.iface, s.net)
+		if err != nil {
+			return nil, err
+		}
+		_, port, err := net.SplitHostPort(s.addrStr)
+		if err != nil {
+			return nil, wrapError(err, "parsing server address")
+		}
+		s.addrStr = net.JoinHostPort(ip.String(), port)
+	}
+
+	s.ctx, s.cancel = context.WithCancel(s.ctx)
+
+	if s.maxConcurrent > 0 {
+		s.transferSlots = make(chan struct{}, s.maxConcurrent)
+	}
+	if s.maxReads > 0 {
+		s.readSlots = make(chan struct{}, s.maxReads)
+	}
+	if s.maxWrites > 0 {
+		s.writeSlots = make(chan struct{}, s.maxWrites)
+	}
+
 	return s, nil
 }
 
+// interfaceAddr returns the first address of the named interface
+// usable with network.
+func interfaceAddr(name, network string) (*net.IPAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, ErrInvalidInterface
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, wrapError(err, "getting interface addresses")
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		is4 := ip.To4() != nil
+		if (network == "udp4" && !is4) || (network == "udp6" && is4) {
+			continue
+		}
+		a := &net.IPAddr{IP: ip}
+		if !is4 && ip.IsLinkLocalUnicast() {
+			a.Zone = iface.Name
+		}
+		return a, nil
+	}
+	return nil, ErrInvalidInterface
+}
+
 // Addr is the network address of the server. It is available
 // after the server has been started.
 func (s *Server) Addr() (*net.UDPAddr, error) {
@@ -74,90 +272,225 @@ func (s *Server) Addr() (*net.UDPAddr, error) {
 	if s.conn == nil {
 		return nil, ErrAddressNotAvailable
 	}
-	return s.conn.LocalAddr().(*net.UDPAddr), nil
+	addr := localUDPAddr(s.conn)
+	if addr == nil {
+		return nil, ErrAddressNotAvailable
+	}
+	return addr, nil
+}
+
+// localUDPAddr returns the local address of conn, or nil if it isn't
+// a UDP address.
+func localUDPAddr(conn net.PacketConn) *net.UDPAddr {
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	return addr
 }
 
 // ReadHandler registers a ReadHandler for the server.
+//
+// Middleware configured with ServerReadMiddleware is applied to rh.
 func (s *Server) ReadHandler(rh ReadHandler) {
+	if rh != nil {
+		rh = ChainRead(rh, s.readMiddleware...)
+	}
 	s.rh = rh
 }
 
 // WriteHandler registers a WriteHandler for the server.
+//
+// Middleware configured with ServerWriteMiddleware is applied to wh.
 func (s *Server) WriteHandler(wh WriteHandler) {
+	if wh != nil {
+		wh = ChainWrite(wh, s.writeMiddleware...)
+	}
 	s.wh = wh
 }
 
 // Serve starts the server using an existing UDPConn.
+//
+// Transfers are sent from the local address each request was received
+// on, so that clients on multihomed hosts see replies from the address
+// they sent to. When conn is listening on all addresses this requires
+// packet info support (Linux), otherwise the system chooses the address.
 func (s *Server) Serve(conn *net.UDPConn) error {
+	return s.ServePacketConn(conn)
+}
+
+// ServePacketConn starts the server using an existing PacketConn, such
+// as an in-memory implementation for testing.
+//
+// Addresses returned by conn must be *net.UDPAddr, datagrams from other
+// addresses are dropped. Transfers are sent from new UDP sockets unless
+// single port mode is enabled, in which case all datagrams are sent and
+// received on conn.
+func (s *Server) ServePacketConn(conn net.PacketConn) error {
+	return s.serve(conn, nil)
+}
+
+// serve starts the server, receiving requests on conn and any
+// additional listeners.
+func (s *Server) serve(conn net.PacketConn, listeners []*net.UDPConn) error {
 	if s.rh == nil && s.wh == nil {
 		return ErrNoRegisteredHandlers
 	}
 
 	s.connMu.Lock()
 	s.conn = conn
+	s.listeners = listeners
 	s.connMu.Unlock()
 
 	go s.connManager()
 
+	for _, l := range listeners {
+		go func(l *net.UDPConn) {
+			if err := s.receive(l); err != nil {
+				s.log.err("Additional listener stopped: %v", err)
+			}
+		}(l)
+	}
+
 	s.connMu.RLock()
 	defer s.connMu.RUnlock()
+	err := s.receive(conn)
+	if err != nil {
+		s.errMu.Lock()
+		s.err = err
+		s.errMu.Unlock()
+	}
+	return err
+}
+
+// receive reads requests from conn and passes them to connManager
+// until the server is closed.
+func (s *Server) receive(conn net.PacketConn) error {
 	buf := make([]byte, 65536) // Largest possible TFTP datagram
+
+	// Transfers reply from the address the request was sent to, which
+	// must be learned from each datagram when listening on all addresses.
+	udpConn, _ := conn.(*net.UDPConn)
+	var local *net.UDPAddr
+	var oob []byte
+	if laddr := localUDPAddr(conn); laddr != nil {
+		if !laddr.IP.IsUnspecified() {
+			local = &net.UDPAddr{IP: laddr.IP, Zone: laddr.Zone}
+		} else if udpConn != nil && enablePktInfo(udpConn) {
+			oob = make([]byte, pktInfoLen)
+		}
+	}
+
 	for {
 		select {
 		case <-s.close:
 			return nil
 		default:
 			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-			n, addr, err := conn.ReadFromUDP(buf)
+			n, oobn, addr, err := readRequestFrom(conn, udpConn, buf, oob)
 			if err != nil {
-				if err, ok := err.(*net.OpError); ok && err.Timeout() {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
 					continue
 				}
+				select {
+				case <-s.close:
+					return nil // Error due to Close
+				default:
+				}
 				return wrapError(err, "reading from conn")
 			}
 
 			if n < 2 {
 				continue // Must be at least 2 bytes to read opcode
 			}
+			if addr == nil {
+				s.log.debug("Dropping datagram, source address is not UDP")
+				continue
+			}
 
 			// Make a copy of the received data
 			req := &request{
-				addr: addr,
-				pkt:  make([]byte, n),
+				addr:  addr,
+				local: local,
+				pkt:   make([]byte, n),
 			}
 			copy(req.pkt, buf)
+			if oobn > 0 {
+				req.local = parsePktInfo(oob[:oobn])
+			}
 			s.dispatchChan <- req
 		}
 	}
 }
 
+// readRequestFrom reads a datagram from conn into buf, using udpConn to
+// read packet info into oob if it is non-nil. addr is nil if the source
+// address is not a *net.UDPAddr.
+func readRequestFrom(conn net.PacketConn, udpConn *net.UDPConn, buf, oob []byte) (n, oobn int, addr *net.UDPAddr, err error) {
+	if udpConn != nil {
+		n, oobn, _, addr, err = udpConn.ReadMsgUDP(buf, oob)
+		return n, oobn, addr, err
+	}
+	n, from, err := conn.ReadFrom(buf)
+	addr, _ = from.(*net.UDPAddr)
+	return n, 0, addr, err
+}
+
 func (s *Server) connManager() {
-	reqMap := make(map[string]chan []byte)
-	var reqChan chan []byte
+	// Single port transfers accepted from s.connMgr, to expire idle ones
+	active := make(map[transferKey]*singlePortTransfer)
+
+	// Periodically remove transfers that have stopped receiving datagrams
+	var sweep <-chan time.Time
+	if s.singlePort && s.idleTimeout > 0 {
+		ticker := time.NewTicker(s.idleTimeout / 2)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
 
 	for {
 		select {
 		case req := <-s.dispatchChan:
 			switch req.pkt[1] {
-			case 1: //RRQ
+			case 1, 2: //RRQ, WRQ
 				if s.singlePort {
-					reqChan = make(chan []byte, 64)
-					reqMap[req.addr.String()] = reqChan
+					ch, ok := s.connMgr.GetOrNew(req.transferAddr())
+					if ok {
+						// Most likely a retransmitted request, the
+						// transfer is already in progress.
+						s.log.debug("Ignoring duplicate request from %v", req.addr)
+						if t, ok := active[req.transferKey()]; ok {
+							t.lastActivity = time.Now()
+						}
+						break
+					}
+					req.reqChan = ch
 				}
-				go s.dispatchReadRequest(req, reqChan)
-			case 2: //WRQ
-				if s.singlePort {
-					reqChan = make(chan []byte, 64)
-					reqMap[req.addr.String()] = reqChan
+				if !s.startTransfer() {
+					s.log.debug("Rejecting request from %v, server draining.", req.addr)
+					s.sendRequestError(req, ErrCodeNotDefined, "server shutting down")
+					s.removeTransfer(active, req)
+					break
+				}
+				if !s.filterRequest(req) {
+					s.transfers.Done()
+					s.removeTransfer(active, req)
+					break
 				}
-				go s.dispatchWriteRequest(req, reqChan)
-			default:
 				if s.singlePort {
-					if reqChan, ok := reqMap[req.addr.String()]; ok {
-						reqChan <- req.pkt
-						break
+					active[req.transferKey()] = &singlePortTransfer{
+						addr:         req.transferAddr(),
+						reqChan:      req.reqChan,
+						lastActivity: time.Now(),
 					}
 				}
+				if req.pkt[1] == 1 {
+					go s.dispatchReadRequest(req, req.reqChan)
+				} else {
+					go s.dispatchWriteRequest(req, req.reqChan)
+				}
+			default:
+				if s.singlePort && s.routeDatagram(active, req) {
+					break
+				}
 
 				// RFC1350:
 				// "If a source TID does not match, the packet should be
@@ -168,16 +501,95 @@ func (s *Server) connManager() {
 				dg.writeError(ErrCodeUnknownTransferID, "Unexpected TID")
 				// Don't care about an error here, just a courtesy
 				_, _ = s.conn.WriteTo(dg.bytes(), req.addr)
+				atomic.AddUint64(&s.stats.errorsSent, 1)
 				s.log.debug("Unexpected datagram: %s", dg)
 			}
-		case addr := <-s.reqDoneChan:
-			delete(reqMap, addr)
+		case req := <-s.reqDoneChan:
+			s.removeTransfer(active, req)
+		case now := <-sweep:
+			for key, t := range active {
+				if now.Sub(t.lastActivity) < s.idleTimeout {
+					continue
+				}
+				s.log.debug("Removing idle transfer from %s", key.addr)
+				if ch, ok := s.connMgr.Get(t.addr); ok && ch == t.reqChan {
+					s.connMgr.Remove(t.addr)
+				}
+				close(t.reqChan) // Unblocks the transfer
+				delete(active, key)
+				atomic.AddUint64(&s.stats.expired, 1)
+			}
 		case <-s.close:
 			return
 		}
 	}
 }
 
+// removeTransfer unregisters the single port transfer for req. Entries
+// are only removed if they belong to req, the transfer may have expired
+// and been replaced by a new one.
+func (s *Server) removeTransfer(active map[transferKey]*singlePortTransfer, req *request) {
+	if req.reqChan == nil {
+		return
+	}
+	addr := req.transferAddr()
+	if ch, ok := s.connMgr.Get(addr); ok && ch == req.reqChan {
+		s.connMgr.Remove(addr)
+	}
+	key := req.transferKey()
+	if t, ok := active[key]; ok && t.reqChan == req.reqChan {
+		delete(active, key)
+	}
+}
+
+// singlePortTransfer tracks the activity of a transfer in single port mode.
+type singlePortTransfer struct {
+	addr         TransferAddr // Address of the transfer in connMgr
+	reqChan      chan []byte  // Datagrams for the transfer
+	lastActivity time.Time    // When the last datagram was received
+}
+
+// routeDatagram passes a datagram received in single port mode to the
+// transfer(s) it belongs to in s.connMgr, returning false if there are
+// none.
+//
+// A client may read and write from the same address, so datagrams are
+// routed by direction. DATA is sent by the client in a write transfer
+// and ACK in a read transfer. ERROR could belong to either.
+func (s *Server) routeDatagram(active map[transferKey]*singlePortTransfer, req *request) bool {
+	var writes []bool
+	switch opcode(req.pkt[1]) {
+	case opCodeDATA:
+		writes = []bool{true}
+	case opCodeACK:
+		writes = []bool{false}
+	case opCodeERROR:
+		writes = []bool{false, true}
+	}
+
+	routed := false
+	for _, write := range writes {
+		reqChan, ok := s.connMgr.Get(TransferAddr{UDPAddr: req.addr, Write: write})
+		if !ok {
+			continue
+		}
+		routed = true
+		if t, ok := active[transferKey{addr: addrKey(req.addr), write: write}]; ok {
+			t.lastActivity = time.Now()
+		}
+
+		// Don't block the receive loop on a stalled transfer, the
+		// datagram will be retransmitted.
+		select {
+		case reqChan <- req.pkt:
+		default:
+			atomic.AddUint64(&s.stats.dropped, 1)
+			s.log.debug("Dropping datagram from %v, transfer queue full", req.addr)
+		}
+	}
+	return routed
+}
+
 // Connected is true if the server has started serving.
 func (s *Server) Connected() bool {
 	s.connMu.RLock()
@@ -185,23 +597,94 @@ func (s *Server) Connected() bool {
 	return s.conn != nil
 }
 
+// startTransfer counts a new request as in progress, returning false
+// if the server is draining.
+func (s *Server) startTransfer() bool {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.transfers.Add(1)
+	return true
+}
+
+// Drain stops the server from accepting new requests, waits for
+// transfers in progress to finish, and then closes the server.
+//
+// Requests received while draining are refused with a "server shutting
+// down" ERROR. If ctx is done before the transfers finish, Drain returns
+// the context's error and the server keeps draining; Close can be used
+// to stop it immediately.
+func (s *Server) Drain(ctx context.Context) error {
+	s.drainMu.Lock()
+	s.draining = true
+	s.drainMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.transfers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return s.Close()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Close stops the server and closes the network connection.
 func (s *Server) Close() error {
 	s.connMu.RLock()
 	defer s.connMu.RUnlock()
-	close(s.close)
+	s.closed.Do(func() { close(s.close) })
+	s.cancel()
+	for _, l := range s.listeners {
+		errorDefer(l.Close, s.log, "error closing additional listener")
+	}
 	return s.conn.Close()
 }
 
 // dispatchReadRequest dispatches the read handler, if it is registered.
 // If a handler is not registered the server sends an error to the client.
 func (s *Server) dispatchReadRequest(req *request, reqChan chan []byte) {
+	defer s.transfers.Done()
+	atomic.AddUint64(&s.stats.readRequests, 1)
+
 	// Check for handler
 	if s.rh == nil {
 		s.log.debug("No read handler registered.")
-		var err datagram
-		err.writeError(ErrCodeIllegalOperation, "Server does not support read requests.")
-		_, _ = s.conn.WriteTo(err.bytes(), req.addr) // Ignore error
+		s.rejectRequest(req, s.noRead.Code, s.noRead.Message)
+		return
+	}
+
+	if s.writeOnly != nil {
+		s.log.debug("Rejecting read request from %v, server is write-only.", req.addr)
+		s.rejectRequest(req, s.writeOnly.Code, s.writeOnly.Message)
+		return
+	}
+
+	if !s.ipAllowed(req.addr.IP) {
+		s.log.debug("Rejecting request from %v, address not allowed.", req.addr)
+		s.rejectRequest(req, ErrCodeAccessViolation, "Access denied.")
+		return
+	}
+
+	// A file that was just written may not be readable yet. Waits before
+	// taking a transfer slot.
+	if s.commitDelay > 0 {
+		s.commits.wait(s.ctx, requestFilename(req))
+	}
+
+	release, ok := s.admitRequest(req)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if s.joinMulticast(req) {
 		return
 	}
 
@@ -214,24 +697,55 @@ func (s *Server) dispatchReadRequest(req *request, reqChan chan []byte) {
 	s.log.debug("New request from %v: %s", req.addr, c.rx)
 
 	// Create request
-	w := &readRequest{conn: c, name: c.rx.filename()}
+	w := &readRequest{conn: c, name: c.rx.filename(), opts: c.rx.options()}
 
 	// execute handler
-	s.rh.ServeTFTP(w)
+	defer s.recoverHandler(c, RequestInfo{Op: "read", Addr: req.addr, Name: w.name})
+	if s.coalesce != nil {
+		s.coalesce.serve(w)
+	} else {
+		s.rh.ServeTFTP(w)
+	}
+	w.finish()
 }
 
 // dispatchWriteRequest dispatches the read handler, if it is registered.
 // If a handler is not registered the server sends an error to the client.
 func (s *Server) dispatchWriteRequest(req *request, reqChan chan []byte) {
+	defer s.transfers.Done()
+	atomic.AddUint64(&s.stats.writeRequests, 1)
+
 	// Check for handler
 	if s.wh == nil {
 		s.log.debug("No write handler registered.")
-		var err datagram
-		err.writeError(ErrCodeIllegalOperation, "Server does not support write requests.")
-		_, _ = s.conn.WriteTo(err.bytes(), req.addr) // Ignore error
+		s.rejectRequest(req, s.noWrite.Code, s.noWrite.Message)
+		return
+	}
+
+	if s.readOnly != nil {
+		s.log.debug("Rejecting write request from %v, server is read-only.", req.addr)
+		s.rejectRequest(req, s.readOnly.Code, s.readOnly.Message)
+		return
+	}
+
+	if s.needTSize && s.missingTransferSize(req) {
+		s.log.debug("Rejecting write request from %v, tsize not provided.", req.addr)
+		s.rejectRequest(req, ErrCodeIllegalOperation, "Transfer size (tsize) required.")
+		return
+	}
+
+	if !s.ipAllowed(req.addr.IP) {
+		s.log.debug("Rejecting request from %v, address not allowed.", req.addr)
+		s.rejectRequest(req, ErrCodeAccessViolation, "Access denied.")
 		return
 	}
 
+	release, ok := s.admitRequest(req)
+	if !ok {
+		return
+	}
+	defer release()
+
 	c, closer, err := s.newConn(req, reqChan)
 	if err != nil {
 		return
@@ -240,90 +754,618 @@ func (s *Server) dispatchWriteRequest(req *request, reqChan chan []byte) {
 
 	s.log.debug("New request from %v: %s", req.addr, c.rx)
 
-	// Create request
-	w := &writeRequest{conn: c, name: c.rx.filename()}
-
-	// parse options to get size
-	c.log.trace("performing write setup")
-	c.readSetup()
+	// Create request. The ACK or OACK is sent on the first Read, allowing
+	// the handler to reject the request with an ERROR instead.
+	w := &writeRequest{conn: c, name: c.rx.filename(), opts: c.rx.options()}
 
+	defer s.recoverHandler(c, RequestInfo{Op: "write", Addr: req.addr, Name: w.name})
 	s.wh.ReceiveTFTP(w)
+	if s.commitDelay > 0 {
+		s.commits.add(w.name, time.Now().Add(s.commitDelay))
+	}
+	s.sleepCommitDelay()
 }
 
-func (s *Server) newConn(req *request, reqChan chan []byte) (*conn, func() error, error) {
-	var c *conn
-	var err error
-	var dg datagram
+// sleepCommitDelay waits for the ServerWriteCommitDelay, or until the
+// server is closed.
+func (s *Server) sleepCommitDelay() {
+	if s.commitDelay <= 0 {
+		return
+	}
+	t := time.NewTimer(s.commitDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.ctx.Done():
+	}
+}
+
+// writeCommits tracks files whose write handler returned within the
+// commit delay, so that reads of them can wait until it has passed.
+type writeCommits struct {
+	mu        sync.Mutex
+	committed map[string]time.Time // When each file is readable, by name
+}
 
+// add records that name is readable at t. Expired entries are removed.
+func (w *writeCommits) add(name string, t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed == nil {
+		w.committed = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for n, readable := range w.committed {
+		if !readable.After(now) {
+			delete(w.committed, n)
+		}
+	}
+	w.committed[name] = t
+}
+
+// wait waits until name is readable, or ctx is done. Names that haven't
+// been written recently don't wait.
+func (w *writeCommits) wait(ctx context.Context, name string) {
+	w.mu.Lock()
+	readable, ok := w.committed[name]
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+	d := time.Until(readable)
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// requestFilename returns the file name requested by req, or "" if the
+// request is invalid.
+func requestFilename(req *request) string {
+	var dg datagram
 	dg.setBytes(req.pkt)
+	if err := dg.validate(); err != nil {
+		return ""
+	}
+	return dg.filename()
+}
 
-	// Validate request datagram
+// missingTransferSize reports whether the write request req lacks a
+// valid tsize option. Invalid requests are left to newConn to reject.
+func (s *Server) missingTransferSize(req *request) bool {
+	var dg datagram
+	dg.setBytes(req.pkt)
 	if err := dg.validate(); err != nil {
-		s.log.debug("Error decoding new request: %v", err)
-		return nil, nil, err
+		return false
+	}
+	if s.strict {
+		return true // Options are ignored
 	}
+	_, err := strconv.ParseInt(dg.options()[optTransferSize], 10, 64)
+	return err != nil
+}
 
-	if s.singlePort {
-		c = newSinglePortConn(req.addr, dg.mode(), s.conn, reqChan)
-	} else {
-		c, err = newConn(s.net, dg.mode(), req.addr) // Use empty mode until request has been parsed.
-		if err != nil {
-			s.log.err("Received error opening connection for new request: %v", err)
-			return nil, nil, err
-		}
+// joinMulticast serves req as part of a multicast transfer, if enabled and
+// requested by the client. It returns false if req should be served
+// individually.
+func (s *Server) joinMulticast(req *request) bool {
+	if s.multicast == nil || s.singlePort || s.strict {
+		return false
 	}
 
-	c.rx = dg
-	// Set retransmit
-	c.retransmit = s.retransmit
+	var dg datagram
+	dg.setBytes(req.pkt)
+	if err := dg.validate(); err != nil || !s.modeAllowed(dg.mode()) {
+		return false // Rejected by newConn
+	}
+	return s.multicast.join(req, dg)
+}
 
-	closer := func() error {
-		err := c.Close()
-		if s.singlePort {
-			s.reqDoneChan <- req.addr.String()
-		}
-		return err
+// transferFinished records the result of a transfer that has been closed
+// with closeErr.
+func (s *Server) transferFinished(c *conn, closeErr error) {
+	stats := c.transferStats(closeErr)
+	c.statsMu.Lock()
+	c.final = &stats
+	c.statsMu.Unlock()
+
+	op, d, err := stats.Op, stats.Duration, stats.Err
+	c.log.with("bytes", c.total, "error", err).debug("Transfer finished in %s, %d bytes, error: %v", d, c.total, err)
+
+	if err == nil {
+		atomic.AddUint64(&s.stats.completed, 1)
+	} else {
+		atomic.AddUint64(&s.stats.failed, 1)
 	}
+	if op == "read" {
+		atomic.AddUint64(&s.stats.bytesSent, uint64(c.total))
+	} else {
+		atomic.AddUint64(&s.stats.bytesReceived, uint64(c.total))
+	}
+	atomic.AddInt64(&s.stats.active, -1)
 
-	return c, closer, nil
+	if s.metrics != nil {
+		s.metrics.TransferFinished(op, c.total, d, err)
+	}
+	if s.transferLogger != nil {
+		s.transferLogger(stats)
+	}
 }
 
-// ListenAndServe starts a configured server.
-func (s *Server) ListenAndServe() error {
-	addr, err := net.ResolveUDPAddr(s.net, s.addrStr)
-	if err != nil {
-		return wrapError(err, "resolving server address")
+// recoverHandler recovers a panic in a handler, sending an ERROR to the
+// client and reporting the panic to the panic handler or log.
+//
+// It must be deferred.
+func (s *Server) recoverHandler(c *conn, info RequestInfo) {
+	r := recover()
+	if r == nil {
+		return
 	}
-	s.addr = addr
 
-	conn, err := net.ListenUDP(s.net, s.addr)
-	if err != nil {
-		return wrapError(err, "opening network connection")
+	if !c.hijacked {
+		c.sendError(ErrCodeNotDefined, "internal server error")
+		c.err = fmt.Errorf("handler panic: %v", r) // Prevent Close from continuing the transfer
 	}
 
-	return wrapError(s.Serve(conn), "serving tftp")
+	s.reportPanic(r, info)
 }
 
-// ServerOpt is a function that configures a Server.
-type ServerOpt func(*Server) error
+// reportPanic passes a panic recovered from a handler to the panic
+// handler, or logs it with a stack trace if there isn't one.
+func (s *Server) reportPanic(r interface{}, info RequestInfo) {
+	if s.panicHandler != nil {
+		s.panicHandler(r, info)
+		return
+	}
+	stack := make([]byte, 64<<10)
+	stack = stack[:runtime.Stack(stack, false)]
+	s.log.err("Panic serving %s request for %q from %v: %v\n%s", info.Op, info.Name, info.Addr, r, stack)
+}
 
-// ServerNet configures the network a server listens on.
-// Must be one of: udp, udp4, udp6.
-//
-// Default: udp.
-func ServerNet(net string) ServerOpt {
-	return func(s *Server) error {
-		if net != "udp" && net != "udp4" && net != "udp6" {
-			return ErrInvalidNetwork
-		}
-		s.net = net
-		return nil
+// rejectRequest sends an error to the client from the server's connection
+// and releases the request's single port resources.
+func (s *Server) rejectRequest(req *request, code ErrorCode, msg string) {
+	s.sendRequestError(req, code, msg)
+
+	if s.singlePort {
+		s.reqDoneChan <- req
 	}
 }
 
-// ServerRetransmit configures the per-packet retransmission limit for all requests.
+// sendRequestError sends an ERROR in response to req.
+func (s *Server) sendRequestError(req *request, code ErrorCode, msg string) {
+	var err datagram
+	err.writeError(code, msg)
+	_, _ = s.conn.WriteTo(err.bytes(), req.addr) // Ignore error
+	atomic.AddUint64(&s.stats.errorsSent, 1)
+}
+
+// filterRequest passes req to the request filter, if configured. If the
+// filter refuses the request an ERROR is sent and false is returned.
 //
-// Default: 10.
+// It is called by connManager before a transfer is started, so refused
+// requests don't consume any resources.
+func (s *Server) filterRequest(req *request) bool {
+	if s.filter == nil {
+		return true
+	}
+
+	var dg datagram
+	dg.setBytes(req.pkt)
+	if err := dg.validate(); err != nil {
+		return true // Dropped by newConn
+	}
+
+	op := "read"
+	if dg.opcode() == opCodeWRQ {
+		op = "write"
+	}
+
+	err := s.filter(RequestInfo{Op: op, Addr: req.addr, Name: dg.filename()})
+	if err == nil {
+		return true
+	}
+
+	s.log.debug("Rejecting request from %v, refused by filter: %v", req.addr, err)
+	code, msg := ErrCodeAccessViolation, err.Error()
+	var reqErr *Error
+	if errors.As(err, &reqErr) {
+		code, msg = reqErr.Code, reqErr.Message
+	}
+	s.sendRequestError(req, code, msg)
+	return false
+}
+
+// modeAllowed checks mode against the allowed transfer modes.
+func (s *Server) modeAllowed(mode TransferMode) bool {
+	if s.modes == nil {
+		return true
+	}
+	for _, m := range s.modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed checks ip against the denied and allowed networks.
+//
+// Denied networks are checked first. If any allowed networks are
+// configured, ip must be in one of them.
+func (s *Server) ipAllowed(ip net.IP) bool {
+	for _, n := range s.deniedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(s.allowedNets) == 0 {
+		return true
+	}
+	for _, n := range s.allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitRequest enforces the server's concurrency limits. If the request
+// is admitted, the returned func must be called when the transfer ends.
+// Otherwise an error is sent to the client.
+func (s *Server) admitRequest(req *request) (func(), bool) {
+	ip := req.addr.IP.String()
+	if !s.acquireIP(ip) {
+		s.log.debug("Rejecting request from %v, too many transfers from client.", req.addr)
+		atomic.AddUint64(&s.stats.rejected, 1)
+		s.rejectRequest(req, ErrCodeAccessViolation, "too many transfers from client")
+		return nil, false
+	}
+
+	if !s.acquireSlot(s.transferSlots) {
+		s.releaseIP(ip)
+		s.log.debug("Rejecting request from %v, server busy.", req.addr)
+		atomic.AddUint64(&s.stats.rejected, 1)
+		s.rejectRequest(req, ErrCodeNotDefined, "server busy")
+		return nil, false
+	}
+
+	opSlots, op := s.readSlots, "reads"
+	if opcode(req.pkt[1]) == opCodeWRQ {
+		opSlots, op = s.writeSlots, "writes"
+	}
+	if !s.acquireSlot(opSlots) {
+		s.releaseSlot(s.transferSlots)
+		s.releaseIP(ip)
+		s.log.debug("Rejecting request from %v, too many concurrent %s.", req.addr, op)
+		atomic.AddUint64(&s.stats.rejected, 1)
+		s.rejectRequest(req, ErrCodeNotDefined, "server busy: too many concurrent "+op)
+		return nil, false
+	}
+
+	return func() {
+		s.releaseSlot(opSlots)
+		s.releaseSlot(s.transferSlots)
+		s.releaseIP(ip)
+	}, true
+}
+
+// acquireIP counts a transfer against ip, returning false if
+// ip is at the ServerMaxConcurrentPerIP limit.
+func (s *Server) acquireIP(ip string) bool {
+	if s.maxPerIP == 0 {
+		return true
+	}
+
+	s.ipMu.Lock()
+	defer s.ipMu.Unlock()
+	if s.ipTransfers[ip] >= s.maxPerIP {
+		return false
+	}
+	s.ipTransfers[ip]++
+	return true
+}
+
+// releaseIP releases a transfer counted by acquireIP.
+func (s *Server) releaseIP(ip string) {
+	if s.maxPerIP == 0 {
+		return
+	}
+
+	s.ipMu.Lock()
+	defer s.ipMu.Unlock()
+	if s.ipTransfers[ip]--; s.ipTransfers[ip] <= 0 {
+		delete(s.ipTransfers, ip)
+	}
+}
+
+// acquireSlot reserves one of the concurrent transfer slots in the
+// semaphore slots, waiting up to queueTimeout for one to become available.
+// A nil semaphore is unlimited.
+//
+// It returns false if a slot could not be acquired.
+func (s *Server) acquireSlot(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if s.queueTimeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-s.close:
+		return false
+	}
+}
+
+// releaseSlot releases a slot acquired by acquireSlot.
+func (s *Server) releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+func (s *Server) newConn(req *request, reqChan chan []byte) (*conn, func() error, error) {
+	var c *conn
+	var err error
+	var dg datagram
+
+	dg.setBytes(req.pkt)
+
+	// Validate request datagram
+	if err := dg.validate(); err != nil {
+		s.log.debug("Error decoding new request: %v", err)
+		if s.singlePort {
+			s.reqDoneChan <- req
+		}
+		return nil, nil, err
+	}
+
+	if mode := dg.mode(); !s.modeAllowed(mode) {
+		s.log.debug("Rejecting request from %v, transfer mode %q not allowed.", req.addr, mode)
+		s.rejectRequest(req, ErrCodeIllegalOperation, fmt.Sprintf("Transfer mode %q not allowed.", mode))
+		return nil, nil, fmt.Errorf("transfer mode %q not allowed", mode)
+	}
+
+	// Copy the client's address, including any IPv6 zone, so that
+	// replies go out the interface the request arrived on.
+	addr := *req.addr
+	if s.singlePort {
+		c = newSinglePortConn(&addr, dg.mode(), s.conn, reqChan)
+	} else {
+		c, err = newBoundConn(s.net, dg.mode(), req.local, &addr) // Use empty mode until request has been parsed.
+		if err != nil && req.local != nil {
+			// The address may have been removed, fall back to letting
+			// the system choose.
+			s.log.debug("Received error binding connection to %v: %v", req.local, err)
+			c, err = newConn(s.net, dg.mode(), &addr)
+		}
+		if err != nil {
+			s.log.err("Received error opening connection for new request: %v", err)
+			return nil, nil, err
+		}
+		if err := setBufferSizes(c.netConn, s.readBuffer, s.writeBuffer); err != nil {
+			s.log.err("Received error configuring connection for new request: %v", err)
+			errorDefer(c.netConn.Close, s.log, "error closing network connection in newConn")
+			return nil, nil, err
+		}
+		if err := setDSCP(c.netConn, s.dscp); err != nil {
+			s.log.err("Received error configuring connection for new request: %v", err)
+			errorDefer(c.netConn.Close, s.log, "error closing network connection in newConn")
+			return nil, nil, err
+		}
+	}
+
+	op := "read"
+	if dg.opcode() == opCodeWRQ {
+		op = "write"
+	}
+	c.id = atomic.AddUint64(&s.stats.transfers, 1)
+	if s.log.slog != nil {
+		c.log = s.log.withID(c.id).with("client_addr", req.addr.String(), "op", op, "filename", dg.filename())
+	} else {
+		c.log = c.log.withID(c.id) // Prefixed with the client address by newConn
+	}
+
+	c.rx = dg
+	if s.negotiator != nil && !s.strict {
+		opts := s.negotiator(net.UDPAddrFromAddrPort(addrKey(&addr)), dg.filename(), dg.options())
+		if opts == nil {
+			opts = map[string]string{}
+		}
+		c.reqOpts = opts
+	}
+	// Set retransmit
+	c.timeout = s.timeout
+	c.retransmit = s.retransmit
+	c.maxBlksize = s.maxBlksize
+	c.maxTimeout = s.maxTimeout
+	c.maxWindow = s.maxWindow
+	c.ignoreOptions = s.strict
+	c.checksumAlg = s.checksum
+	if s.checksum != "" && dg.opcode() == opCodeWRQ {
+		c.hash = checksumAlgs[s.checksum]()
+	}
+	c.stats = &s.stats
+	if s.rateLimit != nil {
+		c.limiters = append(c.limiters, s.rateLimit)
+	}
+	c.transferTimeout = s.transferTimeout
+	if s.transferDeadline > 0 {
+		c.deadline = time.Now().Add(s.transferDeadline)
+		c.ctx, c.cancel = context.WithDeadline(s.ctx, c.deadline)
+	} else {
+		c.ctx, c.cancel = context.WithCancel(s.ctx)
+	}
+
+	c.start = time.Now()
+	c.info = RequestInfo{Op: op, Addr: req.addr, Name: dg.filename()}
+	atomic.AddInt64(&s.stats.active, 1)
+	if s.metrics != nil {
+		s.metrics.TransferStarted(op)
+	}
+
+	closer := func() error {
+		err := c.Close()
+		if s.singlePort {
+			s.reqDoneChan <- req
+		}
+		s.transferFinished(c, err)
+		return err
+	}
+
+	return c, closer, nil
+}
+
+// validServerAddr reports whether addr has a port that can be resolved
+// when the server starts listening on network. An empty addr is valid.
+func validServerAddr(network, addr string) bool {
+	if addr == "" {
+		return true
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	// Numeric ports are range checked, names looked up in the services
+	// database, as by net.ResolveUDPAddr
+	_, err = net.LookupPort(network, port)
+	return err == nil
+}
+
+// ListenAndServe starts a configured server.
+func (s *Server) ListenAndServe() error {
+	addr, err := net.ResolveUDPAddr(s.net, s.addrStr)
+	if err != nil {
+		return wrapError(err, "resolving server address")
+	}
+	s.addr = addr
+
+	n := s.numListeners
+	if n > 1 && !reusePortSupported {
+		s.log.err("SO_REUSEPORT is not supported on this platform, using a single listener.")
+		n = 1
+	}
+
+	conn, err := s.listen(s.addr, n > 1 || s.reusePort)
+	if err != nil {
+		return err
+	}
+
+	// Additional listeners bind to the same address as the first, which
+	// may have been system assigned.
+	listeners := make([]*net.UDPConn, 0, n-1)
+	for i := 1; i < n; i++ {
+		l, err := s.listen(conn.LocalAddr().(*net.UDPAddr), true)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			conn.Close()
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	return wrapError(s.serve(conn, listeners), "serving tftp")
+}
+
+// listen opens a configured network connection on addr.
+func (s *Server) listen(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if reusePort {
+		lc := net.ListenConfig{Control: reusePortControl}
+		pc, err := lc.ListenPacket(context.Background(), s.net, addr.String())
+		if err != nil {
+			return nil, wrapError(err, "opening network connection")
+		}
+		conn = pc.(*net.UDPConn)
+	} else {
+		var err error
+		conn, err = net.ListenUDP(s.net, addr)
+		if err != nil {
+			return nil, wrapError(err, "opening network connection")
+		}
+	}
+
+	if err := setBufferSizes(conn, s.readBuffer, s.writeBuffer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := setDSCP(conn, s.dscp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for _, g := range s.groups {
+		if err := joinGroup(conn, g); err != nil {
+			conn.Close()
+			return nil, wrapError(err, "joining multicast group "+g.group.String())
+		}
+	}
+	return conn, nil
+}
+
+// groupMembership is a multicast group joined by ListenAndServe.
+type groupMembership struct {
+	group      net.IP
+	ifaceIP    net.IP // IPv4 address of the interface to join on, nil for the system default
+	ifaceIndex int    // Index of the interface to join IPv6 groups on, 0 for the system default
+}
+
+// ServerOpt is a function that configures a Server.
+type ServerOpt func(*Server) error
+
+// ServerNet configures the network a server listens on.
+// Must be one of: udp, udp4, udp6.
+//
+// Default: udp.
+func ServerNet(net string) ServerOpt {
+	return func(s *Server) error {
+		if net != "udp" && net != "udp4" && net != "udp6" {
+			return ErrInvalidNetwork
+		}
+		s.net = net
+		return nil
+	}
+}
+
+// ServerInterface configures the server to listen only on the named network
+// interface, such as "eth0". The first address of the interface usable with
+// the ServerNet network replaces the host in the address passed to NewServer.
+//
+// NewServer returns ErrInvalidInterface if the interface does not exist or has
+// no usable address. The address is determined when NewServer is called.
+//
+// Default: the host in the address passed to NewServer is used.
+func ServerInterface(name string) ServerOpt {
+	return func(s *Server) error {
+		s.iface = name
+		return nil
+	}
+}
+
+// ServerRetransmit configures the per-packet retransmission limit for all requests.
+//
+// Default: 10.
 func ServerRetransmit(i int) ServerOpt {
 	return func(s *Server) error {
 		if i < 0 {
@@ -334,6 +1376,755 @@ func ServerRetransmit(i int) ServerOpt {
 	}
 }
 
+// ServerTimeout configures how long to wait for a response before
+// retransmitting a datagram. Sub-second values can be used to recover
+// quickly from loss on low latency networks. If the client negotiates
+// the timeout option (RFC2349), the negotiated value is used instead.
+//
+// Default: 1 second.
+func ServerTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d <= 0 {
+			return ErrInvalidRetransmitTimeout
+		}
+		s.timeout = d
+		return nil
+	}
+}
+
+// ServerBlocksize configures the largest blocksize the server will negotiate.
+// If a client requests a larger blocksize, the server will respond with this
+// value in the OACK, as permitted by RFC2348. Valid range is 8 to 65464.
+//
+// Setting this to fit within the network's MTU (e.g. 1428 for 1500 byte
+// Ethernet frames) avoids IP fragmentation.
+//
+// Default: 65464.
+func ServerBlocksize(size int) ServerOpt {
+	return func(s *Server) error {
+		if size < 8 || size > maxRFCBlksize {
+			return ErrInvalidBlocksize
+		}
+		s.maxBlksize = uint16(size)
+		return nil
+	}
+}
+
+// ServerMaxTimeout configures the longest timeout the server will negotiate.
+// If a client requests a longer timeout, the server will respond with this
+// value in the OACK. Valid range is 1 to 255 seconds, fractional seconds
+// are truncated.
+//
+// Default: 255 seconds.
+func ServerMaxTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < time.Second || d >= 256*time.Second {
+			return ErrInvalidTimeout
+		}
+		s.maxTimeout = d
+		return nil
+	}
+}
+
+// ServerMaxWindowSize configures the largest windowsize (RFC7440) the
+// server will negotiate. If a client requests a larger windowsize, the
+// server will respond with this value in the OACK. A value of 1 disables
+// windowsize, it will be omitted from the OACK and one DATA will be sent
+// per ACK. Valid range is 1 to 65535.
+//
+// Default: 65535.
+func ServerMaxWindowSize(n int) ServerOpt {
+	return func(s *Server) error {
+		if n < 1 || n > 65535 {
+			return ErrInvalidWindowsize
+		}
+		s.maxWindow = uint16(n)
+		return nil
+	}
+}
+
+// ServerMaxConcurrent limits the number of transfers the server will
+// process simultaneously. Requests received while at the limit wait
+// for the duration configured by ServerQueueTimeout, and are answered
+// with a "server busy" error if a transfer does not complete in time.
+//
+// Default: 0 (unlimited).
+func ServerMaxConcurrent(n int) ServerOpt {
+	return func(s *Server) error {
+		if n < 0 {
+			return ErrInvalidMaxConcurrent
+		}
+		s.maxConcurrent = n
+		return nil
+	}
+}
+
+// ServerMaxConcurrentReads limits the number of read transfers the server
+// will process simultaneously, independent of write transfers. Requests
+// received while at the limit are queued as with ServerMaxConcurrent.
+//
+// Default: 0 (unlimited).
+func ServerMaxConcurrentReads(n int) ServerOpt {
+	return func(s *Server) error {
+		if n < 0 {
+			return ErrInvalidMaxConcurrent
+		}
+		s.maxReads = n
+		return nil
+	}
+}
+
+// ServerMaxConcurrentWrites limits the number of write transfers the server
+// will process simultaneously, independent of read transfers. Requests
+// received while at the limit are queued as with ServerMaxConcurrent.
+//
+// Default: 0 (unlimited).
+func ServerMaxConcurrentWrites(n int) ServerOpt {
+	return func(s *Server) error {
+		if n < 0 {
+			return ErrInvalidMaxConcurrent
+		}
+		s.maxWrites = n
+		return nil
+	}
+}
+
+// ServerMaxConcurrentPerIP limits the number of transfers the server will
+// process simultaneously for a single client IP address, preventing a
+// single client from consuming all of the server's transfers. Requests
+// over the limit are answered with an access violation error and counted
+// in Stats.Rejected, without starting a handler. A transfer counts
+// against the limit until it is closed.
+//
+// Default: 0 (unlimited).
+func ServerMaxConcurrentPerIP(n int) ServerOpt {
+	return func(s *Server) error {
+		if n < 0 {
+			return ErrInvalidMaxConcurrent
+		}
+		s.maxPerIP = n
+		return nil
+	}
+}
+
+// ServerRateLimit limits the total rate of DATA sent by all of the
+// server's transfers to bytesPerSec, allowing bursts of up to burst bytes.
+// Packets are paced as described by NewRateLimitedReader, which limits
+// transfers individually. A bytesPerSec of zero disables the limit.
+//
+// Default: 0 (unlimited).
+func ServerRateLimit(bytesPerSec, burst int64) ServerOpt {
+	return func(s *Server) error {
+		if bytesPerSec < 0 || burst < 0 {
+			return ErrInvalidRateLimit
+		}
+		s.rateLimit = nil
+		if bytesPerSec > 0 {
+			s.rateLimit = newTokenBucket(bytesPerSec, burst)
+		}
+		return nil
+	}
+}
+
+// ServerQueueTimeout configures how long a request waits for a transfer
+// slot when the ServerMaxConcurrent limit has been reached. A value of
+// zero rejects such requests immediately.
+//
+// Default: 0.
+func ServerQueueTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidQueueTimeout
+		}
+		s.queueTimeout = d
+		return nil
+	}
+}
+
+// ServerReadBufferSize configures the size of the operating system's receive
+// buffer for the server's network connections, including those created
+// for each transfer.
+//
+// Default: 0 (operating system default).
+func ServerReadBufferSize(bytes int) ServerOpt {
+	return func(s *Server) error {
+		if bytes < 0 {
+			return ErrInvalidBufferSize
+		}
+		s.readBuffer = bytes
+		return nil
+	}
+}
+
+// ServerWriteBufferSize configures the size of the operating system's send
+// buffer for the server's network connections, including those created
+// for each transfer.
+//
+// Default: 0 (operating system default).
+func ServerWriteBufferSize(bytes int) ServerOpt {
+	return func(s *Server) error {
+		if bytes < 0 {
+			return ErrInvalidBufferSize
+		}
+		s.writeBuffer = bytes
+		return nil
+	}
+}
+
+// ServerDSCP configures the DiffServ code point (RFC 2474) used to mark
+// packets sent by the server, including those sent on the connections
+// created for each transfer. It is applied with IP_TOS for IPv4 and
+// IPV6_TCLASS for IPv6. Connections provided to Serve are not modified.
+//
+// Value must be between 0 and 63. ErrDSCPUnsupported is returned on
+// platforms where the traffic class cannot be set.
+//
+// Default: 0 (operating system default).
+func ServerDSCP(value int) ServerOpt {
+	return func(s *Server) error {
+		if value < 0 || value > 63 {
+			return ErrInvalidDSCP
+		}
+		if value != 0 && !dscpSupported {
+			return ErrDSCPUnsupported
+		}
+		s.dscp = value
+		return nil
+	}
+}
+
+// ServerAllowedModes restricts the transfer modes the server will accept.
+// Requests for other modes are answered with an Illegal Operation error
+// before the handler is called.
+//
+// For example, ServerAllowedModes(ModeOctet) refuses netascii requests
+// for binary content that would otherwise be altered in transfer.
+//
+// Default: ModeNetASCII and ModeOctet are allowed.
+func ServerAllowedModes(modes ...TransferMode) ServerOpt {
+	return func(s *Server) error {
+		if len(modes) == 0 {
+			return ErrInvalidMode
+		}
+		for _, m := range modes {
+			if m != ModeNetASCII && m != ModeOctet {
+				return ErrInvalidMode
+			}
+		}
+		s.modes = modes
+		return nil
+	}
+}
+
+// ServerAllowedNets restricts the server to clients within the given
+// networks. Requests from other clients are answered with an
+// Access Violation error. May be combined with ServerDeniedNets, which
+// takes precedence.
+//
+// Default: all clients are allowed.
+func ServerAllowedNets(nets ...*net.IPNet) ServerOpt {
+	return func(s *Server) error {
+		for _, n := range nets {
+			if n == nil {
+				return ErrInvalidIPNet
+			}
+		}
+		s.allowedNets = append(s.allowedNets, nets...)
+		return nil
+	}
+}
+
+// ServerDeniedNets refuses requests from clients within the given networks
+// with an Access Violation error.
+//
+// Default: no clients are denied.
+func ServerDeniedNets(nets ...*net.IPNet) ServerOpt {
+	return func(s *Server) error {
+		for _, n := range nets {
+			if n == nil {
+				return ErrInvalidIPNet
+			}
+		}
+		s.deniedNets = append(s.deniedNets, nets...)
+		return nil
+	}
+}
+
+// ServerTransferTimeout configures how long a transfer may be idle before
+// it is aborted. The deadline starts when the server first waits for the
+// client, after the handler's first Read or Write, and is reset each time
+// a DATA or ACK is received from the client, limiting how long a stalled
+// client can hold a transfer open. Once it expires the client is sent an
+// ERROR and the handler's Read or Write returns ErrTransferTimeout.
+//
+// Default: 0 (no limit).
+func ServerTransferTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidTransferTimeout
+		}
+		s.transferTimeout = d
+		return nil
+	}
+}
+
+// ServerWriteCommitDelay configures the server to wait for d after a write
+// handler returns before the transfer is finished, giving storage with
+// eventual consistency, such as NFS, time to make the file readable.
+//
+// The client has received the final ACK before the handler returns, and
+// may request the file immediately. Read requests for a file, by the
+// requested name, wait until d has passed since the last write of it
+// finished before the read handler is called, without holding a transfer
+// slot. Writes in progress don't delay reads. Clients retransmit requests
+// that aren't answered within their timeout, d should be shorter.
+//
+// Default: 0 (no delay).
+func ServerWriteCommitDelay(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidCommitDelay
+		}
+		s.commitDelay = d
+		return nil
+	}
+}
+
+// ServerTransferDeadline configures the longest a transfer may take,
+// regardless of activity. Once exceeded the client is sent an ERROR,
+// the request's context is canceled, and the handler's Read or Write
+// returns ErrTransferDeadline.
+//
+// Default: 0 (no limit).
+func ServerTransferDeadline(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidTransferDeadline
+		}
+		s.transferDeadline = d
+		return nil
+	}
+}
+
+// ServerMetrics configures m to receive instrumentation events for each
+// transfer.
+//
+// Default: nil (disabled).
+func ServerMetrics(m Metrics) ServerOpt {
+	return func(s *Server) error {
+		s.metrics = m
+		return nil
+	}
+}
+
+// ServerTransferLogger configures fn to be called once each transfer has
+// finished, successfully or not, with statistics about the transfer.
+// It is called from the transfer's goroutine and may be called
+// concurrently. Multicast transfers are not reported.
+//
+// Default: nil (disabled).
+func ServerTransferLogger(fn func(TransferStats)) ServerOpt {
+	return func(s *Server) error {
+		s.transferLogger = fn
+		return nil
+	}
+}
+
+// ServerReadMiddleware configures middleware to wrap the read handler when it
+// is registered. Middleware is applied in the same order as ChainRead and
+// multiple calls append to the list.
+func ServerReadMiddleware(mw ...ReadMiddleware) ServerOpt {
+	return func(s *Server) error {
+		s.readMiddleware = append(s.readMiddleware, mw...)
+		return nil
+	}
+}
+
+// ServerWriteMiddleware configures middleware to wrap the write handler when
+// it is registered. Middleware is applied in the same order as ChainWrite and
+// multiple calls append to the list.
+func ServerWriteMiddleware(mw ...WriteMiddleware) ServerOpt {
+	return func(s *Server) error {
+		s.writeMiddleware = append(s.writeMiddleware, mw...)
+		return nil
+	}
+}
+
+// ServerRequestFilter configures a function to accept or refuse requests
+// before a transfer is started or any handler is called. The function is
+// called sequentially for each request and should return quickly.
+//
+// If filter returns an error the request is refused. If the error is a
+// *Error its code and message are sent to the client, otherwise
+// an Access Violation with the error's text is sent.
+//
+// Default: all requests are accepted.
+func ServerRequestFilter(filter func(RequestInfo) error) ServerOpt {
+	return func(s *Server) error {
+		s.filter = filter
+		return nil
+	}
+}
+
+// ServerPanicHandler configures fn to be called when a handler panics. The
+// panic is recovered and the client is sent an ERROR. The panic value is not
+// included in the ERROR, it may reveal details of the server to clients.
+//
+// fn is called from the deferred recover in the handler's goroutine, so
+// runtime/debug.Stack returns the stack trace of the panic.
+//
+// Default: the panic and stack trace are logged.
+func ServerPanicHandler(fn func(recovered interface{}, req RequestInfo)) ServerOpt {
+	return func(s *Server) error {
+		s.panicHandler = fn
+		return nil
+	}
+}
+
+// ServerWithSlogger configures the server to log with l. Messages
+// about a transfer include the client_addr, op, and filename
+// attributes, and the final message includes bytes and error.
+//
+// Debug and trace messages are logged at slog.LevelDebug and
+// slog.LevelDebug-4, regardless of the TRIVIALT_DEBUG and
+// TRIVIALT_TRACE environment variables.
+//
+// Default: messages are logged to stderr.
+func ServerWithSlogger(l *slog.Logger) ServerOpt {
+	return func(s *Server) error {
+		if l == nil {
+			return ErrNilLogger
+		}
+		s.log = newSlogger(l)
+		return nil
+	}
+}
+
+// ServerListeners configures the number of sockets ListenAndServe opens to
+// receive requests. With more than one listener, each socket is bound to the
+// same address with SO_REUSEPORT and the operating system distributes
+// requests between them. This allows receiving requests on multiple cores.
+//
+// On platforms without SO_REUSEPORT a single listener is used and
+// a warning is logged.
+//
+// Default: 1.
+func ServerListeners(n int) ServerOpt {
+	return func(s *Server) error {
+		if n < 1 {
+			return ErrInvalidListeners
+		}
+		s.numListeners = n
+		return nil
+	}
+}
+
+// ServerReadOnly configures the server to refuse write requests with an
+// ERROR of code and msg, without calling the write handler. This allows
+// a server with both handlers registered to be switched to read-only.
+//
+// Default: write requests are allowed.
+func ServerReadOnly(code ErrorCode, msg string) ServerOpt {
+	return func(s *Server) error {
+		s.readOnly = &Error{Code: code, Message: msg}
+		return nil
+	}
+}
+
+// ServerWriteOnly configures the server to refuse read requests with an
+// ERROR of code and msg, without calling the read handler.
+//
+// Default: read requests are allowed.
+func ServerWriteOnly(code ErrorCode, msg string) ServerOpt {
+	return func(s *Server) error {
+		s.writeOnly = &Error{Code: code, Message: msg}
+		return nil
+	}
+}
+
+// ServerReadNotSupported configures the ERROR code and msg sent to read
+// requests when no ReadHandler is registered. Some clients act on the
+// code, for example trying another server after ErrCodeFileNotFound.
+//
+// Default: ErrCodeIllegalOperation, "Server does not support read requests."
+func ServerReadNotSupported(code ErrorCode, msg string) ServerOpt {
+	return func(s *Server) error {
+		s.noRead = Error{Code: code, Message: msg}
+		return nil
+	}
+}
+
+// ServerWriteNotSupported configures the ERROR code and msg sent to write
+// requests when no WriteHandler is registered.
+//
+// Default: ErrCodeIllegalOperation, "Server does not support write requests."
+func ServerWriteNotSupported(code ErrorCode, msg string) ServerOpt {
+	return func(s *Server) error {
+		s.noWrite = Error{Code: code, Message: msg}
+		return nil
+	}
+}
+
+// ServerRequireTSize configures whether write requests without the
+// transfer size (tsize) option are refused with an ERROR, without
+// calling the write handler. Handlers can then rely on
+// WriteRequest.Size to bound uploads.
+//
+// Default: false.
+func ServerRequireTSize(enable bool) ServerOpt {
+	return func(s *Server) error {
+		s.needTSize = enable
+		return nil
+	}
+}
+
+// ServerReusePort configures whether ListenAndServe sets SO_REUSEPORT on
+// its sockets, allowing multiple server processes to listen on the same
+// address. The operating system distributes requests between them.
+//
+// Transfers are served independently by the process receiving the
+// request. It can't be combined with single port mode, where transfers
+// share the listening socket, as DATA and ACKs may be delivered to
+// another process. NewServer returns ErrReusePortSinglePort if both are
+// enabled.
+//
+// ErrReusePortUnsupported is returned on platforms without SO_REUSEPORT.
+//
+// Default: false.
+func ServerReusePort(enable bool) ServerOpt {
+	return func(s *Server) error {
+		if enable && !reusePortSupported {
+			return ErrReusePortUnsupported
+		}
+		s.reusePort = enable
+		return nil
+	}
+}
+
+// ServerJoinMulticastGroup configures ListenAndServe to join the multicast
+// group at groupAddr, an IP address, on the named network interface. If
+// ifaceName is empty the system chooses the interface. It may be used
+// more than once to join several groups.
+//
+// Requests sent to the group and the server's port are delivered to every
+// server that has joined it. This allows servers in a high availability
+// cluster to share a group address, the client continues the transfer
+// with the first server to respond. Transfers started by the other
+// servers fail, as the client doesn't respond to them. Servers on the
+// same host must also enable ServerReusePort, and listen on an address
+// that accepts datagrams to the group, such as ":69".
+//
+// ErrJoinGroupUnsupported is returned on platforms that don't support
+// joining multicast groups.
+func ServerJoinMulticastGroup(ifaceName, groupAddr string) ServerOpt {
+	return func(s *Server) error {
+		if !joinGroupSupported {
+			return ErrJoinGroupUnsupported
+		}
+		ip := net.ParseIP(groupAddr)
+		if ip == nil || !ip.IsMulticast() {
+			return ErrInvalidGroupAddress
+		}
+
+		g := groupMembership{group: ip}
+		if ifaceName != "" {
+			iface, err := net.InterfaceByName(ifaceName)
+			if err != nil {
+				return ErrInvalidInterface
+			}
+			g.ifaceIndex = iface.Index
+			if ip.To4() != nil {
+				addr, err := interfaceAddr(ifaceName, "udp4")
+				if err != nil {
+					return err
+				}
+				g.ifaceIP = addr.IP
+			}
+		}
+		s.groups = append(s.groups, g)
+		return nil
+	}
+}
+
+// ServerBaseContext configures the context from which all request contexts
+// are derived. Request contexts are also canceled when the server is closed.
+//
+// Default: context.Background().
+func ServerBaseContext(ctx context.Context) ServerOpt {
+	return func(s *Server) error {
+		if ctx == nil {
+			return ErrNilContext
+		}
+		s.ctx = ctx
+		return nil
+	}
+}
+
+// ServerChecksumVerify enables checksums using the algorithm alg, which
+// must be "md5" or "sha256".
+//
+// For read requests, clients requesting the checksum option with the same
+// algorithm (see ClientVerifyChecksum) are sent a checksum of the file after
+// the final DATA is acknowledged. For write requests, the checksum of the
+// received data is available from WriteRequest.Checksum.
+//
+// Default is disabled.
+func ServerChecksumVerify(alg string) ServerOpt {
+	return func(s *Server) error {
+		if _, ok := checksumAlgs[alg]; !ok {
+			return ErrInvalidChecksum
+		}
+		s.checksum = alg
+		return nil
+	}
+}
+
+// ServerStrictRFC1350 configures the server to ignore all requested
+// options (RFC2347) and never send an OACK. Transfers use the RFC1350
+// 512 byte blocksize and one DATA per ACK. This supports clients that
+// fail when receiving an OACK.
+//
+// WriteRequest.Size returns ErrSizeNotReceived and ReadRequest.WriteSize
+// has no effect.
+//
+// Default is disabled.
+func ServerStrictRFC1350(enable bool) ServerOpt {
+	return func(s *Server) error {
+		s.strict = enable
+		return nil
+	}
+}
+
+// ServerOptionNegotiator configures fn to adjust the options (RFC2347)
+// requested by each client before they are negotiated. fn is called with
+// the client's address, the requested file name, and the requested options.
+// The options it returns replace those requested: options that are removed
+// are not acknowledged, and rewritten values are negotiated as if the client
+// had requested them. Returning an empty or nil map causes no OACK to be
+// sent, as if the client had not requested any options.
+//
+// Rewritten values should not be larger than the client requested, clients
+// may reject an OACK with larger values. Server limits such as
+// ServerBlocksize and ServerMaxWindowSize still apply.
+//
+// The requested options returned by ReadRequest.Options and
+// WriteRequest.Options are not affected. fn is not called for multicast
+// transfers or when ServerStrictRFC1350 is enabled.
+//
+// Default: nil, options are negotiated as requested.
+func ServerOptionNegotiator(fn func(addr *net.UDPAddr, filename string, requested map[string]string) map[string]string) ServerOpt {
+	return func(s *Server) error {
+		s.negotiator = fn
+		return nil
+	}
+}
+
+// ServerCoalesceReads enables sharing a single call to the read handler
+// between concurrent requests for the same file name.
+//
+// While a file is being sent, further requests for it are sent the data
+// written by the handler for the first request rather than calling the
+// handler again. Each client is still sent the data in its own transfer.
+// Up to 1 MB of data that hasn't been sent to every client is buffered in
+// memory, once exceeded the handler's Write blocks until the slowest
+// transfer catches up. Requests arriving after data has been discarded, or
+// after the handler has returned, call the handler again.
+//
+// The handler is called with the first request's address and options, so
+// this should only be enabled if responses depend solely on the file name.
+//
+// Default: disabled.
+func ServerCoalesceReads(enable bool) ServerOpt {
+	return func(s *Server) error {
+		s.coalesce = nil
+		if enable {
+			s.coalesce = &readCoalescer{
+				s:       s,
+				bufSize: defaultCoalesceBufferSize,
+				reads:   make(map[string]*readBroadcaster),
+			}
+		}
+		return nil
+	}
+}
+
+// ServerMulticast enables multicast read transfers (RFC 2090) using
+// groupAddr, in the form "ip:port".
+//
+// When a client includes the multicast option in a read request the file
+// is sent to the group, which the client is expected to have joined.
+// Clients requesting the same file while it's being sent join the
+// transfer, receiving any blocks they missed once they become the master
+// client. The file is read from the read handler once and buffered in
+// memory for the duration of the transfer.
+//
+// Only one file is sent to the group at a time, requests for other files
+// and requests without the multicast option are served normally. Multicast
+// is not used in single port mode.
+//
+// Default: disabled.
+func ServerMulticast(groupAddr string) ServerOpt {
+	return func(s *Server) error {
+		addr, err := net.ResolveUDPAddr("udp", groupAddr)
+		if err != nil || !addr.IP.IsMulticast() || addr.Port == 0 {
+			return ErrInvalidMulticastGroup
+		}
+		s.multicast = &multicastManager{s: s, group: addr}
+		return nil
+	}
+}
+
+// ServerConnManager configures cm to track transfers in single port mode,
+// replacing the DefaultConnManager. ServerSinglePortQueueDepth only
+// applies to the DefaultConnManager, cm determines the size of the
+// channels it creates. Idle transfers are removed from cm as configured
+// by ServerSinglePortIdleTimeout.
+//
+// Default: a DefaultConnManager.
+func ServerConnManager(cm ConnManager) ServerOpt {
+	return func(s *Server) error {
+		if cm == nil {
+			return ErrNilConnManager
+		}
+		s.connMgr = cm
+		return nil
+	}
+}
+
+// ServerSinglePortQueueDepth configures the number of datagrams buffered for
+// each transfer in single port mode. Datagrams received while a transfer's
+// queue is full are dropped and counted in Stats. It configures the
+// DefaultConnManager and has no effect if ServerConnManager is used.
+//
+// Default: 64.
+func ServerSinglePortQueueDepth(n int) ServerOpt {
+	return func(s *Server) error {
+		if n < 1 {
+			return ErrInvalidQueueDepth
+		}
+		s.queueDepth = n
+		return nil
+	}
+}
+
+// ServerSinglePortIdleTimeout configures how long a transfer in single port
+// mode may go without receiving a datagram before it is removed. This
+// prevents clients that disappear from leaking resources. The transfer's
+// pending Read or Write returns ErrTransferTimeout.
+//
+// A value of 0 disables removal.
+//
+// Default: 5 minutes.
+func ServerSinglePortIdleTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidIdleTimeout
+		}
+		s.idleTimeout = d
+		return nil
+	}
+}
+
 // ServerSinglePort enables the server to service all requests via a single port rather
 // than the standard TFTP behavior of each client communicating on a separate port.
 //
@@ -0,0 +1,238 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServer_bufferSizes(t *testing.T) {
+	const size = 256 * 1024
+
+	s, _, _, closeServer := startTestServer(t, false, func(ReadRequest) {}, nil,
+		ServerReadBufferSize(size),
+		ServerWriteBufferSize(size),
+	)
+	defer closeServer()
+
+	s.connMu.RLock()
+	conn := s.conn
+	s.connMu.RUnlock()
+
+	// Linux doubles the requested value to allow for bookkeeping overhead,
+	// capped by net.core.rmem_max/wmem_max.
+	if got := getsockoptInt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got < size && got < maxSockBuf("rmem_max") {
+		t.Errorf("expected SO_RCVBUF to be at least %d, got %d", size, got)
+	}
+	if got := getsockoptInt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got < size && got < maxSockBuf("wmem_max") {
+		t.Errorf("expected SO_SNDBUF to be at least %d, got %d", size, got)
+	}
+}
+
+func TestServer_dscp(t *testing.T) {
+	const dscp = 46 // Expedited Forwarding
+	const tos = dscp << 2
+
+	requests := make(chan ReadRequest, 1)
+	proceed := make(chan struct{})
+	s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+		requests <- w
+		<-proceed
+		w.Write([]byte("data"))
+	}, nil, ServerDSCP(dscp))
+	defer closeServer()
+
+	s.connMu.RLock()
+	conn := s.conn
+	s.connMu.RUnlock()
+	if got := getsockoptInt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS); got != tos {
+		t.Errorf("expected listener IP_TOS %d, got %d", tos, got)
+	}
+
+	client, err := NewClient(ClientDSCP(dscp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		resp *Response
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+		results <- result{resp, err}
+	}()
+
+	w := <-requests
+	transferConn := w.(*readRequest).conn.netConn
+	if got := getsockoptInt(t, transferConn, syscall.IPPROTO_IP, syscall.IP_TOS); got != tos {
+		t.Errorf("expected transfer IP_TOS %d, got %d", tos, got)
+	}
+	close(proceed)
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if got := getsockoptInt(t, res.resp.conn.netConn, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS); got != tos {
+		t.Errorf("expected client IPV6_TCLASS %d, got %d", tos, got)
+	}
+	if _, err := ioutil.ReadAll(res.resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_replySourceAddr(t *testing.T) {
+	cases := []struct {
+		net  string
+		addr string
+	}{
+		{net: "udp4", addr: "0.0.0.0:0"},
+		{net: "udp", addr: ":0"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.net, func(t *testing.T) {
+			s, err := NewServer(c.addr, ServerNet(c.net))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+				w.Write([]byte("data"))
+			}))
+			go s.ListenAndServe()
+			defer s.Close()
+			for !s.Connected() {
+				runtime.Gosched()
+			}
+			addr, err := s.Addr()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// All of 127.0.0.0/8 is routed to loopback, send the request to
+			// a secondary address from the primary.
+			conn := sendTestRequestFrom(t, "127.0.0.1", "127.0.0.2:"+strconv.Itoa(addr.Port), opCodeRRQ, "file", nil)
+			defer conn.Close()
+
+			buf := make([]byte, 1024)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, raddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !raddr.IP.Equal(net.ParseIP("127.0.0.2")) {
+				t.Errorf("expected reply from 127.0.0.2, got %v", raddr.IP)
+			}
+		})
+	}
+}
+
+func getsockoptInt(t *testing.T, conn net.PacketConn, level, opt int) int {
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var val int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		val, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return val
+}
+
+// maxSockBuf returns the kernel's limit for socket buffers set without
+// privileges, or 0 if unavailable.
+func maxSockBuf(name string) int {
+	data, err := ioutil.ReadFile("/proc/sys/net/core/" + name)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n * 2
+}
+
+func TestServer_joinMulticastGroup(t *testing.T) {
+	const group = "239.255.69.69"
+
+	requests := make(chan int, 2)
+	port := 0
+	for i := 0; i < 2; i++ {
+		i := i
+		s, err := NewServer(":"+strconv.Itoa(port),
+			ServerNet("udp4"),
+			ServerReusePort(true),
+			ServerJoinMulticastGroup("lo", group),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+			requests <- i
+		}))
+		errs := make(chan error, 1)
+		go func() { errs <- s.ListenAndServe() }()
+		defer s.Close()
+		for !s.Connected() {
+			select {
+			case err := <-errs:
+				t.Skipf("joining multicast group on loopback: %v", err)
+			default:
+				runtime.Gosched()
+			}
+		}
+		addr, err := s.Addr()
+		if err != nil {
+			t.Fatal(err)
+		}
+		port = addr.Port
+	}
+
+	// Send the request to the group over loopback
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, [4]byte{127, 0, 0, 1})
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	var dg datagram
+	dg.writeReq(opCodeRRQ, "file", ModeOctet, nil)
+	if _, err := conn.WriteTo(dg.bytes(), &net.UDPAddr{IP: net.ParseIP(group), Port: port}); err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(map[int]bool)
+	for len(served) < 2 {
+		select {
+		case i := <-requests:
+			served[i] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected both servers to receive the request, got %v", served)
+		}
+	}
+}
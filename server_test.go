@@ -4,7 +4,30 @@
 
 package trivialt
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestNewServer(t *testing.T) {
 	t.Parallel()
@@ -36,6 +59,46 @@ func TestNewServer(t *testing.T) {
 			expectedNet:        "udp6",
 			expectedRetransmit: 10,
 		},
+		{
+			name: "addr, random port",
+			addr: ":0",
+
+			expectedAddrStr:    ":0",
+			expectedNet:        "udp",
+			expectedRetransmit: 10,
+		},
+		{
+			name: "addr, host and port",
+			addr: "127.0.0.1:6969",
+
+			expectedAddrStr:    "127.0.0.1:6969",
+			expectedNet:        "udp",
+			expectedRetransmit: 10,
+		},
+		{
+			name: "addr, port out of range",
+			addr: ":99999",
+
+			expectedError: ErrInvalidAddress,
+		},
+		{
+			name: "addr, negative port",
+			addr: ":-1",
+
+			expectedError: ErrInvalidAddress,
+		},
+		{
+			name: "addr, missing port",
+			addr: "localhost",
+
+			expectedError: ErrInvalidAddress,
+		},
+		{
+			name: "addr, unknown service",
+			addr: ":not-a-service",
+
+			expectedError: ErrInvalidAddress,
+		},
 		{
 			name: "net, invalid",
 			addr: "",
@@ -55,6 +118,312 @@ func TestNewServer(t *testing.T) {
 			expectedNet:        "udp",
 			expectedRetransmit: 2,
 		},
+		{
+			name: "blocksize, too small",
+			addr: "",
+			opts: []ServerOpt{
+				ServerBlocksize(7),
+			},
+
+			expectedError: ErrInvalidBlocksize,
+		},
+		{
+			name: "blocksize, too large",
+			addr: "",
+			opts: []ServerOpt{
+				ServerBlocksize(65465),
+			},
+
+			expectedError: ErrInvalidBlocksize,
+		},
+		{
+			name: "max timeout, too small",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxTimeout(time.Millisecond),
+			},
+
+			expectedError: ErrInvalidTimeout,
+		},
+		{
+			name: "max timeout, too large",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxTimeout(256 * time.Second),
+			},
+
+			expectedError: ErrInvalidTimeout,
+		},
+		{
+			name: "max concurrent, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxConcurrent(-1),
+			},
+
+			expectedError: ErrInvalidMaxConcurrent,
+		},
+		{
+			name: "max windowsize, too small",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxWindowSize(0),
+			},
+
+			expectedError: ErrInvalidWindowsize,
+		},
+		{
+			name: "max windowsize, too large",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxWindowSize(65536),
+			},
+
+			expectedError: ErrInvalidWindowsize,
+		},
+		{
+			name: "allowed modes, empty",
+			addr: "",
+			opts: []ServerOpt{
+				ServerAllowedModes(),
+			},
+
+			expectedError: ErrInvalidMode,
+		},
+		{
+			name: "allowed modes, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerAllowedModes(ModeOctet, "mail"),
+			},
+
+			expectedError: ErrInvalidMode,
+		},
+		{
+			name: "checksum, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerChecksumVerify("crc32"),
+			},
+
+			expectedError: ErrInvalidChecksum,
+		},
+		{
+			name: "max concurrent reads, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxConcurrentReads(-1),
+			},
+
+			expectedError: ErrInvalidMaxConcurrent,
+		},
+		{
+			name: "max concurrent writes, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxConcurrentWrites(-1),
+			},
+
+			expectedError: ErrInvalidMaxConcurrent,
+		},
+		{
+			name: "join multicast group, not multicast",
+			addr: "",
+			opts: []ServerOpt{
+				ServerJoinMulticastGroup("", "10.0.0.1"),
+			},
+
+			expectedError: ErrInvalidGroupAddress,
+		},
+		{
+			name: "join multicast group, invalid interface",
+			addr: "",
+			opts: []ServerOpt{
+				ServerJoinMulticastGroup("doesnotexist0", "239.255.69.69"),
+			},
+
+			expectedError: ErrInvalidInterface,
+		},
+		{
+			name: "write commit delay, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerWriteCommitDelay(-time.Second),
+			},
+
+			expectedError: ErrInvalidCommitDelay,
+		},
+		{
+			name: "rate limit, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerRateLimit(-1, 0),
+			},
+
+			expectedError: ErrInvalidRateLimit,
+		},
+		{
+			name: "max concurrent per IP, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxConcurrentPerIP(-1),
+			},
+
+			expectedError: ErrInvalidMaxConcurrent,
+		},
+		{
+			name: "queue timeout, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerQueueTimeout(-time.Second),
+			},
+
+			expectedError: ErrInvalidQueueTimeout,
+		},
+		{
+			name: "read buffer, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerReadBufferSize(-1),
+			},
+
+			expectedError: ErrInvalidBufferSize,
+		},
+		{
+			name: "write buffer, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerWriteBufferSize(-1),
+			},
+
+			expectedError: ErrInvalidBufferSize,
+		},
+		{
+			name: "dscp, too large",
+			addr: "",
+			opts: []ServerOpt{
+				ServerDSCP(64),
+			},
+
+			expectedError: ErrInvalidDSCP,
+		},
+		{
+			name: "multicast, unicast address",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMulticast("127.0.0.1:1758"),
+			},
+
+			expectedError: ErrInvalidMulticastGroup,
+		},
+		{
+			name: "multicast, no port",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMulticast("239.255.0.1"),
+			},
+
+			expectedError: ErrInvalidMulticastGroup,
+		},
+		{
+			name: "dscp, negative",
+			addr: "",
+			opts: []ServerOpt{
+				ServerDSCP(-1),
+			},
+
+			expectedError: ErrInvalidDSCP,
+		},
+		{
+			name: "allowed nets, nil",
+			addr: "",
+			opts: []ServerOpt{
+				ServerAllowedNets(nil),
+			},
+
+			expectedError: ErrInvalidIPNet,
+		},
+		{
+			name: "denied nets, nil",
+			addr: "",
+			opts: []ServerOpt{
+				ServerDeniedNets(nil),
+			},
+
+			expectedError: ErrInvalidIPNet,
+		},
+		{
+			name: "transfer timeout, negative",
+			addr: "",
+			opts: []ServerOpt{
+				ServerTransferTimeout(-1),
+			},
+
+			expectedError: ErrInvalidTransferTimeout,
+		},
+		{
+			name: "single port queue depth, zero",
+			addr: "",
+			opts: []ServerOpt{
+				ServerSinglePortQueueDepth(0),
+			},
+
+			expectedError: ErrInvalidQueueDepth,
+		},
+		{
+			name: "single port idle timeout, negative",
+			addr: "",
+			opts: []ServerOpt{
+				ServerSinglePortIdleTimeout(-1),
+			},
+
+			expectedError: ErrInvalidIdleTimeout,
+		},
+		{
+			name: "timeout, zero",
+			addr: "",
+			opts: []ServerOpt{
+				ServerTimeout(0),
+			},
+
+			expectedError: ErrInvalidRetransmitTimeout,
+		},
+		{
+			name: "slogger, nil",
+			addr: "",
+			opts: []ServerOpt{
+				ServerWithSlogger(nil),
+			},
+
+			expectedError: ErrNilLogger,
+		},
+		{
+			name: "transfer deadline, negative",
+			addr: "",
+			opts: []ServerOpt{
+				ServerTransferDeadline(-1),
+			},
+
+			expectedError: ErrInvalidTransferDeadline,
+		},
+		{
+			name: "listeners, zero",
+			addr: "",
+			opts: []ServerOpt{
+				ServerListeners(0),
+			},
+
+			expectedError: ErrInvalidListeners,
+		},
+		{
+			name: "base context, nil",
+			addr: "",
+			opts: []ServerOpt{
+				ServerBaseContext(nil),
+			},
+
+			expectedError: ErrNilContext,
+		},
 		{
 			name: "retransmit, invalid",
 			addr: "",
@@ -96,3 +465,4191 @@ func TestNewServer(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_requestContext(t *testing.T) {
+	t.Parallel()
+
+	type ctxKey struct{}
+	random1MB := getTestData(t, "1MB-random")
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("client canceled, single port mode: %t", singlePort), func(t *testing.T) {
+			baseCtx := context.WithValue(context.Background(), ctxKey{}, "base")
+			ctxErr := make(chan error, 1)
+			ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+				if v := w.Context().Value(ctxKey{}); v != "base" {
+					t.Errorf("expected context value %q, got %v", "base", v)
+				}
+				if _, err := w.Write(random1MB); err == nil {
+					t.Error("expected write to fail after client canceled")
+				}
+				ctxErr <- w.Context().Err()
+			}, nil, ServerBaseContext(baseCtx))
+			defer closeServer()
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("%s:%d/file", ip, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Close()
+
+			select {
+			case err := <-ctxErr:
+				if err != context.Canceled {
+					t.Errorf("expected context to be canceled, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for handler")
+			}
+		})
+	}
+
+	t.Run("server closed", func(t *testing.T) {
+		started := make(chan struct{})
+		ctxErr := make(chan error, 1)
+		ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+			close(started)
+			select {
+			case <-w.Context().Done():
+				ctxErr <- w.Context().Err()
+			case <-time.After(5 * time.Second):
+				ctxErr <- nil
+			}
+		}, nil)
+
+		conn, err := net.Dial("udp", ip+":"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		var dg datagram
+		dg.writeReadReq("file", ModeOctet, nil)
+		if _, err := conn.Write(dg.bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		<-started
+		closeServer()
+
+		if err := <-ctxErr; err != context.Canceled {
+			t.Errorf("expected context to be canceled, got %v", err)
+		}
+	})
+}
+
+func TestServer_maxConcurrent(t *testing.T) {
+	t.Parallel()
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("reject, single port mode: %t", singlePort), func(t *testing.T) {
+			const limit = 2
+			started := make(chan struct{}, limit)
+			release := make(chan struct{})
+			s, ip, port, closeServer := startTestServer(t, singlePort, func(w ReadRequest) {
+				started <- struct{}{}
+				<-release
+			}, nil, ServerMaxConcurrent(limit))
+			defer closeServer()
+			addr := ip + ":" + strconv.Itoa(port)
+
+			// Fill the slots
+			for i := 0; i < limit; i++ {
+				conn := sendTestRequest(t, addr, opCodeRRQ, "file", nil)
+				defer conn.Close()
+				<-started
+			}
+
+			// Remaining requests should be rejected
+			for i := 0; i < 3; i++ {
+				conn := sendTestRequest(t, addr, opCodeRRQ, "file", nil)
+				defer conn.Close()
+
+				dg := readTestDatagram(t, conn)
+				if dg.opcode() != opCodeERROR {
+					t.Fatalf("expected ERROR, got %s", dg)
+				}
+				if dg.errorCode() != ErrCodeNotDefined || dg.errMsg() != "server busy" {
+					t.Errorf("expected server busy error, got %s", dg)
+				}
+			}
+			close(release)
+
+			if rejected := s.Stats().Rejected; rejected != 3 {
+				t.Errorf("expected 3 rejected requests, got %d", rejected)
+			}
+		})
+	}
+
+	t.Run("queue", func(t *testing.T) {
+		random1MB := getTestData(t, "1MB-random")
+		_, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+			w.Write(random1MB)
+		}, nil, ServerMaxConcurrent(1), ServerQueueTimeout(5*time.Second))
+		defer closeServer()
+
+		client, err := NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make(chan error, 3)
+		for i := 0; i < cap(errs); i++ {
+			go func() {
+				resp, err := client.Get(fmt.Sprintf("%s:%d/file", ip, port))
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer resp.Close()
+				_, err = ioutil.ReadAll(resp)
+				errs <- err
+			}()
+		}
+		for i := 0; i < cap(errs); i++ {
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestServer_maxConcurrentByOp(t *testing.T) {
+	t.Parallel()
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			readStarted := make(chan struct{}, 1)
+			writeStarted := make(chan struct{}, 1)
+			release := make(chan struct{})
+			s, ip, port, closeServer := startTestServer(t, singlePort, func(w ReadRequest) {
+				readStarted <- struct{}{}
+				<-release
+			}, func(w WriteRequest) {
+				writeStarted <- struct{}{}
+				<-release
+			}, ServerMaxConcurrentReads(1), ServerMaxConcurrentWrites(1))
+			defer closeServer()
+			defer close(release)
+			addr := ip + ":" + strconv.Itoa(port)
+
+			conn := sendTestRequest(t, addr, opCodeRRQ, "file", nil)
+			defer conn.Close()
+			<-readStarted
+
+			// Writes are limited independently of reads
+			conn = sendTestRequest(t, addr, opCodeWRQ, "file", nil)
+			defer conn.Close()
+			<-writeStarted
+
+			cases := []struct {
+				op  opcode
+				msg string
+			}{
+				{opCodeRRQ, "server busy: too many concurrent reads"},
+				{opCodeWRQ, "server busy: too many concurrent writes"},
+			}
+			for _, c := range cases {
+				conn := sendTestRequest(t, addr, c.op, "file", nil)
+				defer conn.Close()
+
+				dg := readTestDatagram(t, conn)
+				if dg.opcode() != opCodeERROR || dg.errMsg() != c.msg {
+					t.Errorf("expected %q error, got %s", c.msg, dg)
+				}
+			}
+
+			if rejected := s.Stats().Rejected; rejected != 2 {
+				t.Errorf("expected 2 rejected requests, got %d", rejected)
+			}
+		})
+	}
+}
+
+func TestServer_maxConcurrentPerIP(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("requires 127.0.0.0/8 on loopback")
+	}
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			started := make(chan string, 3)
+			release := make(chan struct{})
+			s, ip, port, closeServer := startTestServer(t, singlePort, func(w ReadRequest) {
+				started <- w.Addr().IP.String()
+				<-release
+			}, nil, ServerMaxConcurrentPerIP(1))
+			defer closeServer()
+			addr := ip + ":" + strconv.Itoa(port)
+
+			conn := sendTestRequestFrom(t, "127.0.0.1", addr, opCodeRRQ, "file", nil)
+			defer conn.Close()
+			<-started
+
+			// Second request from the same IP is throttled
+			conn = sendTestRequestFrom(t, "127.0.0.1", addr, opCodeRRQ, "file", nil)
+			defer conn.Close()
+			dg := readTestDatagram(t, conn)
+			if dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeAccessViolation || dg.errMsg() != "too many transfers from client" {
+				t.Errorf("expected ACCESS_VIOLATION too many transfers error, got %s", dg)
+			}
+
+			// Other IP is unaffected
+			conn = sendTestRequestFrom(t, "127.0.0.2", addr, opCodeRRQ, "file", nil)
+			defer conn.Close()
+			if ip := <-started; ip != "127.0.0.2" {
+				t.Errorf("expected request from 127.0.0.2 to be served, got %s", ip)
+			}
+
+			// Counts are released when transfers end
+			close(release)
+			for {
+				s.ipMu.Lock()
+				n := len(s.ipTransfers)
+				s.ipMu.Unlock()
+				if n == 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			conn = sendTestRequestFrom(t, "127.0.0.1", addr, opCodeRRQ, "file", nil)
+			defer conn.Close()
+			if ip := <-started; ip != "127.0.0.1" {
+				t.Errorf("expected request from 127.0.0.1 to be served, got %s", ip)
+			}
+
+			if rejected := s.Stats().Rejected; rejected != 1 {
+				t.Errorf("expected 1 rejected request, got %d", rejected)
+			}
+		})
+	}
+}
+
+// sendTestRequest sends a RRQ or WRQ to addr from a new connection and
+// returns the connection so responses can be read.
+func sendTestRequest(t *testing.T, addr string, op opcode, filename string, opts map[string]string) *net.UDPConn {
+	return sendTestRequestFrom(t, "", addr, op, filename, opts)
+}
+
+// sendTestRequestFrom is sendTestRequest with a specific source IP. If srcIP
+// is empty, the server's IP is used.
+func sendTestRequestFrom(t *testing.T, srcIP string, addr string, op opcode, filename string, opts map[string]string) *net.UDPConn {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := &net.UDPAddr{IP: raddr.IP}
+	if srcIP != "" {
+		laddr.IP = net.ParseIP(srcIP)
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dg datagram
+	dg.writeReq(op, filename, ModeOctet, opts)
+	if _, err := conn.WriteTo(dg.bytes(), raddr); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readTestDatagram reads a single datagram from conn.
+func readTestDatagram(t *testing.T, conn *net.UDPConn) datagram {
+	dg := datagram{buf: make([]byte, 65536)}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(dg.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dg.offset = n
+	return dg
+}
+
+func TestServer_readTransferSize(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		writeSize bool
+		opts      map[string]string
+
+		expectedOptions options
+	}{
+		{
+			name:      "size set, requested",
+			writeSize: true,
+			opts:      map[string]string{optTransferSize: "0"},
+
+			expectedOptions: options{optTransferSize: "8"},
+		},
+		{
+			name: "size not set, requested",
+			opts: map[string]string{optTransferSize: "0", optBlocksize: "1024"},
+
+			expectedOptions: options{optBlocksize: "1024"},
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, single port mode: %t", c.name, singlePort), func(t *testing.T) {
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					if c.writeSize {
+						w.WriteSize(8)
+					}
+					w.Write([]byte("the data"))
+				}, nil)
+				defer closeServer()
+
+				conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", c.opts)
+				defer conn.Close()
+
+				dg := readTestDatagram(t, conn)
+				if dg.opcode() != opCodeOACK {
+					t.Fatalf("expected OACK, got %s", dg)
+				}
+				if opts := dg.options(); !reflect.DeepEqual(opts, c.expectedOptions) {
+					t.Errorf("expected options %s, got %s", c.expectedOptions, opts)
+				}
+			})
+		}
+	}
+}
+
+func TestServer_ipAllowed(t *testing.T) {
+	mustCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	cases := []struct {
+		name string
+		ip   string
+		opts []ServerOpt
+
+		expected bool
+	}{
+		{
+			name: "default",
+			ip:   "192.0.2.1",
+
+			expected: true,
+		},
+		{
+			name: "allowed",
+			ip:   "192.0.2.1",
+			opts: []ServerOpt{ServerAllowedNets(mustCIDR("198.51.100.0/24"), mustCIDR("192.0.2.0/24"))},
+
+			expected: true,
+		},
+		{
+			name: "not allowed",
+			ip:   "203.0.113.1",
+			opts: []ServerOpt{ServerAllowedNets(mustCIDR("192.0.2.0/24"))},
+
+			expected: false,
+		},
+		{
+			name: "denied",
+			ip:   "192.0.2.1",
+			opts: []ServerOpt{ServerDeniedNets(mustCIDR("192.0.2.0/24"))},
+
+			expected: false,
+		},
+		{
+			name: "not denied",
+			ip:   "203.0.113.1",
+			opts: []ServerOpt{ServerDeniedNets(mustCIDR("192.0.2.0/24"))},
+
+			expected: true,
+		},
+		{
+			name: "denied takes precedence",
+			ip:   "192.0.2.1",
+			opts: []ServerOpt{
+				ServerAllowedNets(mustCIDR("192.0.2.0/24")),
+				ServerDeniedNets(mustCIDR("192.0.2.1/32")),
+			},
+
+			expected: false,
+		},
+		{
+			name: "allowed, not denied",
+			ip:   "192.0.2.2",
+			opts: []ServerOpt{
+				ServerAllowedNets(mustCIDR("192.0.2.0/24")),
+				ServerDeniedNets(mustCIDR("192.0.2.1/32")),
+			},
+
+			expected: true,
+		},
+		{
+			name: "ipv6",
+			ip:   "2001:db8::1",
+			opts: []ServerOpt{ServerAllowedNets(mustCIDR("2001:db8::/32"))},
+
+			expected: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := NewServer("", c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if allowed := s.ipAllowed(net.ParseIP(c.ip)); allowed != c.expected {
+				t.Errorf("expected ipAllowed(%s) to be %t, but it was %t", c.ip, c.expected, allowed)
+			}
+		})
+	}
+}
+
+func TestServer_deniedRequest(t *testing.T) {
+	t.Parallel()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	for _, op := range []opcode{opCodeRRQ, opCodeWRQ} {
+		t.Run(op.String(), func(t *testing.T) {
+			ip, port, closeServer := newTestServer(t, false, func(ReadRequest) {
+				t.Error("read handler should not be called")
+			}, func(WriteRequest) {
+				t.Error("write handler should not be called")
+			}, ServerDeniedNets(loopback))
+			defer closeServer()
+
+			conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), op, "file", nil)
+			defer conn.Close()
+
+			dg := readTestDatagram(t, conn)
+			if dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeAccessViolation {
+				t.Errorf("expected access violation error, got %s", dg)
+			}
+		})
+	}
+}
+
+func TestServerReusePort(t *testing.T) {
+	t.Parallel()
+
+	if !reusePortSupported {
+		if _, err := NewServer("127.0.0.1:0", ServerReusePort(true)); err != ErrReusePortUnsupported {
+			t.Errorf("expected %v, got %v", ErrReusePortUnsupported, err)
+		}
+		return
+	}
+
+	_, err := NewServer("127.0.0.1:0", ServerReusePort(true), ServerSinglePort(true))
+	if err != ErrReusePortSinglePort {
+		t.Errorf("expected %v, got %v", ErrReusePortSinglePort, err)
+	}
+
+	var served [2]int32
+	_, ip, port, closeA := startTestServer(t, false, func(w ReadRequest) {
+		atomic.AddInt32(&served[0], 1)
+		w.Write([]byte("a"))
+	}, nil, ServerReusePort(true))
+	defer closeA()
+	addr := ip + ":" + strconv.Itoa(port)
+
+	// A server without the option can't bind the same address
+	other, err := NewServer(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {}))
+	if err := other.ListenAndServe(); err == nil {
+		other.Close()
+		t.Fatal("expected ListenAndServe without ServerReusePort to fail")
+	}
+
+	b, err := NewServer(addr, ServerReusePort(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		atomic.AddInt32(&served[1], 1)
+		w.Write([]byte("b"))
+	}))
+	errChan := make(chan error, 1)
+	go func() { errChan <- b.ListenAndServe() }()
+	defer b.Close()
+	for !b.Connected() {
+		select {
+		case err := <-errChan:
+			t.Fatalf("second server failed: %v", err)
+		default:
+			runtime.Gosched()
+		}
+	}
+	if bAddr, _ := b.Addr(); bAddr.String() != addr {
+		t.Errorf("expected second server on %s, got %s", addr, bAddr)
+	}
+
+	const requests = 20
+	for i := 0; i < requests; i++ {
+		client, err := NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get("tftp://" + addr + "/file")
+		if err != nil {
+			t.Fatalf("Get %d: %v", i, err)
+		}
+		if _, err := ioutil.ReadAll(resp); err != nil {
+			t.Fatalf("Get %d: %v", i, err)
+		}
+	}
+	if total := atomic.LoadInt32(&served[0]) + atomic.LoadInt32(&served[1]); total != requests {
+		t.Errorf("expected %d requests served, got %d", requests, total)
+	}
+}
+
+func TestServer_listeners(t *testing.T) {
+	t.Parallel()
+
+	const numListeners = 4
+	data := []byte("the data")
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			s, ip, port, closeServer := startTestServer(t, singlePort, func(w ReadRequest) {
+				w.Write(data)
+			}, nil, ServerListeners(numListeners))
+			defer closeServer()
+
+			expectedListeners := 0
+			if reusePortSupported {
+				expectedListeners = numListeners - 1
+			}
+			s.connMu.RLock()
+			if l := len(s.listeners); l != expectedListeners {
+				t.Errorf("expected %d additional listeners, got %d", expectedListeners, l)
+			}
+			s.connMu.RUnlock()
+
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+			for i := 0; i < 20; i++ {
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				resp, err := client.Get(url)
+				if err != nil {
+					t.Fatalf("Get %d: %v", i, err)
+				}
+				got, err := ioutil.ReadAll(resp)
+				if err != nil {
+					t.Fatalf("Get %d: %v", i, err)
+				}
+				if !reflect.DeepEqual(got, data) {
+					t.Errorf("Get %d: expected %q, got %q", i, data, got)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_transferTimeout(t *testing.T) {
+	t.Parallel()
+
+	const timeout = 300 * time.Millisecond
+
+	for _, op := range []opcode{opCodeRRQ, opCodeWRQ} {
+		for _, singlePort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, single port mode: %t", op, singlePort), func(t *testing.T) {
+				errChan := make(chan error, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					_, err := w.Write(make([]byte, 4096))
+					errChan <- err
+				}, func(w WriteRequest) {
+					_, err := ioutil.ReadAll(w)
+					errChan <- err
+				}, ServerTransferTimeout(timeout))
+				defer closeServer()
+
+				start := time.Now()
+				conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), op, "file", nil)
+				defer conn.Close()
+
+				// Never respond, the server should give up after the
+				// transfer timeout rather than exhausting retransmits.
+				for {
+					dg := readTestDatagram(t, conn)
+					if dg.opcode() == opCodeERROR {
+						break
+					}
+				}
+
+				select {
+				case err := <-errChan:
+					if ErrorCause(err) != ErrTransferTimeout {
+						t.Errorf("expected handler error %v, got %v", ErrTransferTimeout, err)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("handler did not return")
+				}
+
+				if elapsed := time.Since(start); elapsed > 3*timeout {
+					t.Errorf("expected transfer to be aborted after about %s, took %s", timeout, elapsed)
+				}
+			})
+		}
+	}
+}
+
+func TestServer_transferTimeoutSlowHandler(t *testing.T) {
+	t.Parallel()
+
+	const timeout = 200 * time.Millisecond
+	data := []byte("the data")
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		time.Sleep(2 * timeout) // Opening the file
+		w.Write(data)
+	}, nil, ServerTransferTimeout(timeout))
+	defer closeServer()
+
+	client, err := NewClient(ClientTimeout(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatalf("expected transfer to succeed, got %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected %q, got %q", data, got)
+	}
+}
+
+func TestServer_singlePortReadWriteSameAddr(t *testing.T) {
+	t.Parallel()
+
+	readData := getTestData(t, "1MB-random")[:1000]
+	writeData := []byte("the written data")
+
+	received := make(chan []byte, 1)
+	ip, port, closeServer := newTestServer(t, true, func(w ReadRequest) {
+		w.Write(readData)
+	}, func(w WriteRequest) {
+		data, err := ioutil.ReadAll(w)
+		if err != nil {
+			t.Errorf("write handler: %v", err)
+		}
+		received <- data
+	})
+	defer closeServer()
+
+	// Send RRQ and WRQ from the same socket
+	addr := ip + ":" + strconv.Itoa(port)
+	conn := sendTestRequest(t, addr, opCodeRRQ, "read", nil)
+	defer conn.Close()
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	var dg datagram
+	dg.writeWriteReq("write", ModeOctet, nil)
+	if _, err := conn.WriteTo(dg.bytes(), raddr); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	readDone, writeDone := false, false
+	for !readDone || !writeDone {
+		rx := readTestDatagram(t, conn)
+		switch rx.opcode() {
+		case opCodeDATA:
+			got = append(got, rx.data()...)
+			readDone = len(rx.data()) < 512
+			dg.writeAck(rx.block())
+		case opCodeACK:
+			if rx.block() == 1 {
+				writeDone = true
+				continue
+			}
+			dg.writeData(1, writeData)
+		default:
+			t.Fatalf("unexpected datagram %s", rx)
+		}
+		if _, err := conn.WriteTo(dg.bytes(), raddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(got, readData) {
+		t.Errorf("expected to read %d bytes, got %d", len(readData), len(got))
+	}
+	select {
+	case data := <-received:
+		if !reflect.DeepEqual(data, writeData) {
+			t.Errorf("expected server to receive %q, got %q", writeData, data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("write handler did not return")
+	}
+}
+
+func TestServer_singlePortQueueFull(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("the data")
+	unblock := make(chan struct{})
+	s, ip, port, closeServer := startTestServer(t, true, func(w ReadRequest) {
+		w.Write(data)
+	}, func(w WriteRequest) {
+		w.Read(nil) // Accept the transfer
+		<-unblock   // Wedge the transfer
+	}, ServerSinglePortQueueDepth(4))
+	defer closeServer()
+	defer close(unblock)
+
+	// Start a write and flood the server with DATA it won't read
+	addr := ip + ":" + strconv.Itoa(port)
+	conn := sendTestRequest(t, addr, opCodeWRQ, "file", nil)
+	defer conn.Close()
+	if dg := readTestDatagram(t, conn); dg.opcode() != opCodeACK {
+		t.Fatalf("expected ACK, got %s", dg)
+	}
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	var dg datagram
+	dg.writeData(1, make([]byte, 512))
+	for i := 0; i < 100; i++ {
+		if _, err := conn.WriteTo(dg.bytes(), raddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Another client should be unaffected
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("tftp://" + addr + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Errorf("expected %q, got %q", data, got)
+	}
+
+	if dropped := s.Stats().Dropped; dropped == 0 {
+		t.Error("expected dropped datagrams to be counted")
+	}
+}
+
+type metricsEvent struct {
+	op      string
+	started bool
+	bytes   int64
+	failed  bool
+}
+
+// metricsRecorder implements Metrics, sending events to a channel.
+type metricsRecorder chan metricsEvent
+
+func (m metricsRecorder) TransferStarted(op string) {
+	m <- metricsEvent{op: op, started: true}
+}
+
+func (m metricsRecorder) TransferFinished(op string, bytes int64, duration time.Duration, err error) {
+	m <- metricsEvent{op: op, bytes: bytes, failed: err != nil}
+}
+
+func TestServer_metrics(t *testing.T) {
+	t.Parallel()
+
+	data := getTestData(t, "1MB-random")[:2000]
+
+	cases := []struct {
+		name string
+		op   opcode
+		file string
+
+		expectedFinish metricsEvent
+	}{
+		{
+			name: "read",
+			op:   opCodeRRQ,
+			file: "file",
+
+			expectedFinish: metricsEvent{op: "read", bytes: 2000},
+		},
+		{
+			name: "read, handler error",
+			op:   opCodeRRQ,
+			file: "missing",
+
+			expectedFinish: metricsEvent{op: "read", failed: true},
+		},
+		{
+			name: "write",
+			op:   opCodeWRQ,
+			file: "file",
+
+			expectedFinish: metricsEvent{op: "write", bytes: 2000},
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, single port mode: %t", c.name, singlePort), func(t *testing.T) {
+				events := make(metricsRecorder, 2)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					if w.Name() == "missing" {
+						w.WriteError(ErrCodeFileNotFound, "not found")
+						return
+					}
+					w.Write(data)
+				}, func(w WriteRequest) {
+					ioutil.ReadAll(w)
+				}, ServerMetrics(events))
+				defer closeServer()
+
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/" + c.file
+				if c.op == opCodeRRQ {
+					if resp, err := client.Get(url); err == nil {
+						ioutil.ReadAll(resp)
+					}
+				} else {
+					if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				for _, expected := range []metricsEvent{{op: c.expectedFinish.op, started: true}, c.expectedFinish} {
+					select {
+					case e := <-events:
+						if e != expected {
+							t.Errorf("expected event %+v, got %+v", expected, e)
+						}
+					case <-time.After(2 * time.Second):
+						t.Fatalf("timeout waiting for event %+v", expected)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestServerTransferLogger(t *testing.T) {
+	t.Parallel()
+
+	data := getTestData(t, "1MB-random")[:2000]
+
+	cases := []struct {
+		name string
+		// Performs the transfer, returns the client's address
+		transfer func(t *testing.T, url, addr string) string
+
+		expected TransferStats
+	}{
+		{
+			name: "read",
+			transfer: func(t *testing.T, url, addr string) string {
+				client, err := NewClient(ClientBlocksize(1024), ClientWindowsize(2))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := client.Get(url + "file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				ioutil.ReadAll(resp)
+				return ""
+			},
+
+			expected: TransferStats{Op: "read", Name: "file", Bytes: 2000, BlockSize: 1024, WindowSize: 2},
+		},
+		{
+			name: "read, handler error",
+			transfer: func(t *testing.T, url, addr string) string {
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				client.Get(url + "missing")
+				return ""
+			},
+
+			expected: TransferStats{Op: "read", Name: "missing", BlockSize: 512, WindowSize: 1, Err: errors.New("")},
+		},
+		{
+			name: "read, retransmit",
+			transfer: func(t *testing.T, url, addr string) string {
+				conn := sendTestRequest(t, addr, opCodeRRQ, "small", nil)
+				defer conn.Close()
+
+				// ACK block 0 after receiving block 1, as if block 1
+				// was lost, causing it to be resent
+				_, tid := readTestDatagramFrom(t, conn)
+				var ack datagram
+				ack.writeAck(0)
+				if _, err := conn.WriteTo(ack.bytes(), tid); err != nil {
+					t.Fatal(err)
+				}
+				if dg := readTestDatagram(t, conn); dg.opcode() != opCodeDATA || dg.block() != 1 {
+					t.Fatalf("expected DATA block 1 to be resent, got %s", dg)
+				}
+				ack.writeAck(1)
+				if _, err := conn.WriteTo(ack.bytes(), tid); err != nil {
+					t.Fatal(err)
+				}
+				return conn.LocalAddr().String()
+			},
+
+			expected: TransferStats{Op: "read", Name: "small", Bytes: 10, BlockSize: 512, WindowSize: 1, Retransmits: 1},
+		},
+		{
+			name: "write",
+			transfer: func(t *testing.T, url, addr string) string {
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := client.Put(url+"file", bytes.NewReader(data), int64(len(data))); err != nil {
+					t.Fatal(err)
+				}
+				return ""
+			},
+
+			expected: TransferStats{Op: "write", Name: "file", Bytes: 2000, BlockSize: 512, WindowSize: 1},
+		},
+		{
+			name: "write, aborted by client",
+			transfer: func(t *testing.T, url, addr string) string {
+				conn := sendTestRequest(t, addr, opCodeWRQ, "file", nil)
+				defer conn.Close()
+
+				_, tid := readTestDatagramFrom(t, conn)
+				var dg datagram
+				dg.writeData(1, make([]byte, 512))
+				if _, err := conn.WriteTo(dg.bytes(), tid); err != nil {
+					t.Fatal(err)
+				}
+				readTestDatagram(t, conn)
+				dg.writeError(ErrCodeDiskFull, "disk full")
+				if _, err := conn.WriteTo(dg.bytes(), tid); err != nil {
+					t.Fatal(err)
+				}
+				return conn.LocalAddr().String()
+			},
+
+			expected: TransferStats{Op: "write", Name: "file", Bytes: 512, BlockSize: 512, WindowSize: 1, Err: errors.New("")},
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{true, false} {
+			c := c
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s, single port mode: %t", c.name, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				events := make(chan TransferStats, 2)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					switch w.Name() {
+					case "missing":
+						w.WriteError(ErrCodeFileNotFound, "not found")
+					case "small":
+						w.Write([]byte("small file"))
+					default:
+						w.Write(data)
+					}
+				}, func(w WriteRequest) {
+					ioutil.ReadAll(w)
+				}, ServerTransferLogger(func(s TransferStats) {
+					events <- s
+				}))
+				defer closeServer()
+
+				addr := ip + ":" + strconv.Itoa(port)
+				clientAddr := c.transfer(t, "tftp://"+addr+"/", addr)
+
+				var got TransferStats
+				select {
+				case got = <-events:
+				case <-time.After(2 * time.Second):
+					t.Fatal("timeout waiting for transfer stats")
+				}
+				if got.Op != c.expected.Op || got.Name != c.expected.Name || got.Bytes != c.expected.Bytes ||
+					got.BlockSize != c.expected.BlockSize || got.WindowSize != c.expected.WindowSize ||
+					got.Retransmits != c.expected.Retransmits || (got.Err == nil) != (c.expected.Err == nil) {
+					t.Errorf("expected %+v, got %+v", c.expected, got)
+				}
+				if got.Addr == nil || (clientAddr != "" && got.Addr.String() != clientAddr) {
+					t.Errorf("expected client address %q, got %v", clientAddr, got.Addr)
+				}
+				if got.Duration <= 0 {
+					t.Errorf("expected positive duration, got %v", got.Duration)
+				}
+
+				// Called exactly once
+				select {
+				case s := <-events:
+					t.Errorf("unexpected additional transfer stats %+v", s)
+				case <-time.After(100 * time.Millisecond):
+				}
+			})
+		}
+	}
+}
+
+func TestServer_singlePortIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	const idleTimeout = 200 * time.Millisecond
+
+	t.Run("abandoned", func(t *testing.T) {
+		errChan := make(chan error, 1)
+		s, ip, port, closeServer := startTestServer(t, true, func(w ReadRequest) {
+			_, err := w.Write(make([]byte, 1024))
+			errChan <- err
+		}, nil, ServerSinglePortIdleTimeout(idleTimeout), ServerRetransmit(100))
+		defer closeServer()
+
+		// Send a request and disappear
+		conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", nil)
+		conn.Close()
+
+		select {
+		case err := <-errChan:
+			if ErrorCause(err) != ErrTransferTimeout {
+				t.Errorf("expected handler error %v, got %v", ErrTransferTimeout, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler did not return")
+		}
+
+		if expired := s.Stats().Expired; expired != 1 {
+			t.Errorf("expected 1 expired transfer, got %d", expired)
+		}
+	})
+
+	t.Run("active", func(t *testing.T) {
+		data := getTestData(t, "1MB-random")[:512*8]
+		s, ip, port, closeServer := startTestServer(t, true, func(w ReadRequest) {
+			// Take longer than the idle timeout overall
+			for i := 0; i < len(data); i += 512 {
+				time.Sleep(idleTimeout / 4)
+				if _, err := w.Write(data[i : i+512]); err != nil {
+					t.Errorf("write: %v", err)
+					return
+				}
+			}
+		}, nil, ServerSinglePortIdleTimeout(idleTimeout))
+		defer closeServer()
+
+		client, err := NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, data) {
+			t.Errorf("expected %d bytes, got %d", len(data), len(got))
+		}
+
+		if expired := s.Stats().Expired; expired != 0 {
+			t.Errorf("expected no expired transfers, got %d", expired)
+		}
+	})
+}
+
+func TestServer_middleware(t *testing.T) {
+	t.Parallel()
+
+	calls := make(chan string, 2)
+	readMW := func(h ReadHandler) ReadHandler {
+		return ReadHandlerFunc(func(w ReadRequest) {
+			calls <- "read " + w.Name()
+			h.ServeTFTP(w)
+		})
+	}
+	writeMW := func(h WriteHandler) WriteHandler {
+		return WriteHandlerFunc(func(w WriteRequest) {
+			calls <- "write " + w.Name()
+			h.ReceiveTFTP(w)
+		})
+	}
+
+	data := []byte("the data")
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		w.Write(data)
+	}, func(w WriteRequest) {
+		ioutil.ReadAll(w)
+	}, ServerReadMiddleware(readMW), ServerWriteMiddleware(writeMW))
+	defer closeServer()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp)
+	if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"read file", "write file"} {
+		select {
+		case call := <-calls:
+			if call != expected {
+				t.Errorf("expected middleware call %q, got %q", expected, call)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for middleware call %q", expected)
+		}
+	}
+}
+
+func TestServer_handlerPanic(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("the data")
+
+	for _, op := range []opcode{opCodeRRQ, opCodeWRQ} {
+		for _, singlePort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, single port mode: %t", op, singlePort), func(t *testing.T) {
+				type recovered struct {
+					r     interface{}
+					info  RequestInfo
+					stack string
+				}
+				panics := make(chan recovered, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					if w.Name() == "panic" {
+						panic("read panic")
+					}
+					w.Write(data)
+				}, func(w WriteRequest) {
+					if w.Name() == "panic" {
+						panic("write panic")
+					}
+					ioutil.ReadAll(w)
+				}, ServerPanicHandler(func(r interface{}, info RequestInfo) {
+					stack := make([]byte, 64<<10)
+					stack = stack[:runtime.Stack(stack, false)]
+					panics <- recovered{r: r, info: info, stack: string(stack)}
+				}))
+				defer closeServer()
+
+				addr := ip + ":" + strconv.Itoa(port)
+				conn := sendTestRequest(t, addr, op, "panic", nil)
+				defer conn.Close()
+
+				dg := readTestDatagram(t, conn)
+				if dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeNotDefined {
+					t.Errorf("expected not defined error, got %s", dg)
+				}
+
+				select {
+				case p := <-panics:
+					expectedOp := "read"
+					if op == opCodeWRQ {
+						expectedOp = "write"
+					}
+					if info := p.info; info.Op != expectedOp || info.Name != "panic" || info.Addr.String() != conn.LocalAddr().String() {
+						t.Errorf("unexpected request info %+v", info)
+					}
+					if expected := expectedOp + " panic"; p.r != expected {
+						t.Errorf("expected recovered value %q, got %v", expected, p.r)
+					}
+					// The stack includes the handler that panicked
+					if !strings.Contains(p.stack, "TestServer_handlerPanic") {
+						t.Errorf("expected stack trace of the panic, got:\n%s", p.stack)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("panic handler not called")
+				}
+
+				// Server should continue serving
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				url := "tftp://" + addr + "/file"
+				if op == opCodeRRQ {
+					resp, err := client.Get(url)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, _ := ioutil.ReadAll(resp); !reflect.DeepEqual(got, data) {
+						t.Errorf("expected %q, got %q", data, got)
+					}
+				} else if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestServer_Stats(t *testing.T) {
+	t.Parallel()
+
+	text := getTestData(t, "text")
+	random := getTestData(t, "1MB-random")
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			s, ip, port, closeServer := startTestServer(t, singlePort, func(w ReadRequest) {
+				switch w.Name() {
+				case "text":
+					w.Write(text)
+				case "random":
+					w.Write(random)
+				default:
+					w.WriteError(ErrCodeFileNotFound, "not found")
+				}
+			}, func(w WriteRequest) {
+				ioutil.ReadAll(w)
+			})
+			defer closeServer()
+
+			client, err := NewClient(ClientBlocksize(1024))
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/"
+			for _, name := range []string{"text", "random", "missing"} {
+				resp, err := client.Get(url + name)
+				if err != nil {
+					continue
+				}
+				ioutil.ReadAll(resp)
+			}
+			if err := client.Put(url+"upload", bytes.NewReader(text), int64(len(text))); err != nil {
+				t.Fatal(err)
+			}
+
+			// Transfers are recorded after the handler returns
+			deadline := time.Now().Add(2 * time.Second)
+			for s.Stats().ActiveTransfers > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			expected := Stats{
+				ReadRequests:  3,
+				WriteRequests: 1,
+				Completed:     3,
+				Failed:        1,
+				ErrorsSent:    1,
+				BytesSent:     uint64(len(text) + len(random)),
+				BytesReceived: uint64(len(text)),
+			}
+			if stats := s.Stats(); stats != expected {
+				t.Errorf("expected stats %+v, got %+v", expected, stats)
+			}
+		})
+	}
+}
+
+func TestServer_timeout(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		timeout time.Duration
+		opts    map[string]string
+
+		expectedTimeout time.Duration
+	}{
+		{
+			name: "default",
+
+			expectedTimeout: time.Second,
+		},
+		{
+			name:    "configured",
+			timeout: 250 * time.Millisecond,
+
+			expectedTimeout: 250 * time.Millisecond,
+		},
+		{
+			name:    "negotiated",
+			timeout: 250 * time.Millisecond,
+			opts:    map[string]string{optTimeout: "3"},
+
+			expectedTimeout: 3 * time.Second,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var opts []ServerOpt
+			if c.timeout > 0 {
+				opts = append(opts, ServerTimeout(c.timeout))
+			}
+			s, err := NewServer("127.0.0.1:0", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var dg datagram
+			dg.writeReadReq("file", ModeOctet, c.opts)
+			req := &request{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69}, pkt: dg.bytes()}
+			conn, _, err := s.newConn(req, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.netConn.Close()
+
+			if _, err := conn.parseOptions(); err != nil {
+				t.Fatal(err)
+			}
+			if conn.timeout != c.expectedTimeout {
+				t.Errorf("expected timeout %s, got %s", c.expectedTimeout, conn.timeout)
+			}
+		})
+	}
+}
+
+func TestServer_slog(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	data := []byte("the data")
+	s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+		w.Write(data)
+	}, nil, ServerWithSlogger(l))
+	defer closeServer()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats().Completed == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var finished map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			break
+		}
+		if _, ok := record["bytes"]; ok {
+			finished = record
+		}
+	}
+	if finished == nil {
+		t.Fatal("transfer finished record not logged")
+	}
+
+	expected := map[string]interface{}{
+		"level":       "DEBUG",
+		"op":          "read",
+		"filename":    "file",
+		"client_addr": "127.0.0.1:" + strconv.Itoa(resp.conn.netConn.LocalAddr().(*net.UDPAddr).Port),
+		"bytes":       float64(len(data)),
+		"error":       nil,
+	}
+	for k, v := range expected {
+		if finished[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, finished[k])
+		}
+	}
+}
+
+func TestServer_writeCommitDelay(t *testing.T) {
+	t.Parallel()
+
+	const delay = 200 * time.Millisecond
+	written := make(chan time.Time, 1)
+	readStarted := make(chan time.Time, 1)
+	finished := make(chan time.Time, 2)
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		readStarted <- time.Now()
+		w.Write([]byte("data"))
+	}, func(w WriteRequest) {
+		ioutil.ReadAll(w)
+		written <- time.Now()
+	}, ServerWriteCommitDelay(delay), ServerTransferLogger(func(s TransferStats) {
+		if s.Op == "write" {
+			finished <- time.Now()
+		}
+	}))
+	defer closeServer()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := ip + ":" + strconv.Itoa(port) + "/"
+	if err := client.Put(url+"file", strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	get := func(name string) {
+		t.Helper()
+		resp, err := client.Get(url + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Other files aren't delayed
+	get("other")
+	handlerReturned := <-written
+	if d := (<-readStarted).Sub(handlerReturned); d >= delay {
+		t.Errorf("expected read of another file not to wait, waited %s", d)
+	}
+
+	// Read back the written file
+	get("file")
+	if d := (<-finished).Sub(handlerReturned); d < delay {
+		t.Errorf("expected write to finish %s after the handler returned, got %s", delay, d)
+	}
+	if d := (<-readStarted).Sub(handlerReturned); d < delay {
+		t.Errorf("expected read to wait %s after the write handler returned, got %s", delay, d)
+	}
+}
+
+func TestServer_transferDeadline(t *testing.T) {
+	t.Parallel()
+
+	const deadline = 300 * time.Millisecond
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			errChan := make(chan error, 1)
+			ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+				_, err := w.Write(make([]byte, 512*10))
+				if w.Context().Err() == nil {
+					t.Error("expected context to be done")
+				}
+				errChan <- err
+			}, nil, ServerTransferDeadline(deadline))
+			defer closeServer()
+
+			conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", nil)
+			defer conn.Close()
+
+			// Slowly ACK each block
+			start := time.Now()
+			var ack datagram
+			for {
+				dg := datagram{buf: make([]byte, 1024)}
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, raddr, err := conn.ReadFrom(dg.buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dg.offset = n
+				if dg.opcode() == opCodeERROR {
+					if msg := dg.errMsg(); msg != "transfer timed out" {
+						t.Errorf("expected error message %q, got %q", "transfer timed out", msg)
+					}
+					break
+				}
+				if dg.opcode() != opCodeDATA {
+					t.Fatalf("expected DATA, got %s", dg)
+				}
+				time.Sleep(deadline / 4)
+				ack.writeAck(dg.block())
+				conn.WriteTo(ack.bytes(), raddr)
+			}
+
+			select {
+			case err := <-errChan:
+				if ErrorCause(err) != ErrTransferDeadline {
+					t.Errorf("expected handler error %v, got %v", ErrTransferDeadline, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("handler did not return")
+			}
+
+			if elapsed := time.Since(start); elapsed > 3*deadline {
+				t.Errorf("expected transfer to be aborted after about %s, took %s", deadline, elapsed)
+			}
+		})
+	}
+}
+
+func TestServer_strictRFC1350(t *testing.T) {
+	t.Parallel()
+
+	opts := map[string]string{
+		optBlocksize:    "1024",
+		optTransferSize: "0",
+		optTimeout:      "5",
+		optWindowSize:   "4",
+	}
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			sizeErr := make(chan error, 1)
+			ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+				w.WriteSize(2000)
+				w.Write(make([]byte, 2000))
+			}, func(w WriteRequest) {
+				_, err := w.Size()
+				sizeErr <- err
+				w.Read(nil) // Accept the transfer
+			}, ServerStrictRFC1350(true))
+			defer closeServer()
+
+			addr := ip + ":" + strconv.Itoa(port)
+
+			rconn := sendTestRequest(t, addr, opCodeRRQ, "file", opts)
+			defer rconn.Close()
+			dg := readTestDatagram(t, rconn)
+			if dg.opcode() != opCodeDATA || dg.block() != 1 || len(dg.data()) != 512 {
+				t.Errorf("expected 512 byte DATA block 1, got %s", dg)
+			}
+
+			wconn := sendTestRequest(t, addr, opCodeWRQ, "file", opts)
+			defer wconn.Close()
+			dg = readTestDatagram(t, wconn)
+			if dg.opcode() != opCodeACK || dg.block() != 0 {
+				t.Errorf("expected ACK block 0, got %s", dg)
+			}
+
+			select {
+			case err := <-sizeErr:
+				if err != ErrSizeNotReceived {
+					t.Errorf("expected Size error %v, got %v", ErrSizeNotReceived, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("write handler not called")
+			}
+		})
+	}
+}
+
+func TestAddrKey(t *testing.T) {
+	cases := []struct {
+		name string
+		addr *net.UDPAddr
+		want string
+	}{
+		{
+			name: "ipv4",
+			addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 69},
+			want: "127.0.0.1:69",
+		},
+		{
+			name: "ipv4-mapped ipv6",
+			addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69},
+			want: "127.0.0.1:69",
+		},
+		{
+			name: "ipv6",
+			addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 69},
+			want: "[2001:db8::1]:69",
+		},
+		{
+			name: "ipv6 link-local with zone",
+			addr: &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 69, Zone: "eth0"},
+			want: "[fe80::1%eth0]:69",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := addrKey(c.addr).String(); got != c.want {
+				t.Errorf("expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestServer_routeDatagramZones(t *testing.T) {
+	s := &Server{log: newLogger("test"), connMgr: NewDefaultConnManager(1)}
+
+	eth0 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 1234, Zone: "eth0"}
+	eth1 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 1234, Zone: "eth1"}
+
+	var rrq datagram
+	rrq.writeReadReq("file", ModeOctet, nil)
+
+	active := make(map[transferKey]*singlePortTransfer)
+	chans := make(map[string]chan []byte)
+	for _, addr := range []*net.UDPAddr{eth0, eth1} {
+		req := &request{addr: addr, pkt: rrq.bytes()}
+		ch, ok := s.connMgr.GetOrNew(req.transferAddr())
+		if ok {
+			t.Fatalf("expected new transfer for %v", addr)
+		}
+		chans[addr.Zone] = ch
+	}
+
+	for i, addr := range []*net.UDPAddr{eth0, eth1} {
+		var ack datagram
+		ack.writeAck(uint16(i))
+		if !s.routeDatagram(active, &request{addr: addr, pkt: ack.bytes()}) {
+			t.Fatalf("datagram from %v not routed", addr)
+		}
+	}
+
+	for i, zone := range []string{"eth0", "eth1"} {
+		select {
+		case pkt := <-chans[zone]:
+			var dg datagram
+			dg.setBytes(pkt)
+			if dg.block() != uint16(i) {
+				t.Errorf("%s: expected ACK %d, got %s", zone, i, dg)
+			}
+		default:
+			t.Errorf("%s: no datagram received", zone)
+		}
+	}
+}
+
+func TestServer_blocksizeDefaultCap(t *testing.T) {
+	t.Parallel()
+
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		w.Write([]byte("data"))
+	}, nil)
+	defer closeServer()
+
+	// Larger than RFC2348 allows
+	conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", map[string]string{
+		optBlocksize: "65535",
+	})
+	defer conn.Close()
+
+	dg := readTestDatagram(t, conn)
+	if dg.opcode() != opCodeOACK {
+		t.Fatalf("expected OACK, got %s", dg)
+	}
+	if blksize := dg.options()[optBlocksize]; blksize != "65464" {
+		t.Errorf("expected OACK blksize 65464, got %q", blksize)
+	}
+}
+
+func TestServer_blocksizeCap(t *testing.T) {
+	t.Parallel()
+
+	const maxBlksize = 1428
+	data := make([]byte, 3000)
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+				w.Write(data)
+			}, nil, ServerBlocksize(maxBlksize))
+			defer closeServer()
+
+			conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", map[string]string{
+				optBlocksize: "65464",
+			})
+			defer conn.Close()
+
+			var ack datagram
+			received := 0
+			for {
+				dg := datagram{buf: make([]byte, 65536)}
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, raddr, err := conn.ReadFrom(dg.buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dg.offset = n
+
+				var block uint16
+				switch dg.opcode() {
+				case opCodeOACK:
+					if blksize := dg.options()[optBlocksize]; blksize != strconv.Itoa(maxBlksize) {
+						t.Errorf("expected OACK blksize %d, got %q", maxBlksize, blksize)
+					}
+				case opCodeDATA:
+					block = dg.block()
+					size := len(dg.data())
+					received += size
+					if received < len(data) && size != maxBlksize {
+						t.Errorf("block %d: expected %d bytes, got %d", dg.block(), maxBlksize, size)
+					}
+					if size > maxBlksize {
+						t.Fatalf("block %d: %d bytes exceeds blksize %d", dg.block(), size, maxBlksize)
+					}
+				default:
+					t.Fatalf("unexpected datagram %s", dg)
+				}
+
+				ack.writeAck(block)
+				conn.WriteTo(ack.bytes(), raddr)
+				if dg.opcode() == opCodeDATA && len(dg.data()) < maxBlksize {
+					break
+				}
+			}
+
+			if received != len(data) {
+				t.Errorf("expected %d bytes, got %d", len(data), received)
+			}
+		})
+	}
+}
+
+func TestWriteRequest_Checksum(t *testing.T) {
+	t.Parallel()
+
+	random1MB := getTestData(t, "1MB-random")
+
+	cases := []struct {
+		name string
+		opts []ServerOpt
+
+		expectedChecksum []byte
+		expectedError    error
+	}{
+		{
+			name: "sha256",
+			opts: []ServerOpt{ServerChecksumVerify("sha256")},
+
+			expectedChecksum: func() []byte { sum := sha256.Sum256(random1MB); return sum[:] }(),
+		},
+		{
+			name: "md5",
+			opts: []ServerOpt{ServerChecksumVerify("md5")},
+
+			expectedChecksum: func() []byte { sum := md5.Sum(random1MB); return sum[:] }(),
+		},
+		{
+			name: "disabled",
+
+			expectedError: ErrChecksumNotEnabled,
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, single port mode: %t", c.name, singlePort), func(t *testing.T) {
+				type result struct {
+					sum []byte
+					err error
+				}
+				results := make(chan result, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, nil, func(w WriteRequest) {
+					ioutil.ReadAll(w)
+					sum, err := w.Checksum()
+					results <- result{sum, err}
+				}, c.opts...)
+				defer closeServer()
+
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				url := fmt.Sprintf("%s:%d/file", ip, port)
+				if err := client.Put(url, bytes.NewReader(random1MB), int64(len(random1MB))); err != nil {
+					t.Fatal(err)
+				}
+
+				r := <-results
+				if r.err != c.expectedError {
+					t.Errorf("expected error %v, got %v", c.expectedError, r.err)
+				}
+				if !bytes.Equal(r.sum, c.expectedChecksum) {
+					t.Errorf("expected checksum %x, got %x", c.expectedChecksum, r.sum)
+				}
+			})
+		}
+	}
+}
+
+func TestServer_maxWindowSize(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		maxWindow int
+		requested string
+
+		expectedWindow string // Empty if omitted from the OACK
+		expectedBlocks int    // DATA sent before waiting for ACK
+	}{
+		{
+			name:      "clamped",
+			maxWindow: 4,
+			requested: "16",
+
+			expectedWindow: "4",
+			expectedBlocks: 4,
+		},
+		{
+			name:      "under limit",
+			maxWindow: 4,
+			requested: "2",
+
+			expectedWindow: "2",
+			expectedBlocks: 2,
+		},
+		{
+			name:      "disabled",
+			maxWindow: 1,
+			requested: "16",
+
+			expectedBlocks: 1,
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, single port mode: %t", c.name, singlePort), func(t *testing.T) {
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					w.Write(make([]byte, 512*32))
+				}, nil, ServerMaxWindowSize(c.maxWindow))
+				defer closeServer()
+
+				conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", map[string]string{
+					optBlocksize:  "512",
+					optWindowSize: c.requested,
+				})
+				defer conn.Close()
+
+				dg := datagram{buf: make([]byte, 1024)}
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, raddr, err := conn.ReadFrom(dg.buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dg.offset = n
+				if dg.opcode() != opCodeOACK {
+					t.Fatalf("expected OACK, got %s", dg)
+				}
+				if window := dg.options()[optWindowSize]; window != c.expectedWindow {
+					t.Errorf("expected OACK windowsize %q, got %q", c.expectedWindow, window)
+				}
+
+				var ack datagram
+				ack.writeAck(0)
+				conn.WriteTo(ack.bytes(), raddr)
+
+				// Count DATA until the server stops to wait for an ACK,
+				// shorter than the retransmit timeout
+				blocks := 0
+				for {
+					conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+					n, err := conn.Read(dg.buf)
+					if err != nil {
+						break
+					}
+					dg.offset = n
+					if dg.opcode() != opCodeDATA {
+						t.Fatalf("expected DATA, got %s", dg)
+					}
+					blocks++
+				}
+				if blocks != c.expectedBlocks {
+					t.Errorf("expected %d DATA before ACK, got %d", c.expectedBlocks, blocks)
+				}
+			})
+		}
+	}
+}
+
+func TestServer_requestOptions(t *testing.T) {
+	t.Parallel()
+
+	opts := map[string]string{
+		optBlocksize:  "1024",
+		optWindowSize: "4",
+		"unknown":     "value",
+	}
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			got := make(chan map[string]string, 2)
+			ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+				got <- w.Options()
+			}, func(w WriteRequest) {
+				got <- w.Options()
+			}, ServerMaxWindowSize(2))
+			defer closeServer()
+			addr := ip + ":" + strconv.Itoa(port)
+
+			for _, op := range []opcode{opCodeRRQ, opCodeWRQ} {
+				conn := sendTestRequest(t, addr, op, "file", opts)
+				defer conn.Close()
+
+				select {
+				case o := <-got:
+					if !reflect.DeepEqual(o, opts) {
+						t.Errorf("%s: expected options %v, got %v", op, opts, o)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("%s: handler not called", op)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_allowedModes(t *testing.T) {
+	t.Parallel()
+
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			called := make(chan TransferMode, 2)
+			ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+				called <- w.TransferMode()
+				w.Write([]byte("data"))
+			}, nil, ServerAllowedModes(ModeOctet))
+			defer closeServer()
+
+			client, err := NewClient(ClientMode(ModeOctet))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("%s:%d/file", ip, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(resp); err != nil {
+				t.Errorf("octet request failed: %v", err)
+			}
+			resp.Close()
+			if mode := <-called; mode != ModeOctet {
+				t.Errorf("expected handler to be called with %s, got %s", ModeOctet, mode)
+			}
+
+			client, err = NewClient(ClientMode(ModeNetASCII))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Get(fmt.Sprintf("%s:%d/file", ip, port))
+			if !IsRemoteError(err) {
+				t.Fatalf("expected remote error, got %v", err)
+			}
+			if msg := err.Error(); !strings.Contains(msg, "ILLEGAL_OPERATION") || !strings.Contains(msg, "not allowed") {
+				t.Errorf("expected transfer mode error, got %v", err)
+			}
+
+			select {
+			case mode := <-called:
+				t.Errorf("handler called for %s request", mode)
+			default:
+			}
+		})
+	}
+}
+
+func TestServer_requestFilter(t *testing.T) {
+	t.Parallel()
+
+	_, writers, _ := net.ParseCIDR("10.20.0.0/16")
+	filter := func(info RequestInfo) error {
+		if info.Op == "write" && !writers.Contains(info.Addr.IP) {
+			return &Error{Code: ErrCodeAccessViolation, Message: "writes not allowed"}
+		}
+		if matched, _ := path.Match("*.bin", info.Name); !matched {
+			return &Error{Code: ErrCodeFileNotFound, Message: "only .bin files"}
+		}
+		if info.Name == "secret.bin" {
+			return errors.New("denied")
+		}
+		return nil
+	}
+
+	cases := []struct {
+		name   string
+		filter func(RequestInfo) error
+		op     opcode
+		file   string
+
+		expectedCode ErrorCode
+		expectedMsg  string // Empty if the request should be served
+	}{
+		{
+			name: "no filter",
+			op:   opCodeWRQ,
+			file: "file.txt",
+		},
+		{
+			name:   "allowed",
+			filter: filter,
+			op:     opCodeRRQ,
+			file:   "file.bin",
+		},
+		{
+			name:   "denied, custom code",
+			filter: filter,
+			op:     opCodeRRQ,
+			file:   "file.txt",
+
+			expectedCode: ErrCodeFileNotFound,
+			expectedMsg:  "only .bin files",
+		},
+		{
+			name:   "denied write, custom code",
+			filter: filter,
+			op:     opCodeWRQ,
+			file:   "file.bin",
+
+			expectedCode: ErrCodeAccessViolation,
+			expectedMsg:  "writes not allowed",
+		},
+		{
+			name:   "denied, plain error",
+			filter: filter,
+			op:     opCodeRRQ,
+			file:   "secret.bin",
+
+			expectedCode: ErrCodeAccessViolation,
+			expectedMsg:  "denied",
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, single port mode: %t", c.name, singlePort), func(t *testing.T) {
+				called := make(chan struct{}, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					called <- struct{}{}
+					w.Write([]byte("data"))
+				}, func(w WriteRequest) {
+					called <- struct{}{}
+					w.Read(nil) // Accept the transfer
+				}, ServerRequestFilter(c.filter))
+				defer closeServer()
+
+				conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), c.op, c.file, nil)
+				defer conn.Close()
+				dg := readTestDatagram(t, conn)
+
+				if c.expectedMsg == "" {
+					if dg.opcode() == opCodeERROR {
+						t.Fatalf("expected request to be served, got %s", dg)
+					}
+					<-called
+					return
+				}
+
+				if dg.opcode() != opCodeERROR || dg.errorCode() != c.expectedCode || dg.errMsg() != c.expectedMsg {
+					t.Errorf("expected ERROR %s %q, got %s", c.expectedCode, c.expectedMsg, dg)
+				}
+				select {
+				case <-called:
+					t.Error("handler called for refused request")
+				default:
+				}
+			})
+		}
+	}
+}
+
+func TestServer_Drain(t *testing.T) {
+	t.Parallel()
+
+	for _, singlePort := range []bool{false, true} {
+		singlePort := singlePort
+		t.Run(fmt.Sprintf("single port %t", singlePort), func(t *testing.T) {
+			t.Parallel()
+
+			data := []byte("the data")
+			started := make(chan struct{}, 1)
+			proceed := make(chan struct{})
+			s, ip, port, closeServer := startTestServer(t, singlePort, func(w ReadRequest) {
+				started <- struct{}{}
+				<-proceed
+				w.Write(data)
+			}, nil)
+			defer closeServer()
+			addr := ip + ":" + strconv.Itoa(port)
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			type result struct {
+				data []byte
+				err  error
+			}
+			results := make(chan result, 1)
+			go func() {
+				resp, err := client.Get("tftp://" + addr + "/slow")
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				got, err := ioutil.ReadAll(resp)
+				results <- result{got, err}
+			}()
+			<-started
+
+			drained := make(chan error, 1)
+			go func() {
+				drained <- s.Drain(context.Background())
+			}()
+			for {
+				s.drainMu.Lock()
+				draining := s.draining
+				s.drainMu.Unlock()
+				if draining {
+					break
+				}
+				runtime.Gosched()
+			}
+
+			conn := sendTestRequest(t, addr, opCodeRRQ, "new", nil)
+			defer conn.Close()
+			dg := readTestDatagram(t, conn)
+			if dg.opcode() != opCodeERROR || dg.errMsg() != "server shutting down" {
+				t.Errorf("expected server shutting down error, got %s", dg)
+			}
+
+			select {
+			case err := <-drained:
+				t.Fatalf("Drain returned before transfer finished: %v", err)
+			default:
+			}
+
+			close(proceed)
+			res := <-results
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			if !bytes.Equal(res.data, data) {
+				t.Errorf("expected %q, got %q", data, res.data)
+			}
+
+			select {
+			case err := <-drained:
+				if err != nil {
+					t.Errorf("unexpected Drain error: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Drain did not return after transfer finished")
+			}
+			if s.Stats().ActiveTransfers != 0 {
+				t.Errorf("expected no active transfers, got %d", s.Stats().ActiveTransfers)
+			}
+		})
+	}
+}
+
+func TestServer_Drain_contextDone(t *testing.T) {
+	t.Parallel()
+
+	proceed := make(chan struct{})
+	started := make(chan struct{}, 1)
+	s, ip, port, closeServer := startTestServer(t, false, func(w ReadRequest) {
+		started <- struct{}{}
+		<-proceed
+	}, nil)
+	defer closeServer()
+	defer close(proceed)
+
+	conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "slow", nil)
+	defer conn.Close()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestServer_requestAddrPort(t *testing.T) {
+	t.Parallel()
+
+	addrs := make(chan [2]string, 2)
+	s, err := NewServer(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		addrs <- [2]string{w.AddrPort().String(), w.Addr().String()}
+		w.Write([]byte("data"))
+	}))
+	s.WriteHandler(WriteHandlerFunc(func(w WriteRequest) {
+		addrs <- [2]string{w.AddrPort().String(), w.Addr().String()}
+		ioutil.ReadAll(w)
+	}))
+	go s.ListenAndServe()
+	defer s.Close()
+	for !s.Connected() {
+		runtime.Gosched()
+	}
+	addr, _ := s.Addr()
+
+	// The server listens on a dual-stack socket, the IPv4 client address
+	// must not be reported in IPv4-mapped form.
+	for _, op := range []opcode{opCodeRRQ, opCodeWRQ} {
+		conn := sendTestRequest(t, "127.0.0.1:"+strconv.Itoa(addr.Port), op, "file", nil)
+		defer conn.Close()
+
+		got := <-addrs
+		expected := conn.LocalAddr().String()
+		if got[0] != expected {
+			t.Errorf("%s: expected AddrPort %s, got %s", op, expected, got[0])
+		}
+		if got[1] != expected {
+			t.Errorf("%s: expected Addr %s, got %s", op, expected, got[1])
+		}
+	}
+}
+
+func TestServer_negotiatedOptions(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		serverOpts []ServerOpt
+		clientOpts []ClientOpt
+
+		expectedBlksize    int
+		expectedWindowsize int
+	}{
+		{
+			name:               "defaults",
+			expectedBlksize:    512,
+			expectedWindowsize: 1,
+		},
+		{
+			name:               "negotiated",
+			clientOpts:         []ClientOpt{ClientBlocksize(1024), ClientWindowsize(4)},
+			expectedBlksize:    1024,
+			expectedWindowsize: 4,
+		},
+		{
+			name:               "limited by server",
+			serverOpts:         []ServerOpt{ServerBlocksize(768), ServerMaxWindowSize(2)},
+			clientOpts:         []ClientOpt{ClientBlocksize(1024), ClientWindowsize(4)},
+			expectedBlksize:    768,
+			expectedWindowsize: 2,
+		},
+	}
+
+	for _, singlePort := range []bool{false, true} {
+		for _, c := range cases {
+			c := c
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s single port %t", c.name, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				got := make(chan [2]int, 2)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					// Reported before any data is written
+					got <- [2]int{w.BlockSize(), w.WindowSize()}
+					w.Write([]byte("data"))
+				}, func(w WriteRequest) {
+					got <- [2]int{w.BlockSize(), w.WindowSize()}
+					ioutil.ReadAll(w)
+				}, c.serverOpts...)
+				defer closeServer()
+
+				client, err := NewClient(c.clientOpts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+				resp, err := client.Get(url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ioutil.ReadAll(resp)
+				if err := client.Put(url, bytes.NewReader([]byte("data")), 4); err != nil {
+					t.Fatal(err)
+				}
+
+				expected := [2]int{c.expectedBlksize, c.expectedWindowsize}
+				for _, op := range []string{"read", "write"} {
+					if g := <-got; g != expected {
+						t.Errorf("%s: expected blksize/windowsize %v, got %v", op, expected, g)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestServer_netasciiWire(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping non-windows tests")
+	}
+	t.Parallel()
+
+	received := make(chan []byte, 1)
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		w.Write([]byte("line\nend\r"))
+	}, func(w WriteRequest) {
+		data, _ := ioutil.ReadAll(w)
+		received <- data
+	})
+	defer closeServer()
+
+	raddr := &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: raddr.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Read: LF is sent as CRLF, trailing CR as CRNUL
+	var dg datagram
+	dg.writeReq(opCodeRRQ, "file", ModeNetASCII, nil)
+	if _, err := conn.WriteTo(dg.bytes(), raddr); err != nil {
+		t.Fatal(err)
+	}
+	data, tid := readTestDatagramFrom(t, conn)
+	if data.opcode() != opCodeDATA {
+		t.Fatalf("expected DATA, got %s", data)
+	}
+	if expected := "line\r\nend\r\x00"; string(data.data()) != expected {
+		t.Errorf("expected %q on the wire, got %q", expected, data.data())
+	}
+	ackBlock(t, conn, tid, 1)
+
+	// Write: CRLF is received as LF, CRNUL as CR
+	dg.writeReq(opCodeWRQ, "file", ModeNetASCII, nil)
+	if _, err := conn.WriteTo(dg.bytes(), raddr); err != nil {
+		t.Fatal(err)
+	}
+	ack, tid := readTestDatagramFrom(t, conn)
+	if ack.opcode() != opCodeACK {
+		t.Fatalf("expected ACK, got %s", ack)
+	}
+	dg.writeData(1, []byte("line\r\nend\r\x00"))
+	if _, err := conn.WriteTo(dg.bytes(), tid); err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := <-received, "line\nend\r"; string(got) != expected {
+		t.Errorf("expected handler to receive %q, got %q", expected, got)
+	}
+}
+
+func TestServer_netasciiBlockBoundary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping non-windows tests")
+	}
+	t.Parallel()
+
+	// The CR of the encoded line ending is the last byte of the first
+	// block, the LF or NUL the first byte of the next.
+	prefix := strings.Repeat("a", 511)
+	cases := []struct {
+		name string
+		data string
+	}{
+		{name: "CRLF", data: prefix + "\nbbb"},
+		{name: "CRNUL", data: prefix + "\rbbb"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			received := make(chan []byte, 1)
+			ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+				w.Write([]byte(c.data))
+			}, func(w WriteRequest) {
+				data, _ := ioutil.ReadAll(w)
+				received <- data
+			})
+			defer closeServer()
+
+			client, err := NewClient(ClientMode(ModeNetASCII))
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Read in block sized chunks
+			var got []byte
+			p := make([]byte, 512)
+			for {
+				n, err := resp.Read(p)
+				got = append(got, p[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(got) != c.data {
+				t.Errorf("expected Get to return %q, got %q", c.data, got)
+			}
+
+			if err := client.Put(url, strings.NewReader(c.data), 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-received; string(got) != c.data {
+				t.Errorf("expected handler to receive %q, got %q", c.data, got)
+			}
+		})
+	}
+}
+
+func TestServer_netasciiMultiBlock(t *testing.T) {
+	t.Parallel()
+
+	// The client's netascii decoder buffers data, the final blocks must
+	// be read before io.EOF is returned.
+	text := getTestData(t, "text")
+	for _, size := range []int{512, 2000, len(text)} {
+		size := size
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			t.Parallel()
+
+			data := text[:size]
+			ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+				w.Write(data)
+			}, nil)
+			defer closeServer()
+
+			client, err := NewClient(ClientMode(ModeNetASCII))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("expected %d bytes, got %d", len(data), len(got))
+			}
+		})
+	}
+}
+
+func TestServer_readTransferSizeDetected(t *testing.T) {
+	t.Parallel()
+
+	text := getTestData(t, "text")
+
+	cases := []struct {
+		name    string
+		handler func(ReadRequest)
+
+		expectedTsize *int64
+	}{
+		{
+			name: "io.Copy from file",
+			handler: func(w ReadRequest) {
+				file, err := os.Open("testdata/text")
+				if err != nil {
+					w.WriteError(ErrCodeFileNotFound, err.Error())
+					return
+				}
+				defer file.Close()
+				io.Copy(w, file)
+			},
+			expectedTsize: ptrInt64(int64(len(text))),
+		},
+		{
+			name: "io.Copy from partially read file",
+			handler: func(w ReadRequest) {
+				file, err := os.Open("testdata/text")
+				if err != nil {
+					w.WriteError(ErrCodeFileNotFound, err.Error())
+					return
+				}
+				defer file.Close()
+				file.Seek(10, io.SeekStart)
+				io.Copy(w, file)
+			},
+			expectedTsize: ptrInt64(int64(len(text) - 10)),
+		},
+		{
+			name: "io.Copy from seeker",
+			handler: func(w ReadRequest) {
+				io.Copy(w, io.NewSectionReader(bytes.NewReader(text), 0, int64(len(text))))
+			},
+			expectedTsize: ptrInt64(int64(len(text))),
+		},
+		{
+			name: "io.Copy from pipe",
+			handler: func(w ReadRequest) {
+				r, pw := io.Pipe()
+				go func() {
+					pw.Write(text)
+					pw.Close()
+				}()
+				io.Copy(w, r)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			ip, port, closeServer := newTestServer(t, false, c.handler, nil)
+			defer closeServer()
+
+			conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "text", map[string]string{optTransferSize: "0", optBlocksize: "1024"})
+			defer conn.Close()
+
+			dg := readTestDatagram(t, conn)
+			if dg.opcode() != opCodeOACK {
+				t.Fatalf("expected OACK, got %s", dg)
+			}
+			tsize, ok := dg.options()[optTransferSize]
+			switch {
+			case c.expectedTsize == nil && ok:
+				t.Errorf("expected tsize to be omitted, got %q", tsize)
+			case c.expectedTsize != nil && tsize != strconv.FormatInt(*c.expectedTsize, 10):
+				t.Errorf("expected tsize %d, got %q", *c.expectedTsize, tsize)
+			}
+		})
+	}
+}
+
+func TestServer_writeDiscard(t *testing.T) {
+	t.Parallel()
+
+	random := getTestData(t, "1MB-random")
+
+	for _, singlePort := range []bool{false, true} {
+		singlePort := singlePort
+		t.Run(fmt.Sprintf("single port %t", singlePort), func(t *testing.T) {
+			t.Parallel()
+
+			discardErr := make(chan error, 1)
+			received := make(chan int64, 1)
+			ip, port, closeServer := newTestServer(t, singlePort, nil, func(w WriteRequest) {
+				if w.Name() == "small" {
+					ioutil.ReadAll(w)
+				} else {
+					// Inspect the start of the file
+					magic := make([]byte, 4)
+					io.ReadFull(w, magic)
+				}
+				discardErr <- w.Discard()
+				received <- w.(*writeRequest).conn.total
+			})
+			defer closeServer()
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/"
+
+			start := time.Now()
+			err = client.Put(url+"large", bytes.NewReader(random), int64(len(random)))
+			if !errors.Is(err, ErrCodeAccessViolation) {
+				t.Errorf("expected ACCESS_VIOLATION error, got %v", err)
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("expected client to be notified promptly, took %s", d)
+			}
+			if err := <-discardErr; err != nil {
+				t.Errorf("expected Discard to succeed, got %v", err)
+			}
+			// The remaining data was received before rejecting
+			if n := <-received; n != int64(len(random)) {
+				t.Errorf("expected %d bytes received, got %d", len(random), n)
+			}
+
+			// The client has been told the transfer succeeded
+			if err := client.Put(url+"small", bytes.NewReader([]byte("data")), 4); err != nil {
+				t.Errorf("expected transfer to succeed, got %v", err)
+			}
+			if err := <-discardErr; err != ErrTransferComplete {
+				t.Errorf("expected ErrTransferComplete, got %v", err)
+			}
+			<-received
+		})
+	}
+}
+
+func TestServerOptionNegotiator(t *testing.T) {
+	t.Parallel()
+
+	requested := map[string]string{optBlocksize: "1024", optWindowSize: "4"}
+
+	cases := []struct {
+		name       string
+		negotiator func(*net.UDPAddr, string, map[string]string) map[string]string
+
+		expectedOptions options // nil if no OACK is expected
+	}{
+		{
+			name:            "nil callback",
+			expectedOptions: options{optBlocksize: "1024", optWindowSize: "4"},
+		},
+		{
+			name: "drop option",
+			negotiator: func(addr *net.UDPAddr, filename string, opts map[string]string) map[string]string {
+				if filename == "buggy-firmware.bin" {
+					delete(opts, optWindowSize)
+				}
+				return opts
+			},
+			expectedOptions: options{optBlocksize: "1024"},
+		},
+		{
+			name: "rewrite value",
+			negotiator: func(addr *net.UDPAddr, filename string, opts map[string]string) map[string]string {
+				if addr.IP.IsLoopback() {
+					opts[optBlocksize] = "512"
+				}
+				return opts
+			},
+			expectedOptions: options{optBlocksize: "512", optWindowSize: "4"},
+		},
+		{
+			name: "no options",
+			negotiator: func(*net.UDPAddr, string, map[string]string) map[string]string {
+				return nil
+			},
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{false, true} {
+			c := c
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s, single port %t", c.name, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				var opts []ServerOpt
+				var gotAddr *net.UDPAddr
+				if c.negotiator != nil {
+					opts = append(opts, ServerOptionNegotiator(func(addr *net.UDPAddr, filename string, requested map[string]string) map[string]string {
+						gotAddr = addr
+						return c.negotiator(addr, filename, requested)
+					}))
+				}
+				handlerOpts := make(chan map[string]string, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					handlerOpts <- w.Options()
+					w.Write([]byte("data"))
+				}, nil, opts...)
+				defer closeServer()
+
+				conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "buggy-firmware.bin", requested)
+				defer conn.Close()
+
+				dg := readTestDatagram(t, conn)
+				switch {
+				case c.expectedOptions == nil && dg.opcode() != opCodeDATA:
+					t.Errorf("expected DATA without OACK, got %s", dg)
+				case c.expectedOptions != nil && dg.opcode() != opCodeOACK:
+					t.Errorf("expected OACK, got %s", dg)
+				case c.expectedOptions != nil && !reflect.DeepEqual(dg.options(), c.expectedOptions):
+					t.Errorf("expected options %s, got %s", c.expectedOptions, dg.options())
+				}
+
+				if got := <-handlerOpts; !reflect.DeepEqual(got, requested) {
+					t.Errorf("expected handler to see requested options %v, got %v", requested, got)
+				}
+				if c.negotiator != nil && gotAddr.String() != conn.LocalAddr().String() {
+					t.Errorf("expected negotiator called with %s, got %s", conn.LocalAddr(), gotAddr)
+				}
+			})
+		}
+	}
+}
+
+func TestServer_writeReject(t *testing.T) {
+	t.Parallel()
+
+	opts := map[string]string{optBlocksize: "1024", optTransferSize: "2048"}
+
+	cases := []struct {
+		name   string
+		reject func(WriteRequest)
+
+		expectedCode ErrorCode
+		expectedMsg  string
+	}{
+		{
+			name: "WriteError",
+			reject: func(w WriteRequest) {
+				w.WriteError(ErrCodeDiskFull, "file too large")
+			},
+			expectedCode: ErrCodeDiskFull,
+			expectedMsg:  "file too large",
+		},
+		{
+			name: "Discard",
+			reject: func(w WriteRequest) {
+				w.Discard()
+			},
+			expectedCode: ErrCodeAccessViolation,
+			expectedMsg:  "transfer rejected",
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{false, true} {
+			c := c
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s, single port %t", c.name, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				type result struct {
+					size    int64
+					readErr error
+				}
+				results := make(chan result, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, nil, func(w WriteRequest) {
+					size, _ := w.Size() // Available before accepting
+					c.reject(w)
+					_, err := w.Read(make([]byte, 10))
+					results <- result{size: size, readErr: err}
+				}, ServerTimeout(100*time.Millisecond))
+				defer closeServer()
+
+				conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeWRQ, "file", opts)
+				defer conn.Close()
+
+				dg := readTestDatagram(t, conn)
+				if dg.opcode() != opCodeERROR || dg.errorCode() != c.expectedCode || dg.errMsg() != c.expectedMsg {
+					t.Errorf("expected ERROR %s %q without OACK, got %s", c.expectedCode, c.expectedMsg, dg)
+				}
+
+				r := <-results
+				if r.size != 2048 {
+					t.Errorf("expected Size 2048, got %d", r.size)
+				}
+				if !errors.Is(r.readErr, ErrTransferRejected) {
+					t.Errorf("expected Read to return ErrTransferRejected, got %v", r.readErr)
+				}
+
+				// Nothing follows the ERROR, even after the server's timeout
+				conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+				if n, _, err := conn.ReadFrom(make([]byte, 512)); err == nil {
+					t.Errorf("expected only one datagram, received another %d bytes", n)
+				}
+			})
+		}
+	}
+}
+
+func TestServerInterface(t *testing.T) {
+	t.Parallel()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	if _, err := NewServer(":0", ServerInterface("does-not-exist0")); err != ErrInvalidInterface {
+		t.Errorf("expected ErrInvalidInterface for missing interface, got %v", err)
+	}
+
+	// ServerNet is applied regardless of order
+	s, err := NewServer(":0", ServerInterface(loopback), ServerNet("udp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.addrStr != "127.0.0.1:0" {
+		t.Errorf("expected to listen on 127.0.0.1:0, got %s", s.addrStr)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		w.Write([]byte("data"))
+	}))
+	go s.ListenAndServe()
+	defer s.Close()
+	for !s.Connected() {
+		runtime.Gosched()
+	}
+	addr, _ := s.Addr()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("tftp://" + addr.String() + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(resp); string(got) != "data" {
+		t.Errorf("expected %q, got %q", "data", got)
+	}
+}
+
+func TestServer_readFrom(t *testing.T) {
+	t.Parallel()
+
+	random := getTestData(t, "1MB-random")
+	text := getTestData(t, "text")
+
+	cases := []struct {
+		name string
+		data []byte // Defaults to random
+		size int
+		opts []ClientOpt
+		// Data written after ReadFrom
+		trailer []byte
+	}{
+		{name: "empty", size: 0},
+		{name: "less than a block", size: 511},
+		{name: "one block", size: 512},
+		{name: "exact multiple of blksize", size: 512 * 5},
+		{name: "exact multiple of blksize, windowsize", size: 1024 * 8, opts: []ClientOpt{ClientBlocksize(1024), ClientWindowsize(4)}},
+		{name: "partial final block, windowsize", size: 1024*8 + 7, opts: []ClientOpt{ClientBlocksize(1024), ClientWindowsize(3)}},
+		{name: "1MB", size: len(random), opts: []ClientOpt{ClientBlocksize(1468)}},
+		{name: "followed by Write", size: 512*2 + 100, trailer: []byte("trailer")},
+		{name: "netascii", data: text, size: 2000, opts: []ClientOpt{ClientMode(ModeNetASCII)}},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{false, true} {
+			c := c
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s, single port %t", c.name, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				data := random[:c.size]
+				if c.data != nil {
+					data = c.data[:c.size]
+				}
+				readFromErr := make(chan error, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					// Hide WriterTo so the source is read in blocks
+					n, err := w.(io.ReaderFrom).ReadFrom(struct{ io.Reader }{bytes.NewReader(data)})
+					if err == nil && n != int64(len(data)) {
+						err = fmt.Errorf("expected ReadFrom to return %d, got %d", len(data), n)
+					}
+					readFromErr <- err
+					if c.trailer != nil {
+						w.Write(c.trailer)
+					}
+				}, nil)
+				defer closeServer()
+
+				client, err := NewClient(c.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := <-readFromErr; err != nil {
+					t.Error(err)
+				}
+				expected := append(append([]byte{}, data...), c.trailer...)
+				if !bytes.Equal(got, expected) {
+					t.Errorf("expected %d bytes, got %d", len(expected), len(got))
+				}
+			})
+		}
+	}
+}
+
+func TestServer_readFromTruncated(t *testing.T) {
+	t.Parallel()
+
+	// The source fails mid-block with io.ErrUnexpectedEOF, which must not
+	// be mistaken for a short final block.
+	data := make([]byte, 512*2+100)
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		src := io.MultiReader(bytes.NewReader(data), &errReader{err: io.ErrUnexpectedEOF})
+		_, err := w.(io.ReaderFrom).ReadFrom(struct{ io.Reader }{src})
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected %v from ReadFrom, got %v", io.ErrUnexpectedEOF, err)
+		}
+		w.WriteError(ErrCodeNotDefined, "truncated source")
+	}, nil)
+	defer closeServer()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(resp); !errors.Is(err, ErrCodeNotDefined) {
+		t.Errorf("expected %s, got %v", ErrCodeNotDefined, err)
+	}
+}
+
+func TestServer_writeTo(t *testing.T) {
+	t.Parallel()
+
+	random := getTestData(t, "1MB-random")
+	text := getTestData(t, "text")
+
+	cases := []struct {
+		name string
+		data []byte // Defaults to random
+		size int
+		opts []ClientOpt
+		// Bytes read with Read before WriteTo
+		readFirst int
+	}{
+		{name: "empty", size: 0},
+		{name: "less than a block", size: 511},
+		{name: "one block", size: 512},
+		{name: "exact multiple of blksize", size: 512 * 5},
+		{name: "exact multiple of blksize, windowsize", size: 1024 * 8, opts: []ClientOpt{ClientBlocksize(1024), ClientWindowsize(4)}},
+		{name: "partial final block, windowsize", size: 1024*8 + 7, opts: []ClientOpt{ClientBlocksize(1024), ClientWindowsize(3)}},
+		{name: "1MB", size: len(random), opts: []ClientOpt{ClientBlocksize(1468)}},
+		{name: "after Read", size: 512*2 + 100, readFirst: 10},
+		{name: "netascii", data: text, size: 2000, opts: []ClientOpt{ClientMode(ModeNetASCII)}},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{false, true} {
+			c := c
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s, single port %t", c.name, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				data := random[:c.size]
+				if c.data != nil {
+					data = c.data[:c.size]
+				}
+				received := make(chan []byte, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, nil, func(w WriteRequest) {
+					var buf bytes.Buffer
+					if c.readFirst > 0 {
+						if _, err := io.CopyN(&buf, w, int64(c.readFirst)); err != nil {
+							t.Error(err)
+						}
+					}
+					n, err := w.(io.WriterTo).WriteTo(&buf)
+					if err != nil {
+						t.Error(err)
+					}
+					if expected := int64(len(data) - c.readFirst); n != expected {
+						t.Errorf("expected WriteTo to return %d, got %d", expected, n)
+					}
+					received <- buf.Bytes()
+				})
+				defer closeServer()
+
+				client, err := NewClient(c.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+				if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+					t.Fatal(err)
+				}
+				if got := <-received; !bytes.Equal(got, data) {
+					t.Errorf("expected %d bytes, got %d", len(data), len(got))
+				}
+			})
+		}
+	}
+}
+
+func TestServer_writeToError(t *testing.T) {
+	t.Parallel()
+
+	ip, port, closeServer := newTestServer(t, false, nil, func(w WriteRequest) {
+		dst := writerFunc(func(p []byte) (int, error) {
+			return 0, errors.New("disk full")
+		})
+		if _, err := w.(io.WriterTo).WriteTo(dst); err == nil {
+			t.Error("expected error from WriteTo")
+		}
+		w.WriteError(ErrCodeDiskFull, "disk full")
+	})
+	defer closeServer()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+	err = client.Put(url, bytes.NewReader(make([]byte, 2000)), 0)
+	if !errors.Is(err, ErrCodeDiskFull) {
+		t.Errorf("expected %s, got %v", ErrCodeDiskFull, err)
+	}
+}
+
+func TestServer_clientAbort(t *testing.T) {
+	t.Parallel()
+
+	const abortAfter = 3 // blocks
+
+	for _, op := range []opcode{opCodeRRQ, opCodeWRQ} {
+		for _, singlePort := range []bool{false, true} {
+			op := op
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s, single port %t", op, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				type result struct {
+					n   int
+					err error
+				}
+				results := make(chan result, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					var res result
+					block := make([]byte, 512)
+					for res.err == nil && res.n < 512*10 {
+						var n int
+						n, res.err = w.Write(block)
+						res.n += n
+					}
+					results <- res
+				}, func(w WriteRequest) {
+					var res result
+					buf := make([]byte, 32*1024) // Larger than the data received before the ERROR
+					for res.err == nil {
+						var n int
+						n, res.err = w.Read(buf)
+						res.n += n
+					}
+					results <- res
+				})
+				defer closeServer()
+
+				conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), op, "file", nil)
+				defer conn.Close()
+
+				dg, tid := readTestDatagramFrom(t, conn)
+				for block := uint16(1); block <= abortAfter; block++ {
+					if op == opCodeRRQ {
+						if dg.opcode() != opCodeDATA || dg.block() != block {
+							t.Fatalf("expected DATA block %d, got %s", block, dg)
+						}
+						dg.writeAck(block)
+					} else {
+						dg.writeData(block, make([]byte, 512))
+					}
+					if _, err := conn.WriteTo(dg.bytes(), tid); err != nil {
+						t.Fatal(err)
+					}
+					if block < abortAfter || op == opCodeWRQ {
+						dg = readTestDatagram(t, conn)
+					}
+				}
+				dg.writeError(ErrCodeDiskFull, "out of space")
+				if _, err := conn.WriteTo(dg.bytes(), tid); err != nil {
+					t.Fatal(err)
+				}
+
+				var res result
+				select {
+				case res = <-results:
+				case <-time.After(time.Second):
+					// Well within the retransmit limit
+					t.Fatal("handler did not return after ERROR")
+				}
+				var tftpErr *Error
+				if !errors.As(res.err, &tftpErr) {
+					t.Fatalf("expected *Error, got %v", res.err)
+				}
+				if tftpErr.Code != ErrCodeDiskFull || tftpErr.Message != "out of space" {
+					t.Errorf("expected %s: out of space, got %v", ErrCodeDiskFull, tftpErr)
+				}
+				if op == opCodeWRQ && res.n != 512*abortAfter {
+					t.Errorf("expected %d bytes read before the ERROR, got %d", 512*abortAfter, res.n)
+				}
+			})
+		}
+	}
+}
+
+func TestServerReadOnly(t *testing.T) {
+	t.Parallel()
+
+	const msg = "TFTP-RO: uploads disabled"
+
+	cases := []struct {
+		name string
+		opt  ServerOpt
+
+		allowed opcode
+		blocked opcode
+		code    ErrorCode
+	}{
+		{
+			name:    "read only",
+			opt:     ServerReadOnly(ErrCodeAccessViolation, msg),
+			allowed: opCodeRRQ,
+			blocked: opCodeWRQ,
+			code:    ErrCodeAccessViolation,
+		},
+		{
+			name:    "write only",
+			opt:     ServerWriteOnly(ErrCodeNotDefined, msg),
+			allowed: opCodeWRQ,
+			blocked: opCodeRRQ,
+			code:    ErrCodeNotDefined,
+		},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{false, true} {
+			c := c
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s, single port %t", c.name, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				var called int32
+				ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+					atomic.AddInt32(&called, 1)
+					w.Write([]byte("data"))
+				}, func(w WriteRequest) {
+					atomic.AddInt32(&called, 1)
+					ioutil.ReadAll(w)
+				}, c.opt)
+				defer closeServer()
+				addr := ip + ":" + strconv.Itoa(port)
+
+				conn := sendTestRequest(t, addr, c.blocked, "file", nil)
+				defer conn.Close()
+				dg := readTestDatagram(t, conn)
+				if dg.opcode() != opCodeERROR || dg.errorCode() != c.code || dg.errMsg() != msg {
+					t.Errorf("expected ERROR %s %q, got %s", c.code, msg, dg)
+				}
+				if n := atomic.LoadInt32(&called); n != 0 {
+					t.Errorf("expected handler not to be called, called %d times", n)
+				}
+
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				url := "tftp://" + addr + "/file"
+				if c.allowed == opCodeRRQ {
+					resp, err := client.Get(url)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, _ := ioutil.ReadAll(resp); string(got) != "data" {
+						t.Errorf("expected %q, got %q", "data", got)
+					}
+				} else if err := client.Put(url, strings.NewReader("data"), 4); err != nil {
+					t.Fatal(err)
+				}
+				if n := atomic.LoadInt32(&called); n != 1 {
+					t.Errorf("expected allowed handler to be called once, called %d times", n)
+				}
+			})
+		}
+	}
+}
+
+func TestServer_writePeek(t *testing.T) {
+	t.Parallel()
+
+	data := getTestData(t, "1MB-random")[:3000]
+
+	cases := []struct {
+		name  string
+		peeks []int
+		// Read the remainder with WriteTo instead of Read
+		writeTo bool
+
+		expectedErr error // From the final Peek
+	}{
+		{name: "within first block", peeks: []int{4}},
+		{name: "across blocks", peeks: []int{1000}},
+		{name: "grow", peeks: []int{4, 2000, 16}},
+		{name: "entire file", peeks: []int{3000}},
+		{name: "longer than file", peeks: []int{4000}, expectedErr: io.EOF},
+		{name: "WriteTo", peeks: []int{4, 1500}, writeTo: true},
+	}
+
+	for _, c := range cases {
+		for _, singlePort := range []bool{false, true} {
+			c := c
+			singlePort := singlePort
+			t.Run(fmt.Sprintf("%s, single port %t", c.name, singlePort), func(t *testing.T) {
+				t.Parallel()
+
+				received := make(chan []byte, 1)
+				ip, port, closeServer := newTestServer(t, singlePort, nil, func(w WriteRequest) {
+					for i, n := range c.peeks {
+						p, err := w.Peek(n)
+						if i == len(c.peeks)-1 && err != c.expectedErr {
+							t.Errorf("expected Peek error %v, got %v", c.expectedErr, err)
+						}
+						if expected := data[:min(n, len(data))]; !bytes.Equal(p, expected) {
+							t.Errorf("Peek(%d): expected %d bytes, got %d", n, len(expected), len(p))
+						}
+					}
+
+					var buf bytes.Buffer
+					var err error
+					if c.writeTo {
+						_, err = w.(io.WriterTo).WriteTo(&buf)
+					} else {
+						_, err = buf.ReadFrom(struct{ io.Reader }{w})
+					}
+					if err != nil {
+						t.Error(err)
+					}
+					received <- buf.Bytes()
+				})
+				defer closeServer()
+
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+				if err := client.Put(url, bytes.NewReader(data), 0); err != nil {
+					t.Fatal(err)
+				}
+				if got := <-received; !bytes.Equal(got, data) {
+					t.Errorf("expected %d bytes, got %d", len(data), len(got))
+				}
+			})
+		}
+	}
+
+	t.Run("reject after Peek", func(t *testing.T) {
+		t.Parallel()
+
+		ip, port, closeServer := newTestServer(t, false, nil, func(w WriteRequest) {
+			if magic, _ := w.Peek(4); !bytes.Equal(magic, []byte("\x7fELF")) {
+				w.WriteError(ErrCodeAccessViolation, "not a firmware image")
+			}
+		})
+		defer closeServer()
+
+		client, err := NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+		err = client.Put(url, bytes.NewReader(data), 0)
+		if !errors.Is(err, ErrCodeAccessViolation) {
+			t.Errorf("expected %s, got %v", ErrCodeAccessViolation, err)
+		}
+	})
+}
+
+func TestServer_localAddrID(t *testing.T) {
+	t.Parallel()
+
+	type transfer struct {
+		local *net.UDPAddr
+		id    uint64
+	}
+
+	for _, singlePort := range []bool{false, true} {
+		singlePort := singlePort
+		t.Run(fmt.Sprintf("single port %t", singlePort), func(t *testing.T) {
+			t.Parallel()
+
+			transfers := make(chan transfer, 2)
+			s, ip, port, closeServer := startTestServer(t, singlePort, func(w ReadRequest) {
+				transfers <- transfer{w.LocalAddr(), w.ID()}
+				w.Write([]byte("data"))
+			}, func(w WriteRequest) {
+				transfers <- transfer{w.LocalAddr(), w.ID()}
+				ioutil.ReadAll(w)
+			})
+			defer closeServer()
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp)
+			if err := client.Put(url, strings.NewReader("data"), 4); err != nil {
+				t.Fatal(err)
+			}
+
+			serverAddr, err := s.Addr()
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, b := <-transfers, <-transfers
+			if a.id == 0 || b.id == 0 || a.id == b.id {
+				t.Errorf("expected unique non-zero IDs, got %d and %d", a.id, b.id)
+			}
+			for _, tr := range []transfer{a, b} {
+				if singlePort != (tr.local.String() == serverAddr.String()) {
+					t.Errorf("expected local address %v to match server address %v: %t", tr.local, serverAddr, singlePort)
+				}
+			}
+			if !singlePort && a.local.Port == b.local.Port {
+				t.Errorf("expected transfers to use different local ports, both used %d", a.local.Port)
+			}
+		})
+	}
+}
+
+func TestServer_writeZeroSize(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		opts        map[string]string
+		requireSize bool
+
+		expectedKnown bool
+		expectedErr   error
+		rejected      bool
+	}{
+		{
+			name:          "with tsize",
+			opts:          map[string]string{optTransferSize: "0"},
+			expectedKnown: true,
+		},
+		{
+			name:        "without tsize",
+			expectedErr: ErrSizeNotReceived,
+		},
+		{
+			name:          "with tsize, required",
+			opts:          map[string]string{optTransferSize: "0"},
+			requireSize:   true,
+			expectedKnown: true,
+		},
+		{
+			name:        "without tsize, required",
+			requireSize: true,
+			rejected:    true,
+		},
+		{
+			name:        "invalid tsize, required",
+			opts:        map[string]string{optTransferSize: "zero"},
+			requireSize: true,
+			rejected:    true,
+		},
+	}
+
+	type result struct {
+		known bool
+		size  int64
+		err   error
+		data  []byte
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			results := make(chan result, 1)
+			ip, port, closeServer := newTestServer(t, false, nil, func(w WriteRequest) {
+				var r result
+				r.known = w.SizeKnown()
+				r.size, r.err = w.Size()
+				r.data, _ = ioutil.ReadAll(w)
+				results <- r
+			}, ServerRequireTSize(c.requireSize))
+			defer closeServer()
+
+			conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeWRQ, "file", c.opts)
+			defer conn.Close()
+
+			dg, addr := readTestDatagramFrom(t, conn)
+			if c.rejected {
+				if dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeIllegalOperation {
+					t.Fatalf("expected ERROR %s, got %s", ErrCodeIllegalOperation, dg)
+				}
+				select {
+				case <-results:
+					t.Error("expected handler not to be called")
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+			if op := dg.opcode(); op != opCodeOACK && op != opCodeACK {
+				t.Fatalf("expected ACK or OACK, got %s", dg)
+			}
+
+			// Empty final block
+			dg.writeData(1, nil)
+			if _, err := conn.WriteTo(dg.bytes(), addr); err != nil {
+				t.Fatal(err)
+			}
+			if dg, _ := readTestDatagramFrom(t, conn); dg.opcode() != opCodeACK || dg.block() != 1 {
+				t.Fatalf("expected ACK 1, got %s", dg)
+			}
+
+			r := <-results
+			if r.known != c.expectedKnown {
+				t.Errorf("expected SizeKnown %t, got %t", c.expectedKnown, r.known)
+			}
+			if r.size != 0 || r.err != c.expectedErr {
+				t.Errorf("expected size 0 and error %v, got %d and %v", c.expectedErr, r.size, r.err)
+			}
+			if len(r.data) != 0 {
+				t.Errorf("expected no data, got %q", r.data)
+			}
+		})
+	}
+}
+
+func TestServer_ServePacketConn(t *testing.T) {
+	t.Parallel()
+
+	pc := newPipePacketConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69})
+	s, err := NewServer("", ServerSinglePort(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		w.Write([]byte("hello"))
+	}))
+	go s.ServePacketConn(pc)
+	defer s.Close()
+	for !s.Connected() {
+		runtime.Gosched()
+	}
+
+	if addr, err := s.Addr(); err != nil || addr.String() != "127.0.0.1:69" {
+		t.Errorf("expected address 127.0.0.1:69, got %v (%v)", addr, err)
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	var dg datagram
+
+	// Not a UDP address, dropped
+	dg.writeReadReq("file", ModeOctet, nil)
+	pc.send(dg.bytes(), &net.IPAddr{IP: client.IP})
+
+	dg.writeReadReq("file", ModeOctet, nil)
+	pc.send(dg.bytes(), client)
+	dg, addr := pc.recv(t)
+	if addr.String() != client.String() {
+		t.Errorf("expected DATA to be sent to %v, got %v", client, addr)
+	}
+	if dg.opcode() != opCodeDATA || dg.block() != 1 || string(dg.data()) != "hello" {
+		t.Fatalf("expected DATA 1 %q, got %s", "hello", dg)
+	}
+	dg.writeAck(1)
+	pc.send(dg.bytes(), client)
+
+	// No write handler registered
+	dg.writeWriteReq("file", ModeOctet, nil)
+	pc.send(dg.bytes(), client)
+	if dg, _ = pc.recv(t); dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeIllegalOperation {
+		t.Errorf("expected ERROR %s, got %s", ErrCodeIllegalOperation, dg)
+	}
+}
+
+// pipePacketConn is an in-memory net.PacketConn. Datagrams passed to
+// send are returned by ReadFrom and datagrams passed to WriteTo are
+// returned by recv.
+type pipePacketConn struct {
+	laddr     net.Addr
+	in        chan pipeDatagram
+	out       chan pipeDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time // Read deadline
+}
+
+type pipeDatagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+func newPipePacketConn(laddr net.Addr) *pipePacketConn {
+	return &pipePacketConn{
+		laddr:  laddr,
+		in:     make(chan pipeDatagram, 16),
+		out:    make(chan pipeDatagram, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (pc *pipePacketConn) send(b []byte, addr net.Addr) {
+	pc.in <- pipeDatagram{b: append([]byte(nil), b...), addr: addr}
+}
+
+func (pc *pipePacketConn) recv(t *testing.T) (datagram, net.Addr) {
+	t.Helper()
+	select {
+	case d := <-pc.out:
+		var dg datagram
+		dg.setBytes(d.b)
+		return dg, d.addr
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for datagram")
+		return datagram{}, nil
+	}
+}
+
+func (pc *pipePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	pc.mu.Lock()
+	deadline := pc.deadline
+	pc.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case d := <-pc.in:
+		return copy(p, d.b), d.addr, nil
+	case <-pc.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (pc *pipePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case pc.out <- pipeDatagram{b: append([]byte(nil), b...), addr: addr}:
+		return len(b), nil
+	case <-pc.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (pc *pipePacketConn) Close() error {
+	pc.closeOnce.Do(func() { close(pc.closed) })
+	return nil
+}
+
+func (pc *pipePacketConn) LocalAddr() net.Addr { return pc.laddr }
+
+func (pc *pipePacketConn) SetDeadline(t time.Time) error { return pc.SetReadDeadline(t) }
+
+func (pc *pipePacketConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	pc.deadline = t
+	pc.mu.Unlock()
+	return nil
+}
+
+func (pc *pipePacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestServer_abort(t *testing.T) {
+	t.Parallel()
+
+	const msg = "backend failed"
+
+	cases := []struct {
+		name string
+		op   opcode
+		rh   func(ReadRequest) error
+		wh   func(WriteRequest) error
+
+		expectedCode ErrorCode
+		expectedMsg  string
+		expectedErr  error
+	}{
+		{
+			name: "read",
+			op:   opCodeRRQ,
+			rh: func(w ReadRequest) error {
+				w.Write(make([]byte, 512*10))
+				w.Abort(ErrCodeDiskFull, msg)
+				_, err := w.Write([]byte("more"))
+				return err
+			},
+			expectedCode: ErrCodeDiskFull,
+			expectedMsg:  msg,
+			expectedErr:  ErrTransferAborted,
+		},
+		{
+			name: "read, WriteError",
+			op:   opCodeRRQ,
+			rh: func(w ReadRequest) error {
+				w.Write(make([]byte, 512*10+100))
+				w.WriteError(ErrCodeAccessViolation, msg)
+				_, err := w.Write([]byte("more"))
+				return err
+			},
+			expectedCode: ErrCodeAccessViolation,
+			expectedMsg:  msg,
+			expectedErr:  ErrTransferRejected,
+		},
+		{
+			name: "read, WriteError before Write",
+			op:   opCodeRRQ,
+			rh: func(w ReadRequest) error {
+				w.WriteError(ErrCodeAccessViolation, msg)
+				_, err := w.Write([]byte("data"))
+				return err
+			},
+			expectedCode: ErrCodeAccessViolation,
+			expectedMsg:  msg,
+			expectedErr:  ErrTransferRejected,
+		},
+		{
+			name: "read, short of size",
+			op:   opCodeRRQ,
+			rh: func(w ReadRequest) error {
+				w.WriteSize(512 * 20)
+				_, err := w.Write(make([]byte, 512*10))
+				return err
+			},
+			expectedCode: ErrCodeNotDefined,
+			expectedMsg:  "transfer incomplete",
+		},
+		{
+			name: "write",
+			op:   opCodeWRQ,
+			wh: func(w WriteRequest) error {
+				w.Read(make([]byte, 512*10))
+				w.Abort(ErrCodeDiskFull, msg)
+				_, err := w.Read(make([]byte, 512))
+				return ErrorCause(err)
+			},
+			expectedCode: ErrCodeDiskFull,
+			expectedMsg:  msg,
+			expectedErr:  ErrTransferAborted,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			results := make(chan error, 1)
+			ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+				if c.rh != nil {
+					results <- ErrorCause(c.rh(w))
+				}
+			}, func(w WriteRequest) {
+				if c.wh != nil {
+					results <- c.wh(w)
+				}
+			})
+			defer closeServer()
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+			client, err := NewClient(ClientTimeout(5 * time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			if c.op == opCodeRRQ {
+				var resp *Response
+				resp, err = client.Get(url)
+				if err == nil {
+					_, err = ioutil.ReadAll(resp)
+				}
+			} else {
+				err = client.Put(url, bytes.NewReader(make([]byte, 512*20)), 512*20)
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("expected client to fail promptly, took %s", d)
+			}
+
+			var tftpErr *Error
+			if !errors.As(err, &tftpErr) {
+				t.Fatalf("expected *Error, got %v", err)
+			}
+			if tftpErr.Code != c.expectedCode || tftpErr.Message != c.expectedMsg {
+				t.Errorf("expected ERROR %s %q, got %s %q", c.expectedCode, c.expectedMsg, tftpErr.Code, tftpErr.Message)
+			}
+			if err := <-results; err != c.expectedErr {
+				t.Errorf("expected handler error %v, got %v", c.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestServer_duplicateAck(t *testing.T) {
+	t.Parallel()
+
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		w.Write(make([]byte, 512*4))
+	}, nil, ServerTimeout(500*time.Millisecond))
+	defer closeServer()
+
+	conn := sendTestRequest(t, ip+":"+strconv.Itoa(port), opCodeRRQ, "file", nil)
+	defer conn.Close()
+
+	expectData := func(block uint16) *net.UDPAddr {
+		t.Helper()
+		dg, addr := readTestDatagramFrom(t, conn)
+		if dg.opcode() != opCodeDATA || dg.block() != block {
+			t.Fatalf("expected DATA block %d, got %s", block, dg)
+		}
+		return addr
+	}
+	ack := func(addr *net.UDPAddr, block uint16) {
+		t.Helper()
+		var dg datagram
+		dg.writeAck(block)
+		if _, err := conn.WriteTo(dg.bytes(), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tid := expectData(1)
+	ack(tid, 1)
+	expectData(2)
+
+	// A delayed duplicate of ACK 1 must not cause block 2 to be resent
+	ack(tid, 1)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(make([]byte, 516)); err == nil {
+		t.Fatal("expected duplicate ACK to be ignored")
+	}
+
+	ack(tid, 2)
+	expectData(3)
+
+	// Without an ACK, block 3 is resent after the timeout
+	expectData(3)
+	ack(tid, 3)
+	expectData(4)
+}
+
+func TestRequest_Stats(t *testing.T) {
+	t.Parallel()
+
+	data := getTestData(t, "1MB-random")[:1500]
+
+	type handlerResult struct {
+		live  TransferStats // From the handler after copying
+		stats func() TransferStats
+	}
+	results := make(chan handlerResult, 1)
+	finished := make(chan struct{}, 1)
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		io.Copy(w, bytes.NewReader(data))
+		results <- handlerResult{w.Stats(), w.Stats}
+	}, func(w WriteRequest) {
+		io.Copy(ioutil.Discard, w)
+		results <- handlerResult{w.Stats(), w.Stats}
+	}, ServerTimeout(100*time.Millisecond), ServerTransferLogger(func(TransferStats) {
+		finished <- struct{}{}
+	}))
+	defer closeServer()
+	addr := ip + ":" + strconv.Itoa(port)
+
+	send := func(conn *net.UDPConn, tid *net.UDPAddr, dg datagram) {
+		t.Helper()
+		if _, err := conn.WriteTo(dg.bytes(), tid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(liveComplete bool, expected TransferStats) {
+		t.Helper()
+		res := <-results
+		if res.live.Complete != liveComplete || res.live.Bytes != expected.Bytes {
+			t.Errorf("expected %d bytes and complete %t in handler, got %+v", expected.Bytes, liveComplete, res.live)
+		}
+		if res.live.Rate() <= 0 {
+			t.Errorf("expected positive rate in handler, got %f", res.live.Rate())
+		}
+		<-finished
+		got := res.stats()
+		if got.Bytes != expected.Bytes || got.Retransmits != expected.Retransmits ||
+			got.Duplicates != expected.Duplicates || got.Complete != expected.Complete || got.Err != nil {
+			t.Errorf("expected %+v, got %+v", expected, got)
+		}
+	}
+
+	t.Run("read", func(t *testing.T) {
+		conn := sendTestRequest(t, addr, opCodeRRQ, "file", nil)
+		defer conn.Close()
+
+		var ack datagram
+		readTestDatagramFrom(t, conn) // Dropped, resent after the timeout
+		dg, tid := readTestDatagramFrom(t, conn)
+		for block := uint16(1); block <= 3; block++ {
+			if dg.opcode() != opCodeDATA || dg.block() != block {
+				t.Fatalf("expected DATA block %d, got %s", block, dg)
+			}
+			ack.writeAck(block)
+			send(conn, tid, ack)
+			if block == 2 {
+				send(conn, tid, ack) // Duplicate
+			}
+			if block < 3 {
+				dg, _ = readTestDatagramFrom(t, conn)
+			}
+		}
+
+		// The final block is sent after the handler returns
+		check(false, TransferStats{Bytes: 1500, Retransmits: 1, Duplicates: 1, Complete: true})
+	})
+
+	t.Run("write", func(t *testing.T) {
+		conn := sendTestRequest(t, addr, opCodeWRQ, "file", nil)
+		defer conn.Close()
+
+		_, tid := readTestDatagramFrom(t, conn)
+		var dg datagram
+		dg.writeData(1, data[:512])
+		send(conn, tid, dg)
+		readTestDatagramFrom(t, conn)
+		send(conn, tid, dg) // Duplicate
+		dg.writeData(2, data[512:600])
+		send(conn, tid, dg)
+		readTestDatagramFrom(t, conn)
+
+		check(true, TransferStats{Bytes: 600, Duplicates: 1, Complete: true})
+	})
+}
+
+func TestTransferStats_Rate(t *testing.T) {
+	cases := []struct {
+		name     string
+		stats    TransferStats
+		expected float64
+	}{
+		{name: "bytes", stats: TransferStats{Bytes: 3000, Duration: 2 * time.Second}, expected: 1500},
+		{name: "no bytes", stats: TransferStats{Duration: time.Second}, expected: 0},
+		{name: "no duration", stats: TransferStats{Bytes: 3000}, expected: 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.stats.Rate(); got != c.expected {
+				t.Errorf("expected rate %f, got %f", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestServer_blockRollover(t *testing.T) {
+	t.Parallel()
+
+	// 65536 full blocks, followed by an empty final block numbered 1
+	const (
+		blksize = 8
+		blocks  = 65536
+		size    = blksize * blocks
+	)
+
+	for _, singlePort := range []bool{false, true} {
+		singlePort := singlePort
+		t.Run(fmt.Sprintf("single port %t", singlePort), func(t *testing.T) {
+			t.Parallel()
+
+			received := make(chan error, 1)
+			ip, port, closeServer := newTestServer(t, singlePort, func(w ReadRequest) {
+				io.Copy(w, io.LimitReader(&blockIndexReader{}, size))
+			}, func(w WriteRequest) {
+				received <- checkBlockIndexes(w, blocks)
+			})
+			defer closeServer()
+			url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+			client, err := NewClient(ClientBlocksize(blksize), ClientWindowsize(16))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkBlockIndexes(resp, blocks); err != nil {
+				t.Errorf("read: %v", err)
+			}
+
+			if err := client.Put(url, io.LimitReader(&blockIndexReader{}, size), size); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-received; err != nil {
+				t.Errorf("write: %v", err)
+			}
+		})
+	}
+}
+
+// blockIndexReader returns each 8 byte block's index, big endian.
+type blockIndexReader struct {
+	off uint64
+}
+
+func (r *blockIndexReader) Read(p []byte) (int, error) {
+	for i := range p {
+		shift := 56 - 8*(r.off%8)
+		p[i] = byte((r.off / 8) >> shift)
+		r.off++
+	}
+	return len(p), nil
+}
+
+// checkBlockIndexes reads r, verifying it contains exactly n blocks
+// from blockIndexReader.
+func checkBlockIndexes(r io.Reader, n uint64) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if uint64(len(data)) != n*8 {
+		return fmt.Errorf("expected %d bytes, got %d", n*8, len(data))
+	}
+	for i := uint64(0); i < n; i++ {
+		var expected [8]byte
+		binary.BigEndian.PutUint64(expected[:], i)
+		if !bytes.Equal(data[i*8:i*8+8], expected[:]) {
+			return fmt.Errorf("block %d contains %x", i, data[i*8:i*8+8])
+		}
+	}
+	return nil
+}
+
+func TestServerNotSupported(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		op   opcode
+		opts []ServerOpt
+
+		expectedCode ErrorCode
+		expectedMsg  string
+	}{
+		{
+			name:         "read, default",
+			op:           opCodeRRQ,
+			expectedCode: ErrCodeIllegalOperation,
+			expectedMsg:  "Server does not support read requests.",
+		},
+		{
+			name:         "write, default",
+			op:           opCodeWRQ,
+			expectedCode: ErrCodeIllegalOperation,
+			expectedMsg:  "Server does not support write requests.",
+		},
+		{
+			name:         "read, custom",
+			op:           opCodeRRQ,
+			opts:         []ServerOpt{ServerReadNotSupported(ErrCodeFileNotFound, "No boot files")},
+			expectedCode: ErrCodeFileNotFound,
+			expectedMsg:  "No boot files",
+		},
+		{
+			name:         "write, custom",
+			op:           opCodeWRQ,
+			opts:         []ServerOpt{ServerWriteNotSupported(ErrCodeAccessViolation, "Read only")},
+			expectedCode: ErrCodeAccessViolation,
+			expectedMsg:  "Read only",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewServer("127.0.0.1:0", c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Register only the other handler
+			if c.op == opCodeRRQ {
+				s.WriteHandler(WriteHandlerFunc(func(WriteRequest) {}))
+			} else {
+				s.ReadHandler(ReadHandlerFunc(func(ReadRequest) {}))
+			}
+			go s.ListenAndServe()
+			defer s.Close()
+			for !s.Connected() {
+				runtime.Gosched()
+			}
+			addr, err := s.Addr()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn := sendTestRequest(t, addr.String(), c.op, "file", nil)
+			defer conn.Close()
+			dg := readTestDatagram(t, conn)
+			if dg.opcode() != opCodeERROR || dg.errorCode() != c.expectedCode || dg.errMsg() != c.expectedMsg {
+				t.Errorf("expected ERROR %s %q, got %s", c.expectedCode, c.expectedMsg, dg)
+			}
+		})
+	}
+}
+
+func TestServer_hijack(t *testing.T) {
+	t.Parallel()
+
+	const payload = "sent by the handler"
+
+	// exchange sends tx to addr over conn, returning the response
+	exchange := func(conn net.PacketConn, addr *net.UDPAddr, tx datagram) (datagram, error) {
+		if _, err := conn.WriteTo(tx.bytes(), addr); err != nil {
+			return datagram{}, err
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return datagram{}, err
+		}
+		var rx datagram
+		rx.setBytes(buf[:n])
+		return rx, rx.validate()
+	}
+
+	var received []byte
+	results := make(chan error, 2)
+	ip, port, closeServer := newTestServer(t, false, func(w ReadRequest) {
+		conn, addr, err := w.(Hijacker).Hijack()
+		if err != nil {
+			results <- err
+			return
+		}
+		defer conn.Close()
+		if _, err := w.Write([]byte("more")); ErrorCause(err) != ErrHijacked {
+			results <- fmt.Errorf("expected Write to return ErrHijacked, got %v", err)
+			return
+		}
+		if _, _, err := w.(Hijacker).Hijack(); err != ErrHijacked {
+			results <- fmt.Errorf("expected second Hijack to return ErrHijacked, got %v", err)
+			return
+		}
+
+		var tx datagram
+		tx.writeData(1, []byte(payload))
+		rx, err := exchange(conn, addr, tx)
+		if err == nil && (rx.opcode() != opCodeACK || rx.block() != 1) {
+			err = fmt.Errorf("expected ACK 1, got %s", rx)
+		}
+		results <- err
+	}, func(w WriteRequest) {
+		conn, addr, err := w.(Hijacker).Hijack()
+		if err != nil {
+			results <- err
+			return
+		}
+		defer conn.Close()
+
+		var tx datagram
+		tx.writeAck(0)
+		rx, err := exchange(conn, addr, tx)
+		if err != nil {
+			results <- err
+			return
+		}
+		if rx.opcode() != opCodeDATA || rx.block() != 1 {
+			results <- fmt.Errorf("expected DATA 1, got %s", rx)
+			return
+		}
+		received = append([]byte(nil), rx.data()...)
+		tx.writeAck(1)
+		_, err = conn.WriteTo(tx.bytes(), addr)
+		results <- err
+	})
+	defer closeServer()
+	url := "tftp://" + ip + ":" + strconv.Itoa(port) + "/file"
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("read", func(t *testing.T) {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != payload {
+			t.Errorf("expected %q, got %q", payload, data)
+		}
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		if err := client.Put(url, strings.NewReader(payload), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+		if string(received) != payload {
+			t.Errorf("expected handler to receive %q, got %q", payload, received)
+		}
+	})
+
+	t.Run("single port mode", func(t *testing.T) {
+		hijackErr := make(chan error, 1)
+		ip, port, closeServer := newTestServer(t, true, func(w ReadRequest) {
+			_, _, err := w.(Hijacker).Hijack()
+			hijackErr <- err
+			w.Write([]byte(payload))
+		}, nil)
+		defer closeServer()
+
+		resp, err := client.Get("tftp://" + ip + ":" + strconv.Itoa(port) + "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadAll(resp); err != nil || string(data) != payload {
+			t.Errorf("expected transfer to continue, got %q (%v)", data, err)
+		}
+		if err := <-hijackErr; err != ErrHijackNotSupported {
+			t.Errorf("expected ErrHijackNotSupported, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a Server's counters.
+type Stats struct {
+	// ReadRequests and WriteRequests are the number of read (RRQ) and
+	// write (WRQ) requests received.
+	ReadRequests  uint64
+	WriteRequests uint64
+
+	// Completed is the number of transfers that finished successfully.
+	Completed uint64
+
+	// Failed is the number of transfers that ended with an error,
+	// including when the handler sent an ERROR.
+	Failed uint64
+
+	// ActiveTransfers is the number of transfers in progress. A multicast
+	// transfer is counted once, regardless of the number of clients.
+	ActiveTransfers int64
+
+	// ErrorsSent is the number of ERROR datagrams sent to clients.
+	ErrorsSent uint64
+
+	// BytesSent and BytesReceived are the number of bytes written by
+	// read handlers and read by write handlers.
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// Rejected is the number of requests refused because of the
+	// ServerMaxConcurrent or ServerMaxConcurrentPerIP limits.
+	Rejected uint64
+
+	// Dropped is the number of datagrams discarded in single port mode
+	// because the transfer's queue was full.
+	Dropped uint64
+
+	// Expired is the number of single port mode transfers removed after
+	// exceeding ServerSinglePortIdleTimeout.
+	Expired uint64
+}
+
+// serverStats holds the counters backing Stats.
+//
+// All fields must be accessed atomically.
+type serverStats struct {
+	readRequests  uint64
+	writeRequests uint64
+	completed     uint64
+	failed        uint64
+	active        int64
+	errorsSent    uint64
+	bytesSent     uint64
+	bytesReceived uint64
+	rejected      uint64
+	dropped       uint64
+	expired       uint64
+	transfers     uint64 // Last transfer ID assigned
+}
+
+// Stats returns a snapshot of the server's counters.
+func (s *Server) Stats() Stats {
+	return Stats{
+		ReadRequests:    atomic.LoadUint64(&s.stats.readRequests),
+		WriteRequests:   atomic.LoadUint64(&s.stats.writeRequests),
+		Completed:       atomic.LoadUint64(&s.stats.completed),
+		Failed:          atomic.LoadUint64(&s.stats.failed),
+		ActiveTransfers: atomic.LoadInt64(&s.stats.active),
+		ErrorsSent:      atomic.LoadUint64(&s.stats.errorsSent),
+		BytesSent:       atomic.LoadUint64(&s.stats.bytesSent),
+		BytesReceived:   atomic.LoadUint64(&s.stats.bytesReceived),
+		Rejected:        atomic.LoadUint64(&s.stats.rejected),
+		Dropped:         atomic.LoadUint64(&s.stats.dropped),
+		Expired:         atomic.LoadUint64(&s.stats.expired),
+	}
+}
+
+// TransferStats describes a transfer, see ServerTransferLogger and
+// ReadRequest.Stats.
+type TransferStats struct {
+	ID   uint64       // Unique transfer ID, see ReadRequest.ID
+	Op   string       // "read" or "write"
+	Addr *net.UDPAddr // Network address of the client
+	Name string       // File name requested by the client
+
+	// Bytes is the number of bytes written by the read handler or read
+	// by the write handler.
+	Bytes    int64
+	Duration time.Duration
+
+	// Retransmits is the number of DATA blocks resent and ACKs repeated
+	// due to timeouts or lost datagrams.
+	Retransmits int
+
+	// Duplicates is the number of DATA blocks or ACKs received again
+	// after they had been processed, and discarded.
+	Duplicates int
+
+	// Complete is true once the final DATA block has been acknowledged
+	// by the client (read) or received from the client (write).
+	Complete bool
+
+	// BlockSize and WindowSize are the negotiated blksize and windowsize.
+	BlockSize  int
+	WindowSize int
+
+	// Upstream is the host and port of the upstream server that a Proxy
+	// relayed the transfer to, empty if the transfer wasn't proxied.
+	Upstream string
+
+	// Err is non-nil if the transfer failed, including when an ERROR
+	// was sent to the client.
+	Err error
+}
+
+// Rate returns the average transfer rate in bytes per second, Bytes
+// divided by Duration. Handlers can use the Rate of their request's
+// Stats to make throttling decisions during a transfer.
+func (s TransferStats) Rate() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// transferStats returns the transfer's counters, with err or the ERROR
+// sent to the client if err is nil, or else a failure recorded by the
+// handler.
+func (c *conn) transferStats(err error) TransferStats {
+	if err == nil {
+		err = c.sentErr
+	}
+	if err == nil {
+		err = c.failure
+	}
+	blksize, windowsize := c.negotiated()
+	return TransferStats{
+		ID:          c.id,
+		Op:          c.info.Op,
+		Addr:        c.info.Addr,
+		Name:        c.info.Name,
+		Bytes:       c.total,
+		Duration:    time.Since(c.start),
+		Retransmits: c.retransmits,
+		Duplicates:  c.duplicates,
+		Complete:    c.acked || (!c.isSender && c.done),
+		BlockSize:   int(blksize),
+		WindowSize:  int(windowsize),
+		Upstream:    c.upstream,
+		Err:         err,
+	}
+}
+
+// currentStats returns the stats recorded when the transfer finished,
+// or the current counters if it hasn't.
+func (c *conn) currentStats() TransferStats {
+	c.statsMu.Lock()
+	final := c.final
+	c.statsMu.Unlock()
+	if final != nil {
+		return *final
+	}
+	return c.transferStats(nil)
+}
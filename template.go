@@ -0,0 +1,55 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"text/template"
+)
+
+// NewTemplateHandler returns a ReadHandler that sends the output of t,
+// executed with the value returned by data for the client and requested
+// file, such as a per-client iPXE script.
+//
+// The output is streamed to the client as the template executes, so the
+// transfer size (tsize) is not sent. If data returns an error matching
+// fs.ErrNotExist the client is sent a File Not Found error, and for
+// fs.ErrPermission an Access Violation. If executing the template fails
+// the transfer is aborted.
+func NewTemplateHandler(t *template.Template, data func(addr *net.UDPAddr, filename string) (interface{}, error)) ReadHandler {
+	return &templateHandler{t: t, data: data, log: newLogger("templatehandler")}
+}
+
+type templateHandler struct {
+	t    *template.Template
+	data func(addr *net.UDPAddr, filename string) (interface{}, error)
+	log  *logger
+}
+
+// ServeTFTP renders the template for the request.
+func (h *templateHandler) ServeTFTP(w ReadRequest) {
+	data, err := h.data(w.Addr(), w.Name())
+	if err != nil {
+		h.log.debug("getting data for %q: %v", w.Name(), err)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+		case errors.Is(err, fs.ErrPermission):
+			w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Cannot read file %q", w.Name()))
+		default:
+			w.WriteError(ErrCodeNotDefined, fmt.Sprintf("Cannot read file %q", w.Name()))
+		}
+		return
+	}
+
+	if err := h.t.Execute(w, data); err != nil {
+		h.log.debug("rendering %q: %v", w.Name(), err)
+		// Output may have been sent, no effect if the client ended the transfer
+		w.Abort(ErrCodeNotDefined, fmt.Sprintf("Cannot render file %q", w.Name()))
+	}
+}
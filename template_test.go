@@ -0,0 +1,95 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"testing"
+	"text/template"
+)
+
+func TestTemplateHandler(t *testing.T) {
+	tmpl := template.Must(template.New("ipxe").Funcs(template.FuncMap{
+		"fail": func() (string, error) { return "", errors.New("render failed") },
+	}).Parse(`#!ipxe
+chain http://boot.local/{{.Host}}/{{.Name}}
+{{if .Fail}}{{fail}}{{end}}`))
+
+	type data struct {
+		Host string
+		Name string
+		Fail bool
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1234}
+
+	cases := []struct {
+		name    string
+		dataErr error
+		fail    bool
+
+		expectedData      string
+		expectedErrorCode ErrorCode
+		expectedErrorMsg  string
+	}{
+		{
+			name:         "success",
+			expectedData: "#!ipxe\nchain http://boot.local/192.0.2.10/boot.ipxe\n",
+		},
+		{
+			name:              "not found",
+			dataErr:           fs.ErrNotExist,
+			expectedErrorCode: ErrCodeFileNotFound,
+			expectedErrorMsg:  `File "boot.ipxe" does not exist`,
+		},
+		{
+			name:              "permission denied",
+			dataErr:           &fs.PathError{Op: "open", Path: "boot.ipxe", Err: fs.ErrPermission},
+			expectedErrorCode: ErrCodeAccessViolation,
+			expectedErrorMsg:  `Cannot read file "boot.ipxe"`,
+		},
+		{
+			name:              "data error",
+			dataErr:           errors.New("database unavailable"),
+			expectedErrorCode: ErrCodeNotDefined,
+			expectedErrorMsg:  `Cannot read file "boot.ipxe"`,
+		},
+		{
+			name:              "render failure",
+			fail:              true,
+			expectedData:      "#!ipxe\nchain http://boot.local/192.0.2.10/boot.ipxe\n",
+			expectedErrorCode: ErrCodeNotDefined,
+			expectedErrorMsg:  `Cannot render file "boot.ipxe"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := NewTemplateHandler(tmpl, func(a *net.UDPAddr, filename string) (interface{}, error) {
+				if !a.IP.Equal(addr.IP) {
+					t.Errorf("expected addr %s, got %s", addr, a)
+				}
+				if c.dataErr != nil {
+					return nil, c.dataErr
+				}
+				return data{Host: a.IP.String(), Name: filename, Fail: c.fail}, nil
+			})
+
+			req := readRequestMock{addr: addr, name: "boot.ipxe"}
+			h.ServeTFTP(&req)
+
+			if got := req.writer.String(); got != c.expectedData {
+				t.Errorf("expected data %q, got %q", c.expectedData, got)
+			}
+			if req.size != nil {
+				t.Errorf("expected tsize to be omitted, got %d", *req.size)
+			}
+			if c.expectedErrorCode != req.errCode || c.expectedErrorMsg != req.errMsg {
+				t.Errorf("expected error %s %q, got %s %q", c.expectedErrorCode, c.expectedErrorMsg, req.errCode, req.errMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// WritableFS is a file system that files can be created in.
+//
+// Names follow the io/fs conventions: unrooted, slash-separated paths
+// as validated by fs.ValidPath.
+type WritableFS interface {
+	// Create creates or truncates the named file. The file is
+	// committed when the returned writer is closed.
+	//
+	// If the returned writer also has an Abort() error method, it is
+	// called instead of Close when a transfer fails so that the file
+	// can be discarded.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// StatFS is an optional interface implemented by a WritableFS that
+// can report the space available for new files.
+type StatFS interface {
+	WritableFS
+
+	// Available returns the number of bytes available.
+	Available() (int64, error)
+}
+
+// ExistsFS is an optional interface implemented by a WritableFS that
+// can report whether a file exists.
+type ExistsFS interface {
+	WritableFS
+
+	// Exists reports whether the named file exists.
+	Exists(name string) (bool, error)
+}
+
+// DirWriteOpt is a function that configures a handler created by DirWriteServer.
+type DirWriteOpt func(*dirWriteServer)
+
+// DirWriteMaxSize configures the largest file that will be accepted.
+// Requests with a larger tsize are refused and transfers are aborted
+// once they exceed size.
+//
+// Default: 0 (no limit).
+func DirWriteMaxSize(size int64) DirWriteOpt {
+	return func(d *dirWriteServer) {
+		d.maxSize = size
+	}
+}
+
+// DirWriteNoOverwrite configures whether requests for files that already
+// exist are refused with a File Already Exists error. It requires the
+// WritableFS to implement ExistsFS, a file created by another transfer
+// after the request is accepted may still be replaced.
+//
+// Default: false.
+func DirWriteNoOverwrite(enable bool) DirWriteOpt {
+	return func(d *dirWriteServer) {
+		d.noOverwrite = enable
+	}
+}
+
+// NewDirWriter creates a handler for receiving files into the directory
+// dir. It is shorthand for DirWriteServer(OSDirWriteFS(dir), opts...).
+func NewDirWriter(dir string, opts ...DirWriteOpt) WriteHandler {
+	return DirWriteServer(OSDirWriteFS(dir), opts...)
+}
+
+// DirWriteServer creates a handler for receiving files into wfs.
+//
+// Requested names are cleaned and a leading slash is removed before
+// creating the file. If wfs implements StatFS and the client sent
+// tsize, the available space is checked before accepting the file.
+func DirWriteServer(wfs WritableFS, opts ...DirWriteOpt) WriteHandler {
+	d := &dirWriteServer{wfs: wfs, log: newLogger("dirwriteserver")}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+type dirWriteServer struct {
+	log         *logger
+	wfs         WritableFS
+	maxSize     int64
+	noOverwrite bool
+}
+
+// ReceiveTFTP writes the received file to the configured WritableFS.
+func (d *dirWriteServer) ReceiveTFTP(w WriteRequest) {
+	name := strings.TrimPrefix(path.Clean("/"+w.Name()), "/")
+
+	if size, err := w.Size(); err == nil {
+		if d.maxSize > 0 && size > d.maxSize {
+			w.WriteError(ErrCodeDiskFull, fmt.Sprintf("File size %d exceeds maximum %d", size, d.maxSize))
+			return
+		}
+		if sfs, ok := d.wfs.(StatFS); ok {
+			if avail, err := sfs.Available(); err == nil && size > avail {
+				w.WriteError(ErrCodeDiskFull, "Insufficient space")
+				return
+			}
+		}
+	}
+
+	if efs, ok := d.wfs.(ExistsFS); ok && d.noOverwrite {
+		if exists, err := efs.Exists(name); err == nil && exists {
+			w.WriteError(ErrCodeFileAlreadyExists, fmt.Sprintf("File %q already exists", w.Name()))
+			return
+		}
+	}
+
+	file, err := d.wfs.Create(name)
+	if err != nil {
+		d.log.debug("creating %q: %v", name, err)
+		w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Cannot create file %q", w.Name()))
+		return
+	}
+
+	var r io.Reader = w
+	if d.maxSize > 0 {
+		// Read one byte past the limit to detect oversized transfers
+		r = io.LimitReader(w, d.maxSize+1)
+	}
+	n, err := io.Copy(file, r)
+	if err != nil {
+		d.log.debug("receiving %q: %v", name, err)
+		d.abort(file)
+		return
+	}
+	if d.maxSize > 0 && n > d.maxSize {
+		w.WriteError(ErrCodeDiskFull, fmt.Sprintf("File exceeds maximum size %d", d.maxSize))
+		d.abort(file)
+		return
+	}
+
+	if err := file.Close(); err != nil {
+		d.log.debug("committing %q: %v", name, err)
+		w.WriteError(ErrCodeNotDefined, fmt.Sprintf("Cannot write file %q", w.Name()))
+	}
+}
+
+// abort discards file after a failed transfer. Files that can't be
+// aborted are closed.
+func (d *dirWriteServer) abort(file io.WriteCloser) {
+	if a, ok := file.(interface {
+		Abort() error
+	}); ok {
+		errorDefer(a.Abort, d.log, "error aborting file")
+		return
+	}
+	errorDefer(file.Close, d.log, "error closing file")
+}
+
+// OSDirWriteFS returns a WritableFS that creates files in dir.
+//
+// Files are written to a temporary file in the same directory and
+// renamed to the requested name when closed, so readers never observe a
+// partially written file. The file is synced to disk before it is renamed.
+// The temporary file is removed if the transfer fails. New files are
+// created with mode 0666 before the umask, as by os.Create, replaced files
+// keep their mode.
+//
+// The returned WritableFS implements ExistsFS.
+func OSDirWriteFS(dir string) WritableFS {
+	return osDirWriteFS(dir)
+}
+
+type osDirWriteFS string
+
+func (dir osDirWriteFS) Create(name string) (io.WriteCloser, error) {
+	path, ok := dir.path(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	file, err := createTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		var perr *fs.PathError
+		if errors.As(err, &perr) {
+			perr.Path = name // Don't expose the directory
+		}
+		return nil, err
+	}
+	return &atomicFile{File: file, path: path}, nil
+}
+
+func (dir osDirWriteFS) Exists(name string) (bool, error) {
+	path, ok := dir.path(name)
+	if !ok {
+		return false, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// path returns the location of name in dir, or false if name is not
+// a local, slash-separated path.
+func (dir osDirWriteFS) path(name string) (string, bool) {
+	if !fs.ValidPath(name) || name == "." || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", false
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(name)), true
+}
+
+// createTemp creates a new file in dir with a random name beginning with
+// prefix. Unlike os.CreateTemp, which uses mode 0600, the file is created
+// with mode 0666 before the umask.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+".tmp")
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, fs.ErrExist) && try < 10000 {
+			continue
+		}
+		return file, err
+	}
+}
+
+// atomicFile is a temporary file that is renamed to path when closed.
+type atomicFile struct {
+	*os.File
+	path string // Final location
+}
+
+// Close syncs and closes the temporary file and renames it to the
+// final path. If a file exists at the final path its mode is kept.
+func (f *atomicFile) Close() error {
+	if fi, err := os.Stat(f.path); err == nil {
+		if err := f.File.Chmod(fi.Mode().Perm()); err != nil {
+			f.File.Close()
+			os.Remove(f.Name())
+			return err
+		}
+	}
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary file.
+func (f *atomicFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// rename renames oldpath to newpath, replacing newpath if it exists.
+func rename(oldpath, newpath string) error {
+	err := os.Rename(oldpath, newpath)
+	if err != nil && runtime.GOOS == "windows" {
+		// Renaming over an existing file may fail on Windows, e.g.
+		// when it is open, remove it and try again.
+		if rerr := os.Remove(newpath); rerr == nil {
+			err = os.Rename(oldpath, newpath)
+		}
+	}
+	return err
+}
@@ -0,0 +1,430 @@
+// Copyright (C) 2016 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package trivialt
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// memWriteFS is a WritableFS storing files in memory.
+type memWriteFS struct {
+	files     map[string]*bytes.Buffer
+	committed map[string]bool
+	available int64 // Implements StatFS if > 0
+}
+
+func (m *memWriteFS) Create(name string) (io.WriteCloser, error) {
+	if name == "denied" {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrPermission}
+	}
+	buf := &bytes.Buffer{}
+	m.files[name] = buf
+	return &memFile{Buffer: buf, fs: m, name: name}, nil
+}
+
+// memFile is a file created by memWriteFS.
+type memFile struct {
+	*bytes.Buffer
+	fs   *memWriteFS
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fs.committed[f.name] = true
+	return nil
+}
+
+func (f *memFile) Abort() error {
+	delete(f.fs.files, f.name)
+	return nil
+}
+
+// memStatFS is a memWriteFS implementing StatFS.
+type memStatFS struct {
+	*memWriteFS
+}
+
+func (m memStatFS) Available() (int64, error) { return m.available, nil }
+
+func TestDirWriteServer(t *testing.T) {
+	text := getTestData(t, "text")
+
+	cases := []struct {
+		name      string
+		reqName   string
+		size      *int64
+		maxSize   int64
+		available int64
+
+		expectedFile      string
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:    "success",
+			reqName: "/config/boot.cfg",
+
+			expectedFile: "config/boot.cfg",
+		},
+		{
+			name:    "under max size",
+			reqName: "file",
+			size:    ptrInt64(int64(len(text))),
+			maxSize: int64(len(text)),
+
+			expectedFile: "file",
+		},
+		{
+			name:    "tsize over max size",
+			reqName: "file",
+			size:    ptrInt64(int64(len(text))),
+			maxSize: int64(len(text)) - 1,
+
+			expectedErrorCode: ErrCodeDiskFull,
+		},
+		{
+			name:    "data over max size",
+			reqName: "file",
+			maxSize: int64(len(text)) - 1,
+
+			expectedErrorCode: ErrCodeDiskFull,
+		},
+		{
+			name:      "sufficient space",
+			reqName:   "file",
+			size:      ptrInt64(int64(len(text))),
+			available: int64(len(text)),
+
+			expectedFile: "file",
+		},
+		{
+			name:      "insufficient space",
+			reqName:   "file",
+			size:      ptrInt64(int64(len(text))),
+			available: int64(len(text)) - 1,
+
+			expectedErrorCode: ErrCodeDiskFull,
+		},
+		{
+			name:    "create fails",
+			reqName: "denied",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mfs := &memWriteFS{
+				files:     make(map[string]*bytes.Buffer),
+				committed: make(map[string]bool),
+				available: c.available,
+			}
+			var wfs WritableFS = mfs
+			if c.available > 0 {
+				wfs = memStatFS{mfs}
+			}
+
+			req := writeRequestMock{name: c.reqName, size: c.size}
+			req.reader.Write(text)
+
+			DirWriteServer(wfs, DirWriteMaxSize(c.maxSize)).ReceiveTFTP(&req)
+
+			if c.expectedFile != "" {
+				buf, ok := mfs.files[c.expectedFile]
+				if !ok {
+					t.Fatalf("expected file %q to be created, files: %v", c.expectedFile, mfs.files)
+				}
+				if !reflect.DeepEqual(buf.Bytes(), text) {
+					t.Errorf("expected file data to be %q, got %q", text, buf.Bytes())
+				}
+				if !mfs.committed[c.expectedFile] {
+					t.Errorf("expected file %q to be committed", c.expectedFile)
+				}
+			} else if len(mfs.files) != 0 {
+				t.Errorf("expected failed file to be discarded, files: %v", mfs.files)
+			}
+
+			if c.expectedErrorCode != req.errCode {
+				t.Errorf("expected error code to be %s, but it was %s", c.expectedErrorCode, req.errCode)
+			}
+		})
+	}
+}
+
+func TestOSDirWriteFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wfs := OSDirWriteFS(dir)
+
+	w, err := wfs.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("the data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "file"))
+	if string(data) != "the data" {
+		t.Errorf("expected file data to be %q, got %q", "the data", data)
+	}
+
+	// Not visible until closed
+	w, err = wfs.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new data"))
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "file"))
+	if string(data) != "the data" {
+		t.Errorf("expected file data before Close to be %q, got %q", "the data", data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "file"))
+	if string(data) != "new data" {
+		t.Errorf("expected file data to be replaced with %q, got %q", "new data", data)
+	}
+
+	// Aborted files are discarded
+	w, err = wfs.Create("aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("partial"))
+	aborter, ok := w.(interface{ Abort() error })
+	if !ok {
+		t.Fatal("expected writer to implement Abort")
+	}
+	if err := aborter.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("expected only %q in directory, got %v", "file", names)
+	}
+
+	for _, name := range []string{"", ".", "../file", "/file", "dir/../../file"} {
+		if _, err := wfs.Create(name); err == nil {
+			t.Errorf("expected Create(%q) to fail", name)
+		}
+	}
+}
+
+func TestOSDirWriteFS_mode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+	dir := t.TempDir()
+	wfs := OSDirWriteFS(dir)
+
+	create := func(name string) {
+		t.Helper()
+		w, err := wfs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMode := func(name string, expected os.FileMode) {
+		t.Helper()
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := fi.Mode().Perm(); mode != expected {
+			t.Errorf("expected %q to have mode %v, but it was %v", name, expected, mode)
+		}
+	}
+
+	// New files have the mode given by os.Create
+	ref, err := os.Create(filepath.Join(dir, "ref"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Close()
+	fi, err := os.Stat(ref.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	create("new")
+	expectMode("new", fi.Mode().Perm())
+
+	// Replaced files keep their mode
+	if err := os.Chmod(filepath.Join(dir, "new"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	create("new")
+	expectMode("new", 0640)
+}
+
+func TestNewDirWriter_noOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "existing"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		reqName     string
+		noOverwrite bool
+
+		expectedErrorCode ErrorCode
+		expectedData      string
+	}{
+		{
+			name:    "overwrite allowed",
+			reqName: "existing",
+
+			expectedData: "new data",
+		},
+		{
+			name:        "overwrite refused",
+			reqName:     "existing",
+			noOverwrite: true,
+
+			expectedErrorCode: ErrCodeFileAlreadyExists,
+			expectedData:      "original",
+		},
+		{
+			name:        "new file",
+			reqName:     "new",
+			noOverwrite: true,
+
+			expectedData: "new data",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ioutil.WriteFile(filepath.Join(dir, "existing"), []byte("original"), 0644)
+			req := writeRequestMock{name: c.reqName}
+			req.reader.WriteString("new data")
+
+			NewDirWriter(dir, DirWriteNoOverwrite(c.noOverwrite)).ReceiveTFTP(&req)
+
+			if req.errCode != c.expectedErrorCode {
+				t.Errorf("expected error code %s, got %s", c.expectedErrorCode, req.errCode)
+			}
+			data, _ := ioutil.ReadFile(filepath.Join(dir, c.reqName))
+			if string(data) != c.expectedData {
+				t.Errorf("expected file data %q, got %q", c.expectedData, data)
+			}
+		})
+	}
+}
+
+func TestNewDirWriter_abort(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		// send performs the transfer, which must fail.
+		send func(t *testing.T, addr string)
+	}{
+		{
+			name: "client error mid-transfer",
+			send: func(t *testing.T, addr string) {
+				conn := sendTestRequest(t, addr, opCodeWRQ, "upload", nil)
+				defer conn.Close()
+
+				ack := datagram{buf: make([]byte, 512)}
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, raddr, err := conn.ReadFrom(ack.buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ack.offset = n
+				if ack.opcode() != opCodeACK {
+					t.Fatalf("expected ACK, got %s", ack)
+				}
+
+				var dg datagram
+				dg.writeData(1, bytes.Repeat([]byte("x"), 512))
+				conn.WriteTo(dg.bytes(), raddr)
+				readTestDatagram(t, conn) // ACK 1
+				dg.writeError(ErrCodeNotDefined, "client canceled")
+				conn.WriteTo(dg.bytes(), raddr)
+			},
+		},
+		{
+			name: "exceeds max size without tsize",
+			send: func(t *testing.T, addr string) {
+				client, err := NewClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := client.Put("tftp://"+addr+"/upload", bytes.NewReader(make([]byte, 4096)), -1); err == nil {
+					t.Error("expected transfer to fail")
+				}
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			done := make(chan struct{})
+			wh := NewDirWriter(dir, DirWriteMaxSize(1024))
+			ip, port, closeServer := newTestServer(t, false, nil, func(w WriteRequest) {
+				defer close(done)
+				wh.ReceiveTFTP(w)
+			})
+			defer closeServer()
+
+			c.send(t, ip+":"+strconv.Itoa(port))
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler did not return")
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				t.Errorf("expected no files after failed transfer, found %q", e.Name())
+			}
+		})
+	}
+}